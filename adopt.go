@@ -0,0 +1,75 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization.h"
+*/
+import "C"
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// AdoptVirtualMachine wraps an existing VZVirtualMachine which is created by other Objective-C
+// bridges or cgo code, so it can be operated by this package.
+//
+// Ownership: ptr is retained by AdoptVirtualMachine, and the returned VirtualMachine releases
+// its own reference when it is not reachable. The caller keeps its reference and is responsible
+// for releasing it as usual.
+//
+// The virtual machine must be operated on the queue which it is created with. Give the queue by
+// WithDispatchQueue (see AdoptDispatchQueue); otherwise the main queue is assumed, which is the
+// queue of the virtual machines created by -initWithConfiguration:. AdoptVirtualMachine must not
+// be called on that queue. The state of the virtual machine is observed from now on, and the
+// delegate is set only if it has none, so the stop notifications are not reported to the
+// logger and VirtualMachineStats when the other code has its own delegate.
+//
+// The configuration of the adopted virtual machine is unknown to this package, so Configuration
+// returns nil, the files are not locked by Start, SetResources can not change the resources,
+// and the saved states are neither checked nor fingerprinted by SavedStateInfo.
+func AdoptVirtualMachine(ptr unsafe.Pointer, opts ...VirtualMachineOption) *VirtualMachine {
+	options := &virtualMachineOptions{
+		logger: nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	queue := options.dispatchQueue
+	if queue == nil {
+		queue = mainDispatchQueue()
+	}
+
+	// should not call Free function for this string.
+	cs := getUUID()
+	ms := newMachineStatus(cs.String(), options.logger)
+	status := cgo.NewHandle(ms)
+	state := VirtualMachineState(C.adoptVZVirtualMachine(ptr, queue.Ptr(), unsafe.Pointer(&status)))
+	ms.mu.Lock()
+	if ms.stateTransitions == 0 {
+		// the state has not been changed since it is observed.
+		ms.state = state
+	}
+	ms.mu.Unlock()
+
+	v := &VirtualMachine{
+		id:                 cs.String(),
+		pointer:            newPointer(ptr),
+		dispatchQueue:      queue.Ptr(),
+		queue:              queue,
+		status:             status,
+		networkAttachments: newNetworkAttachments(nil),
+	}
+	setVirtualMachineFinalizer(v)
+	return v
+}
+
+// Ptr returns the raw pointer of VZVirtualMachine. This can be passed to other Objective-C bridges.
+//
+// The pointer is owned by the VirtualMachine and valid while it is reachable, so use runtime.KeepAlive,
+// or retain the object on the Objective-C side to use it longer. The methods of the object must be
+// called on the queue which is returned by DispatchQueue.
+func (v *VirtualMachine) Ptr() unsafe.Pointer { return v.pointer.Ptr() }
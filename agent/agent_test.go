@@ -0,0 +1,286 @@
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/agent"
+)
+
+func newTestClient(t *testing.T, server *agent.Server) *agent.Client {
+	t.Helper()
+	host, guest := net.Pipe()
+	go server.ServeConn(guest)
+	client := agent.NewClient(host)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available")
+	}
+	client := newTestClient(t, &agent.Server{EnableExec: true})
+	ctx := context.Background()
+
+	result, err := client.Exec(ctx, &agent.ExecRequest{
+		Path:  "sh",
+		Args:  []string{"-c", "cat; echo err >&2; exit 3"},
+		Stdin: []byte("hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("want exit code 3 but got %d", result.ExitCode)
+	}
+	if got := string(result.Stdout); got != "hello" {
+		t.Errorf("want stdout %q but got %q", "hello", got)
+	}
+	if got := string(result.Stderr); got != "err\n" {
+		t.Errorf("want stderr %q but got %q", "err\n", got)
+	}
+
+	_, err = client.Exec(ctx, &agent.ExecRequest{Path: "command-does-not-exist"})
+	var remoteErr *agent.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("want *agent.RemoteError but got %v", err)
+	}
+}
+
+func TestReadWriteFile(t *testing.T) {
+	client := newTestClient(t, &agent.Server{EnableFiles: true})
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "file")
+
+	want := []byte("hello, world")
+	if err := client.WriteFile(ctx, path, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.ReadFile(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("want perm 0600 but got %v", fi.Mode().Perm())
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	// the zero value does not serve the requests which are not enabled explicitly.
+	client := newTestClient(t, &agent.Server{})
+	ctx := context.Background()
+
+	if _, err := client.Exec(ctx, &agent.ExecRequest{Path: "true"}); err == nil {
+		t.Error("want error for exec")
+	}
+	if _, err := client.ReadFile(ctx, "file"); err == nil {
+		t.Error("want error for readFile")
+	}
+	if err := client.WriteFile(ctx, "file", nil, 0600); err == nil {
+		t.Error("want error for writeFile")
+	}
+
+	host, guest := net.Pipe()
+	defer host.Close()
+	go (&agent.Server{}).ServeConn(guest)
+	if _, err := agent.Dial(ctx, host, "tcp", "127.0.0.1:80"); err == nil {
+		t.Error("want error for dial")
+	}
+}
+
+func TestDial(t *testing.T) {
+	target, targetConn := net.Pipe()
+	server := &agent.Server{
+		EnableDial: true,
+		Dial: func(network, address string) (net.Conn, error) {
+			if network != "tcp" || address != "127.0.0.1:80" {
+				return nil, errors.New("unexpected address")
+			}
+			return targetConn, nil
+		},
+	}
+	host, guest := net.Pipe()
+	go server.ServeConn(guest)
+
+	conn, err := agent.Dial(context.Background(), host, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(target, buf); err != nil {
+			return
+		}
+		target.Write(append([]byte("ack:"), buf...))
+	}()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "ack:ping" {
+		t.Fatalf("want %q but got %q", "ack:ping", got)
+	}
+}
+
+func TestDialError(t *testing.T) {
+	server := &agent.Server{
+		EnableDial: true,
+		Dial: func(network, address string) (net.Conn, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	host, guest := net.Pipe()
+	defer host.Close()
+	go server.ServeConn(guest)
+
+	_, err := agent.Dial(context.Background(), host, "tcp", "127.0.0.1:80")
+	var remoteErr *agent.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("want *agent.RemoteError but got %v", err)
+	}
+}
+
+func TestContextCanceled(t *testing.T) {
+	host, guest := net.Pipe()
+	defer guest.Close()
+	client := agent.NewClient(host)
+	defer client.Close()
+
+	// nobody serves the guest side, so the request blocks until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.ReadFile(ctx, "file")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded but got %v", err)
+	}
+}
+
+func TestSyncTime(t *testing.T) {
+	// the guest clock is one hour behind.
+	var (
+		mu     sync.Mutex
+		offset = -time.Hour
+	)
+	client := newTestClient(t, &agent.Server{
+		EnableSetTime: true,
+		SetTime: func(tm time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			offset = time.Until(tm)
+			return nil
+		},
+	})
+	ctx := context.Background()
+
+	// Time reports the real clock of the server, so check the offset with SetTime only.
+	previous, err := client.SetTime(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(previous); d < 0 || d > time.Minute {
+		t.Errorf("unexpected previous time: %v", previous)
+	}
+	mu.Lock()
+	got := offset
+	mu.Unlock()
+	if got < 59*time.Second || got > time.Minute {
+		t.Errorf("want offset about 1m but got %v", got)
+	}
+
+	if _, err := client.SyncTime(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got = offset
+	mu.Unlock()
+	if got < -time.Second || got > time.Second {
+		t.Errorf("want offset about 0 but got %v", got)
+	}
+}
+
+func TestSetTimeDisabled(t *testing.T) {
+	client := newTestClient(t, &agent.Server{})
+	if _, err := client.SetTime(context.Background(), time.Now()); err == nil {
+		t.Fatal("want error for setTime")
+	}
+	if _, err := client.Time(context.Background()); err != nil {
+		t.Fatalf("time must be served: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	client := newTestClient(t, &agent.Server{})
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var got []bool
+	client := newTestClient(t, &agent.Server{
+		EnableShutdown: true,
+		Shutdown: func(reboot bool) error {
+			got = append(got, reboot)
+			return nil
+		},
+	})
+	ctx := context.Background()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Reboot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] || !got[1] {
+		t.Fatalf("Shutdown is called with %v, want [false true]", got)
+	}
+}
+
+func TestShutdownError(t *testing.T) {
+	client := newTestClient(t, &agent.Server{
+		EnableShutdown: true,
+		Shutdown: func(bool) error {
+			return errors.New("permission denied")
+		},
+	})
+	err := client.Shutdown(context.Background())
+	var remoteErr *agent.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != "permission denied" {
+		t.Fatalf("Shutdown() = %v, want RemoteError", err)
+	}
+}
+
+func TestShutdownDisabled(t *testing.T) {
+	client := newTestClient(t, &agent.Server{
+		Shutdown: func(bool) error {
+			t.Error("Shutdown must not be called")
+			return nil
+		},
+	})
+	if err := client.Shutdown(context.Background()); err == nil {
+		t.Fatal("want error for shutdown")
+	}
+}
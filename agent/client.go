@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client is a client of the agent which is running in the guest.
+//
+// A Client is safe for concurrent use, but the requests are processed one by one
+// on the connection. If the context is done while a request is in progress, the connection
+// is closed because the stream of the messages can not be recovered.
+type Client struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// NewClient creates a new Client with the connection to the agent.
+//
+// conn is typically *vz.VirtioSocketConnection which is connected to DefaultPort.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Exec executes the command in the guest and waits for it to complete.
+//
+// A non-zero exit code is not an error. Check ExitCode of the result.
+func (c *Client) Exec(ctx context.Context, req *ExecRequest) (*ExecResult, error) {
+	var result ExecResult
+	if err := c.call(ctx, methodExec, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ReadFile reads the file in the guest which is named path.
+func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	var result readFileResult
+	if err := c.call(ctx, methodReadFile, &readFileParams{Path: path}, &result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+// WriteFile writes data to the file in the guest which is named path, creating it if necessary.
+// If the file does not exist, WriteFile creates it with permissions perm.
+func (c *Client) WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+	params := &writeFileParams{
+		Path: path,
+		Data: data,
+		Perm: uint32(perm.Perm()),
+	}
+	return c.call(ctx, methodWriteFile, params, nil)
+}
+
+// SetTime sets the clock of the guest to t and returns the time of the guest just before it was changed.
+// The Server of the guest must enable it by EnableSetTime.
+func (c *Client) SetTime(ctx context.Context, t time.Time) (time.Time, error) {
+	var result setTimeResult
+	if err := c.call(ctx, methodSetTime, &setTimeParams{UnixNano: t.UnixNano()}, &result); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, result.PreviousUnixNano), nil
+}
+
+// Ping checks that the agent is responding. This is cheap enough to be used as a heartbeat.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, methodPing, nil, nil)
+}
+
+// Shutdown asks the agent to power off the guest. It returns once the shutdown is initiated,
+// so wait for the virtual machine to be stopped after that.
+//
+// This is the fallback for the guests which ignore (*vz.VirtualMachine).RequestStop, e.g.
+// the headless Linux guests without the handler of the power button. See vz.WithShutdownFallback.
+// The Server of the guest must enable it by EnableShutdown.
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.call(ctx, methodShutdown, &shutdownParams{}, nil)
+}
+
+// Reboot asks the agent to reboot the guest. It returns once the reboot is initiated.
+// The Server of the guest must enable it by EnableShutdown.
+func (c *Client) Reboot(ctx context.Context) error {
+	return c.call(ctx, methodShutdown, &shutdownParams{Reboot: true}, nil)
+}
+
+// Time returns the current time of the guest clock.
+func (c *Client) Time(ctx context.Context) (time.Time, error) {
+	var result timeResult
+	if err := c.call(ctx, methodTime, nil, &result); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, result.UnixNano), nil
+}
+
+// SyncTime sets the clock of the guest to the clock of the host and returns the offset of the guest
+// clock from the host clock before it was corrected. A positive offset means the guest was ahead.
+//
+// The clock of the guest drifts while the virtual machine is paused, so call this after
+// (*vz.VirtualMachine).Resume or restoring the saved state. Half of the round trip time which is
+// measured by Time is added to the time to set, to compensate for the latency of the connection.
+// The Server of the guest must enable it by EnableSetTime.
+func (c *Client) SyncTime(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	guest, err := c.Time(ctx)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start) / 2
+	offset := guest.Sub(start.Add(latency))
+
+	if _, err := c.SetTime(ctx, time.Now().Add(latency)); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (c *Client) call(ctx context.Context, method string, params, result interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return roundTrip(ctx, c.conn, method, params, result)
+}
+
+// Dial connects to the address on the named network from the guest through the agent.
+//
+// conn must be a new connection to the agent which is not used by a Client, because
+// the connection is used as a stream to the address after the handshake. The returned
+// net.Conn is conn itself. This is how port forwarding is built on top of the agent.
+//
+// See net.Dial for the network and the address.
+func Dial(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	params := &dialParams{
+		Network: network,
+		Address: address,
+	}
+	if err := roundTrip(ctx, conn, methodDial, params, nil); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// roundTrip sends a request and receives its response on conn.
+// The deadline of conn is bound to ctx while the round trip.
+func roundTrip(ctx context.Context, conn net.Conn, method string, params, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			// unblock reading and writing.
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+		conn.SetDeadline(time.Time{})
+	}()
+
+	err := func() error {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req := &request{
+			Method: method,
+			Params: b,
+		}
+		if err := writeMessage(conn, req); err != nil {
+			return err
+		}
+		var resp response
+		if err := readMessage(conn, &resp); err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return &RemoteError{Method: method, Message: resp.Error}
+		}
+		if result == nil || len(resp.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	}()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The response of the request may arrive later, so the connection
+			// can not be used anymore.
+			conn.Close()
+			return ctxErr
+		}
+	}
+	return err
+}
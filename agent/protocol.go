@@ -0,0 +1,165 @@
+// Package agent provides a small RPC protocol between the host and the guest over
+// a stream connection such as *vz.VirtioSocketConnection.
+//
+// The guest runs a Server which listens on a vsock port and the host connects to the port
+// with (*vz.VirtioSocketDevice).ConnectToPort, then wraps the connection with NewClient.
+//
+// Each message is a JSON object which is prefixed by its length as a 4 bytes big endian integer.
+// A request is followed by exactly one response on the same connection.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultPort is the vsock port which is used by the agent by convention.
+const DefaultPort = 1025
+
+// maxMessageSize is the maximum size of a message. This is the limit to prevent a broken peer
+// from allocating a huge buffer.
+const maxMessageSize = 64 << 20
+
+// Methods of the request.
+const (
+	methodExec      = "exec"
+	methodReadFile  = "readFile"
+	methodWriteFile = "writeFile"
+	methodDial      = "dial"
+	methodTime      = "time"
+	methodSetTime   = "setTime"
+	methodPing      = "ping"
+	methodShutdown  = "shutdown"
+)
+
+type request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ExecRequest is a request to execute a command in the guest.
+type ExecRequest struct {
+	// Path is the path or the name of the command.
+	Path string `json:"path"`
+
+	// Args holds command line arguments, not including the command as Args[0].
+	Args []string `json:"args,omitempty"`
+
+	// Env specifies the environment of the process. Each entry is of the form "key=value".
+	// If Env is nil, the process uses the environment of the server.
+	Env []string `json:"env,omitempty"`
+
+	// Dir specifies the working directory of the command.
+	// If Dir is empty, the command runs in the working directory of the server.
+	Dir string `json:"dir,omitempty"`
+
+	// Stdin is passed to the standard input of the command.
+	Stdin []byte `json:"stdin,omitempty"`
+}
+
+// ExecResult is a result of the command which is executed in the guest.
+type ExecResult struct {
+	// ExitCode is the exit code of the command.
+	ExitCode int `json:"exitCode"`
+
+	// Stdout is the standard output of the command.
+	Stdout []byte `json:"stdout,omitempty"`
+
+	// Stderr is the standard error of the command.
+	Stderr []byte `json:"stderr,omitempty"`
+}
+
+type readFileParams struct {
+	Path string `json:"path"`
+}
+
+type readFileResult struct {
+	Data []byte `json:"data"`
+}
+
+type writeFileParams struct {
+	Path string `json:"path"`
+	Data []byte `json:"data"`
+	Perm uint32 `json:"perm"`
+}
+
+type dialParams struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+type timeResult struct {
+	UnixNano int64 `json:"unixNano"`
+}
+
+type setTimeParams struct {
+	// UnixNano is the time to set on the guest.
+	UnixNano int64 `json:"unixNano"`
+}
+
+type setTimeResult struct {
+	// PreviousUnixNano is the time of the guest just before it was changed.
+	PreviousUnixNano int64 `json:"previousUnixNano"`
+}
+
+type shutdownParams struct {
+	// Reboot is true to reboot the guest instead of powering it off.
+	Reboot bool `json:"reboot,omitempty"`
+}
+
+// RemoteError is an error which is reported by the server.
+type RemoteError struct {
+	Method  string
+	Message string
+}
+
+// Error implements error interface.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("agent: %s: %s", e.Method, e.Message)
+}
+
+var errMessageTooLarge = errors.New("agent: message is too large")
+
+// writeMessage writes v as a length-prefixed JSON message.
+func writeMessage(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxMessageSize {
+		return errMessageTooLarge
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readMessage reads a length-prefixed JSON message to v.
+func readMessage(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxMessageSize {
+		return errMessageTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Server is the agent which runs in the guest.
+//
+// The requests are not authenticated, so anyone who can connect to the port is served.
+// Exec, ReadFile, WriteFile, Dial, SetTime, Shutdown and Reboot requests are served only if
+// they are enabled explicitly. The zero value is a Server which serves only Ping and Time requests.
+type Server struct {
+	// Dial is used to connect to the address for Dial requests.
+	// If nil, net.Dial is used.
+	Dial func(network, address string) (net.Conn, error)
+
+	// EnableExec enables Exec requests, which run any command as the user of the agent.
+	EnableExec bool
+
+	// EnableFiles enables ReadFile and WriteFile requests of any path which the user of the agent can access.
+	EnableFiles bool
+
+	// EnableDial enables Dial requests, which connect to any address from the guest.
+	EnableDial bool
+
+	// SetTime is used to set the clock of the guest for SetTime requests.
+	// If nil, the system clock is set, which requires the privilege (e.g. root).
+	SetTime func(t time.Time) error
+
+	// EnableSetTime enables SetTime requests, which change the clock of the guest.
+	// Time requests are always served.
+	EnableSetTime bool
+
+	// Shutdown is used to power off or reboot the guest for Shutdown and Reboot requests.
+	// It must return once the shutdown is initiated, so the response reaches the host.
+	// If nil, the shutdown command of the system is started, which requires the privilege (e.g. root).
+	Shutdown func(reboot bool) error
+
+	// EnableShutdown enables Shutdown and Reboot requests, which power off or reboot the guest.
+	EnableShutdown bool
+}
+
+// Serve accepts connections on the listener and serves each connection in a new goroutine.
+//
+// Serve always returns a non-nil error which is returned by Accept.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests on the connection until the connection is closed.
+// The connection is closed when ServeConn returns.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	for {
+		var req request
+		if err := readMessage(conn, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if req.Method == methodDial {
+			return s.serveDial(conn, req.Params)
+		}
+		result, err := s.handle(&req)
+		resp := &response{}
+		if err != nil {
+			resp.Error = err.Error()
+		} else if result != nil {
+			b, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			resp.Result = b
+		}
+		if err := writeMessage(conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(req *request) (interface{}, error) {
+	switch req.Method {
+	case methodExec:
+		if !s.EnableExec {
+			return nil, errDisabled
+		}
+		var params ExecRequest
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return execCommand(&params)
+	case methodReadFile:
+		if !s.EnableFiles {
+			return nil, errDisabled
+		}
+		var params readFileParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(params.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &readFileResult{Data: data}, nil
+	case methodWriteFile:
+		if !s.EnableFiles {
+			return nil, errDisabled
+		}
+		var params writeFileParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, os.WriteFile(params.Path, params.Data, os.FileMode(params.Perm))
+	case methodPing:
+		return nil, nil
+	case methodTime:
+		return &timeResult{UnixNano: time.Now().UnixNano()}, nil
+	case methodSetTime:
+		if !s.EnableSetTime {
+			return nil, errDisabled
+		}
+		var params setTimeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		setTime := s.SetTime
+		if setTime == nil {
+			setTime = setSystemTime
+		}
+		previous := time.Now()
+		if err := setTime(time.Unix(0, params.UnixNano)); err != nil {
+			return nil, err
+		}
+		return &setTimeResult{PreviousUnixNano: previous.UnixNano()}, nil
+	case methodShutdown:
+		if !s.EnableShutdown {
+			return nil, errDisabled
+		}
+		var params shutdownParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		shutdown := s.Shutdown
+		if shutdown == nil {
+			shutdown = systemShutdown
+		}
+		return nil, shutdown(params.Reboot)
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+var errDisabled = errors.New("method is disabled")
+
+func execCommand(params *ExecRequest) (*ExecResult, error) {
+	cmd := exec.Command(params.Path, params.Args...)
+	cmd.Env = params.Env
+	cmd.Dir = params.Dir
+	cmd.Stdin = bytes.NewReader(params.Stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	return &ExecResult{
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+	}, nil
+}
+
+// systemShutdown starts the shutdown command of the system. The command is not waited for,
+// because the agent may be killed before it exits.
+func systemShutdown(reboot bool) error {
+	var cmd *exec.Cmd
+	if path, err := exec.LookPath("systemctl"); err == nil {
+		action := "poweroff"
+		if reboot {
+			action = "reboot"
+		}
+		cmd = exec.Command(path, action)
+	} else {
+		flag := "-p"
+		switch {
+		case reboot:
+			flag = "-r"
+		case runtime.GOOS == "linux" || runtime.GOOS == "darwin":
+			flag = "-h"
+		}
+		cmd = exec.Command("shutdown", flag, "now")
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// serveDial connects to the address and proxies the connection until either side is closed.
+func (s *Server) serveDial(conn net.Conn, rawParams json.RawMessage) error {
+	err := func() error {
+		if !s.EnableDial {
+			return errDisabled
+		}
+		return nil
+	}()
+	var params dialParams
+	if err == nil {
+		err = json.Unmarshal(rawParams, &params)
+	}
+	var target net.Conn
+	if err == nil {
+		dial := s.Dial
+		if dial == nil {
+			dial = net.Dial
+		}
+		target, err = dial(params.Network, params.Address)
+	}
+	if err != nil {
+		return writeMessage(conn, &response{Error: err.Error()})
+	}
+	defer target.Close()
+	if err := writeMessage(conn, &response{}); err != nil {
+		return err
+	}
+	return proxy(conn, target)
+}
+
+// proxy copies data between a and b in both directions until either side is closed.
+func proxy(a, b net.Conn) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var retErr error
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		once.Do(func() { retErr = err })
+		// unblock the other direction.
+		a.Close()
+		b.Close()
+	}
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+	return retErr
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !linux && !freebsd && !netbsd && !openbsd
+// +build !darwin,!linux,!freebsd,!netbsd,!openbsd
+
+package agent
+
+import (
+	"errors"
+	"time"
+)
+
+// setSystemTime is not supported on this platform.
+func setSystemTime(t time.Time) error {
+	return errors.New("setting the system clock is not supported on this platform")
+}
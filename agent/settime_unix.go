@@ -0,0 +1,16 @@
+//go:build darwin || linux || freebsd || netbsd || openbsd
+// +build darwin linux freebsd netbsd openbsd
+
+package agent
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSystemTime sets the system clock to t.
+func setSystemTime(t time.Time) error {
+	tv := unix.NsecToTimeval(t.UnixNano())
+	return unix.Settimeofday(&tv)
+}
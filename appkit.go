@@ -0,0 +1,115 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization -framework Cocoa
+# include "virtualization_appkit.h"
+*/
+import "C"
+import "runtime"
+
+// The features which use AppKit are in the files which are not built with the vzheadless build tag.
+// These are StartGraphicApplication, NewVirtualMachineView, the keyboard and pointer events
+// (e.g. KeyPress), TakeScreenshot and ServeViewer.
+
+func init() {
+	C.sharedApplication()
+}
+
+// GraphicApplicationOption is an option for StartGraphicApplicationWithOptions.
+type GraphicApplicationOption func(*graphicApplicationOptions)
+
+type graphicApplicationOptions struct {
+	capturesSystemKeys               bool
+	automaticallyReconfiguresDisplay bool
+}
+
+// WithCapturesSystemKeys sets whether the system hot keys (e.g. Command+Tab or Control+arrow keys)
+// are sent to the guest instead of the host while the window is focused. The default is true.
+// The menu of the application can also toggle it.
+func WithCapturesSystemKeys(capturesSystemKeys bool) GraphicApplicationOption {
+	return func(o *graphicApplicationOptions) {
+		o.capturesSystemKeys = capturesSystemKeys
+	}
+}
+
+// WithAutomaticallyReconfiguresDisplay sets whether the display of the guest is reconfigured to the
+// size of the window when the window is resized, as the sample application of Apple does. The default
+// is false, then the display keeps its configured size and is scaled to the window.
+//
+// The guest must support the reconfiguration of the display, e.g. macOS 14 and newer guests.
+// This is only supported on macOS 14 and newer, StartGraphicApplicationWithOptions returns
+// ErrUnsupportedOSVersion on older versions.
+func WithAutomaticallyReconfiguresDisplay(automaticallyReconfiguresDisplay bool) GraphicApplicationOption {
+	return func(o *graphicApplicationOptions) {
+		o.automaticallyReconfiguresDisplay = automaticallyReconfiguresDisplay
+	}
+}
+
+// StartGraphicApplication starts an application to display graphics of the VM.
+//
+// This method blocks until the window is closed or the guest stops the virtual machine.
+// The window is not tied to the lifecycle of the virtual machine: closing the window does
+// not stop the virtual machine, so it keeps running headless, and StartGraphicApplication
+// can be called again later to attach a new window to the same running virtual machine.
+//
+// Note that the window must be opened from the process which created the virtual machine.
+// Virtualization.framework does not support displaying a virtual machine that is owned by
+// another process. Use ServeViewer to view and control it from another process instead.
+//
+// This method creates its own NSApplication and runs its event loop. If the application already runs
+// an AppKit event loop, use NewVirtualMachineView to embed the view into the window of the application.
+//
+// The system hot keys are sent to the guest while the window is focused. Use
+// StartGraphicApplicationWithOptions to change it or the other options.
+//
+// You must to call runtime.LockOSThread before calling this method.
+func (v *VirtualMachine) StartGraphicApplication(width, height float64) {
+	// the default options are always supported.
+	_ = v.StartGraphicApplicationWithOptions(width, height)
+}
+
+// StartGraphicApplicationWithOptions is same as StartGraphicApplication, but starts the application
+// with the options. An error is returned without opening the window if an option is not supported.
+func (v *VirtualMachine) StartGraphicApplicationWithOptions(width, height float64, opts ...GraphicApplicationOption) error {
+	o := graphicApplicationOptions{
+		capturesSystemKeys: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.automaticallyReconfiguresDisplay {
+		if err := macOSAvailable(14, 0); err != nil {
+			return err
+		}
+	}
+	C.startVirtualMachineWindow(
+		v.Ptr(),
+		v.dispatchQueue,
+		C.double(width),
+		C.double(height),
+		C.bool(o.capturesSystemKeys),
+		C.bool(o.automaticallyReconfiguresDisplay),
+	)
+	return nil
+}
+
+// headlessView is a VZVirtualMachineView which is attached to a hidden window.
+// This is used to send the input events without displaying the virtual machine.
+type headlessView struct {
+	pointer
+}
+
+func (h *headlessView) release() {
+	h.releaseOnMainThread()
+}
+
+// releaseOnMainThread releases allocated resources on the main thread. This is used for AppKit objects.
+func (p *pointer) releaseOnMainThread() {
+	untrackObject(p.Ptr())
+	C.releaseOnMainThread(p.Ptr())
+	runtime.KeepAlive(p)
+}
@@ -0,0 +1,55 @@
+//go:build darwin && arm64 && !vzheadless
+// +build darwin,arm64,!vzheadless
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization -framework Cocoa
+# include "virtualization_appkit.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// ErrScreenNotFound is returned by NewMacGraphicsDisplayConfigurationForScreen when there is no screen at the index.
+var ErrScreenNotFound = errors.New("screen not found")
+
+// NewMacGraphicsDisplayConfigurationForScreen creates a new MacGraphicsDisplayConfiguration which is
+// suitable for showing in a window of the specified size in points on a screen of the host.
+//
+// The size in pixels and the pixel density are computed from the screen, so the guest uses the same
+// scale factor as the screen (e.g. 2x on a Retina screen) and the window is displayed without scaling.
+// screen is the index of the screen, 0 is the screen which has the menu bar.
+//
+// On macOS 14 and newer, the configuration is computed by Virtualization.framework. On older versions,
+// the pixel density is computed from the physical size of the screen. This is not built with the
+// vzheadless build tag because it uses AppKit.
+func NewMacGraphicsDisplayConfigurationForScreen(screen int, widthInPoints, heightInPoints float64) (*MacGraphicsDisplayConfiguration, error) {
+	if screen < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrScreenNotFound, screen)
+	}
+	var widthInPixels, heightInPixels C.NSInteger
+	ptr := C.newVZMacGraphicsDisplayConfigurationForScreen(
+		C.ulong(screen),
+		C.double(widthInPoints),
+		C.double(heightInPoints),
+		&widthInPixels,
+		&heightInPixels,
+	)
+	if ptr == nil {
+		return nil, fmt.Errorf("%w: %d", ErrScreenNotFound, screen)
+	}
+	graphicsDisplayConfiguration := &MacGraphicsDisplayConfiguration{
+		pointer:        newPointer(ptr),
+		widthInPixels:  int64(widthInPixels),
+		heightInPixels: int64(heightInPixels),
+	}
+	runtime.SetFinalizer(graphicsDisplayConfiguration, func(self *MacGraphicsDisplayConfiguration) {
+		self.Release()
+	})
+	return graphicsDisplayConfiguration, nil
+}
@@ -0,0 +1,12 @@
+//go:build darwin && vzheadless
+// +build darwin,vzheadless
+
+package vz
+
+// headlessView is never created when the package is built with the vzheadless build tag,
+// because AppKit is not linked.
+type headlessView struct {
+	pointer
+}
+
+func (h *headlessView) release() {}
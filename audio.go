@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -6,7 +9,10 @@ package vz
 # include "virtualization.h"
 */
 import "C"
-import "runtime"
+import (
+	"runtime"
+	"unsafe"
+)
 
 // AudioDeviceConfiguration interface for an audio device configuration.
 type AudioDeviceConfiguration interface {
@@ -31,6 +37,8 @@ type VirtioSoundDeviceConfiguration struct {
 	pointer
 
 	*baseAudioDeviceConfiguration
+
+	streams []VirtioSoundDeviceStreamConfiguration
 }
 
 var _ AudioDeviceConfiguration = (*VirtioSoundDeviceConfiguration)(nil)
@@ -38,9 +46,7 @@ var _ AudioDeviceConfiguration = (*VirtioSoundDeviceConfiguration)(nil)
 // NewVirtioSoundDeviceConfiguration creates a new sound device configuration.
 func NewVirtioSoundDeviceConfiguration() *VirtioSoundDeviceConfiguration {
 	config := &VirtioSoundDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioSoundDeviceConfiguration(),
-		},
+		pointer: newPointer(C.newVZVirtioSoundDeviceConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *VirtioSoundDeviceConfiguration) {
 		self.Release()
@@ -49,13 +55,26 @@ func NewVirtioSoundDeviceConfiguration() *VirtioSoundDeviceConfiguration {
 }
 
 // SetStreams sets the list of audio streams exposed by this device.
+//
+// More than one output stream (and input stream) can be set, then each of them is exposed to
+// the guest as a separate PCM stream of the device, e.g. for routing the audio to different
+// devices in the guest.
+//
+// Note that Virtualization.framework does not expose the channel count, the sample rate nor
+// the sample format of the streams. These are negotiated between the guest driver and the
+// host audio stack, so they can not be configured by this package.
 func (v *VirtioSoundDeviceConfiguration) SetStreams(streams ...VirtioSoundDeviceStreamConfiguration) {
-	ptrs := make([]NSObject, len(streams))
+	v.streams = streams
+	ptrs := make([]unsafe.Pointer, len(streams))
 	for i, val := range streams {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setStreamsVZVirtioSoundDeviceConfiguration(v.Ptr(), array.Ptr())
+	C.setStreamsVZVirtioSoundDeviceConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// Streams returns the list of audio streams which is set by SetStreams.
+func (v *VirtioSoundDeviceConfiguration) Streams() []VirtioSoundDeviceStreamConfiguration {
+	return v.streams
 }
 
 // VirtioSoundDeviceStreamConfiguration interface for Virtio Sound Device Stream Configuration.
@@ -82,9 +101,7 @@ var _ VirtioSoundDeviceStreamConfiguration = (*VirtioSoundDeviceHostInputStreamC
 // NewVirtioSoundDeviceHostInputStreamConfiguration creates a new PCM stream configuration of input audio data from host.
 func NewVirtioSoundDeviceHostInputStreamConfiguration() *VirtioSoundDeviceHostInputStreamConfiguration {
 	config := &VirtioSoundDeviceHostInputStreamConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioSoundDeviceHostInputStreamConfiguration(),
-		},
+		pointer: newPointer(C.newVZVirtioSoundDeviceHostInputStreamConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *VirtioSoundDeviceHostInputStreamConfiguration) {
 		self.Release()
@@ -107,9 +124,7 @@ var _ VirtioSoundDeviceStreamConfiguration = (*VirtioSoundDeviceHostOutputStream
 // NewVirtioSoundDeviceHostOutputStreamConfiguration creates a new sounds device output stream configuration.
 func NewVirtioSoundDeviceHostOutputStreamConfiguration() *VirtioSoundDeviceHostOutputStreamConfiguration {
 	config := &VirtioSoundDeviceHostOutputStreamConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioSoundDeviceHostOutputStreamConfiguration(),
-		},
+		pointer: newPointer(C.newVZVirtioSoundDeviceHostOutputStreamConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *VirtioSoundDeviceHostOutputStreamConfiguration) {
 		self.Release()
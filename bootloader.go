@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -8,7 +11,10 @@ package vz
 import "C"
 import (
 	"fmt"
+	"os"
 	"runtime"
+
+	"github.com/Code-Hex/vz/v2/internal/kernel"
 )
 
 // BootLoader is the interface of boot loader definitions.
@@ -68,16 +74,17 @@ func WithInitrd(initrdPath string) LinuxBootLoaderOption {
 }
 
 // NewLinuxBootLoader creates a LinuxBootLoader with the Linux kernel passed as Path.
+//
+// The kernel is not checked here. If the format of the kernel is wrong, the virtual machine
+// fails to start without a helpful error. Use ValidateLinuxKernel to check it beforehand.
 func NewLinuxBootLoader(vmlinuz string, opts ...LinuxBootLoaderOption) *LinuxBootLoader {
 	vmlinuzPath := charWithGoString(vmlinuz)
 	defer vmlinuzPath.Free()
 	bootLoader := &LinuxBootLoader{
 		vmlinuzPath: vmlinuz,
-		pointer: pointer{
-			ptr: C.newVZLinuxBootLoader(
-				vmlinuzPath.CString(),
-			),
-		},
+		pointer: newPointer(C.newVZLinuxBootLoader(
+			vmlinuzPath.CString(),
+		)),
 	}
 	runtime.SetFinalizer(bootLoader, func(self *LinuxBootLoader) {
 		self.Release()
@@ -87,3 +94,34 @@ func NewLinuxBootLoader(vmlinuz string, opts ...LinuxBootLoaderOption) *LinuxBoo
 	}
 	return bootLoader
 }
+
+// ValidateLinuxKernel checks whether the kernel image at path can be booted by LinuxBootLoader
+// on the current architecture.
+//
+// On arm64, the kernel must be an uncompressed Image. A compressed kernel such as
+// vmlinuz (Image.gz) or an EFI zboot image must be decompressed before booting.
+// On amd64, the kernel must be a bzImage.
+func ValidateLinuxKernel(path string) error {
+	return kernel.Validate(path, runtime.GOARCH)
+}
+
+// ConcatenateInitrds writes the initrd files to a new file at dst, so that multiple initrd
+// files can be passed to WithInitrd as one initial RAM disk.
+//
+// The Linux kernel unpacks the concatenated cpio archives in order, so a file in the later
+// initrd overrides the same file in the earlier one. dst must not exist.
+func ConcatenateInitrds(dst string, initrds ...string) (retErr error) {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if retErr != nil {
+			os.Remove(dst)
+		}
+	}()
+	return kernel.Concat(f, initrds...)
+}
@@ -0,0 +1,347 @@
+// Package bootwatch detects the progress of the boot of the guest and the guest operating
+// system from the output of the serial console.
+//
+// A Watcher is an io.Writer which is attached to the console of the guest, e.g. by
+// vz.NewWriterSerialPortAttachment. It matches each line against the rules and emits an Event
+// when the boot reaches a later Stage: the boot loader, the kernel and the userspace.
+// Wait blocks until a stage is reached, so the provisioning tools can wait for the guest
+// instead of sleeping for a fixed duration:
+//
+//	w := bootwatch.New(bootwatch.WithStallTimeout(30 * time.Second))
+//	attachment, err := vz.NewWriterSerialPortAttachment(io.MultiWriter(logFile, w))
+//	...
+//	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+//	defer cancel()
+//	if _, err := w.Wait(ctx, bootwatch.StageUserspace); err != nil {
+//		// the guest did not boot, or stopped writing to the console for 30 seconds.
+//	}
+//
+// The progress which is not visible on the console, e.g. a framebuffer which is captured by
+// TakeScreenshot or a connection from the agent, can be reported by Report.
+package bootwatch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Stage is a stage of the boot. The stages only move forward until Reset is called.
+type Stage int
+
+const (
+	// StageNone is the stage before any progress is detected.
+	StageNone Stage = iota
+
+	// StageBootloader is reached when the firmware or the boot loader writes to the console.
+	StageBootloader
+
+	// StageKernel is reached when the kernel writes to the console.
+	StageKernel
+
+	// StageUserspace is reached when the init process or a login prompt is started.
+	StageUserspace
+)
+
+// String returns the name of the stage.
+func (s Stage) String() string {
+	switch s {
+	case StageNone:
+		return "none"
+	case StageBootloader:
+		return "bootloader"
+	case StageKernel:
+		return "kernel"
+	case StageUserspace:
+		return "userspace"
+	}
+	return fmt.Sprintf("Stage(%d)", int(s))
+}
+
+// The guest operating systems which are detected by the default rules.
+const (
+	OSLinux   = "linux"
+	OSFreeBSD = "freebsd"
+	OSNetBSD  = "netbsd"
+	OSOpenBSD = "openbsd"
+)
+
+// Rule detects a stage from a line of the console.
+type Rule struct {
+	// Stage is the stage which is reached when the line matches.
+	Stage Stage
+
+	// OS is the guest operating system which is identified by the line. Empty if the line does
+	// not identify it.
+	OS string
+
+	// Pattern is matched against each line, without the line terminator and the escape sequences
+	// of the terminal.
+	Pattern *regexp.Regexp
+}
+
+// DefaultRules returns the rules which are used if WithRules is not specified. These detect the
+// EDK II based firmware, GRUB and systemd-boot, and the kernels and the userspace of Linux and the BSDs.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Stage: StageBootloader, Pattern: regexp.MustCompile(`BdsDxe:|GNU GRUB|\bgrub>|systemd-boot`)},
+		{Stage: StageBootloader, OS: OSFreeBSD, Pattern: regexp.MustCompile(`FreeBSD/\w+ EFI loader`)},
+
+		{Stage: StageKernel, OS: OSLinux, Pattern: regexp.MustCompile(`^(\[\s*\d+\.\d+\] )?(Linux version \d|EFI stub: |Booting Linux on physical CPU)`)},
+		{Stage: StageKernel, OS: OSFreeBSD, Pattern: regexp.MustCompile(`The FreeBSD Project\.|^FreeBSD \d+\.\d+-\S+ `)},
+		{Stage: StageKernel, OS: OSNetBSD, Pattern: regexp.MustCompile(`The NetBSD Foundation, Inc\.|^NetBSD \d+\.\d+ `)},
+		{Stage: StageKernel, OS: OSOpenBSD, Pattern: regexp.MustCompile(`^OpenBSD \d+\.\d+ `)},
+		{Stage: StageKernel, OS: OSLinux, Pattern: regexp.MustCompile(`^\[\s*\d+\.\d+\] `)},
+
+		{Stage: StageUserspace, OS: OSLinux, Pattern: regexp.MustCompile(`Run \S*init as init process|systemd\[1\]: |^Welcome to .+!$`)},
+		{Stage: StageUserspace, Pattern: regexp.MustCompile(`cloud-init\[\d+\]|\blogin: *$`)},
+	}
+}
+
+// Event describes the progress of the boot.
+type Event struct {
+	// Stage is the reached stage.
+	Stage Stage
+
+	// OS is the detected guest operating system. Empty if it is not detected yet.
+	OS string
+
+	// Line is the line of the console which matched, or the detail which is passed to Report.
+	Line string
+
+	// Time is when the stage is reached.
+	Time time.Time
+
+	// Elapsed is the duration since the Watcher is created or reset.
+	Elapsed time.Duration
+}
+
+// ErrStalled is returned by Wait when the guest has not written to the console for the stall timeout.
+var ErrStalled = errors.New("boot stalled")
+
+// maxLineLength is the maximum length of a line. A longer line is matched in pieces, so a guest
+// which never writes a line terminator does not make the Watcher buffer the output without limit.
+const maxLineLength = 4096
+
+// escapeSequence matches the escape sequences of the terminal, e.g. the colors of systemd.
+var escapeSequence = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|[()][0-9A-Za-z]|[@-Z\\-_])`)
+
+// Watcher detects the progress of the boot from the output of the console. It is safe for concurrent use.
+type Watcher struct {
+	rules        []Rule
+	handler      func(Event)
+	stallTimeout time.Duration
+
+	mu         sync.Mutex
+	start      time.Time
+	lastOutput time.Time
+	last       Event
+	line       []byte
+	// changed is closed and replaced when the stage changes or the console is written.
+	changed chan struct{}
+}
+
+// Option is an option for New.
+type Option func(*Watcher)
+
+// WithRules sets the rules which detect the stages instead of DefaultRules.
+// Append to DefaultRules to add the rules of other guests.
+func WithRules(rules ...Rule) Option {
+	return func(w *Watcher) {
+		w.rules = rules
+	}
+}
+
+// WithHandler sets the function which is called for each event. It is called from the goroutine
+// which writes to the Watcher, so it should not block.
+func WithHandler(fn func(Event)) Option {
+	return func(w *Watcher) {
+		w.handler = fn
+	}
+}
+
+// WithStallTimeout makes Wait return ErrStalled when the guest has not written to the console
+// for d, so a slow boot which is still progressing is waited for and a hung one fails early.
+// The default is zero, which disables it.
+func WithStallTimeout(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.stallTimeout = d
+	}
+}
+
+// New creates a new Watcher.
+func New(opts ...Option) *Watcher {
+	now := time.Now()
+	w := &Watcher{
+		rules:      DefaultRules(),
+		start:      now,
+		lastOutput: now,
+		changed:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Write matches the lines of p against the rules. It never fails, so the console is not blocked.
+func (w *Watcher) Write(p []byte) (int, error) {
+	var events []Event
+	w.mu.Lock()
+	w.lastOutput = time.Now()
+	rest := p
+	for len(rest) > 0 {
+		i := bytes.IndexAny(rest, "\r\n")
+		if i < 0 {
+			w.line = append(w.line, rest...)
+			// the prompts, e.g. "login: ", are not terminated, so the partial line is matched too.
+			events = w.matchLocked(events, len(w.line) >= maxLineLength)
+			break
+		}
+		w.line = append(w.line, rest[:i]...)
+		events = w.matchLocked(events, true)
+		rest = rest[i+1:]
+	}
+	w.notifyLocked()
+	w.mu.Unlock()
+	w.emit(events)
+	return len(p), nil
+}
+
+// matchLocked matches the buffered line, and clears it if clear is true.
+func (w *Watcher) matchLocked(events []Event, clear bool) []Event {
+	line := string(escapeSequence.ReplaceAll(w.line, nil))
+	if clear {
+		w.line = w.line[:0]
+	}
+	if line == "" {
+		return events
+	}
+	for _, rule := range w.rules {
+		if rule.Stage <= w.last.Stage && (rule.OS == "" || w.last.OS != "") {
+			continue
+		}
+		if !rule.Pattern.MatchString(line) {
+			continue
+		}
+		if ev, ok := w.advanceLocked(rule.Stage, rule.OS, line); ok {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// advanceLocked moves to the stage and records the OS. It reports whether the stage is changed.
+func (w *Watcher) advanceLocked(stage Stage, os, line string) (Event, bool) {
+	if w.last.OS == "" && os != "" {
+		w.last.OS = os
+	}
+	if stage <= w.last.Stage {
+		return Event{}, false
+	}
+	now := time.Now()
+	w.last = Event{
+		Stage:   stage,
+		OS:      w.last.OS,
+		Line:    line,
+		Time:    now,
+		Elapsed: now.Sub(w.start),
+	}
+	return w.last, true
+}
+
+func (w *Watcher) notifyLocked() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+func (w *Watcher) emit(events []Event) {
+	if w.handler == nil {
+		return
+	}
+	for _, ev := range events {
+		w.handler(ev)
+	}
+}
+
+// Report reports the progress which is detected by other means than the console, e.g. Report(StageUserspace,
+// "agent connected") when the agent in the guest is connected. It is ignored if the stage is already reached.
+func (w *Watcher) Report(stage Stage, detail string) {
+	w.mu.Lock()
+	ev, ok := w.advanceLocked(stage, "", detail)
+	if ok {
+		w.notifyLocked()
+	}
+	w.mu.Unlock()
+	if ok {
+		w.emit([]Event{ev})
+	}
+}
+
+// Reset forgets the progress, e.g. when the virtual machine is restarted.
+func (w *Watcher) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	w.start = now
+	w.lastOutput = now
+	w.last = Event{}
+	w.line = w.line[:0]
+	w.notifyLocked()
+}
+
+// Stage returns the current stage.
+func (w *Watcher) Stage() Stage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last.Stage
+}
+
+// OS returns the detected guest operating system, e.g. OSLinux. Empty if it is not detected yet.
+func (w *Watcher) OS() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last.OS
+}
+
+// Wait blocks until the stage or a later one is reached, and returns the event of the current stage.
+//
+// The error is the one of ctx if it is done, or ErrStalled if the stall timeout is set by
+// WithStallTimeout and the guest has not written to the console for it.
+func (w *Watcher) Wait(ctx context.Context, stage Stage) (Event, error) {
+	for {
+		w.mu.Lock()
+		last, changed, lastOutput := w.last, w.changed, w.lastOutput
+		w.mu.Unlock()
+		if last.Stage >= stage {
+			return last, nil
+		}
+
+		var timer *time.Timer
+		var stalled <-chan time.Time
+		if w.stallTimeout > 0 {
+			idle := time.Since(lastOutput)
+			if idle >= w.stallTimeout {
+				return last, fmt.Errorf("%w: no output on the console for %s at stage %s", ErrStalled, idle.Round(time.Millisecond), last.Stage)
+			}
+			timer = time.NewTimer(w.stallTimeout - idle)
+			stalled = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return last, ctx.Err()
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-stalled:
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package bootwatch_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/bootwatch"
+)
+
+const linuxBoot = "BdsDxe: loading Boot0001 \"UEFI Misc Device\"\r\n" +
+	"EFI stub: Booting Linux Kernel...\r\n" +
+	"[    0.000000] Booting Linux on physical CPU 0x0000000000 [0x610f0000]\n" +
+	"[    0.000000] Linux version 6.1.0 (builder@localhost) #1 SMP\n" +
+	"[    1.234567] Run /init as init process\n" +
+	"\x1b[0;32m  OK  \x1b[0m] Reached target Multi-User System.\n" +
+	"localhost login: "
+
+func TestWatcherLinux(t *testing.T) {
+	var mu sync.Mutex
+	var events []bootwatch.Event
+	w := bootwatch.New(bootwatch.WithHandler(func(ev bootwatch.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}))
+	if _, err := io.WriteString(w, linuxBoot); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Stage(); got != bootwatch.StageUserspace {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageUserspace)
+	}
+	if got := w.OS(); got != bootwatch.OSLinux {
+		t.Fatalf("OS() = %q, want %q", got, bootwatch.OSLinux)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []bootwatch.Stage{bootwatch.StageBootloader, bootwatch.StageKernel, bootwatch.StageUserspace}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, ev := range events {
+		if ev.Stage != want[i] {
+			t.Errorf("events[%d].Stage = %s, want %s", i, ev.Stage, want[i])
+		}
+	}
+	if !strings.HasPrefix(events[0].Line, "BdsDxe:") {
+		t.Errorf("events[0].Line = %q", events[0].Line)
+	}
+	if events[0].OS != "" || events[1].OS != bootwatch.OSLinux {
+		t.Errorf("OS of the events = %q, %q", events[0].OS, events[1].OS)
+	}
+}
+
+func TestWatcherSplitWrites(t *testing.T) {
+	w := bootwatch.New()
+	for _, b := range []byte(linuxBoot) {
+		w.Write([]byte{b})
+	}
+	if got := w.Stage(); got != bootwatch.StageUserspace {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageUserspace)
+	}
+}
+
+func TestWatcherLoginPrompt(t *testing.T) {
+	w := bootwatch.New()
+	io.WriteString(w, "\r\nFreeBSD/arm64 (freebsd) (ttyu0)\r\n\r\nlogin: ")
+	if got := w.Stage(); got != bootwatch.StageUserspace {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageUserspace)
+	}
+}
+
+func TestWatcherFreeBSD(t *testing.T) {
+	w := bootwatch.New()
+	io.WriteString(w, "FreeBSD/arm64 EFI loader, Revision 1.1\n")
+	if got := w.Stage(); got != bootwatch.StageBootloader {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageBootloader)
+	}
+	io.WriteString(w, "Copyright (c) 1992-2023 The FreeBSD Project.\n")
+	if got := w.Stage(); got != bootwatch.StageKernel {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageKernel)
+	}
+	if got := w.OS(); got != bootwatch.OSFreeBSD {
+		t.Fatalf("OS() = %q, want %q", got, bootwatch.OSFreeBSD)
+	}
+}
+
+func TestWatcherCustomRules(t *testing.T) {
+	w := bootwatch.New(bootwatch.WithRules(append(bootwatch.DefaultRules(), bootwatch.Rule{
+		Stage:   bootwatch.StageUserspace,
+		OS:      "plan9",
+		Pattern: regexp.MustCompile(`^term% `),
+	})...))
+	io.WriteString(w, "term% ")
+	if got := w.Stage(); got != bootwatch.StageUserspace {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageUserspace)
+	}
+	if got := w.OS(); got != "plan9" {
+		t.Fatalf("OS() = %q, want %q", got, "plan9")
+	}
+}
+
+func TestWatcherReportAndReset(t *testing.T) {
+	w := bootwatch.New()
+	w.Report(bootwatch.StageUserspace, "agent connected")
+	if got := w.Stage(); got != bootwatch.StageUserspace {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageUserspace)
+	}
+	// the stages do not move backward.
+	io.WriteString(w, "[    0.000000] Linux version 6.1.0\n")
+	if got := w.Stage(); got != bootwatch.StageUserspace {
+		t.Fatalf("Stage() = %s, want %s", got, bootwatch.StageUserspace)
+	}
+
+	w.Reset()
+	if got := w.Stage(); got != bootwatch.StageNone {
+		t.Fatalf("Stage() after Reset = %s, want %s", got, bootwatch.StageNone)
+	}
+	if got := w.OS(); got != "" {
+		t.Fatalf("OS() after Reset = %q, want empty", got)
+	}
+}
+
+func TestWait(t *testing.T) {
+	w := bootwatch.New()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(w, linuxBoot)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ev, err := w.Wait(ctx, bootwatch.StageKernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Stage < bootwatch.StageKernel {
+		t.Fatalf("Wait returned %s", ev.Stage)
+	}
+}
+
+func TestWaitContextDone(t *testing.T) {
+	w := bootwatch.New()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := w.Wait(ctx, bootwatch.StageKernel); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWaitStalled(t *testing.T) {
+	w := bootwatch.New(bootwatch.WithStallTimeout(100 * time.Millisecond))
+	io.WriteString(w, "BdsDxe: loading Boot0001\n")
+
+	// the output keeps the boot from stalling.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			time.Sleep(40 * time.Millisecond)
+			io.WriteString(w, "still loading\n")
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	ev, err := w.Wait(ctx, bootwatch.StageKernel)
+	if !errors.Is(err, bootwatch.ErrStalled) {
+		t.Fatalf("Wait() = %v, want %v", err, bootwatch.ErrStalled)
+	}
+	if ev.Stage != bootwatch.StageBootloader {
+		t.Fatalf("Wait returned %s, want %s", ev.Stage, bootwatch.StageBootloader)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("Wait returned after %s while the guest was writing", elapsed)
+	}
+	<-done
+}
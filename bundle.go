@@ -0,0 +1,277 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// File names in a virtual machine bundle.
+const (
+	bundleConfigName            = "config.json"
+	bundleDiskImageName         = "disk.img"
+	bundleAuxiliaryStorageName  = "aux.img"
+	bundleMachineIdentifierName = "machine-identifier"
+	bundleHardwareModelName     = "hardware-model"
+)
+
+// File names in the legacy bundle which is written by the macOS example of this repository and
+// the earlier versions of CloneMacVM. It has no config.json.
+const (
+	legacyBundleDiskImageName         = "Disk.img"
+	legacyBundleAuxiliaryStorageName  = "AuxiliaryStorage"
+	legacyBundleMachineIdentifierName = "MachineIdentifier"
+	legacyBundleHardwareModelName     = "HardwareModel"
+)
+
+// BundleVersion is the version of the bundle layout which is written by this package.
+const BundleVersion = 1
+
+// ErrBundleLocked is returned when the bundle is opened by another process (or another Bundle).
+var ErrBundleLocked = errors.New("bundle is in use")
+
+// BundleOS is the guest operating system of the bundle.
+type BundleOS string
+
+const (
+	// BundleOSLinux is a Linux guest.
+	BundleOSLinux BundleOS = "linux"
+
+	// BundleOSMacOS is a macOS guest.
+	BundleOSMacOS BundleOS = "macOS"
+)
+
+// BundleConfig is the configuration of the virtual machine which is stored in config.json of the bundle.
+type BundleConfig struct {
+	// Version is the version of the bundle layout. This is set by Save.
+	Version int `json:"version"`
+
+	// Name is the human readable name of the virtual machine.
+	Name string `json:"name,omitempty"`
+
+	// OS is the guest operating system.
+	OS BundleOS `json:"os"`
+
+	// CPUCount is the number of the virtual CPUs.
+	CPUCount uint `json:"cpuCount"`
+
+	// MemorySize is the memory size in bytes.
+	MemorySize uint64 `json:"memorySize"`
+
+	// MACAddress is the MAC address of the network device. e.g. "de:ad:be:ef:00:01"
+	MACAddress string `json:"macAddress,omitempty"`
+
+	// KernelPath is the path of the Linux kernel. This is used only for Linux guests.
+	// A relative path is relative to the bundle.
+	KernelPath string `json:"kernelPath,omitempty"`
+
+	// InitrdPath is the path of the initial RAM disk. This is used only for Linux guests.
+	// A relative path is relative to the bundle.
+	InitrdPath string `json:"initrdPath,omitempty"`
+
+	// CommandLine is the kernel command line. This is used only for Linux guests.
+	CommandLine string `json:"commandLine,omitempty"`
+}
+
+// Bundle is a directory which contains the files of a virtual machine.
+//
+// The layout of the bundle is:
+//
+//	config.json: BundleConfig as JSON
+//	disk.img: the main disk image
+//	aux.img: the auxiliary storage (macOS guests only)
+//	machine-identifier: the data representation of the machine identifier (macOS guests only)
+//	hardware-model: the data representation of the hardware model (macOS guests only)
+//
+// Tools which share this layout can exchange virtual machines each other.
+//
+// The legacy bundle of the macOS guest which is written by the earlier versions of this package and
+// its macOS example (Disk.img, AuxiliaryStorage, MachineIdentifier and HardwareModel without config.json)
+// is also opened by OpenBundle. The paths of the files are resolved to the legacy names if only they exist,
+// and the files are not renamed.
+//
+// A Bundle holds the exclusive lock of the directory until Close is called, so the same virtual
+// machine is not run by two processes at the same time. The lock is an advisory lock by flock(2)
+// which is released automatically when the process exits.
+type Bundle struct {
+	// Config is the configuration of the virtual machine. Call Save to store the changes.
+	Config BundleConfig
+
+	path string
+	lock *os.File
+}
+
+// CreateBundle creates a new bundle at path with the configuration.
+//
+// path must not exist. The disk image and the other files are not created. Create these at
+// the paths returned by the methods of Bundle, e.g. by CreateDiskImage(b.DiskImagePath(), size).
+func CreateBundle(path string, config BundleConfig) (_ *Bundle, retErr error) {
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(path)
+		}
+	}()
+	b, err := openBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	b.Config = config
+	if err := b.Save(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// OpenBundle opens the bundle at path and loads its configuration.
+//
+// ErrBundleLocked is returned if the bundle is opened by another process. If the bundle is a legacy
+// one which has no config.json, Config has only OS which is BundleOSMacOS, and Version which is 0.
+// Set the other fields and call Save to write config.json.
+func OpenBundle(path string) (_ *Bundle, retErr error) {
+	b, err := openBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			b.Close()
+		}
+	}()
+	data, err := os.ReadFile(b.ConfigPath())
+	if errors.Is(err, os.ErrNotExist) && b.exists(legacyBundleHardwareModelName) {
+		b.Config = BundleConfig{OS: BundleOSMacOS}
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the configuration of the bundle: %w", err)
+	}
+	if err := json.Unmarshal(data, &b.Config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", b.ConfigPath(), err)
+	}
+	if b.Config.Version > BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Config.Version)
+	}
+	return b, nil
+}
+
+func openBundle(path string) (*Bundle, error) {
+	lock, err := lockFile(path)
+	if err != nil {
+		if errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrBundleLocked, path)
+		}
+		return nil, err
+	}
+	return &Bundle{
+		path: path,
+		lock: lock,
+	}, nil
+}
+
+// Save writes the configuration to config.json of the bundle.
+//
+// The file is replaced atomically, so a reader never sees a partially written file.
+func (b *Bundle) Save() error {
+	b.Config.Version = BundleVersion
+	data, err := json.MarshalIndent(&b.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(b.path, bundleConfigName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.ConfigPath())
+}
+
+// Close releases the lock of the bundle.
+func (b *Bundle) Close() error {
+	return b.lock.Close()
+}
+
+// Path returns the path of the bundle.
+func (b *Bundle) Path() string { return b.path }
+
+// ConfigPath returns the path of config.json.
+func (b *Bundle) ConfigPath() string { return filepath.Join(b.path, bundleConfigName) }
+
+// DiskImagePath returns the path of the main disk image.
+func (b *Bundle) DiskImagePath() string {
+	return b.file(bundleDiskImageName, legacyBundleDiskImageName)
+}
+
+// AuxiliaryStoragePath returns the path of the auxiliary storage.
+func (b *Bundle) AuxiliaryStoragePath() string {
+	return b.file(bundleAuxiliaryStorageName, legacyBundleAuxiliaryStorageName)
+}
+
+// MachineIdentifierPath returns the path of the data representation of the machine identifier.
+func (b *Bundle) MachineIdentifierPath() string {
+	return b.file(bundleMachineIdentifierName, legacyBundleMachineIdentifierName)
+}
+
+// HardwareModelPath returns the path of the data representation of the hardware model.
+func (b *Bundle) HardwareModelPath() string {
+	return b.file(bundleHardwareModelName, legacyBundleHardwareModelName)
+}
+
+// file returns the path of name in the bundle, or the path of legacy if only it exists.
+func (b *Bundle) file(name, legacy string) string {
+	if !b.exists(name) && b.exists(legacy) {
+		return filepath.Join(b.path, legacy)
+	}
+	return filepath.Join(b.path, name)
+}
+
+func (b *Bundle) exists(name string) bool {
+	_, err := os.Lstat(filepath.Join(b.path, name))
+	return err == nil
+}
+
+// resolve returns the path which is relative to the bundle if path is not absolute.
+func (b *Bundle) resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(b.path, path)
+}
+
+// LinuxBootLoader creates a LinuxBootLoader from KernelPath, InitrdPath and CommandLine
+// of the configuration.
+func (b *Bundle) LinuxBootLoader() (*LinuxBootLoader, error) {
+	if b.Config.OS != BundleOSLinux {
+		return nil, fmt.Errorf("bundle is not for linux: %q", b.Config.OS)
+	}
+	if b.Config.KernelPath == "" {
+		return nil, errors.New("kernel path is not set")
+	}
+	opts := []LinuxBootLoaderOption{}
+	if b.Config.CommandLine != "" {
+		opts = append(opts, WithCommandLine(b.Config.CommandLine))
+	}
+	if b.Config.InitrdPath != "" {
+		opts = append(opts, WithInitrd(b.resolve(b.Config.InitrdPath)))
+	}
+	return NewLinuxBootLoader(b.resolve(b.Config.KernelPath), opts...), nil
+}
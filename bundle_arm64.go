@@ -0,0 +1,220 @@
+//go:build darwin && arm64
+// +build darwin,arm64
+
+package vz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// CreateMacPlatformConfiguration creates the files of the macOS guest in the bundle and returns
+// the platform configuration for them.
+//
+// The hardware model is written to hardware-model, a new machine identifier is generated and
+// written to machine-identifier, and a new auxiliary storage is created at aux.img. This is used
+// to prepare the bundle before installing macOS.
+func (b *Bundle) CreateMacPlatformConfiguration(hardwareModel *MacHardwareModel) (*MacPlatformConfiguration, error) {
+	if err := os.WriteFile(b.HardwareModelPath(), hardwareModel.DataRepresentation(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write hardware model: %w", err)
+	}
+	machineIdentifier := NewMacMachineIdentifier()
+	if err := os.WriteFile(b.MachineIdentifierPath(), machineIdentifier.DataRepresentation(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write machine identifier: %w", err)
+	}
+	auxiliaryStorage, err := NewMacAuxiliaryStorage(
+		b.AuxiliaryStoragePath(),
+		WithCreatingStorage(hardwareModel),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auxiliary storage: %w", err)
+	}
+	return NewMacPlatformConfiguration(
+		WithHardwareModel(hardwareModel),
+		WithMachineIdentifier(machineIdentifier),
+		WithAuxiliaryStorage(auxiliaryStorage),
+	), nil
+}
+
+// MacPlatformConfiguration loads the platform configuration of the macOS guest from the bundle.
+func (b *Bundle) MacPlatformConfiguration() (*MacPlatformConfiguration, error) {
+	hardwareModel, err := NewMacHardwareModelWithDataPath(b.HardwareModelPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hardware model: %w", err)
+	}
+	machineIdentifier, err := NewMacMachineIdentifierWithDataPath(b.MachineIdentifierPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load machine identifier: %w", err)
+	}
+	auxiliaryStorage, err := NewMacAuxiliaryStorage(b.AuxiliaryStoragePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load auxiliary storage: %w", err)
+	}
+	return NewMacPlatformConfiguration(
+		WithHardwareModel(hardwareModel),
+		WithMachineIdentifier(machineIdentifier),
+		WithAuxiliaryStorage(auxiliaryStorage),
+	), nil
+}
+
+// CloneMacVM clones the macOS virtual machine bundle srcBundle to dstBundle and returns
+// the platform configuration for the cloned virtual machine.
+//
+// See Bundle for the layout of the bundle. srcBundle may be a legacy bundle, and dstBundle
+// is always written in the current layout. The disk image and the auxiliary storage are cloned by
+// clonefile(2), so cloning is fast and does not consume the disk space until the files are modified
+// when the bundle is on an APFS volume. Otherwise, only the data regions of these are copied, so the
+// sparse disk image is not written out at full size. The hardware model is preserved and a new machine
+// identifier is generated, so the cloned virtual machine can run concurrently with the source one. If the source bundle has a MAC address, a new random locally administered one is
+// written to the cloned bundle, so the clones do not conflict on the same network.
+//
+// dstBundle must not exist. If an error occurs, dstBundle is removed. ErrBundleLocked is returned
+// if the source bundle, its disk image or its auxiliary storage is in use, because the source
+// virtual machine must be stopped while cloning. The files are locked by the shared lock while
+// they are cloned.
+func CloneMacVM(srcBundle, dstBundle string) (_ *MacPlatformConfiguration, retErr error) {
+	src, err := OpenBundle(srcBundle)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	hardwareModel, err := NewMacHardwareModelWithDataPath(src.HardwareModelPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hardware model: %w", err)
+	}
+	if !hardwareModel.Supported() {
+		return nil, errors.New("hardware model of the source bundle is not supported on this host")
+	}
+
+	for _, path := range []string{
+		src.DiskImagePath(),
+		src.AuxiliaryStoragePath(),
+	} {
+		f, err := lockFileShared(path)
+		if err != nil {
+			if errors.Is(err, errLocked) {
+				return nil, fmt.Errorf("%w: %s", ErrBundleLocked, path)
+			}
+			return nil, fmt.Errorf("failed to lock %s: %w", filepath.Base(path), err)
+		}
+		defer f.Close()
+	}
+
+	config := src.Config
+	if config.MACAddress != "" {
+		config.MACAddress = NewRandomLocallyAdministeredMACAddress().String()
+	}
+	dst, err := CreateBundle(dstBundle, config)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(dstBundle)
+		}
+	}()
+
+	for _, f := range []struct{ src, dst string }{
+		{src.DiskImagePath(), dst.DiskImagePath()},
+		{src.AuxiliaryStoragePath(), dst.AuxiliaryStoragePath()},
+	} {
+		if err := cloneFile(f.src, f.dst); err != nil {
+			return nil, fmt.Errorf("failed to clone %s: %w", filepath.Base(f.src), err)
+		}
+	}
+
+	if err := os.WriteFile(dst.HardwareModelPath(), hardwareModel.DataRepresentation(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write hardware model: %w", err)
+	}
+	machineIdentifier := NewMacMachineIdentifier()
+	if err := os.WriteFile(dst.MachineIdentifierPath(), machineIdentifier.DataRepresentation(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write machine identifier: %w", err)
+	}
+
+	auxiliaryStorage, err := NewMacAuxiliaryStorage(dst.AuxiliaryStoragePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load auxiliary storage: %w", err)
+	}
+
+	return NewMacPlatformConfiguration(
+		WithHardwareModel(hardwareModel),
+		WithMachineIdentifier(machineIdentifier),
+		WithAuxiliaryStorage(auxiliaryStorage),
+	), nil
+}
+
+// cloneFile clones src to dst using clonefile(2). If the file system does not support cloning,
+// src is copied to dst instead, preserving its holes.
+func cloneFile(src, dst string) error {
+	err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, unix.ENOTSUP) && !errors.Is(err, unix.EXDEV) {
+		return &os.LinkError{Op: "clonefile", Old: src, New: dst, Err: err}
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := copySparse(out, in, fi.Size()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copySparse copies only the data regions of src which are found by SEEK_DATA and SEEK_HOLE,
+// so a sparse disk image is not written out at full size. An error is returned if the file
+// system of src can not find the holes.
+func copySparse(dst, src *os.File, size int64) error {
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+	for offset := int64(0); offset < size; {
+		data, err := src.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// no data after offset.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find the data of %s: %w", src.Name(), err)
+		}
+		hole, err := src.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return fmt.Errorf("failed to find the hole of %s: %w", src.Name(), err)
+		}
+		if _, err := src.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := dst.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, hole-data); err != nil {
+			return err
+		}
+		offset = hole
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLegacyBundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "VM.bundle")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		legacyBundleDiskImageName,
+		legacyBundleAuxiliaryStorageName,
+		legacyBundleMachineIdentifierName,
+		legacyBundleHardwareModelName,
+	} {
+		writeTestFile(t, filepath.Join(path, name), name)
+	}
+
+	b, err := OpenBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.Config.OS != BundleOSMacOS || b.Config.Version != 0 {
+		t.Fatalf("want the legacy macOS configuration but got %+v", b.Config)
+	}
+	for got, want := range map[string]string{
+		b.DiskImagePath():         legacyBundleDiskImageName,
+		b.AuxiliaryStoragePath():  legacyBundleAuxiliaryStorageName,
+		b.MachineIdentifierPath(): legacyBundleMachineIdentifierName,
+		b.HardwareModelPath():     legacyBundleHardwareModelName,
+	} {
+		if got != filepath.Join(path, want) {
+			t.Errorf("want %s but got %s", want, got)
+		}
+	}
+
+	// the files of the current layout take precedence.
+	writeTestFile(t, filepath.Join(path, bundleDiskImageName), "disk")
+	if got, want := b.DiskImagePath(), filepath.Join(path, bundleDiskImageName); got != want {
+		t.Errorf("want %s but got %s", want, got)
+	}
+}
+
+func TestOpenBundleWithoutConfig(t *testing.T) {
+	path := t.TempDir()
+	if _, err := OpenBundle(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want os.ErrNotExist but got %v", err)
+	}
+}
+
+func TestCreateBundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.vzvm")
+	b, err := CreateBundle(path, BundleConfig{OS: BundleOSLinux, CPUCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.DiskImagePath(), filepath.Join(path, bundleDiskImageName); got != want {
+		t.Errorf("want %s but got %s", want, got)
+	}
+	if _, err := OpenBundle(path); !errors.Is(err, ErrBundleLocked) {
+		t.Fatalf("want ErrBundleLocked but got %v", err)
+	}
+	b.Close()
+
+	b, err = OpenBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.Config.CPUCount != 2 || b.Config.Version != BundleVersion {
+		t.Fatalf("unexpected configuration: %+v", b.Config)
+	}
+}
@@ -0,0 +1,93 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Code-Hex/vz/v2/internal/iso9660"
+)
+
+// CloudInitVolumeID is the volume label which cloud-init looks for to find the NoCloud seed.
+const CloudInitVolumeID = "cidata"
+
+// CloudInitSeed is the data which is provided to cloud-init in the guest by the NoCloud data source.
+//
+// see: https://cloudinit.readthedocs.io/en/latest/reference/datasources/nocloud.html
+type CloudInitSeed struct {
+	// UserData is the content of user-data. e.g. "#cloud-config\nhostname: guest\n"
+	UserData string
+
+	// MetaData is the content of meta-data. e.g. "instance-id: guest-1\nlocal-hostname: guest\n"
+	// cloud-init runs the per-instance modules again when the instance-id is changed.
+	MetaData string
+
+	// NetworkConfig is the content of network-config. This is omitted from the seed if empty.
+	NetworkConfig string
+
+	// VendorData is the content of vendor-data. This is omitted from the seed if empty.
+	VendorData string
+}
+
+// CreateCloudInitSeedImage writes the NoCloud seed ISO image which contains the seed to path.
+//
+// The image is built in pure Go, so genisoimage or hdiutil is not required. Note that if path
+// already exists, this function returns os.ErrExist error as same as CreateDiskImage.
+func CreateCloudInitSeedImage(path string, seed CloudInitSeed) (retErr error) {
+	w := &iso9660.Writer{VolumeID: CloudInitVolumeID}
+	files := []struct {
+		name     string
+		data     string
+		optional bool
+	}{
+		{name: "user-data", data: seed.UserData},
+		{name: "meta-data", data: seed.MetaData},
+		{name: "network-config", data: seed.NetworkConfig, optional: true},
+		{name: "vendor-data", data: seed.VendorData, optional: true},
+	}
+	for _, f := range files {
+		if f.optional && f.data == "" {
+			continue
+		}
+		if err := w.AddFile(f.name, []byte(f.data)); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if retErr != nil {
+			os.Remove(path)
+		}
+	}()
+	_, err = w.WriteTo(f)
+	return err
+}
+
+// NewCloudInitSeedStorageDeviceConfiguration writes the NoCloud seed ISO image to path with
+// CreateCloudInitSeedImage and creates a read-only Virtio block device which is backed by the image.
+// Add the returned device to the storage devices of the configuration.
+//
+// Unlike CreateCloudInitSeedImage, an existing file at path is replaced, so the seed is
+// regenerated every time the virtual machine is configured.
+func NewCloudInitSeedStorageDeviceConfiguration(path string, seed CloudInitSeed) (*VirtioBlockDeviceConfiguration, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := CreateCloudInitSeedImage(path, seed); err != nil {
+		return nil, err
+	}
+	attachment, err := NewDiskImageStorageDeviceAttachment(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return NewVirtioBlockDeviceConfiguration(attachment), nil
+}
@@ -0,0 +1,330 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrRestartRequired is returned by (*ConfigurationDiff).Apply when the diff contains changes
+// which can not be applied to the running virtual machine.
+var ErrRestartRequired = errors.New("configuration change requires restart")
+
+// ConfigurationChange is a difference between two configurations.
+type ConfigurationChange struct {
+	// Field is the changed part of the configuration, e.g. "MemorySize" or "NetworkDevices[0].Attachment".
+	Field string
+
+	// Old is the description of the old value.
+	Old string
+
+	// New is the description of the new value.
+	New string
+
+	// Live is true if the change can be applied to the running virtual machine by
+	// (*ConfigurationDiff).Apply. Otherwise the virtual machine must be restarted with the new configuration.
+	Live bool
+
+	// apply applies the live change to the running virtual machine.
+	apply func(vm *VirtualMachine) error
+}
+
+// String returns the description of the change.
+func (c *ConfigurationChange) String() string {
+	mode := "restart"
+	if c.Live {
+		mode = "live"
+	}
+	return fmt.Sprintf("%s: %s -> %s (%s)", c.Field, c.Old, c.New, mode)
+}
+
+// ConfigurationDiff is the list of the changes from a configuration to another one.
+type ConfigurationDiff struct {
+	// Changes is the list of the changes in the order of the configuration.
+	Changes []*ConfigurationChange
+}
+
+// DiffConfiguration compares the configuration from, e.g. the one which is stored in the bundle
+// and used by the running virtual machine, with the desired configuration to, and reports which
+// changes can be applied live, so a manager can update the virtual machine with minimal downtime:
+//
+//	diff := vz.DiffConfiguration(running, desired)
+//	if diff.RequiresRestart() {
+//		// stop the virtual machine and start a new one with desired.
+//	} else if err := diff.Apply(vm); err != nil {
+//		...
+//	}
+//
+// The changes which can be applied live are:
+//
+//   - the decrease of the memory size when both configurations have a memory balloon device.
+//     The memory balloon target is set to the new size, and the guest keeps the old maximum
+//     until it is restarted.
+//   - the replacement of the attachments of the network devices, which requires macOS 13 and newer.
+//
+// Any other change, e.g. the CPU count, the boot loader, the storage devices or the number of the
+// devices, requires a restart. The Linux boot loaders are compared by the kernel, the initial RAM disk
+// and the command line, and the platforms by the files on the host which they use (e.g. the auxiliary
+// storage which holds the NVRAM variables of the macOS guest) and the identity of the macOS guest
+// (the hardware model and the machine identifier). The devices are compared by their types and the
+// files on the host which they use, and the network attachments by the networks which they attach to,
+// so a change of an option which is not visible from the configuration is not reported.
+func DiffConfiguration(from, to *VirtualMachineConfiguration) *ConfigurationDiff {
+	d := &ConfigurationDiff{}
+	restart := func(field string, oldValue, newValue interface{}) {
+		d.Changes = append(d.Changes, &ConfigurationChange{
+			Field: field,
+			Old:   fmt.Sprint(oldValue),
+			New:   fmt.Sprint(newValue),
+		})
+	}
+
+	if from.cpuCount != to.cpuCount {
+		restart("CPUCount", from.cpuCount, to.cpuCount)
+	}
+	if from.memorySize != to.memorySize {
+		target := to.memorySize
+		if target < from.memorySize && len(from.memoryBalloonDevices) > 0 && len(to.memoryBalloonDevices) > 0 {
+			d.Changes = append(d.Changes, &ConfigurationChange{
+				Field: "MemorySize",
+				Old:   fmt.Sprint(from.memorySize),
+				New:   fmt.Sprint(to.memorySize),
+				Live:  true,
+				apply: func(vm *VirtualMachine) error {
+					balloons := vm.MemoryBalloonDevices()
+					if len(balloons) == 0 {
+						return errors.New("virtual machine has no memory balloon device")
+					}
+					balloons[0].SetTargetVirtualMachineMemorySize(target)
+					return nil
+				},
+			})
+		} else {
+			restart("MemorySize", from.memorySize, to.memorySize)
+		}
+	}
+	if o, n := bootLoaderString(from.bootLoader), bootLoaderString(to.bootLoader); o != n {
+		restart("BootLoader", o, n)
+	}
+	if o, n := platformString(from.platform), platformString(to.platform); o != n {
+		restart("Platform", o, n)
+	}
+
+	d.diffNetworkDevices(from.networkDevices, to.networkDevices)
+	d.diffStorageDevices(from.storageDevices, to.storageDevices)
+
+	devices := []struct {
+		field    string
+		from, to []string
+	}{
+		{"EntropyDevices", typeNames(from.entropyDevices), typeNames(to.entropyDevices)},
+		{"MemoryBalloonDevices", typeNames(from.memoryBalloonDevices), typeNames(to.memoryBalloonDevices)},
+		{"SerialPorts", typeNames(from.serialPorts), typeNames(to.serialPorts)},
+		{"SocketDevices", typeNames(from.socketDevices), typeNames(to.socketDevices)},
+		{"DirectorySharingDevices", typeNames(from.directorySharingDevices), typeNames(to.directorySharingDevices)},
+		{"GraphicsDevices", typeNames(from.graphicsDevices), typeNames(to.graphicsDevices)},
+		{"PointingDevices", typeNames(from.pointingDevices), typeNames(to.pointingDevices)},
+		{"Keyboards", typeNames(from.keyboards), typeNames(to.keyboards)},
+		{"AudioDevices", typeNames(from.audioDevices), typeNames(to.audioDevices)},
+		{"ConsoleDevices", typeNames(from.consoleDevices), typeNames(to.consoleDevices)},
+	}
+	for _, dev := range devices {
+		if o, n := strings.Join(dev.from, ","), strings.Join(dev.to, ","); o != n {
+			restart(dev.field, "["+o+"]", "["+n+"]")
+		}
+	}
+	return d
+}
+
+func (d *ConfigurationDiff) diffNetworkDevices(from, to []*VirtioNetworkDeviceConfiguration) {
+	if len(from) != len(to) {
+		d.Changes = append(d.Changes, &ConfigurationChange{
+			Field: "NetworkDevices",
+			Old:   fmt.Sprintf("%d devices", len(from)),
+			New:   fmt.Sprintf("%d devices", len(to)),
+		})
+		return
+	}
+	for i := range from {
+		oldMAC, newMAC := macAddressString(from[i].macAddress), macAddressString(to[i].macAddress)
+		if oldMAC != newMAC {
+			d.Changes = append(d.Changes, &ConfigurationChange{
+				Field: fmt.Sprintf("NetworkDevices[%d].MACAddress", i),
+				Old:   oldMAC,
+				New:   newMAC,
+			})
+		}
+		o, n := networkDeviceAttachmentString(from[i].attachment), networkDeviceAttachmentString(to[i].attachment)
+		if o == n {
+			continue
+		}
+		index, attachment := i, to[i].attachment
+		d.Changes = append(d.Changes, &ConfigurationChange{
+			Field: fmt.Sprintf("NetworkDevices[%d].Attachment", i),
+			Old:   o,
+			New:   n,
+			Live:  true,
+			apply: func(vm *VirtualMachine) error {
+				devices, err := vm.NetworkDevices()
+				if err != nil {
+					return err
+				}
+				if index >= len(devices) {
+					return fmt.Errorf("virtual machine has no network device at index %d", index)
+				}
+				return devices[index].SetAttachment(attachment)
+			},
+		})
+	}
+}
+
+func (d *ConfigurationDiff) diffStorageDevices(from, to []StorageDeviceConfiguration) {
+	if len(from) != len(to) {
+		d.Changes = append(d.Changes, &ConfigurationChange{
+			Field: "StorageDevices",
+			Old:   fmt.Sprintf("%d devices", len(from)),
+			New:   fmt.Sprintf("%d devices", len(to)),
+		})
+		return
+	}
+	for i := range from {
+		o, n := storageDeviceString(from[i]), storageDeviceString(to[i])
+		if o != n {
+			d.Changes = append(d.Changes, &ConfigurationChange{
+				Field: fmt.Sprintf("StorageDevices[%d]", i),
+				Old:   o,
+				New:   n,
+			})
+		}
+	}
+}
+
+// Empty reports whether the configurations are the same.
+func (d *ConfigurationDiff) Empty() bool { return len(d.Changes) == 0 }
+
+// RequiresRestart reports whether any of the changes can not be applied live.
+func (d *ConfigurationDiff) RequiresRestart() bool {
+	for _, c := range d.Changes {
+		if !c.Live {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply applies the changes to the running virtual machine which is created with the old configuration.
+//
+// The returned error wraps ErrRestartRequired and nothing is applied if any of the changes can not
+// be applied live. Otherwise the changes are applied in order, and the first error is returned.
+func (d *ConfigurationDiff) Apply(vm *VirtualMachine) error {
+	var fields []string
+	for _, c := range d.Changes {
+		if !c.Live {
+			fields = append(fields, c.Field)
+		}
+	}
+	if len(fields) > 0 {
+		return fmt.Errorf("%w: %s", ErrRestartRequired, strings.Join(fields, ", "))
+	}
+	for _, c := range d.Changes {
+		if err := c.apply(vm); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", c.Field, err)
+		}
+	}
+	return nil
+}
+
+// networkDeviceAttachmentString describes the network which the attachment attaches the device to,
+// so the attachments are compared by their identities instead of the objects:
+//
+//   - the NAT attachments have no state, so any of them are the same.
+//   - the bridged attachments are identified by the interface, e.g. "en0".
+//   - the file handle attachments are identified by the file descriptor and the MTU. The attachments
+//     of a vnet.Network use the same file descriptor, so they are the same.
+//
+// The other attachments are identified by the objects.
+func networkDeviceAttachmentString(a NetworkDeviceAttachment) string {
+	switch a := a.(type) {
+	case nil:
+		return "none"
+	case *NATNetworkDeviceAttachment:
+		return "nat"
+	case *BridgedNetworkDeviceAttachment:
+		return "bridged:" + a.interfaceIdentifier
+	case *FileHandleNetworkDeviceAttachment:
+		return fmt.Sprintf("file-handle:fd=%d,mtu=%d", a.fd, a.mtu)
+	}
+	return fmt.Sprintf("%T(%p)", a, a)
+}
+
+// storageDeviceString describes the storage device by its type and the files on the host.
+func storageDeviceString(d StorageDeviceConfiguration) string {
+	return typeName(d) + diskFilesString(d)
+}
+
+// bootLoaderString describes the boot loader by its type, the files which it boots and its options.
+// The files on the host which the boot loader uses (e.g. a variable store) are also described.
+func bootLoaderString(b BootLoader) string {
+	s := typeName(b)
+	if l, ok := b.(*LinuxBootLoader); ok {
+		s += fmt.Sprintf(" kernel=%q initrd=%q cmdline=%q", l.vmlinuzPath, l.initrdPath, l.cmdLine)
+	}
+	return s + diskFilesString(b)
+}
+
+// platformString describes the platform by its type, the files on the host which it uses and
+// the identity of the macOS guest.
+func platformString(p PlatformConfiguration) string {
+	s := typeName(p) + diskFilesString(p)
+	if p, ok := p.(interface {
+		identity() (hardwareModel, machineIdentifier []byte)
+	}); ok {
+		hardwareModel, machineIdentifier := p.identity()
+		s += fmt.Sprintf(" hardwareModel=%x machineIdentifier=%x", hardwareModel, machineIdentifier)
+	}
+	return s
+}
+
+func diskFilesString(v interface{}) string {
+	u, ok := v.(diskFileUser)
+	if !ok {
+		return ""
+	}
+	var s string
+	for _, f := range u.diskFiles() {
+		mode := "rw"
+		if f.readOnly {
+			mode = "ro"
+		}
+		s += fmt.Sprintf(" %s:%s", f.path, mode)
+	}
+	return s
+}
+
+func macAddressString(m *MACAddress) string {
+	if m == nil {
+		return "random"
+	}
+	return m.String()
+}
+
+func typeName(v interface{}) string {
+	if v == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// typeNames returns the type names of the elements of the slice vs.
+func typeNames(vs interface{}) []string {
+	rv := reflect.ValueOf(vs)
+	names := make([]string, rv.Len())
+	for i := range names {
+		names[i] = typeName(rv.Index(i).Interface())
+	}
+	return names
+}
@@ -0,0 +1,228 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testMacPlatform is a platform which has the auxiliary storage and the identity like MacPlatformConfiguration.
+type testMacPlatform struct {
+	*GenericPlatformConfiguration
+	auxiliaryStorage  string
+	machineIdentifier string
+}
+
+func (p *testMacPlatform) diskFiles() []diskFile {
+	return []diskFile{{path: p.auxiliaryStorage}}
+}
+
+func (p *testMacPlatform) identity() (hardwareModel, machineIdentifier []byte) {
+	return []byte("model"), []byte(p.machineIdentifier)
+}
+
+func testLinuxBootLoader(kernel, initrd, cmdLine string) *LinuxBootLoader {
+	return &LinuxBootLoader{vmlinuzPath: kernel, initrdPath: initrd, cmdLine: cmdLine}
+}
+
+func testDiffConfiguration(attachment NetworkDeviceAttachment, disk string) *VirtualMachineConfiguration {
+	return &VirtualMachineConfiguration{
+		cpuCount:   2,
+		memorySize: 4 << 30,
+		bootLoader: testLinuxBootLoader("/vm/vmlinuz", "/vm/initrd", "console=hvc0"),
+		platform:   &testMacPlatform{auxiliaryStorage: "/vm/aux.img", machineIdentifier: "id"},
+		networkDevices: []*VirtioNetworkDeviceConfiguration{
+			{attachment: attachment},
+		},
+		storageDevices: []StorageDeviceConfiguration{
+			&VirtioBlockDeviceConfiguration{
+				attachment: &DiskImageStorageDeviceAttachment{diskPath: disk},
+			},
+		},
+		memoryBalloonDevices: []MemoryBalloonDeviceConfiguration{
+			&VirtioTraditionalMemoryBalloonDeviceConfiguration{},
+		},
+	}
+}
+
+func TestDiffConfiguration(t *testing.T) {
+	bridged := func(name string) *BridgedNetworkDeviceAttachment {
+		return &BridgedNetworkDeviceAttachment{interfaceIdentifier: name}
+	}
+	fileHandle := func(fd uintptr) *FileHandleNetworkDeviceAttachment {
+		return &FileHandleNetworkDeviceAttachment{fd: fd, mtu: 1500}
+	}
+	cases := []struct {
+		name    string
+		from    *VirtualMachineConfiguration
+		to      func(c *VirtualMachineConfiguration)
+		fields  []string
+		restart bool
+	}{
+		{
+			name:   "same NAT attachments",
+			from:   testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to:     func(c *VirtualMachineConfiguration) { c.networkDevices[0].attachment = &NATNetworkDeviceAttachment{} },
+			fields: nil,
+		},
+		{
+			name:   "same bridged interface",
+			from:   testDiffConfiguration(bridged("en0"), "/vm/disk.img"),
+			to:     func(c *VirtualMachineConfiguration) { c.networkDevices[0].attachment = bridged("en0") },
+			fields: nil,
+		},
+		{
+			name:   "other bridged interface",
+			from:   testDiffConfiguration(bridged("en0"), "/vm/disk.img"),
+			to:     func(c *VirtualMachineConfiguration) { c.networkDevices[0].attachment = bridged("en1") },
+			fields: []string{"NetworkDevices[0].Attachment"},
+		},
+		{
+			name:   "same file descriptor",
+			from:   testDiffConfiguration(fileHandle(5), "/vm/disk.img"),
+			to:     func(c *VirtualMachineConfiguration) { c.networkDevices[0].attachment = fileHandle(5) },
+			fields: nil,
+		},
+		{
+			name:   "other file descriptor",
+			from:   testDiffConfiguration(fileHandle(5), "/vm/disk.img"),
+			to:     func(c *VirtualMachineConfiguration) { c.networkDevices[0].attachment = fileHandle(6) },
+			fields: []string{"NetworkDevices[0].Attachment"},
+		},
+		{
+			name:   "NAT to bridged",
+			from:   testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to:     func(c *VirtualMachineConfiguration) { c.networkDevices[0].attachment = bridged("en0") },
+			fields: []string{"NetworkDevices[0].Attachment"},
+		},
+		{
+			name:   "decrease of memory with balloon",
+			from:   testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to:     func(c *VirtualMachineConfiguration) { c.memorySize = 2 << 30 },
+			fields: []string{"MemorySize"},
+		},
+		{
+			name:    "increase of memory",
+			from:    testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to:      func(c *VirtualMachineConfiguration) { c.memorySize = 8 << 30 },
+			fields:  []string{"MemorySize"},
+			restart: true,
+		},
+		{
+			name: "CPU count and disk",
+			from: testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to: func(c *VirtualMachineConfiguration) {
+				c.cpuCount = 4
+				c.storageDevices[0].(*VirtioBlockDeviceConfiguration).attachment = &DiskImageStorageDeviceAttachment{diskPath: "/vm/other.img"}
+			},
+			fields:  []string{"CPUCount", "StorageDevices[0]"},
+			restart: true,
+		},
+		{
+			name: "kernel",
+			from: testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to: func(c *VirtualMachineConfiguration) {
+				c.bootLoader = testLinuxBootLoader("/vm/vmlinuz-2", "/vm/initrd", "console=hvc0")
+			},
+			fields:  []string{"BootLoader"},
+			restart: true,
+		},
+		{
+			name: "initrd",
+			from: testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to: func(c *VirtualMachineConfiguration) {
+				c.bootLoader = testLinuxBootLoader("/vm/vmlinuz", "", "console=hvc0")
+			},
+			fields:  []string{"BootLoader"},
+			restart: true,
+		},
+		{
+			name: "command line",
+			from: testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to: func(c *VirtualMachineConfiguration) {
+				c.bootLoader = testLinuxBootLoader("/vm/vmlinuz", "/vm/initrd", "console=hvc0 quiet")
+			},
+			fields:  []string{"BootLoader"},
+			restart: true,
+		},
+		{
+			name: "auxiliary storage",
+			from: testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to: func(c *VirtualMachineConfiguration) {
+				c.platform = &testMacPlatform{auxiliaryStorage: "/vm/other-aux.img", machineIdentifier: "id"}
+			},
+			fields:  []string{"Platform"},
+			restart: true,
+		},
+		{
+			name: "machine identifier",
+			from: testDiffConfiguration(&NATNetworkDeviceAttachment{}, "/vm/disk.img"),
+			to: func(c *VirtualMachineConfiguration) {
+				c.platform = &testMacPlatform{auxiliaryStorage: "/vm/aux.img", machineIdentifier: "other"}
+			},
+			fields:  []string{"Platform"},
+			restart: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			to := testDiffConfiguration(tc.from.networkDevices[0].attachment, "/vm/disk.img")
+			tc.to(to)
+			d := DiffConfiguration(tc.from, to)
+			var fields []string
+			for _, c := range d.Changes {
+				fields = append(fields, c.Field)
+			}
+			if !reflect.DeepEqual(fields, tc.fields) {
+				t.Fatalf("want changes %v but got %v", tc.fields, d.Changes)
+			}
+			if got := d.Empty(); got != (len(tc.fields) == 0) {
+				t.Errorf("want Empty() %v but got %v", len(tc.fields) == 0, got)
+			}
+			if got := d.RequiresRestart(); got != tc.restart {
+				t.Errorf("want RequiresRestart() %v but got %v", tc.restart, got)
+			}
+		})
+	}
+}
+
+func TestConfigurationDiffApply(t *testing.T) {
+	var applied []string
+	change := func(field string, live bool, err error) *ConfigurationChange {
+		return &ConfigurationChange{
+			Field: field,
+			Live:  live,
+			apply: func(*VirtualMachine) error {
+				applied = append(applied, field)
+				return err
+			},
+		}
+	}
+
+	d := &ConfigurationDiff{Changes: []*ConfigurationChange{
+		change("MemorySize", true, nil),
+		change("CPUCount", false, nil),
+	}}
+	if err := d.Apply(nil); !errors.Is(err, ErrRestartRequired) {
+		t.Fatalf("want ErrRestartRequired but got %v", err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("want nothing to be applied but got %v", applied)
+	}
+
+	boom := errors.New("boom")
+	d = &ConfigurationDiff{Changes: []*ConfigurationChange{
+		change("MemorySize", true, nil),
+		change("NetworkDevices[0].Attachment", true, boom),
+		change("NetworkDevices[1].Attachment", true, nil),
+	}}
+	if err := d.Apply(nil); !errors.Is(err, boom) {
+		t.Fatalf("want boom but got %v", err)
+	}
+	if want := []string{"MemorySize", "NetworkDevices[0].Attachment"}; !reflect.DeepEqual(applied, want) {
+		t.Fatalf("want %v to be applied but got %v", want, applied)
+	}
+}
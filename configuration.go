@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -6,7 +9,10 @@ package vz
 # include "virtualization.h"
 */
 import "C"
-import "runtime"
+import (
+	"runtime"
+	"unsafe"
+)
 
 // VirtualMachineConfiguration defines the configuration of a VirtualMachine.
 //
@@ -32,7 +38,23 @@ import "runtime"
 type VirtualMachineConfiguration struct {
 	cpuCount   uint
 	memorySize uint64
+	bootLoader BootLoader
 	pointer
+
+	// the devices which are set by the setters. These are returned by the getters.
+	entropyDevices          []*VirtioEntropyDeviceConfiguration
+	memoryBalloonDevices    []MemoryBalloonDeviceConfiguration
+	networkDevices          []*VirtioNetworkDeviceConfiguration
+	serialPorts             []*VirtioConsoleDeviceSerialPortConfiguration
+	socketDevices           []SocketDeviceConfiguration
+	storageDevices          []StorageDeviceConfiguration
+	directorySharingDevices []DirectorySharingDeviceConfiguration
+	platform                PlatformConfiguration
+	graphicsDevices         []GraphicsDeviceConfiguration
+	pointingDevices         []PointingDeviceConfiguration
+	keyboards               []KeyboardConfiguration
+	audioDevices            []AudioDeviceConfiguration
+	consoleDevices          []ConsoleDeviceConfiguration
 }
 
 // NewVirtualMachineConfiguration creates a new configuration.
@@ -43,17 +65,24 @@ type VirtualMachineConfiguration struct {
 // - memorySize parameter represents memory size in bytes.
 //    The memory size must be a multiple of a 1 megabyte (1024 * 1024 bytes) between
 //    VZVirtualMachineConfiguration.minimumAllowedMemorySize and VZVirtualMachineConfiguration.maximumAllowedMemorySize.
+//
+// bootLoader can be nil, then it must be set with SetBootLoader method before validating
+// the configuration. The cpu and memorySize can be also changed with SetCPUCount and
+// SetMemorySize methods.
 func NewVirtualMachineConfiguration(bootLoader BootLoader, cpu uint, memorySize uint64) *VirtualMachineConfiguration {
+	var bootLoaderPtr unsafe.Pointer
+	if bootLoader != nil {
+		bootLoaderPtr = bootLoader.Ptr()
+	}
 	config := &VirtualMachineConfiguration{
 		cpuCount:   cpu,
 		memorySize: memorySize,
-		pointer: pointer{
-			ptr: C.newVZVirtualMachineConfiguration(
-				bootLoader.Ptr(),
-				C.uint(cpu),
-				C.ulonglong(memorySize),
-			),
-		},
+		bootLoader: bootLoader,
+		pointer: newPointer(C.newVZVirtualMachineConfiguration(
+			bootLoaderPtr,
+			C.uint(cpu),
+			C.ulonglong(memorySize),
+		)),
 	}
 	runtime.SetFinalizer(config, func(self *VirtualMachineConfiguration) {
 		self.Release()
@@ -61,134 +90,280 @@ func NewVirtualMachineConfiguration(bootLoader BootLoader, cpu uint, memorySize
 	return config
 }
 
+// SetBootLoader sets the boot loader used when the virtual machine starts.
+func (v *VirtualMachineConfiguration) SetBootLoader(bootLoader BootLoader) {
+	var bootLoaderPtr unsafe.Pointer
+	if bootLoader != nil {
+		bootLoaderPtr = bootLoader.Ptr()
+	}
+	v.bootLoader = bootLoader
+	C.setBootLoaderVZVirtualMachineConfiguration(v.Ptr(), bootLoaderPtr)
+}
+
+// BootLoader returns the boot loader used when the virtual machine starts.
+func (v *VirtualMachineConfiguration) BootLoader() BootLoader { return v.bootLoader }
+
+// SetCPUCount sets the number of CPUs.
+//
+// The number of CPUs must be a value between VirtualMachineConfigurationMinimumAllowedCPUCount
+// and VirtualMachineConfigurationMaximumAllowedCPUCount. This is checked by Validate method.
+func (v *VirtualMachineConfiguration) SetCPUCount(cpu uint) {
+	v.cpuCount = cpu
+	C.setCPUCountVZVirtualMachineConfiguration(v.Ptr(), C.uint(cpu))
+}
+
+// CPUCount returns the number of CPUs.
+func (v *VirtualMachineConfiguration) CPUCount() uint { return v.cpuCount }
+
+// SetMemorySize sets the virtual machine memory size in bytes.
+//
+// The memory size must be a multiple of a 1 megabyte (1024 * 1024 bytes) between
+// VirtualMachineConfigurationMinimumAllowedMemorySize and VirtualMachineConfigurationMaximumAllowedMemorySize.
+// This is checked by Validate method.
+func (v *VirtualMachineConfiguration) SetMemorySize(memorySize uint64) {
+	v.memorySize = memorySize
+	C.setMemorySizeVZVirtualMachineConfiguration(v.Ptr(), C.ulonglong(memorySize))
+}
+
+// MemorySize returns the virtual machine memory size in bytes.
+func (v *VirtualMachineConfiguration) MemorySize() uint64 { return v.memorySize }
+
+// validateResources validates the boot loader. The number of CPUs and the memory size are
+// validated by validateLimits.
+func (v *VirtualMachineConfiguration) validateResources() ValidationErrors {
+	var errs ValidationErrors
+	if v.bootLoader == nil {
+		errs = append(errs, &ValidationError{
+			Device: "bootLoader",
+			Index:  -1,
+			Reason: "boot loader is not set",
+		})
+	}
+	return errs
+}
+
 // Validate the configuration.
 //
 // Return true if the configuration is valid.
 // If error is not nil, assigned with the validation error if the validation failed.
+//
+// The error is ValidationErrors which describes which device or property is invalid and why.
+// The properties which can be checked in Go (including the number of the devices against
+// CurrentLimits) are checked first and all of the problems are reported.
+// Then the configuration is validated by Virtualization.framework.
 func (v *VirtualMachineConfiguration) Validate() (bool, error) {
+	errs := v.validateResources()
+	errs = append(errs, v.validateLimits(CurrentLimits())...)
+	errs = append(errs, validateNetworkDevices(v.networkDevices)...)
+	errs = append(errs, validateStorageDevices(v.storageDevices)...)
+	if len(errs) > 0 {
+		return false, errs
+	}
 	nserr := newNSErrorAsNil()
 	nserrPtr := nserr.Ptr()
 	ret := C.validateVZVirtualMachineConfiguration(v.Ptr(), &nserrPtr)
-	err := newNSError(nserrPtr)
-	if err != nil {
-		return false, err
+	if err := newNSError(nserrPtr); err != nil {
+		return false, ValidationErrors{newValidationErrorFromNSError(err, v.validationFiles())}
 	}
 	return (bool)(ret), nil
 }
 
 // SetEntropyDevicesVirtualMachineConfiguration sets list of entropy devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetEntropyDevicesVirtualMachineConfiguration(cs []*VirtioEntropyDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.entropyDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setEntropyDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setEntropyDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// EntropyDevices returns the list of entropy devices which is set by SetEntropyDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) EntropyDevices() []*VirtioEntropyDeviceConfiguration {
+	return v.entropyDevices
 }
 
 // SetMemoryBalloonDevicesVirtualMachineConfiguration sets list of memory balloon devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetMemoryBalloonDevicesVirtualMachineConfiguration(cs []MemoryBalloonDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.memoryBalloonDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setMemoryBalloonDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setMemoryBalloonDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// MemoryBalloonDevices returns the list of memory balloon devices which is set by SetMemoryBalloonDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) MemoryBalloonDevices() []MemoryBalloonDeviceConfiguration {
+	return v.memoryBalloonDevices
 }
 
 // SetNetworkDevicesVirtualMachineConfiguration sets list of network adapters. Empty by default.
+//
+// The network devices can use different kinds of attachments. e.g. NAT, bridged and file handle attachments.
+// Each network device must have a unique MAC address and file handle attachments must not share the file handle.
+// These are checked by Validate method.
 func (v *VirtualMachineConfiguration) SetNetworkDevicesVirtualMachineConfiguration(cs []*VirtioNetworkDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.networkDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setNetworkDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setNetworkDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// NetworkDevices returns the list of network adapters which is set by SetNetworkDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) NetworkDevices() []*VirtioNetworkDeviceConfiguration {
+	return v.networkDevices
 }
 
 // SetSerialPortsVirtualMachineConfiguration sets list of serial ports. Empty by default.
 func (v *VirtualMachineConfiguration) SetSerialPortsVirtualMachineConfiguration(cs []*VirtioConsoleDeviceSerialPortConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.serialPorts = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setSerialPortsVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setSerialPortsVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// SerialPorts returns the list of serial ports which is set by SetSerialPortsVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) SerialPorts() []*VirtioConsoleDeviceSerialPortConfiguration {
+	return v.serialPorts
 }
 
 // SetSocketDevicesVirtualMachineConfiguration sets list of socket devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetSocketDevicesVirtualMachineConfiguration(cs []SocketDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.socketDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setSocketDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setSocketDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// SocketDevices returns the list of socket devices which is set by SetSocketDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) SocketDevices() []SocketDeviceConfiguration {
+	return v.socketDevices
 }
 
 // SetStorageDevicesVirtualMachineConfiguration sets list of disk devices. Empty by default.
+//
+// The devices are attached to the guest in the order of cs, so Linux names the Virtio block
+// devices /dev/vda, /dev/vdb and so on in this order. Validate reports an error if the same device
+// is listed twice. Use StorageDeviceInfo to map the devices to the names in the guest.
 func (v *VirtualMachineConfiguration) SetStorageDevicesVirtualMachineConfiguration(cs []StorageDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.storageDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setStorageDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setStorageDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// StorageDevices returns the list of disk devices which is set by SetStorageDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) StorageDevices() []StorageDeviceConfiguration {
+	return v.storageDevices
 }
 
 // SetDirectorySharingDevicesVirtualMachineConfiguration sets list of directory sharing devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetDirectorySharingDevicesVirtualMachineConfiguration(cs []DirectorySharingDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.directorySharingDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setDirectorySharingDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setDirectorySharingDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// DirectorySharingDevices returns the list of directory sharing devices which is set by SetDirectorySharingDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) DirectorySharingDevices() []DirectorySharingDeviceConfiguration {
+	return v.directorySharingDevices
 }
 
 // SetPlatformVirtualMachineConfiguration sets the hardware platform to use. Defaults to GenericPlatformConfiguration.
 func (v *VirtualMachineConfiguration) SetPlatformVirtualMachineConfiguration(c PlatformConfiguration) {
+	v.platform = c
 	C.setPlatformVZVirtualMachineConfiguration(v.Ptr(), c.Ptr())
 }
 
+// Platform returns the hardware platform which is set by SetPlatformVirtualMachineConfiguration.
+// This is nil if it is not set, then GenericPlatformConfiguration is used.
+func (v *VirtualMachineConfiguration) Platform() PlatformConfiguration { return v.platform }
+
 // SetGraphicsDevicesVirtualMachineConfiguration sets list of graphics devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetGraphicsDevicesVirtualMachineConfiguration(cs []GraphicsDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.graphicsDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
+	}
+	C.setGraphicsDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// GraphicsDevices returns the list of graphics devices which is set by SetGraphicsDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) GraphicsDevices() []GraphicsDeviceConfiguration {
+	return v.graphicsDevices
+}
+
+// displaySize returns the size in pixels of the first display of the graphics devices.
+// Returns zero if no display is configured.
+func (v *VirtualMachineConfiguration) displaySize() (width, height float64) {
+	for _, device := range v.graphicsDevices {
+		d, ok := device.(interface {
+			displaySize() (width, height float64)
+		})
+		if !ok {
+			continue
+		}
+		if width, height := d.displaySize(); width > 0 && height > 0 {
+			return width, height
+		}
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setGraphicsDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	return 0, 0
 }
 
 // SetPointingDevicesVirtualMachineConfiguration sets list of pointing devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetPointingDevicesVirtualMachineConfiguration(cs []PointingDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.pointingDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setPointingDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setPointingDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// PointingDevices returns the list of pointing devices which is set by SetPointingDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) PointingDevices() []PointingDeviceConfiguration {
+	return v.pointingDevices
 }
 
 // SetKeyboardsVirtualMachineConfiguration sets list of keyboards. Empty by default.
 func (v *VirtualMachineConfiguration) SetKeyboardsVirtualMachineConfiguration(cs []KeyboardConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.keyboards = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setKeyboardsVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setKeyboardsVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
 }
 
+// Keyboards returns the list of keyboards which is set by SetKeyboardsVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) Keyboards() []KeyboardConfiguration { return v.keyboards }
+
 // SetAudioDevicesVirtualMachineConfiguration sets list of audio devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetAudioDevicesVirtualMachineConfiguration(cs []AudioDeviceConfiguration) {
-	ptrs := make([]NSObject, len(cs))
+	v.audioDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
 	for i, val := range cs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setAudioDevicesVZVirtualMachineConfiguration(v.Ptr(), array.Ptr())
+	C.setAudioDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+// AudioDevices returns the list of audio devices which is set by SetAudioDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) AudioDevices() []AudioDeviceConfiguration {
+	return v.audioDevices
 }
 
 // VirtualMachineConfigurationMinimumAllowedMemorySize returns minimum
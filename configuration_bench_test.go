@@ -0,0 +1,86 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newBenchDiskImages creates n empty disk images for the storage devices.
+func newBenchDiskImages(b *testing.B, n int) []string {
+	b.Helper()
+	dir := b.TempDir()
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("disk%d.img", i))
+		if err := os.WriteFile(paths[i], nil, 0o600); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.Truncate(paths[i], 1024*1024); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func newBenchStorageDevices(b *testing.B, paths []string) []StorageDeviceConfiguration {
+	b.Helper()
+	devices := make([]StorageDeviceConfiguration, len(paths))
+	for i, path := range paths {
+		attachment, err := NewDiskImageStorageDeviceAttachment(path, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		devices[i] = NewVirtioBlockDeviceConfiguration(attachment)
+	}
+	return devices
+}
+
+// BenchmarkNewVirtualMachineConfiguration builds a configuration with the common devices
+// as the fleets which create many virtual machines do.
+func BenchmarkNewVirtualMachineConfiguration(b *testing.B) {
+	for _, n := range []int{1, 8, 32} {
+		n := n
+		b.Run(fmt.Sprintf("storage=%d", n), func(b *testing.B) {
+			paths := newBenchDiskImages(b, n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				config := NewVirtualMachineConfiguration(NewLinuxBootLoader("/vmlinuz"), 2, 1024*1024*1024)
+				config.SetEntropyDevicesVirtualMachineConfiguration([]*VirtioEntropyDeviceConfiguration{
+					NewVirtioEntropyDeviceConfiguration(),
+				})
+				config.SetMemoryBalloonDevicesVirtualMachineConfiguration([]MemoryBalloonDeviceConfiguration{
+					NewVirtioTraditionalMemoryBalloonDeviceConfiguration(),
+				})
+				config.SetSocketDevicesVirtualMachineConfiguration([]SocketDeviceConfiguration{
+					NewVirtioSocketDeviceConfiguration(),
+				})
+				network := NewVirtioNetworkDeviceConfiguration(NewNATNetworkDeviceAttachment())
+				config.SetNetworkDevicesVirtualMachineConfiguration([]*VirtioNetworkDeviceConfiguration{network})
+				config.SetStorageDevicesVirtualMachineConfiguration(newBenchStorageDevices(b, paths))
+			}
+		})
+	}
+}
+
+// BenchmarkSetStorageDevicesVirtualMachineConfiguration measures only setting the list of the
+// devices, which is a single cgo call regardless of the number of the devices.
+func BenchmarkSetStorageDevicesVirtualMachineConfiguration(b *testing.B) {
+	for _, n := range []int{0, 1, 8, 32, 128} {
+		n := n
+		b.Run(fmt.Sprintf("devices=%d", n), func(b *testing.B) {
+			config := NewVirtualMachineConfiguration(NewLinuxBootLoader("/vmlinuz"), 2, 1024*1024*1024)
+			devices := newBenchStorageDevices(b, newBenchDiskImages(b, n))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				config.SetStorageDevicesVirtualMachineConfiguration(devices)
+			}
+		})
+	}
+}
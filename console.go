@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -42,12 +45,10 @@ type FileHandleSerialPortAttachment struct {
 // write parameter is an *os.File for writing to the file.
 func NewFileHandleSerialPortAttachment(read, write *os.File) *FileHandleSerialPortAttachment {
 	attachment := &FileHandleSerialPortAttachment{
-		pointer: pointer{
-			ptr: C.newVZFileHandleSerialPortAttachment(
-				C.int(read.Fd()),
-				C.int(write.Fd()),
-			),
-		},
+		pointer: newPointer(C.newVZFileHandleSerialPortAttachment(
+			C.int(read.Fd()),
+			C.int(write.Fd()),
+		)),
 	}
 	runtime.SetFinalizer(attachment, func(self *FileHandleSerialPortAttachment) {
 		self.Release()
@@ -68,26 +69,54 @@ type FileSerialPortAttachment struct {
 	*baseSerialPortAttachment
 }
 
+// FileSerialPortAttachmentOption is an option type for NewFileSerialPortAttachment.
+type FileSerialPortAttachmentOption func(*fileSerialPortAttachmentOptions)
+
+type fileSerialPortAttachmentOptions struct {
+	truncate bool
+}
+
+// WithTruncatingFile is an option to truncate the existing file before the attachment is created.
+//
+// When the file is not opened in append mode, Virtualization.framework writes from the beginning
+// of the file without truncating it, so the stale output remains after the new output if the
+// file was longer. This option removes it. It has no effect in append mode.
+func WithTruncatingFile() FileSerialPortAttachmentOption {
+	return func(o *fileSerialPortAttachmentOptions) {
+		o.truncate = true
+	}
+}
+
 // NewFileSerialPortAttachment initialize the FileSerialPortAttachment from a path of a file.
 // If error is not nil, used to report errors if intialization fails.
 //
 // - path of the file for the attachment on the local file system.
 // - shouldAppend True if the file should be opened in append mode, false otherwise.
 //    When a file is opened in append mode, writing to that file will append to the end of it.
-func NewFileSerialPortAttachment(path string, shouldAppend bool) (*FileSerialPortAttachment, error) {
+//    Use WithTruncatingFile to truncate the existing file otherwise.
+//
+// Use NewWriterSerialPortAttachment to stream the output to an io.Writer instead of a file.
+func NewFileSerialPortAttachment(path string, shouldAppend bool, opts ...FileSerialPortAttachmentOption) (*FileSerialPortAttachment, error) {
+	var o fileSerialPortAttachmentOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.truncate && !shouldAppend {
+		if err := os.Truncate(path, 0); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
 	cpath := charWithGoString(path)
 	defer cpath.Free()
 
 	nserr := newNSErrorAsNil()
 	nserrPtr := nserr.Ptr()
 	attachment := &FileSerialPortAttachment{
-		pointer: pointer{
-			ptr: C.newVZFileSerialPortAttachment(
-				cpath.CString(),
-				C.bool(shouldAppend),
-				&nserrPtr,
-			),
-		},
+		pointer: newPointer(C.newVZFileSerialPortAttachment(
+			cpath.CString(),
+			C.bool(shouldAppend),
+			&nserrPtr,
+		)),
 	}
 	if err := newNSError(nserrPtr); err != nil {
 		return nil, err
@@ -110,11 +139,9 @@ type VirtioConsoleDeviceSerialPortConfiguration struct {
 // NewVirtioConsoleDeviceSerialPortConfiguration creates a new NewVirtioConsoleDeviceSerialPortConfiguration.
 func NewVirtioConsoleDeviceSerialPortConfiguration(attachment SerialPortAttachment) *VirtioConsoleDeviceSerialPortConfiguration {
 	config := &VirtioConsoleDeviceSerialPortConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioConsoleDeviceSerialPortConfiguration(
-				attachment.Ptr(),
-			),
-		},
+		pointer: newPointer(C.newVZVirtioConsoleDeviceSerialPortConfiguration(
+			attachment.Ptr(),
+		)),
 	}
 	runtime.SetFinalizer(config, func(self *VirtioConsoleDeviceSerialPortConfiguration) {
 		self.Release()
@@ -0,0 +1,337 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// ConsoleDeviceConfiguration interface for a console device configuration.
+type ConsoleDeviceConfiguration interface {
+	NSObject
+
+	consoleDeviceConfiguration()
+}
+
+type baseConsoleDeviceConfiguration struct{}
+
+func (*baseConsoleDeviceConfiguration) consoleDeviceConfiguration() {}
+
+var _ ConsoleDeviceConfiguration = (*VirtioConsoleDeviceConfiguration)(nil)
+
+// VirtioConsoleDeviceConfiguration is a configuration of a Virtio console device which has multiple ports.
+//
+// Unlike VirtioConsoleDeviceSerialPortConfiguration, which creates a device of a single port, the
+// ports of this device have names, so the guest can find them, e.g. /dev/virtio-ports/<name> on Linux.
+// The framework does not support adding ports to a running virtual machine, so reserve the ports which
+// are used after boot by the configurations without attachment, then attach them by SetAttachment of
+// VirtioConsolePort while the virtual machine is running.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtioconsoledeviceconfiguration?language=objc
+type VirtioConsoleDeviceConfiguration struct {
+	pointer
+
+	ports map[uint32]*VirtioConsolePortConfiguration
+
+	*baseConsoleDeviceConfiguration
+}
+
+// NewVirtioConsoleDeviceConfiguration creates a new VirtioConsoleDeviceConfiguration.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func NewVirtioConsoleDeviceConfiguration() (*VirtioConsoleDeviceConfiguration, error) {
+	if err := macOSAvailable(13, 0); err != nil {
+		return nil, err
+	}
+	config := &VirtioConsoleDeviceConfiguration{
+		pointer: newPointer(C.newVZVirtioConsoleDeviceConfiguration()),
+		ports:   make(map[uint32]*VirtioConsolePortConfiguration),
+	}
+	runtime.SetFinalizer(config, func(self *VirtioConsoleDeviceConfiguration) {
+		self.Release()
+	})
+	return config, nil
+}
+
+// MaximumPortCount returns the maximum number of the ports of the device.
+// The default is the number of the ports which are set by SetPort.
+func (v *VirtioConsoleDeviceConfiguration) MaximumPortCount() uint32 {
+	return uint32(C.VZVirtioConsoleDeviceConfiguration_maximumPortCount(v.Ptr()))
+}
+
+// SetMaximumPortCount sets the maximum number of the ports of the device, which are allocated
+// for the guest driver. The count must be greater than the indexes of the ports which are set by SetPort.
+func (v *VirtioConsoleDeviceConfiguration) SetMaximumPortCount(count uint32) error {
+	for index := range v.ports {
+		if index >= count {
+			return fmt.Errorf("invalid maximum port count %d: port %d is configured", count, index)
+		}
+	}
+	C.VZVirtioConsoleDeviceConfiguration_setMaximumPortCount(v.Ptr(), C.uint(count))
+	return nil
+}
+
+// SetPort sets the port configuration at the index. Unless SetMaximumPortCount is called, the maximum
+// port count is the number of the ports.
+func (v *VirtioConsoleDeviceConfiguration) SetPort(index uint32, port *VirtioConsolePortConfiguration) {
+	C.VZVirtioConsoleDeviceConfiguration_setPort(v.Ptr(), C.uint(index), port.Ptr())
+	v.ports[index] = port
+}
+
+// Port returns the port configuration at the index which is set by SetPort, or nil.
+func (v *VirtioConsoleDeviceConfiguration) Port(index uint32) *VirtioConsolePortConfiguration {
+	return v.ports[index]
+}
+
+// VirtioConsolePortConfiguration is a configuration of a port of the Virtio console device.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtioconsoleportconfiguration?language=objc
+type VirtioConsolePortConfiguration struct {
+	pointer
+
+	name       string
+	isConsole  bool
+	attachment SerialPortAttachment
+}
+
+// VirtioConsolePortConfigurationOption is an option for NewVirtioConsolePortConfiguration.
+type VirtioConsolePortConfigurationOption func(*VirtioConsolePortConfiguration)
+
+// WithVirtioConsolePortName sets the name of the port which is exposed to the guest.
+func WithVirtioConsolePortName(name string) VirtioConsolePortConfigurationOption {
+	return func(c *VirtioConsolePortConfiguration) {
+		c.name = name
+	}
+}
+
+// WithVirtioConsolePortIsConsole makes the port a console port, e.g. /dev/hvc* on Linux.
+func WithVirtioConsolePortIsConsole(isConsole bool) VirtioConsolePortConfigurationOption {
+	return func(c *VirtioConsolePortConfiguration) {
+		c.isConsole = isConsole
+	}
+}
+
+// WithVirtioConsolePortAttachment sets the serial port attachment of the port.
+// Without the attachment, the port is reserved and disconnected until it is attached while
+// the virtual machine is running.
+func WithVirtioConsolePortAttachment(attachment SerialPortAttachment) VirtioConsolePortConfigurationOption {
+	return func(c *VirtioConsolePortConfiguration) {
+		c.attachment = attachment
+	}
+}
+
+// NewVirtioConsolePortConfiguration creates a new VirtioConsolePortConfiguration.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func NewVirtioConsolePortConfiguration(opts ...VirtioConsolePortConfigurationOption) (*VirtioConsolePortConfiguration, error) {
+	if err := macOSAvailable(13, 0); err != nil {
+		return nil, err
+	}
+	config := &VirtioConsolePortConfiguration{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	var name *char
+	if config.name != "" {
+		name = charWithGoString(config.name)
+		defer name.Free()
+	}
+	var attachment unsafe.Pointer
+	if config.attachment != nil {
+		attachment = config.attachment.Ptr()
+	}
+	config.pointer = newPointer(C.newVZVirtioConsolePortConfiguration(
+		name.CString(),
+		C.bool(config.isConsole),
+		attachment,
+	))
+	runtime.SetFinalizer(config, func(self *VirtioConsolePortConfiguration) {
+		self.Release()
+	})
+	return config, nil
+}
+
+// Name returns the name of the port.
+func (c *VirtioConsolePortConfiguration) Name() string { return c.name }
+
+// IsConsole reports whether the port is a console port.
+func (c *VirtioConsolePortConfiguration) IsConsole() bool { return c.isConsole }
+
+// Attachment returns the serial port attachment of the port, or nil.
+func (c *VirtioConsolePortConfiguration) Attachment() SerialPortAttachment { return c.attachment }
+
+// SetConsoleDevicesVirtualMachineConfiguration sets list of console devices. Empty by default.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (v *VirtualMachineConfiguration) SetConsoleDevicesVirtualMachineConfiguration(cs []ConsoleDeviceConfiguration) error {
+	if err := macOSAvailable(13, 0); err != nil {
+		return err
+	}
+	v.consoleDevices = cs
+	ptrs := make([]unsafe.Pointer, len(cs))
+	for i, val := range cs {
+		ptrs[i] = val.Ptr()
+	}
+	C.setConsoleDevicesVZVirtualMachineConfiguration(v.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+	return nil
+}
+
+// ConsoleDevices returns the list of console devices which is set by SetConsoleDevicesVirtualMachineConfiguration.
+func (v *VirtualMachineConfiguration) ConsoleDevices() []ConsoleDeviceConfiguration {
+	return v.consoleDevices
+}
+
+// ErrConsolePortNotFound is returned by Port of VirtioConsoleDevice when no port is configured at the index.
+var ErrConsolePortNotFound = errors.New("console port not found")
+
+// VirtioConsoleDevice is a Virtio console device of a running virtual machine.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtioconsoledevice?language=objc
+type VirtioConsoleDevice struct {
+	dispatchQueue unsafe.Pointer
+	pointer
+
+	index       int
+	config      *VirtioConsoleDeviceConfiguration
+	attachments *consolePortAttachments
+}
+
+// consolePortAttachments tracks the attachments which are set to the console ports of a virtual machine
+// while it is running, so they are kept alive while they are used.
+type consolePortAttachments struct {
+	mu          sync.Mutex
+	attachments map[[2]int]SerialPortAttachment
+}
+
+func (c *consolePortAttachments) get(key [2]int) (SerialPortAttachment, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.attachments[key]
+	return a, ok
+}
+
+func (c *consolePortAttachments) set(key [2]int, attachment SerialPortAttachment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.attachments == nil {
+		c.attachments = make(map[[2]int]SerialPortAttachment)
+	}
+	c.attachments[key] = attachment
+}
+
+// ConsoleDevices returns the list of console devices configured on this virtual machine.
+// Return an empty array if no console device is configured.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtualmachine/4031415-consoledevices?language=objc
+func (v *VirtualMachine) ConsoleDevices() ([]*VirtioConsoleDevice, error) {
+	if err := macOSAvailable(13, 0); err != nil {
+		return nil, err
+	}
+	nsArray := &NSArray{
+		pointer: pointer{
+			ptr: C.VZVirtualMachine_consoleDevices(v.Ptr()),
+		},
+	}
+	ptrs := nsArray.toRetainedPointerSlice()
+	consoleDevices := make([]*VirtioConsoleDevice, len(ptrs))
+	for i, ptr := range ptrs {
+		var config *VirtioConsoleDeviceConfiguration
+		if v.config != nil && i < len(v.config.consoleDevices) {
+			config, _ = v.config.consoleDevices[i].(*VirtioConsoleDeviceConfiguration)
+		}
+		consoleDevice := &VirtioConsoleDevice{
+			dispatchQueue: v.dispatchQueue,
+			pointer:       newPointer(ptr),
+			index:         i,
+			config:        config,
+			attachments:   &v.consoleAttachments,
+		}
+		runtime.SetFinalizer(consoleDevice, func(self *VirtioConsoleDevice) {
+			self.Release()
+		})
+		consoleDevices[i] = consoleDevice
+	}
+	return consoleDevices, nil
+}
+
+// MaximumPortCount returns the maximum number of the ports of the device.
+func (d *VirtioConsoleDevice) MaximumPortCount() uint32 {
+	return uint32(C.VZVirtioConsoleDevice_maximumPortCount(d.Ptr(), d.dispatchQueue))
+}
+
+// Port returns the port at the index. ErrConsolePortNotFound is returned if no port is configured at the index.
+func (d *VirtioConsoleDevice) Port(index uint32) (*VirtioConsolePort, error) {
+	ptr := C.VZVirtioConsoleDevice_port(d.Ptr(), d.dispatchQueue, C.uint(index))
+	if ptr == nil {
+		return nil, fmt.Errorf("%w: %d", ErrConsolePortNotFound, index)
+	}
+	port := &VirtioConsolePort{
+		dispatchQueue: d.dispatchQueue,
+		pointer:       newPointer(ptr),
+		key:           [2]int{d.index, int(index)},
+		attachments:   d.attachments,
+	}
+	if d.config != nil {
+		if c := d.config.Port(index); c != nil {
+			port.initial = c.attachment
+		}
+	}
+	runtime.SetFinalizer(port, func(self *VirtioConsolePort) {
+		self.Release()
+	})
+	return port, nil
+}
+
+// VirtioConsolePort is a port of the Virtio console device of a running virtual machine.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtioconsoleport?language=objc
+type VirtioConsolePort struct {
+	dispatchQueue unsafe.Pointer
+	pointer
+
+	key         [2]int
+	initial     SerialPortAttachment
+	attachments *consolePortAttachments
+}
+
+// Name returns the name of the port, or empty if it has no name.
+func (p *VirtioConsolePort) Name() string {
+	name := C.VZVirtioConsolePort_name(p.Ptr(), p.dispatchQueue)
+	if name == nil {
+		return ""
+	}
+	defer C.free(unsafe.Pointer(name))
+	return C.GoString(name)
+}
+
+// Attachment returns the serial port attachment which is set by the configuration or SetAttachment,
+// and returns nil if the port is disconnected.
+func (p *VirtioConsolePort) Attachment() SerialPortAttachment {
+	if a, ok := p.attachments.get(p.key); ok {
+		return a
+	}
+	return p.initial
+}
+
+// SetAttachment replaces the serial port attachment of the port while the virtual machine is running,
+// e.g. to open a channel to the agent in the guest after boot. Setting nil disconnects the port.
+func (p *VirtioConsolePort) SetAttachment(attachment SerialPortAttachment) {
+	var ptr unsafe.Pointer
+	if attachment != nil {
+		ptr = attachment.Ptr()
+	}
+	C.VZVirtioConsolePort_setAttachment(p.Ptr(), p.dispatchQueue, ptr)
+	p.attachments.set(p.key, attachment)
+}
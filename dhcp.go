@@ -0,0 +1,75 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/internal/dhcpd"
+)
+
+// ErrLeaseNotFound is returned when the DHCP lease is not found for the MAC address.
+var ErrLeaseNotFound = errors.New("dhcp lease not found")
+
+// LookupNATGuestIPv4 returns the IPv4 address of the guest which is assigned by the DHCP
+// server of the NAT network (see NewNATNetworkDeviceAttachment).
+//
+// The address is found by correlating the hwAddr parameter, which is the MAC address configured
+// for the network device (see (*MACAddress).HardwareAddr method), with the DHCP leases database (/var/db/dhcpd_leases) of the host.
+// Returns ErrLeaseNotFound if the guest has not obtained the address yet.
+func LookupNATGuestIPv4(hwAddr net.HardwareAddr) (net.IP, error) {
+	f, err := os.Open(dhcpd.LeasesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrLeaseNotFound
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	leases, err := dhcpd.ParseLeases(f)
+	if err != nil {
+		return nil, err
+	}
+	lease := dhcpd.FindLease(leases, hwAddr)
+	if lease == nil {
+		return nil, ErrLeaseNotFound
+	}
+	return lease.IPAddress.To4(), nil
+}
+
+// WaitNATGuestIPv4 is like LookupNATGuestIPv4 but waits until the guest obtains the IPv4 address
+// or the context is done. The DHCP leases database is watched for changes while waiting.
+func WaitNATGuestIPv4(ctx context.Context, hwAddr net.HardwareAddr) (net.IP, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastModTime time.Time
+	for {
+		fi, err := os.Stat(dhcpd.LeasesPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// Parse the database only when it has been changed.
+		if err == nil && !fi.ModTime().Equal(lastModTime) {
+			lastModTime = fi.ModTime()
+			ip, err := LookupNATGuestIPv4(hwAddr)
+			if err == nil {
+				return ip, nil
+			}
+			if !errors.Is(err, ErrLeaseNotFound) {
+				return nil, err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
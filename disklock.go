@@ -0,0 +1,160 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrDiskInUse is returned when a disk image, an auxiliary storage or a saved state file is
+// used by another virtual machine, in this process or in another one.
+//
+// The files are locked by flock(2) while the virtual machine is running, so two processes can
+// not start the same virtual machine and corrupt its disks. The read-only disk images are locked
+// by the shared lock, so they can be attached read-only to multiple virtual machines. The locks are
+// advisory, so they do not prevent the other programs which do not take them from writing the files.
+var ErrDiskInUse = errors.New("disk is in use by another virtual machine")
+
+// diskFile is a file on the host which is used by a device.
+type diskFile struct {
+	path     string
+	readOnly bool
+}
+
+// diskFileUser is implemented by the devices and the platforms which use files on the host.
+type diskFileUser interface {
+	diskFiles() []diskFile
+}
+
+// diskFiles returns the files on the host which are used by the configuration.
+func (v *VirtualMachineConfiguration) diskFiles() []diskFile {
+	var files []diskFile
+	for _, d := range v.storageDevices {
+		if u, ok := d.(diskFileUser); ok {
+			files = append(files, u.diskFiles()...)
+		}
+	}
+	if u, ok := v.platform.(diskFileUser); ok {
+		files = append(files, u.diskFiles()...)
+	}
+	return files
+}
+
+// lockDiskFiles locks the files. A file which is used more than once is locked once,
+// exclusively if any of them is writable.
+func lockDiskFiles(files []diskFile) ([]*os.File, error) {
+	paths := make([]string, 0, len(files))
+	readOnly := make(map[string]bool, len(files))
+	for _, f := range files {
+		path, err := filepath.Abs(f.path)
+		if err != nil {
+			return nil, err
+		}
+		ro, seen := readOnly[path]
+		if !seen {
+			paths = append(paths, path)
+			ro = true
+		}
+		readOnly[path] = ro && f.readOnly
+	}
+
+	locks := make([]*os.File, 0, len(paths))
+	for _, path := range paths {
+		lock := lockFile
+		if readOnly[path] {
+			lock = lockFileShared
+		}
+		f, err := lock(path)
+		if err != nil {
+			unlockDiskFiles(locks)
+			if errors.Is(err, errLocked) {
+				return nil, fmt.Errorf("%w: %s", ErrDiskInUse, path)
+			}
+			return nil, err
+		}
+		locks = append(locks, f)
+	}
+	return locks, nil
+}
+
+func unlockDiskFiles(locks []*os.File) {
+	for _, f := range locks {
+		f.Close()
+	}
+}
+
+// lockDisks locks the files of the configuration until the virtual machine is stopped.
+// It does nothing if the files are already locked by the virtual machine.
+func (v *VirtualMachine) lockDisks() error {
+	if v.diskFiles == nil && v.ephemeralDisks == nil {
+		return nil
+	}
+	// I expected it will not cause panic.
+	// if caused panic, that's unexpected behavior.
+	ms, _ := v.status.Value().(*machineStatus)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.diskLocks != nil {
+		return nil
+	}
+	locks, err := lockDiskFiles(v.diskFiles)
+	if err != nil {
+		return err
+	}
+	ms.diskLocks = locks
+	ms.ephemeralDisks = v.ephemeralDisks
+	return nil
+}
+
+// unlockDisksIfStopped releases the locks of the files if the virtual machine is in
+// the Stopped or Error state.
+func (m *machineStatus) unlockDisksIfStopped() {
+	m.mu.Lock()
+	var locks []*os.File
+	if m.state == VirtualMachineStateStopped || m.state == VirtualMachineStateError {
+		locks = m.diskLocks
+		m.diskLocks = nil
+	}
+	m.mu.Unlock()
+	unlockDiskFiles(locks)
+}
+
+// diskLockedHandler locks the files of the configuration before the operation which starts
+// the virtual machine. The returned handler releases the locks if the operation failed and
+// the virtual machine is not running, then calls fn. If the files can not be locked, fn is
+// called with the error and ok is false.
+func (v *VirtualMachine) diskLockedHandler(op string, fn func(error)) (handler func(error), ok bool) {
+	handler = v.recordErrorHandler(op, fn)
+	if err := v.lockDisks(); err != nil {
+		handler(err)
+		return nil, false
+	}
+	return func(err error) {
+		if err != nil {
+			ms, _ := v.status.Value().(*machineStatus)
+			ms.unlockDisksIfStopped()
+		}
+		handler(err)
+	}, true
+}
+
+// lockSavedState locks the saved state file at path while it is read or written.
+// It returns nil if the file does not exist.
+func lockSavedState(path string, shared bool) (*os.File, error) {
+	lock := lockFile
+	if shared {
+		lock = lockFileShared
+	}
+	f, err := lock(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if errors.Is(err, errLocked) {
+		return nil, fmt.Errorf("%w: %s", ErrDiskInUse, path)
+	}
+	return f, err
+}
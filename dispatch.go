@@ -0,0 +1,141 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization.h"
+*/
+import "C"
+import (
+	"runtime"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// DispatchQueueQoSClass is the quality of service class of the dispatch queue.
+//
+// see: https://developer.apple.com/documentation/dispatch/dispatchqos/qosclass?language=objc
+type DispatchQueueQoSClass int
+
+const (
+	// DispatchQueueQoSClassDefault is the default quality of service class.
+	DispatchQueueQoSClassDefault DispatchQueueQoSClass = iota
+
+	// DispatchQueueQoSClassUserInteractive is for the work which is interacting with the user.
+	DispatchQueueQoSClassUserInteractive
+
+	// DispatchQueueQoSClassUserInitiated is for the work which is initiated by the user and the user is waiting for.
+	DispatchQueueQoSClassUserInitiated
+
+	// DispatchQueueQoSClassUtility is for the long-running work which the user does not track actively.
+	DispatchQueueQoSClassUtility
+
+	// DispatchQueueQoSClassBackground is for the maintenance or cleanup work.
+	DispatchQueueQoSClassBackground
+)
+
+// DispatchQueue is a serial dispatch queue.
+//
+// Every operation on the virtual machine is done on its dispatch queue, and the callbacks
+// and the delegate methods are invoked on that queue.
+type DispatchQueue struct {
+	ptr   unsafe.Pointer
+	label string
+}
+
+// NewDispatchQueue creates a new serial dispatch queue with the label and the quality of service class.
+func NewDispatchQueue(label string, qos DispatchQueueQoSClass) *DispatchQueue {
+	cs := charWithGoString(label)
+	defer cs.Free()
+	q := &DispatchQueue{
+		ptr:   C.makeDispatchQueue(cs.CString(), C.int(qos)),
+		label: label,
+	}
+	runtime.SetFinalizer(q, func(self *DispatchQueue) {
+		releaseDispatch(self.ptr)
+	})
+	return q
+}
+
+// AdoptDispatchQueue wraps the serial dispatch_queue_t which is created by other Cocoa interop code,
+// e.g. the queue of a virtual machine which is adopted by AdoptVirtualMachine.
+//
+// The queue is retained, and released when the DispatchQueue is not reachable. The caller keeps
+// its own reference. If the queue is not serial, the behavior is undefined.
+func AdoptDispatchQueue(ptr unsafe.Pointer) *DispatchQueue {
+	C.retainDispatchQueue(ptr)
+	q := &DispatchQueue{
+		ptr:   ptr,
+		label: C.GoString(C.dispatchQueueLabel(ptr)),
+	}
+	runtime.SetFinalizer(q, func(self *DispatchQueue) {
+		releaseDispatch(self.ptr)
+	})
+	return q
+}
+
+// mainDispatchQueue returns the main queue which is never released.
+func mainDispatchQueue() *DispatchQueue {
+	ptr := C.mainDispatchQueue()
+	return &DispatchQueue{
+		ptr:   ptr,
+		label: C.GoString(C.dispatchQueueLabel(ptr)),
+	}
+}
+
+// Ptr returns the raw pointer of dispatch_queue_t. This can be passed to other Cocoa interop code.
+//
+// The queue is valid while the DispatchQueue is reachable, so use runtime.KeepAlive if needed.
+func (q *DispatchQueue) Ptr() unsafe.Pointer { return q.ptr }
+
+// Label returns the label of the queue.
+func (q *DispatchQueue) Label() string { return q.label }
+
+// Sync runs fn on the queue and waits for it.
+//
+// fn must not call the methods of the virtual machines which use this queue, and Sync must not be
+// called in the callbacks which are invoked on this queue, otherwise it is deadlocked.
+func (q *DispatchQueue) Sync(fn func()) {
+	h := cgo.NewHandle(fn)
+	C.dispatchSyncGoFunc(q.ptr, C.uintptr_t(h))
+	runtime.KeepAlive(q)
+}
+
+// Async submits fn to the queue and returns immediately.
+//
+// fn must not call the methods of the virtual machines which use this queue, otherwise it is deadlocked.
+func (q *DispatchQueue) Async(fn func()) {
+	h := cgo.NewHandle(func() {
+		fn()
+		runtime.KeepAlive(q)
+	})
+	C.dispatchAsyncGoFunc(q.ptr, C.uintptr_t(h))
+}
+
+//export dispatchQueueHandler
+func dispatchQueueHandler(handle C.uintptr_t) {
+	h := cgo.Handle(handle)
+	fn := h.Value().(func())
+	h.Delete()
+	fn()
+}
+
+// WithDispatchQueue is an option to use the dispatch queue for the virtual machine instead of
+// creating a new one. The queue may be shared with other virtual machines or other Cocoa
+// interop code, then the operations on them are serialized.
+func WithDispatchQueue(q *DispatchQueue) VirtualMachineOption {
+	return func(o *virtualMachineOptions) {
+		o.dispatchQueue = q
+	}
+}
+
+// DispatchQueue returns the dispatch queue of the virtual machine.
+//
+// This can be used to run the work which touches the virtual machine from other Cocoa interop
+// code on the same queue as the operations of this package.
+func (v *VirtualMachine) DispatchQueue() *DispatchQueue {
+	return v.queue
+}
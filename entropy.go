@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -20,9 +23,7 @@ type VirtioEntropyDeviceConfiguration struct {
 // NewVirtioEntropyDeviceConfiguration creates a new Virtio Entropy Device confiuration.
 func NewVirtioEntropyDeviceConfiguration() *VirtioEntropyDeviceConfiguration {
 	config := &VirtioEntropyDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioEntropyDeviceConfiguration(),
-		},
+		pointer: newPointer(C.newVZVirtioEntropyDeviceConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *VirtioEntropyDeviceConfiguration) {
 		self.Release()
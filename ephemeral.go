@@ -0,0 +1,208 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ StorageDeviceAttachment = (*EphemeralDiskAttachment)(nil)
+
+// EphemeralDiskAttachment is a storage device attachment of a temporary sparse disk image,
+// e.g. for the scratch space of CI jobs.
+//
+// The disk image is removed when the virtual machine which uses it is stopped, so the virtual
+// machine can not be started again with it. It is also removed by Remove, RemoveEphemeralDisks
+// or when the attachment is garbage collected. macOS does not support O_TMPFILE, so the disk
+// images of the processes which exited without removing them, e.g. by a crash, are removed by
+// NewEphemeralDiskAttachment of the next process.
+type EphemeralDiskAttachment struct {
+	*DiskImageStorageDeviceAttachment
+
+	size int64
+
+	removeOnce sync.Once
+	removeErr  error
+}
+
+// ephemeral is the registry of the ephemeral disk images of this process.
+var ephemeral struct {
+	mu sync.Mutex
+	// owner is the lock which is held while this process is alive. The disk images of the
+	// owners which are not locked are removed by sweepEphemeralDisks.
+	owner *os.File
+	paths map[string]struct{}
+}
+
+// ephemeralDir returns the directory of the ephemeral disk images.
+func ephemeralDir() string {
+	return filepath.Join(os.TempDir(), "vz-ephemeral")
+}
+
+// NewEphemeralDiskAttachment creates a sparse disk image of size bytes in the temporary directory
+// and a read-write attachment of it. The guest sees an empty disk, so it must be formatted by the guest.
+func NewEphemeralDiskAttachment(size int64) (*EphemeralDiskAttachment, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid size of ephemeral disk: %d", size)
+	}
+	dir := ephemeralDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	prefix, err := ephemeralOwner(dir)
+	if err != nil {
+		return nil, err
+	}
+	sweepEphemeralDisks(dir)
+
+	f, err := os.CreateTemp(dir, prefix+"-*.img")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	attachment, err := NewDiskImageStorageDeviceAttachment(path, false)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	ephemeral.mu.Lock()
+	ephemeral.paths[path] = struct{}{}
+	ephemeral.mu.Unlock()
+
+	d := &EphemeralDiskAttachment{
+		DiskImageStorageDeviceAttachment: attachment,
+		size:                             size,
+	}
+	runtime.SetFinalizer(d, func(self *EphemeralDiskAttachment) {
+		self.Remove()
+	})
+	return d, nil
+}
+
+// Size returns the size of the disk image in bytes.
+func (d *EphemeralDiskAttachment) Size() int64 { return d.size }
+
+// Remove removes the disk image. It must not be called while the virtual machine is running.
+// It is safe to call Remove multiple times.
+func (d *EphemeralDiskAttachment) Remove() error {
+	d.removeOnce.Do(func() {
+		path := d.DiskPath()
+		ephemeral.mu.Lock()
+		delete(ephemeral.paths, path)
+		ephemeral.mu.Unlock()
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			d.removeErr = err
+		}
+	})
+	return d.removeErr
+}
+
+// RemoveEphemeralDisks removes all the disk images which are created by NewEphemeralDiskAttachment
+// in this process. This should be deferred in main, because the disk images are not removed
+// when the process exits while the virtual machines are running.
+func RemoveEphemeralDisks() error {
+	ephemeral.mu.Lock()
+	paths := make([]string, 0, len(ephemeral.paths))
+	for path := range ephemeral.paths {
+		paths = append(paths, path)
+	}
+	ephemeral.paths = make(map[string]struct{})
+	ephemeral.mu.Unlock()
+
+	var firstErr error
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ephemeralOwner locks the owner file of this process in dir and returns the prefix of the
+// names of the disk images which are owned by this process.
+func ephemeralOwner(dir string) (string, error) {
+	prefix := strconv.Itoa(os.Getpid())
+	ephemeral.mu.Lock()
+	defer ephemeral.mu.Unlock()
+	if ephemeral.owner != nil {
+		return prefix, nil
+	}
+	path := filepath.Join(dir, prefix+".lock")
+	lock, err := flockOpenFile(path, os.O_RDONLY|os.O_CREATE, 0o600, unix.LOCK_EX)
+	if err != nil {
+		return "", fmt.Errorf("failed to lock the owner of ephemeral disks: %w", err)
+	}
+	ephemeral.owner = lock
+	ephemeral.paths = make(map[string]struct{})
+	return prefix, nil
+}
+
+// sweepEphemeralDisks removes the disk images in dir whose owner processes have exited.
+func sweepEphemeralDisks(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, entry := range entries {
+		owner := strings.TrimSuffix(entry.Name(), ".lock")
+		if owner == entry.Name() || owner == self {
+			continue
+		}
+		lockPath := filepath.Join(dir, entry.Name())
+		lock, err := lockFile(lockPath)
+		if err != nil {
+			// the owner is still alive.
+			continue
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), owner+"-") {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+		}
+		os.Remove(lockPath)
+		lock.Close()
+	}
+}
+
+// ephemeralDisks returns the ephemeral disks which are attached to the storage devices.
+func (v *VirtualMachineConfiguration) ephemeralDisks() []*EphemeralDiskAttachment {
+	var disks []*EphemeralDiskAttachment
+	for _, d := range v.storageDevices {
+		a, ok := d.(interface {
+			Attachment() StorageDeviceAttachment
+		})
+		if !ok {
+			continue
+		}
+		if disk, ok := a.Attachment().(*EphemeralDiskAttachment); ok {
+			disks = append(disks, disk)
+		}
+	}
+	return disks
+}
+
+func removeEphemeralDisks(disks []*EphemeralDiskAttachment) {
+	for _, d := range disks {
+		d.Remove()
+	}
+}
@@ -54,6 +54,9 @@ func main() {
 
 	vmlinuz := os.Getenv("VMLINUZ_PATH")
 	initrd := os.Getenv("INITRD_PATH")
+	if err := vz.ValidateLinuxKernel(vmlinuz); err != nil {
+		log.Fatal(err)
+	}
 	diskPath := os.Getenv("DISKIMG_PATH")
 
 	bootLoader := vz.NewLinuxBootLoader(
@@ -81,10 +84,27 @@ func main() {
 	// network
 	natAttachment := vz.NewNATNetworkDeviceAttachment()
 	networkConfig := vz.NewVirtioNetworkDeviceConfiguration(natAttachment)
+	networkConfig.SetMACAddress(vz.NewRandomLocallyAdministeredMACAddress())
+
+	// second network device which is connected to a datagram socket.
+	// the host side of the socket can be used by a userspace network stack.
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostSocket := os.NewFile(uintptr(fds[0]), "host-socket")
+	defer hostSocket.Close()
+	guestSocket := os.NewFile(uintptr(fds[1]), "guest-socket")
+	defer guestSocket.Close()
+	fileHandleConfig := vz.NewVirtioNetworkDeviceConfiguration(
+		vz.NewFileHandleNetworkDeviceAttachment(guestSocket),
+	)
+	fileHandleConfig.SetMACAddress(vz.NewRandomLocallyAdministeredMACAddress())
+
 	config.SetNetworkDevicesVirtualMachineConfiguration([]*vz.VirtioNetworkDeviceConfiguration{
 		networkConfig,
+		fileHandleConfig,
 	})
-	networkConfig.SetMACAddress(vz.NewRandomLocallyAdministeredMACAddress())
 
 	// entropy
 	entropyConfig := vz.NewVirtioEntropyDeviceConfiguration()
@@ -9,15 +9,30 @@ import (
 )
 
 func installMacOS(ctx context.Context) error {
-	restoreImagePath := GetRestoreImagePath()
 	restoreImage, err := vz.LoadMacOSRestoreImageFromPath(restoreImagePath)
 	if err != nil {
 		return fmt.Errorf("failed to load restore image: %w", err)
 	}
+	if !restoreImage.Supported() {
+		return fmt.Errorf("restore image %s (%s) is not supported on this host", restoreImage.OperatingSystemVersion(), restoreImage.BuildVersion())
+	}
 	configurationRequirements := restoreImage.MostFeaturefulSupportedConfiguration()
-	config, err := setupVirtualMachineWithMacOSConfigurationRequirements(
-		configurationRequirements,
-	)
+
+	bundle, err := vz.CreateBundle(GetVMBundlePath(), vz.BundleConfig{
+		OS:         vz.BundleOSMacOS,
+		CPUCount:   computeCPUCount(),
+		MemorySize: computeMemorySize(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer bundle.Close()
+
+	platformConfig, err := bundle.CreateMacPlatformConfiguration(configurationRequirements.HardwareModel())
+	if err != nil {
+		return fmt.Errorf("failed to create mac platform config: %w", err)
+	}
+	config, err := setupVMConfiguration(bundle, platformConfig)
 	if err != nil {
 		return fmt.Errorf("failed to setup config: %w", err)
 	}
@@ -47,42 +62,3 @@ func installMacOS(ctx context.Context) error {
 
 	return installer.Install(ctx)
 }
-
-func setupVirtualMachineWithMacOSConfigurationRequirements(macOSConfiguration *vz.MacOSConfigurationRequirements) (*vz.VirtualMachineConfiguration, error) {
-	platformConfig, err := createMacInstallerPlatformConfiguration(macOSConfiguration)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create mac platform config: %w", err)
-	}
-	return setupVMConfiguration(platformConfig)
-}
-
-func createMacInstallerPlatformConfiguration(macOSConfiguration *vz.MacOSConfigurationRequirements) (*vz.MacPlatformConfiguration, error) {
-	hardwareModel := macOSConfiguration.HardwareModel()
-	if err := CreateFileAndWriteTo(
-		hardwareModel.DataRepresentation(),
-		GetHardwareModelPath(),
-	); err != nil {
-		return nil, fmt.Errorf("failed to write hardware model data: %w", err)
-	}
-
-	machineIdentifier := vz.NewMacMachineIdentifier()
-	if err := CreateFileAndWriteTo(
-		machineIdentifier.DataRepresentation(),
-		GetMachineIdentifierPath(),
-	); err != nil {
-		return nil, fmt.Errorf("failed to write machine identifier data: %w", err)
-	}
-
-	auxiliaryStorage, err := vz.NewMacAuxiliaryStorage(
-		GetAuxiliaryStoragePath(),
-		vz.WithCreatingStorage(hardwareModel),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create a new mac auxiliary storage: %w", err)
-	}
-	return vz.NewMacPlatformConfiguration(
-		vz.WithAuxiliaryStorage(auxiliaryStorage),
-		vz.WithHardwareModel(hardwareModel),
-		vz.WithMachineIdentifier(machineIdentifier),
-	), nil
-}
@@ -12,10 +12,14 @@ import (
 	"github.com/Code-Hex/vz/v2"
 )
 
-var install bool
+var (
+	install          bool
+	restoreImagePath string
+)
 
 func init() {
 	flag.BoolVar(&install, "install", false, "run command as install mode")
+	flag.StringVar(&restoreImagePath, "restore-image", GetRestoreImagePath(), "path of the restore image to install")
 }
 
 func main() {
@@ -37,11 +41,17 @@ func runVM(ctx context.Context) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	platformConfig, err := createMacPlatformConfiguration()
+	bundle, err := vz.OpenBundle(GetVMBundlePath())
+	if err != nil {
+		return fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer bundle.Close()
+
+	platformConfig, err := bundle.MacPlatformConfiguration()
 	if err != nil {
 		return err
 	}
-	config, err := setupVMConfiguration(platformConfig)
+	config, err := setupVMConfiguration(bundle, platformConfig)
 	if err != nil {
 		return err
 	}
@@ -185,41 +195,25 @@ func createAudioDeviceConfiguration() *vz.VirtioSoundDeviceConfiguration {
 	return audioConfig
 }
 
-func createMacPlatformConfiguration() (*vz.MacPlatformConfiguration, error) {
-	auxiliaryStorage, err := vz.NewMacAuxiliaryStorage(GetAuxiliaryStoragePath())
-	if err != nil {
-		return nil, fmt.Errorf("failed to create a new mac auxiliary storage: %w", err)
-	}
-	hardwareModel, err := vz.NewMacHardwareModelWithDataPath(
-		GetHardwareModelPath(),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create a new hardware model: %w", err)
+func setupVMConfiguration(bundle *vz.Bundle, platformConfig vz.PlatformConfiguration) (*vz.VirtualMachineConfiguration, error) {
+	// the bundle which is created by the earlier versions of this example has no CPU count and memory size.
+	cpuCount, memorySize := bundle.Config.CPUCount, bundle.Config.MemorySize
+	if cpuCount == 0 {
+		cpuCount = computeCPUCount()
 	}
-	machineIdentifier, err := vz.NewMacMachineIdentifierWithDataPath(
-		GetMachineIdentifierPath(),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create a new machine identifier: %w", err)
+	if memorySize == 0 {
+		memorySize = computeMemorySize()
 	}
-	return vz.NewMacPlatformConfiguration(
-		vz.WithAuxiliaryStorage(auxiliaryStorage),
-		vz.WithHardwareModel(hardwareModel),
-		vz.WithMachineIdentifier(machineIdentifier),
-	), nil
-}
-
-func setupVMConfiguration(platformConfig vz.PlatformConfiguration) (*vz.VirtualMachineConfiguration, error) {
 	config := vz.NewVirtualMachineConfiguration(
 		vz.NewMacOSBootLoader(),
-		computeCPUCount(),
-		computeMemorySize(),
+		cpuCount,
+		memorySize,
 	)
 	config.SetPlatformVirtualMachineConfiguration(platformConfig)
 	config.SetGraphicsDevicesVirtualMachineConfiguration([]vz.GraphicsDeviceConfiguration{
 		createGraphicsDeviceConfiguration(),
 	})
-	blockDeviceConfig, err := createBlockDeviceConfiguration(GetDiskImagePath())
+	blockDeviceConfig, err := createBlockDeviceConfiguration(bundle.DiskImagePath())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create block device configuration: %w", err)
 	}
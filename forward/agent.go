@@ -0,0 +1,35 @@
+package forward
+
+import (
+	"context"
+	"net"
+
+	"github.com/Code-Hex/vz/v2/agent"
+)
+
+// AgentDialer returns a Dialer which connects to the address through the agent which runs
+// in the guest. See the agent package.
+//
+// connect is called to make a new connection to the agent for each forwarded connection.
+// Typically, it connects to agent.DefaultPort with (*vz.VirtioSocketDevice).ConnectToPort.
+//
+// The host name "guest" in the address is replaced with "127.0.0.1", so the agent
+// connects to the loopback address in the guest.
+func AgentDialer(connect func(ctx context.Context) (net.Conn, error)) Dialer {
+	return DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		address, err := replaceGuestHost(address, "127.0.0.1")
+		if err != nil {
+			return nil, err
+		}
+		conn, err := connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret, err := agent.Dial(ctx, conn, network, address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ret, nil
+	})
+}
@@ -0,0 +1,238 @@
+// Package forward forwards TCP connections from the host to the guest.
+//
+// A forward is described by a Mapping such as "127.0.0.1:2222 -> guest:22". The connections
+// accepted on the local address are forwarded to the remote address in the guest through a Dialer.
+// The Dialer decides how the guest is reached. e.g. AgentDialer uses the agent which runs in the
+// guest over vsock, and IPDialer connects to the IP address of the guest on the host network.
+// Any other transport, such as a userspace network stack behind the file handle network attachment,
+// can be used by implementing Dialer.
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// GuestHost is the host name which means the guest in the remote address of Mapping.
+const GuestHost = "guest"
+
+// Mapping is a mapping from the local address on the host to the remote address in the guest.
+type Mapping struct {
+	// Local is the address to listen on the host. e.g. "127.0.0.1:2222"
+	Local string
+
+	// Remote is the address to connect in the guest. e.g. "guest:22"
+	// The host name "guest" is resolved by the Dialer.
+	Remote string
+}
+
+// String returns the mapping in the form which can be parsed by ParseMapping.
+func (m Mapping) String() string {
+	return m.Local + " -> " + m.Remote
+}
+
+// ParseMapping parses the mapping which is described as "<local address> -> <remote address>".
+//
+// e.g. "127.0.0.1:2222 -> guest:22"
+func ParseMapping(s string) (Mapping, error) {
+	parts := strings.Split(s, "->")
+	if len(parts) != 2 {
+		return Mapping{}, fmt.Errorf("invalid mapping %q: must be \"<local> -> <remote>\"", s)
+	}
+	m := Mapping{
+		Local:  strings.TrimSpace(parts[0]),
+		Remote: strings.TrimSpace(parts[1]),
+	}
+	for _, addr := range []string{m.Local, m.Remote} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return Mapping{}, fmt.Errorf("invalid mapping %q: %w", s, err)
+		}
+	}
+	return m, nil
+}
+
+// Dialer connects to the address in the guest.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialerFunc is an adapter to allow the use of ordinary functions as Dialer.
+type DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// DialContext calls f(ctx, network, address).
+func (f DialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// Error is an error which is occurred on a forward.
+type Error struct {
+	Mapping Mapping
+	Err     error
+}
+
+// Error implements error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("forward %s: %v", e.Mapping, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error { return e.Err }
+
+// Forwarder forwards the connections on the mappings.
+type Forwarder struct {
+	// Dialer is used to connect to the guest.
+	Dialer Dialer
+
+	// Mappings is the list of the forwards.
+	Mappings []Mapping
+
+	// ErrorHandler is called when an error occurred while forwarding a connection.
+	// e.g. the guest refused the connection. The forward continues to accept the connections.
+	// If nil, the errors are ignored.
+	ErrorHandler func(*Error)
+}
+
+// Run listens on the local addresses of the mappings and forwards the connections
+// until ctx is done.
+//
+// If any of the local addresses can not be listened, Run returns the error without
+// forwarding. Otherwise, Run returns nil after ctx is done and all of the forwarded
+// connections are closed.
+func (f *Forwarder) Run(ctx context.Context) error {
+	if f.Dialer == nil {
+		return errors.New("forward: dialer is not set")
+	}
+	var lc net.ListenConfig
+	listeners := make([]net.Listener, 0, len(f.Mappings))
+	for _, m := range f.Mappings {
+		l, err := lc.Listen(ctx, "tcp", m.Local)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return &Error{Mapping: m, Err: err}
+		}
+		listeners = append(listeners, l)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func(m Mapping, l net.Listener) {
+			defer wg.Done()
+			f.serve(ctx, m, l, &wg)
+		}(f.Mappings[i], l)
+	}
+	<-ctx.Done()
+	for _, l := range listeners {
+		l.Close()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (f *Forwarder) serve(ctx context.Context, m Mapping, l net.Listener, wg *sync.WaitGroup) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				f.handleError(m, err)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f.forward(ctx, m, conn); err != nil {
+				f.handleError(m, err)
+			}
+		}()
+	}
+}
+
+func (f *Forwarder) forward(ctx context.Context, m Mapping, conn net.Conn) error {
+	defer conn.Close()
+	remote, err := f.Dialer.DialContext(ctx, "tcp", m.Remote)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	// close both connections when ctx is done to stop copying.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			remote.Close()
+		case <-done:
+		}
+	}()
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- copyAndClose(remote, conn) }()
+	go func() { errCh <- copyAndClose(conn, remote) }()
+	err = <-errCh
+	<-errCh
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// copyAndClose copies from src to dst and closes the write side of dst (or dst itself)
+// so the peer receives EOF.
+func copyAndClose(dst, src net.Conn) error {
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (f *Forwarder) handleError(m Mapping, err error) {
+	if f.ErrorHandler != nil {
+		f.ErrorHandler(&Error{Mapping: m, Err: err})
+	}
+}
+
+// IPDialer returns a Dialer which connects to the IP address of the guest on the host network.
+// e.g. the IP address of the guest on the NAT network which can be found by vz.WaitNATGuestIPv4.
+//
+// The host name "guest" in the address is replaced with ip.
+func IPDialer(ip net.IP) Dialer {
+	var d net.Dialer
+	return DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		address, err := replaceGuestHost(address, ip.String())
+		if err != nil {
+			return nil, err
+		}
+		return d.DialContext(ctx, network, address)
+	})
+}
+
+// replaceGuestHost replaces the host name "guest" in the address with host.
+func replaceGuestHost(address, host string) (string, error) {
+	h, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if h == GuestHost {
+		h = host
+	}
+	return net.JoinHostPort(h, port), nil
+}
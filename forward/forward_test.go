@@ -0,0 +1,217 @@
+package forward_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/agent"
+	"github.com/Code-Hex/vz/v2/forward"
+)
+
+func TestParseMapping(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    forward.Mapping
+		wantErr bool
+	}{
+		{
+			in:   "127.0.0.1:2222 -> guest:22",
+			want: forward.Mapping{Local: "127.0.0.1:2222", Remote: "guest:22"},
+		},
+		{
+			in:   "[::1]:8080->192.168.64.2:80",
+			want: forward.Mapping{Local: "[::1]:8080", Remote: "192.168.64.2:80"},
+		},
+		{in: "127.0.0.1:2222", wantErr: true},
+		{in: "127.0.0.1 -> guest:22", wantErr: true},
+		{in: "a:1 -> b:2 -> c:3", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := forward.ParseMapping(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error but got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %v but got %v", tc.want, got)
+			}
+			if again, err := forward.ParseMapping(got.String()); err != nil || again != got {
+				t.Fatalf("round trip: got %v, %v", again, err)
+			}
+		})
+	}
+}
+
+// echoServer starts a TCP echo server which emulates a service in the guest.
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func runForwarder(t *testing.T, f *forward.Forwarder) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+}
+
+func dialRetry(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func assertEcho(t *testing.T, addr string) {
+	t.Helper()
+	conn := dialRetry(t, addr)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "hello" {
+		t.Fatalf("want %q but got %q", "hello", got)
+	}
+}
+
+func TestForwarderIPDialer(t *testing.T) {
+	guest := echoServer(t)
+	_, port, _ := net.SplitHostPort(guest.Addr().String())
+	local := freeAddr(t)
+
+	runForwarder(t, &forward.Forwarder{
+		Dialer:   forward.IPDialer(net.ParseIP("127.0.0.1")),
+		Mappings: []forward.Mapping{{Local: local, Remote: net.JoinHostPort("guest", port)}},
+	})
+	assertEcho(t, local)
+}
+
+func TestForwarderAgentDialer(t *testing.T) {
+	guest := echoServer(t)
+	_, port, _ := net.SplitHostPort(guest.Addr().String())
+	local := freeAddr(t)
+
+	server := &agent.Server{EnableDial: true}
+	connect := func(ctx context.Context) (net.Conn, error) {
+		host, guest := net.Pipe()
+		go server.ServeConn(guest)
+		return host, nil
+	}
+	runForwarder(t, &forward.Forwarder{
+		Dialer:   forward.AgentDialer(connect),
+		Mappings: []forward.Mapping{{Local: local, Remote: net.JoinHostPort("guest", port)}},
+	})
+	assertEcho(t, local)
+}
+
+func TestForwarderErrorHandler(t *testing.T) {
+	local := freeAddr(t)
+	m := forward.Mapping{Local: local, Remote: "guest:22"}
+	refused := errors.New("refused")
+
+	var mu sync.Mutex
+	var got []*forward.Error
+	gotCh := make(chan struct{}, 1)
+	runForwarder(t, &forward.Forwarder{
+		Dialer: forward.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, refused
+		}),
+		Mappings: []forward.Mapping{m},
+		ErrorHandler: func(err *forward.Error) {
+			mu.Lock()
+			got = append(got, err)
+			mu.Unlock()
+			select {
+			case gotCh <- struct{}{}:
+			default:
+			}
+		},
+	})
+
+	conn := dialRetry(t, local)
+	defer conn.Close()
+	select {
+	case <-gotCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got[0].Mapping != m || !errors.Is(got[0], refused) {
+		t.Fatalf("unexpected error: %v", got[0])
+	}
+}
+
+func TestForwarderListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f := &forward.Forwarder{
+		Dialer:   forward.IPDialer(net.ParseIP("127.0.0.1")),
+		Mappings: []forward.Mapping{{Local: l.Addr().String(), Remote: "guest:22"}},
+	}
+	err = f.Run(context.Background())
+	var ferr *forward.Error
+	if !errors.As(err, &ferr) {
+		t.Fatalf("want *forward.Error but got %v", err)
+	}
+}
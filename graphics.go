@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 // GraphicsDeviceConfiguration is an interface for a graphics device configuration.
@@ -9,12 +9,18 @@ package vz
 # include "virtualization_arm64.h"
 */
 import "C"
-import "runtime"
+import (
+	"math"
+	"runtime"
+	"unsafe"
+)
 
 // MacGraphicsDeviceConfiguration is a configuration for a display attached to a Mac graphics device.
 type MacGraphicsDeviceConfiguration struct {
 	pointer
 
+	displays []*MacGraphicsDisplayConfiguration
+
 	*baseGraphicsDeviceConfiguration
 }
 
@@ -23,9 +29,7 @@ var _ GraphicsDeviceConfiguration = (*MacGraphicsDeviceConfiguration)(nil)
 // NewMacGraphicsDeviceConfiguration creates a new MacGraphicsDeviceConfiguration.
 func NewMacGraphicsDeviceConfiguration() *MacGraphicsDeviceConfiguration {
 	graphicsConfiguration := &MacGraphicsDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZMacGraphicsDeviceConfiguration(),
-		},
+		pointer: newPointer(C.newVZMacGraphicsDeviceConfiguration()),
 	}
 	runtime.SetFinalizer(graphicsConfiguration, func(self *MacGraphicsDeviceConfiguration) {
 		self.Release()
@@ -35,17 +39,29 @@ func NewMacGraphicsDeviceConfiguration() *MacGraphicsDeviceConfiguration {
 
 // SetDisplays sets the displays associated with this graphics device.
 func (m *MacGraphicsDeviceConfiguration) SetDisplays(displayConfigs ...*MacGraphicsDisplayConfiguration) {
-	ptrs := make([]NSObject, len(displayConfigs))
+	m.displays = displayConfigs
+	ptrs := make([]unsafe.Pointer, len(displayConfigs))
 	for i, val := range displayConfigs {
-		ptrs[i] = val
+		ptrs[i] = val.Ptr()
+	}
+	C.setDisplaysVZMacGraphicsDeviceConfiguration(m.Ptr(), pointerArray(ptrs), C.ulong(len(ptrs)))
+}
+
+func (m *MacGraphicsDeviceConfiguration) displaySize() (width, height float64) {
+	if len(m.displays) == 0 {
+		return 0, 0
 	}
-	array := convertToNSMutableArray(ptrs)
-	C.setDisplaysVZMacGraphicsDeviceConfiguration(m.Ptr(), array.Ptr())
+	return float64(m.displays[0].widthInPixels), float64(m.displays[0].heightInPixels)
 }
 
+func (m *MacGraphicsDeviceConfiguration) displayCount() int { return len(m.displays) }
+
 // MacGraphicsDisplayConfiguration is the configuration for a Mac graphics device.
 type MacGraphicsDisplayConfiguration struct {
 	pointer
+
+	widthInPixels  int64
+	heightInPixels int64
 }
 
 // NewMacGraphicsDisplayConfiguration creates a new MacGraphicsDisplayConfiguration.
@@ -53,16 +69,93 @@ type MacGraphicsDisplayConfiguration struct {
 // Creates a display configuration with the specified pixel dimensions and pixel density.
 func NewMacGraphicsDisplayConfiguration(widthInPixels int64, heightInPixels int64, pixelsPerInch int64) *MacGraphicsDisplayConfiguration {
 	graphicsDisplayConfiguration := &MacGraphicsDisplayConfiguration{
-		pointer: pointer{
-			ptr: C.newVZMacGraphicsDisplayConfiguration(
-				C.NSInteger(widthInPixels),
-				C.NSInteger(heightInPixels),
-				C.NSInteger(pixelsPerInch),
-			),
-		},
+		widthInPixels:  widthInPixels,
+		heightInPixels: heightInPixels,
+		pointer: newPointer(C.newVZMacGraphicsDisplayConfiguration(
+			C.NSInteger(widthInPixels),
+			C.NSInteger(heightInPixels),
+			C.NSInteger(pixelsPerInch),
+		)),
 	}
 	runtime.SetFinalizer(graphicsDisplayConfiguration, func(self *MacGraphicsDisplayConfiguration) {
 		self.Release()
 	})
 	return graphicsDisplayConfiguration
 }
+
+// The pixel densities of the displays of Apple, which the macOS guest uses to choose the scale factor.
+const (
+	// StandardPixelsPerInch is the pixel density of the standard displays, e.g. the 27-inch
+	// display of 2560x1440 pixels. The guest renders at 1x, one pixel for each point.
+	StandardPixelsPerInch = 109
+
+	// RetinaPixelsPerInch is the pixel density of the Retina displays, e.g. the 27-inch display
+	// of 5120x2880 pixels. The guest renders at 2x, four pixels for each point.
+	RetinaPixelsPerInch = 2 * StandardPixelsPerInch
+)
+
+// DisplayPixelsPerInch returns the pixel density of a physical display from the pixel dimensions
+// and the diagonal size in inches. Returns zero if diagonalInches is not positive.
+func DisplayPixelsPerInch(widthInPixels, heightInPixels int64, diagonalInches float64) int64 {
+	if diagonalInches <= 0 {
+		return 0
+	}
+	diagonal := math.Hypot(float64(widthInPixels), float64(heightInPixels))
+	return int64(math.Round(diagonal / diagonalInches))
+}
+
+// MacGraphicsDisplayPreset is the pixel dimensions and the pixel density of a display of the macOS guest.
+//
+// The guest chooses the scale factor by the pixel density, so a display of many pixels with a low
+// density is rendered at 1x with tiny text, and a display of few pixels with a high density is
+// rendered at 2x with the resolution of a quarter of the pixels, which is blurry when it is scaled
+// to the window on the host. Use the presets, RetinaMacGraphicsDisplayPreset or
+// StandardMacGraphicsDisplayPreset instead of choosing the values independently.
+type MacGraphicsDisplayPreset struct {
+	WidthInPixels  int64
+	HeightInPixels int64
+	PixelsPerInch  int64
+}
+
+// The presets of the common displays.
+var (
+	// MacGraphicsDisplay1080p is a display of 1920x1080 pixels which is rendered at 1x.
+	MacGraphicsDisplay1080p = StandardMacGraphicsDisplayPreset(1920, 1080)
+
+	// MacGraphicsDisplay1440p is a display of 2560x1440 pixels which is rendered at 1x.
+	MacGraphicsDisplay1440p = StandardMacGraphicsDisplayPreset(2560, 1440)
+
+	// MacGraphicsDisplay4K is a display of 3840x2160 pixels which is rendered at 2x, so it looks like 1920x1080.
+	MacGraphicsDisplay4K = RetinaMacGraphicsDisplayPreset(1920, 1080)
+
+	// MacGraphicsDisplay5K is a display of 5120x2880 pixels which is rendered at 2x, so it looks like 2560x1440.
+	MacGraphicsDisplay5K = RetinaMacGraphicsDisplayPreset(2560, 1440)
+)
+
+// StandardMacGraphicsDisplayPreset returns the preset of a display which is rendered at 1x
+// with the specified size in points, which is the same as the size in pixels.
+func StandardMacGraphicsDisplayPreset(widthInPoints, heightInPoints int64) MacGraphicsDisplayPreset {
+	return MacGraphicsDisplayPreset{
+		WidthInPixels:  widthInPoints,
+		HeightInPixels: heightInPoints,
+		PixelsPerInch:  StandardPixelsPerInch,
+	}
+}
+
+// RetinaMacGraphicsDisplayPreset returns the preset of a Retina display which is rendered at 2x
+// with the specified size in points. The size in pixels is twice the size in points.
+//
+// The window on the host should have the same size in points on a Retina screen of the host,
+// so each pixel of the guest is displayed on a pixel of the host.
+func RetinaMacGraphicsDisplayPreset(widthInPoints, heightInPoints int64) MacGraphicsDisplayPreset {
+	return MacGraphicsDisplayPreset{
+		WidthInPixels:  2 * widthInPoints,
+		HeightInPixels: 2 * heightInPoints,
+		PixelsPerInch:  RetinaPixelsPerInch,
+	}
+}
+
+// NewMacGraphicsDisplayConfigurationWithPreset creates a new MacGraphicsDisplayConfiguration from the preset.
+func NewMacGraphicsDisplayConfigurationWithPreset(preset MacGraphicsDisplayPreset) *MacGraphicsDisplayConfiguration {
+	return NewMacGraphicsDisplayConfiguration(preset.WidthInPixels, preset.HeightInPixels, preset.PixelsPerInch)
+}
@@ -0,0 +1,198 @@
+// Package health serves the health of the virtual machines over HTTP, so the services which
+// embed the virtual machines can plug them into their readiness and liveness probes.
+//
+//	http.Handle("/healthz", health.Handler(health.VirtualMachine("web", vm)))
+//
+// The handler responds 200 OK when all of the machines are healthy and 503 Service Unavailable
+// otherwise. The body is JSON by default, or the Prometheus text exposition format when the
+// request has the query "format=prometheus", so the same endpoint can be scraped as metrics.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Status is the health of a virtual machine.
+type Status struct {
+	// Name is the name of the virtual machine.
+	Name string `json:"name"`
+
+	// State is the execution state of the virtual machine, e.g. "running".
+	// These are the names which are returned by (vz.VirtualMachineState).String.
+	State string `json:"state"`
+
+	// StateChangedAt is the time when the state was changed at last.
+	StateChangedAt time.Time `json:"stateChangedAt"`
+
+	// Uptime is the duration since the virtual machine was started while it is running or paused.
+	Uptime time.Duration `json:"uptime"`
+
+	// StateTransitions is the number of times the state has been changed.
+	StateTransitions uint64 `json:"stateTransitions"`
+
+	// LastError is the error most recently reported by the operations of the virtual machine.
+	// Empty if no error has been reported.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Live reports whether the virtual machine has not failed. A virtual machine which is stopped
+// is live, because it can be started again.
+func (s Status) Live() bool { return s.State != "error" }
+
+// Ready reports whether the virtual machine is running.
+func (s Status) Ready() bool { return s.State == "running" }
+
+// Machine reports the health of a virtual machine. VirtualMachine returns the Machine of *vz.VirtualMachine.
+type Machine interface {
+	Health() Status
+}
+
+// MachineFunc is an adapter to allow the use of ordinary functions as Machine.
+type MachineFunc func() Status
+
+// Health calls f().
+func (f MachineFunc) Health() Status { return f() }
+
+// Probe is the condition which the machines must satisfy to be healthy.
+type Probe int
+
+const (
+	// Readiness requires all of the machines to be running. This is the default.
+	Readiness Probe = iota
+
+	// Liveness requires none of the machines to be in the error state.
+	Liveness
+)
+
+// Option is an option for Handler.
+type Option func(*handler)
+
+// WithProbe sets the condition which the machines must satisfy to respond 200 OK. The default is Readiness.
+func WithProbe(p Probe) Option {
+	return func(h *handler) {
+		h.probe = p
+	}
+}
+
+// Handler returns an http.Handler which serves the health of the machines.
+func Handler(m Machine, opts ...Option) http.Handler {
+	return Handlers([]Machine{m}, opts...)
+}
+
+// Handlers returns an http.Handler which serves the health of all of the machines.
+// The response is 200 OK only if all of them are healthy.
+func Handlers(machines []Machine, opts ...Option) http.Handler {
+	h := &handler{machines: machines}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+type handler struct {
+	machines []Machine
+	probe    Probe
+}
+
+// response is the JSON body of the response.
+type response struct {
+	Healthy  bool     `json:"healthy"`
+	Machines []Status `json:"machines"`
+}
+
+func (h *handler) healthy(s Status) bool {
+	if h.probe == Liveness {
+		return s.Live()
+	}
+	return s.Ready()
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	resp := response{
+		Healthy:  true,
+		Machines: make([]Status, len(h.machines)),
+	}
+	for i, m := range h.machines {
+		resp.Machines[i] = m.Health()
+		if !h.healthy(resp.Machines[i]) {
+			resp.Healthy = false
+		}
+	}
+	code := http.StatusOK
+	if !resp.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(code)
+		writePrometheus(w, resp.Machines)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// states is the list of the states which are reported as the vz_vm_state metric.
+var states = []string{"stopped", "running", "paused", "error", "starting", "pausing", "resuming", "stopping"}
+
+func writePrometheus(w http.ResponseWriter, machines []Status) {
+	var b strings.Builder
+	metric := func(name, typ, help string, value func(s Status) []string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range machines {
+			for _, line := range value(s) {
+				fmt.Fprintf(&b, "%s%s\n", name, line)
+			}
+		}
+	}
+	metric("vz_vm_up", "gauge", "Whether the virtual machine is running.", func(s Status) []string {
+		return []string{fmt.Sprintf("{name=%s} %d", quote(s.Name), boolValue(s.Ready()))}
+	})
+	metric("vz_vm_state", "gauge", "The execution state of the virtual machine.", func(s Status) []string {
+		lines := make([]string, 0, len(states))
+		known := false
+		for _, state := range states {
+			lines = append(lines, fmt.Sprintf("{name=%s,state=%s} %d", quote(s.Name), quote(state), boolValue(s.State == state)))
+			known = known || s.State == state
+		}
+		if !known {
+			lines = append(lines, fmt.Sprintf("{name=%s,state=%s} 1", quote(s.Name), quote(s.State)))
+		}
+		return lines
+	})
+	metric("vz_vm_uptime_seconds", "gauge", "The duration since the virtual machine was started.", func(s Status) []string {
+		return []string{fmt.Sprintf("{name=%s} %g", quote(s.Name), s.Uptime.Seconds())}
+	})
+	metric("vz_vm_state_transitions_total", "counter", "The number of times the state has been changed.", func(s Status) []string {
+		return []string{fmt.Sprintf("{name=%s} %d", quote(s.Name), s.StateTransitions)}
+	})
+	metric("vz_vm_last_error", "gauge", "Whether an error has been reported by the operations of the virtual machine.", func(s Status) []string {
+		return []string{fmt.Sprintf("{name=%s} %d", quote(s.Name), boolValue(s.LastError != ""))}
+	})
+	w.Write([]byte(b.String()))
+}
+
+// quote quotes the label value in the Prometheus text format.
+func quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package health_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/health"
+)
+
+func machine(name, state string) health.Machine {
+	return health.MachineFunc(func() health.Status {
+		return health.Status{
+			Name:             name,
+			State:            state,
+			Uptime:           90 * time.Second,
+			StateTransitions: 2,
+		}
+	})
+}
+
+func get(t *testing.T, h http.Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestHandlerReadiness(t *testing.T) {
+	tests := []struct {
+		state string
+		want  int
+	}{
+		{"running", http.StatusOK},
+		{"starting", http.StatusServiceUnavailable},
+		{"stopped", http.StatusServiceUnavailable},
+		{"error", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		rec := get(t, health.Handler(machine("vm", tt.state)), "/healthz")
+		if rec.Code != tt.want {
+			t.Errorf("state %s: code = %d, want %d", tt.state, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestHandlerLiveness(t *testing.T) {
+	tests := []struct {
+		state string
+		want  int
+	}{
+		{"running", http.StatusOK},
+		{"stopped", http.StatusOK},
+		{"error", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		h := health.Handler(machine("vm", tt.state), health.WithProbe(health.Liveness))
+		if rec := get(t, h, "/healthz"); rec.Code != tt.want {
+			t.Errorf("state %s: code = %d, want %d", tt.state, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestHandlerJSON(t *testing.T) {
+	h := health.Handlers([]health.Machine{
+		machine("a", "running"),
+		health.MachineFunc(func() health.Status {
+			return health.Status{Name: "b", State: "error", LastError: "boom"}
+		}),
+	})
+	rec := get(t, h, "/healthz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("code = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var body struct {
+		Healthy  bool            `json:"healthy"`
+		Machines []health.Status `json:"machines"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Healthy || len(body.Machines) != 2 {
+		t.Fatalf("unexpected body: %s", rec.Body)
+	}
+	if got := body.Machines[1]; got.Name != "b" || got.LastError != "boom" {
+		t.Fatalf("Machines[1] = %+v", got)
+	}
+	if got := body.Machines[0].Uptime; got != 90*time.Second {
+		t.Fatalf("Machines[0].Uptime = %s", got)
+	}
+}
+
+func TestHandlerPrometheus(t *testing.T) {
+	rec := get(t, health.Handler(machine(`my"vm`, "running")), "/healthz?format=prometheus")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE vz_vm_up gauge\n",
+		`vz_vm_up{name="my\"vm"} 1` + "\n",
+		`vz_vm_state{name="my\"vm",state="running"} 1` + "\n",
+		`vz_vm_state{name="my\"vm",state="stopped"} 0` + "\n",
+		`vz_vm_uptime_seconds{name="my\"vm"} 90` + "\n",
+		`vz_vm_state_transitions_total{name="my\"vm"} 2` + "\n",
+		`vz_vm_last_error{name="my\"vm"} 0` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandlerMethodNotAllowed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	health.Handler(machine("vm", "running")).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/healthz", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("code = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build darwin
+// +build darwin
+
+package health
+
+import "github.com/Code-Hex/vz/v2"
+
+// VirtualMachine returns the Machine which reports the statistics of vm with the name.
+func VirtualMachine(name string, vm *vz.VirtualMachine) Machine {
+	return MachineFunc(func() Status {
+		stats := vm.Stats()
+		s := Status{
+			Name:             name,
+			State:            stats.State.String(),
+			StateChangedAt:   stats.StateChangedAt,
+			Uptime:           stats.Uptime,
+			StateTransitions: stats.StateTransitions,
+		}
+		if stats.LastError != nil {
+			s.LastError = stats.LastError.Error()
+		}
+		return s
+	})
+}
@@ -0,0 +1,242 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+/*
+#include <dlfcn.h>
+#include <errno.h>
+#include <libproc.h>
+#include <mach/mach_time.h>
+#include <pthread.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/proc_info.h>
+#include <sys/resource.h>
+#include <unistd.h>
+
+typedef struct hostUsage {
+	uint64_t userTime;
+	uint64_t systemTime;
+	uint64_t residentSize;
+	uint64_t physFootprint;
+	uint64_t wiredSize;
+} hostUsage;
+
+// Virtualization.framework runs each virtual machine in this XPC service.
+static const char *virtualMachineServiceName = "com.apple.Virtualization.VirtualMachine";
+
+// The XPC service is spawned by launchd, so its parent is not this process. The responsible
+// process is, but the function is not declared in the SDK, so it is looked up at runtime.
+static pid_t (*responsibleFor)(pid_t) = NULL;
+static pthread_once_t responsibleForOnce = PTHREAD_ONCE_INIT;
+
+static void lookupResponsibleFor(void)
+{
+	responsibleFor = (pid_t(*)(pid_t))dlsym(RTLD_DEFAULT, "responsibility_get_pid_responsible_for_pid");
+}
+
+static int isVirtualMachineProcess(pid_t pid)
+{
+	char path[PROC_PIDPATHINFO_MAXSIZE];
+	if (proc_pidpath(pid, path, sizeof(path)) <= 0) {
+		return 0;
+	}
+	const char *name = strrchr(path, '/');
+	name = name ? name + 1 : path;
+	if (strcmp(name, virtualMachineServiceName) != 0) {
+		return 0;
+	}
+	pthread_once(&responsibleForOnce, lookupResponsibleFor);
+	if (responsibleFor != NULL) {
+		return responsibleFor(pid) == getpid();
+	}
+	struct proc_bsdshortinfo info;
+	if (proc_pidinfo(pid, PROC_PIDT_SHORTBSDINFO, 0, &info, sizeof(info)) != sizeof(info)) {
+		return 0;
+	}
+	return info.pbsi_uid == getuid();
+}
+
+int listVirtualMachineProcesses(int *pids, int max)
+{
+	int n = proc_listallpids(NULL, 0);
+	if (n <= 0) {
+		return 0;
+	}
+	// leave room for the processes which are spawned between the calls.
+	n += 16;
+	pid_t *all = malloc(sizeof(pid_t) * n);
+	n = proc_listallpids(all, sizeof(pid_t) * n);
+	int count = 0;
+	for (int i = 0; i < n && count < max; i++) {
+		if (isVirtualMachineProcess(all[i])) {
+			pids[count++] = all[i];
+		}
+	}
+	free(all);
+	return count;
+}
+
+int getHostUsage(int pid, hostUsage *usage)
+{
+	if (!isVirtualMachineProcess(pid)) {
+		return ESRCH;
+	}
+	struct rusage_info_v2 info;
+	if (proc_pid_rusage(pid, RUSAGE_INFO_V2, (rusage_info_t *)&info) != 0) {
+		return errno;
+	}
+	// the times are in the units of mach_absolute_time.
+	mach_timebase_info_data_t timebase;
+	mach_timebase_info(&timebase);
+	usage->userTime = info.ri_user_time * timebase.numer / timebase.denom;
+	usage->systemTime = info.ri_system_time * timebase.numer / timebase.denom;
+	usage->residentSize = info.ri_resident_size;
+	usage->physFootprint = info.ri_phys_footprint;
+	usage->wiredSize = info.ri_wired_size;
+	return 0;
+}
+*/
+import "C"
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// maxVirtualMachineProcesses is the maximum number of the processes which are listed at once.
+const maxVirtualMachineProcesses = 256
+
+// HostUsage is the resource usage of the host process which runs the virtual machine.
+//
+// Virtualization.framework runs each virtual machine (including its vCPU threads and the guest
+// memory) in a com.apple.Virtualization.VirtualMachine XPC service process. The usage is read by
+// proc_pid_rusage, which does not need the task port of the process unlike task_info.
+type HostUsage struct {
+	// PID is the process ID of the XPC service process.
+	PID int `json:"pid"`
+
+	// UserTime and SystemTime are the CPU time of the process, including the vCPU threads.
+	UserTime   time.Duration `json:"userTime"`
+	SystemTime time.Duration `json:"systemTime"`
+
+	// ResidentSize is the resident memory size of the process in bytes.
+	ResidentSize uint64 `json:"residentSize"`
+
+	// PhysFootprint is the physical memory footprint of the process in bytes.
+	// This is the value which is shown as "Memory" by Activity Monitor.
+	PhysFootprint uint64 `json:"physFootprint"`
+
+	// WiredSize is the wired memory size of the process in bytes. The guest memory which
+	// is wired by the hypervisor is counted here.
+	WiredSize uint64 `json:"wiredSize"`
+}
+
+// hostProcess finds the XPC service process of a virtual machine.
+//
+// The public API does not tell which process runs the virtual machine, so the process is
+// found as the only new one since the virtual machine was created. The processes which are
+// already claimed by the other virtual machines of this process are excluded.
+type hostProcess struct {
+	mu       sync.Mutex
+	baseline map[int]bool
+	pid      int
+}
+
+// claimedHostProcesses are the processes which are claimed by the virtual machines.
+var claimedHostProcesses = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+func listVirtualMachineProcesses() []int {
+	pids := make([]int32, maxVirtualMachineProcesses)
+	n := int(C.listVirtualMachineProcesses((*C.int)(unsafe.Pointer(&pids[0])), C.int(len(pids))))
+	ret := make([]int, n)
+	for i := 0; i < n; i++ {
+		ret[i] = int(pids[i])
+	}
+	return ret
+}
+
+// newHostProcess must be called before the virtual machine is created.
+func newHostProcess() *hostProcess {
+	baseline := make(map[int]bool)
+	for _, pid := range listVirtualMachineProcesses() {
+		baseline[pid] = true
+	}
+	return &hostProcess{baseline: baseline}
+}
+
+// selectHostProcess returns the only candidate which is neither in baseline nor claimed.
+// 0 is returned if there is no such candidate or more than one.
+func selectHostProcess(candidates []int, baseline, claimed map[int]bool) int {
+	found := 0
+	for _, pid := range candidates {
+		if baseline[pid] || claimed[pid] {
+			continue
+		}
+		if found != 0 {
+			return 0
+		}
+		found = pid
+	}
+	return found
+}
+
+// usage returns the usage of the process, or nil if the process is not found.
+func (h *hostProcess) usage() *HostUsage {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pid == 0 {
+		claimedHostProcesses.Lock()
+		h.pid = selectHostProcess(listVirtualMachineProcesses(), h.baseline, claimedHostProcesses.pids)
+		if h.pid != 0 {
+			claimedHostProcesses.pids[h.pid] = true
+		}
+		claimedHostProcesses.Unlock()
+		if h.pid == 0 {
+			return nil
+		}
+	}
+	var u C.hostUsage
+	if C.getHostUsage(C.int(h.pid), &u) != 0 {
+		// the process has exited, it is found again after the virtual machine is restarted.
+		h.releaseLocked()
+		return nil
+	}
+	return &HostUsage{
+		PID:           h.pid,
+		UserTime:      time.Duration(u.userTime),
+		SystemTime:    time.Duration(u.systemTime),
+		ResidentSize:  uint64(u.residentSize),
+		PhysFootprint: uint64(u.physFootprint),
+		WiredSize:     uint64(u.wiredSize),
+	}
+}
+
+func (h *hostProcess) release() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.releaseLocked()
+}
+
+func (h *hostProcess) releaseLocked() {
+	if h.pid == 0 {
+		return
+	}
+	claimedHostProcesses.Lock()
+	delete(claimedHostProcesses.pids, h.pid)
+	claimedHostProcesses.Unlock()
+	// the exited process must not be found again.
+	h.baseline[h.pid] = true
+	h.pid = 0
+}
@@ -0,0 +1,108 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IgnitionVsockPort is the vsock port where Ignition fetches the config on the "applehv" platform.
+const IgnitionVsockPort = 1024
+
+// IgnitionKernelCommandLine is the kernel command line which selects the "applehv" platform of
+// Ignition. Fedora CoreOS images for Apple Virtualization have this already. Append it to
+// the command line of LinuxBootLoader when booting a kernel which does not.
+const IgnitionKernelCommandLine = "ignition.platform.id=applehv"
+
+// ValidateIgnitionConfig checks that config is a JSON object which has ignition.version.
+// The config is not validated against the Ignition schema; use `ignition-validate` for that.
+func ValidateIgnitionConfig(config []byte) error {
+	var v struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(config, &v); err != nil {
+		return fmt.Errorf("invalid ignition config: %w", err)
+	}
+	if v.Ignition.Version == "" {
+		return errors.New("invalid ignition config: ignition.version is not set")
+	}
+	return nil
+}
+
+// IgnitionServer serves the Ignition config to the guest over vsock.
+//
+// Ignition on the "applehv" platform connects to IgnitionVsockPort on the host in the
+// first boot and fetches the config by HTTP GET. This is how podman machine provisions
+// Fedora CoreOS guests.
+type IgnitionServer struct {
+	listener *VirtioSocketPortListener
+	server   *http.Server
+	config   []byte
+
+	fetchedOnce sync.Once
+	fetched     chan struct{}
+}
+
+// ServeIgnition starts to serve config on IgnitionVsockPort of the socket device.
+//
+// Call this before the virtual machine is started, or at least before the guest reaches
+// the Ignition stage, and call Close after the guest has fetched the config.
+func (v *VirtioSocketDevice) ServeIgnition(config []byte) (*IgnitionServer, error) {
+	if err := ValidateIgnitionConfig(config); err != nil {
+		return nil, err
+	}
+	l, err := v.Listen(IgnitionVsockPort)
+	if err != nil {
+		return nil, err
+	}
+	s := &IgnitionServer{
+		listener: l,
+		config:   config,
+		fetched:  make(chan struct{}),
+	}
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go s.server.Serve(l)
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler. The config is served on any path.
+func (s *IgnitionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.coreos.ignition+json")
+	http.ServeContent(w, r, "config.ign", time.Time{}, bytes.NewReader(s.config))
+	if r.Method == http.MethodGet {
+		s.fetchedOnce.Do(func() { close(s.fetched) })
+	}
+}
+
+// Fetched returns a channel which is closed when the guest has fetched the config.
+func (s *IgnitionServer) Fetched() <-chan struct{} {
+	return s.fetched
+}
+
+// Close stops serving the config and closes the listener.
+func (s *IgnitionServer) Close() error {
+	err := s.server.Close()
+	// the listener may not be tracked by the server yet if Serve has not started.
+	if lerr := s.listener.Close(); err == nil && !errors.Is(lerr, net.ErrClosed) {
+		err = lerr
+	}
+	return err
+}
@@ -0,0 +1,387 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization_appkit.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// default size of the headless view when no display is configured.
+const (
+	defaultHeadlessViewWidth  = 1024
+	defaultHeadlessViewHeight = 768
+)
+
+// NSEventType values which are used by the headless view.
+// see: https://developer.apple.com/documentation/appkit/nseventtype?language=objc
+const (
+	nsEventTypeLeftMouseDown    = 1
+	nsEventTypeLeftMouseUp      = 2
+	nsEventTypeRightMouseDown   = 3
+	nsEventTypeRightMouseUp     = 4
+	nsEventTypeMouseMoved       = 5
+	nsEventTypeLeftMouseDragged = 6
+	nsEventTypeKeyDown          = 10
+	nsEventTypeKeyUp            = 11
+	nsEventTypeFlagsChanged     = 12
+)
+
+// KeyModifier is a set of the modifier keys.
+type KeyModifier uint
+
+const (
+	// KeyModifierShift is the Shift key.
+	KeyModifierShift KeyModifier = 1 << iota
+
+	// KeyModifierControl is the Control key.
+	KeyModifierControl
+
+	// KeyModifierOption is the Option (Alt) key.
+	KeyModifierOption
+
+	// KeyModifierCommand is the Command (Windows) key.
+	KeyModifierCommand
+)
+
+// modifierKeys is the list of the modifier keys in the order to be pressed.
+var modifierKeys = []struct {
+	modifier KeyModifier
+	keyCode  uint16
+	flag     uint64 // NSEventModifierFlags
+}{
+	{KeyModifierShift, 0x38, 1 << 17},
+	{KeyModifierControl, 0x3B, 1 << 18},
+	{KeyModifierOption, 0x3A, 1 << 19},
+	{KeyModifierCommand, 0x37, 1 << 20},
+}
+
+func (m KeyModifier) flags() uint64 {
+	var flags uint64
+	for _, key := range modifierKeys {
+		if m&key.modifier != 0 {
+			flags |= key.flag
+		}
+	}
+	return flags
+}
+
+// Virtual key codes of the keys which do not depend on the keyboard layout.
+// These are same as kVK_* in <HIToolbox/Events.h>.
+const (
+	KeyCodeReturn     uint16 = 0x24
+	KeyCodeTab        uint16 = 0x30
+	KeyCodeSpace      uint16 = 0x31
+	KeyCodeDelete     uint16 = 0x33
+	KeyCodeEscape     uint16 = 0x35
+	KeyCodeF1         uint16 = 0x7A
+	KeyCodeF2         uint16 = 0x78
+	KeyCodeF3         uint16 = 0x63
+	KeyCodeF4         uint16 = 0x76
+	KeyCodeF5         uint16 = 0x60
+	KeyCodeF6         uint16 = 0x61
+	KeyCodeF7         uint16 = 0x62
+	KeyCodeF8         uint16 = 0x64
+	KeyCodeF9         uint16 = 0x65
+	KeyCodeF10        uint16 = 0x6D
+	KeyCodeF11        uint16 = 0x67
+	KeyCodeF12        uint16 = 0x6F
+	KeyCodeHome       uint16 = 0x73
+	KeyCodePageUp     uint16 = 0x74
+	KeyCodeForwardDel uint16 = 0x75
+	KeyCodeEnd        uint16 = 0x77
+	KeyCodePageDown   uint16 = 0x79
+	KeyCodeLeftArrow  uint16 = 0x7B
+	KeyCodeRightArrow uint16 = 0x7C
+	KeyCodeDownArrow  uint16 = 0x7D
+	KeyCodeUpArrow    uint16 = 0x7E
+)
+
+// usKeyCodes maps the characters to the virtual key codes on the US keyboard layout.
+// The characters which need the Shift key are in usShiftedKeyCodes.
+var usKeyCodes = map[rune]uint16{
+	'a': 0x00, 's': 0x01, 'd': 0x02, 'f': 0x03, 'h': 0x04, 'g': 0x05, 'z': 0x06, 'x': 0x07,
+	'c': 0x08, 'v': 0x09, 'b': 0x0B, 'q': 0x0C, 'w': 0x0D, 'e': 0x0E, 'r': 0x0F, 'y': 0x10,
+	't': 0x11, '1': 0x12, '2': 0x13, '3': 0x14, '4': 0x15, '6': 0x16, '5': 0x17, '=': 0x18,
+	'9': 0x19, '7': 0x1A, '-': 0x1B, '8': 0x1C, '0': 0x1D, ']': 0x1E, 'o': 0x1F, 'u': 0x20,
+	'[': 0x21, 'i': 0x22, 'p': 0x23, 'l': 0x25, 'j': 0x26, '\'': 0x27, 'k': 0x28, ';': 0x29,
+	'\\': 0x2A, ',': 0x2B, '/': 0x2C, 'n': 0x2D, 'm': 0x2E, '.': 0x2F, '`': 0x32,
+	' ': KeyCodeSpace, '\t': KeyCodeTab, '\n': KeyCodeReturn,
+}
+
+var usShiftedKeyCodes = map[rune]rune{
+	'!': '1', '@': '2', '#': '3', '$': '4', '%': '5', '^': '6', '&': '7', '*': '8',
+	'(': '9', ')': '0', '_': '-', '+': '=', '{': '[', '}': ']', '|': '\\', ':': ';',
+	'"': '\'', '<': ',', '>': '.', '?': '/', '~': '`',
+}
+
+// ErrMainQueueNotServiced is returned by the keyboard and pointer events and TakeScreenshot when they are
+// not called on the main thread and the main dispatch queue is not serviced, e.g. StartGraphicApplication
+// is not running, because they would block forever.
+var ErrMainQueueNotServiced = errors.New("main dispatch queue is not serviced")
+
+// mainQueueTimeout is the time to wait for the main dispatch queue before ErrMainQueueNotServiced is returned.
+const mainQueueTimeout = time.Second
+
+// MouseButton is a button of the pointing device.
+type MouseButton int
+
+const (
+	// MouseButtonLeft is the left (primary) button.
+	MouseButtonLeft MouseButton = iota
+
+	// MouseButtonRight is the right (secondary) button.
+	MouseButtonRight
+)
+
+// headlessView returns the headless view of the virtual machine. This is created on the first call.
+func (v *VirtualMachine) headlessView() (*headlessView, error) {
+	if v.State() != VirtualMachineStateRunning {
+		return nil, ErrNotRunning
+	}
+	if !C.isMainQueueServiced(C.double(mainQueueTimeout.Seconds())) {
+		return nil, ErrMainQueueNotServiced
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.headless == nil {
+		width, height := v.displayWidth, v.displayHeight
+		if width == 0 || height == 0 {
+			width, height = defaultHeadlessViewWidth, defaultHeadlessViewHeight
+		}
+		nserr := newNSErrorAsNil()
+		nserrPtr := nserr.Ptr()
+		ptr := C.newVZHeadlessView(v.Ptr(), C.double(width), C.double(height), &nserrPtr)
+		if err := newNSError(nserrPtr); err != nil {
+			return nil, err
+		}
+		v.headless = &headlessView{
+			pointer: newPointer(ptr),
+		}
+	}
+	return v.headless, nil
+}
+
+// KeyDown sends the key down event of the virtual key code to the virtual machine.
+//
+// The keyboard and pointer events are sent through a VZVirtualMachineView which is attached to a hidden
+// window, so the virtual machine must be configured with a keyboard (e.g. NewUSBKeyboardConfiguration)
+// and a pointing device (e.g. NewUSBScreenCoordinatePointingDeviceConfiguration).
+//
+// AppKit requires the events to be sent on the main thread. If this method is not called on the main
+// thread, the main dispatch queue must be serviced, e.g. while StartGraphicApplication is running or
+// the application runs its own AppKit event loop on the main thread.
+//
+// ErrNotRunning is returned if the virtual machine is not running. ErrMainQueueNotServiced is returned
+// without sending the event if the main dispatch queue does not respond within a second.
+// If AppKit raises an exception, the error which satisfies errors.Is(err, ErrObjCException) is returned.
+func (v *VirtualMachine) KeyDown(keyCode uint16, modifiers KeyModifier) error {
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	return sendKeyEvent(view, nsEventTypeKeyDown, keyCode, "", modifiers.flags())
+}
+
+// KeyUp sends the key up event of the virtual key code to the virtual machine.
+//
+// See KeyDown for the requirements.
+func (v *VirtualMachine) KeyUp(keyCode uint16, modifiers KeyModifier) error {
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	return sendKeyEvent(view, nsEventTypeKeyUp, keyCode, "", modifiers.flags())
+}
+
+// KeyPress presses and releases the key with the modifier keys.
+// e.g. KeyPress(KeyCodeTab, KeyModifierCommand) sends Command+Tab.
+//
+// See KeyDown for the requirements.
+func (v *VirtualMachine) KeyPress(keyCode uint16, modifiers KeyModifier) error {
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	return keyPress(view, keyCode, "", modifiers)
+}
+
+// TypeText types the text as if it is typed on the US keyboard layout.
+//
+// Only the printable ASCII characters, tab and newline are supported. An error is returned
+// before typing if the text contains any other characters.
+//
+// See KeyDown for the requirements.
+func (v *VirtualMachine) TypeText(text string) error {
+	type key struct {
+		code      uint16
+		char      string
+		modifiers KeyModifier
+	}
+	keys := make([]key, 0, len(text))
+	for _, r := range text {
+		if code, ok := usKeyCodes[r]; ok {
+			keys = append(keys, key{code: code, char: string(r)})
+			continue
+		}
+		if r >= 'A' && r <= 'Z' {
+			keys = append(keys, key{code: usKeyCodes[r-'A'+'a'], char: string(r), modifiers: KeyModifierShift})
+			continue
+		}
+		if base, ok := usShiftedKeyCodes[r]; ok {
+			keys = append(keys, key{code: usKeyCodes[base], char: string(r), modifiers: KeyModifierShift})
+			continue
+		}
+		return fmt.Errorf("unsupported character %q", r)
+	}
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := keyPress(view, k.code, k.char, k.modifiers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MouseMove moves the pointer to the position.
+//
+// The position is in pixels of the first display of the graphics device from the top-left corner.
+//
+// See KeyDown for the requirements.
+func (v *VirtualMachine) MouseMove(x, y float64) error {
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	return sendMouseEvent(view, nsEventTypeMouseMoved, x, y)
+}
+
+// MouseDown presses the button at the position.
+//
+// See MouseMove for the position and KeyDown for the requirements.
+func (v *VirtualMachine) MouseDown(button MouseButton, x, y float64) error {
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	typ := nsEventTypeLeftMouseDown
+	if button == MouseButtonRight {
+		typ = nsEventTypeRightMouseDown
+	}
+	return sendMouseEvent(view, typ, x, y)
+}
+
+// MouseUp releases the button at the position.
+//
+// See MouseMove for the position and KeyDown for the requirements.
+func (v *VirtualMachine) MouseUp(button MouseButton, x, y float64) error {
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	typ := nsEventTypeLeftMouseUp
+	if button == MouseButtonRight {
+		typ = nsEventTypeRightMouseUp
+	}
+	return sendMouseEvent(view, typ, x, y)
+}
+
+// MouseDrag moves the pointer to the position while the left button is pressed.
+//
+// See MouseMove for the position and KeyDown for the requirements.
+func (v *VirtualMachine) MouseDrag(x, y float64) error {
+	view, err := v.headlessView()
+	if err != nil {
+		return err
+	}
+	return sendMouseEvent(view, nsEventTypeLeftMouseDragged, x, y)
+}
+
+// MouseClick moves the pointer to the position, then presses and releases the button.
+//
+// See MouseMove for the position and KeyDown for the requirements.
+func (v *VirtualMachine) MouseClick(button MouseButton, x, y float64) error {
+	if err := v.MouseMove(x, y); err != nil {
+		return err
+	}
+	if err := v.MouseDown(button, x, y); err != nil {
+		return err
+	}
+	return v.MouseUp(button, x, y)
+}
+
+// keyPress presses the modifier keys, presses and releases the key, then releases the modifier keys.
+func keyPress(view *headlessView, keyCode uint16, characters string, modifiers KeyModifier) error {
+	var flags uint64
+	for _, key := range modifierKeys {
+		if modifiers&key.modifier != 0 {
+			flags |= key.flag
+			if err := sendKeyEvent(view, nsEventTypeFlagsChanged, key.keyCode, "", flags); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sendKeyEvent(view, nsEventTypeKeyDown, keyCode, characters, flags); err != nil {
+		return err
+	}
+	if err := sendKeyEvent(view, nsEventTypeKeyUp, keyCode, characters, flags); err != nil {
+		return err
+	}
+	for i := len(modifierKeys) - 1; i >= 0; i-- {
+		key := modifierKeys[i]
+		if modifiers&key.modifier != 0 {
+			flags &^= key.flag
+			if err := sendKeyEvent(view, nsEventTypeFlagsChanged, key.keyCode, "", flags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sendKeyEvent(view *headlessView, typ int, keyCode uint16, characters string, flags uint64) error {
+	cs := charWithGoString(characters)
+	defer cs.Free()
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	C.VZHeadlessView_sendKeyEvent(
+		view.Ptr(),
+		C.ulong(typ),
+		C.ushort(keyCode),
+		cs.CString(),
+		C.ulong(flags),
+		&nserrPtr,
+	)
+	if err := newNSError(nserrPtr); err != nil {
+		return err
+	}
+	return nil
+}
+
+func sendMouseEvent(view *headlessView, typ int, x, y float64) error {
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	C.VZHeadlessView_sendMouseEvent(
+		view.Ptr(),
+		C.ulong(typ),
+		C.double(x),
+		C.double(y),
+		0,
+		&nserrPtr,
+	)
+	if err := newNSError(nserrPtr); err != nil {
+		return err
+	}
+	return nil
+}
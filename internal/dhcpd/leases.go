@@ -0,0 +1,133 @@
+// Package dhcpd provides a parser for the DHCP leases database of the macOS
+// bootpd(8) daemon which serves the NAT network of Virtualization.framework.
+package dhcpd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LeasesPath is the path of the DHCP leases database.
+const LeasesPath = "/var/db/dhcpd_leases"
+
+// Lease is an entry of the DHCP leases database.
+type Lease struct {
+	Name            string
+	IPAddress       net.IP
+	HardwareAddress net.HardwareAddr
+	Identifier      string
+	Expiry          time.Time
+}
+
+// ParseLeases parses the DHCP leases database which has the following format:
+//
+//	{
+//		name=ubuntu
+//		ip_address=192.168.64.2
+//		hw_address=1,2e:e3:f5:a:67:bf
+//		identifier=1,2e:e3:f5:a:67:bf
+//		lease=0x634f6d7e
+//	}
+func ParseLeases(r io.Reader) ([]*Lease, error) {
+	var (
+		leases  []*Lease
+		current *Lease
+	)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case line == "{":
+			if current != nil {
+				return nil, fmt.Errorf("line %d: unexpected %q", lineno, line)
+			}
+			current = &Lease{}
+			continue
+		case line == "}":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: unexpected %q", lineno, line)
+			}
+			leases = append(leases, current)
+			current = nil
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("line %d: %q is outside of a lease entry", lineno, line)
+		}
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: invalid line %q", lineno, line)
+		}
+		key, value := line[:idx], line[idx+1:]
+		switch key {
+		case "name":
+			current.Name = value
+		case "ip_address":
+			current.IPAddress = net.ParseIP(value)
+		case "hw_address":
+			hw, err := parseHardwareAddress(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			current.HardwareAddress = hw
+		case "identifier":
+			current.Identifier = value
+		case "lease":
+			v, err := strconv.ParseInt(strings.TrimPrefix(value, "0x"), 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid lease %q: %w", lineno, value, err)
+			}
+			current.Expiry = time.Unix(v, 0)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("unterminated lease entry")
+	}
+	return leases, nil
+}
+
+// parseHardwareAddress parses "<type>,<address>" value. bootpd strips
+// leading zeros from each octet of the address (e.g. "1,2e:e3:f5:a:67:bf").
+func parseHardwareAddress(value string) (net.HardwareAddr, error) {
+	idx := strings.Index(value, ",")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid hardware address %q", value)
+	}
+	octets := strings.Split(value[idx+1:], ":")
+	hw := make(net.HardwareAddr, len(octets))
+	for i, octet := range octets {
+		v, err := strconv.ParseUint(octet, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hardware address %q: %w", value, err)
+		}
+		hw[i] = byte(v)
+	}
+	return hw, nil
+}
+
+// FindLease returns the lease which is assigned to the specified hardware address.
+// If there are some leases for the address, the lease which expires the latest is returned.
+//
+// Returns nil if not found.
+func FindLease(leases []*Lease, hw net.HardwareAddr) *Lease {
+	var found *Lease
+	for _, lease := range leases {
+		if lease.HardwareAddress.String() != hw.String() || lease.IPAddress == nil {
+			continue
+		}
+		if found == nil || lease.Expiry.After(found.Expiry) {
+			found = lease
+		}
+	}
+	return found
+}
@@ -0,0 +1,96 @@
+package dhcpd_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/internal/dhcpd"
+)
+
+const leasesDB = `{
+	name=ubuntu
+	ip_address=192.168.64.3
+	hw_address=1,2e:e3:f5:a:67:bf
+	identifier=1,2e:e3:f5:a:67:bf
+	lease=0x634f6d7e
+}
+{
+	name=debian
+	ip_address=192.168.64.2
+	hw_address=1,3a:0:1:2:3:4
+	identifier=1,3a:0:1:2:3:4
+	lease=0x634f0000
+}
+{
+	name=ubuntu
+	ip_address=192.168.64.4
+	hw_address=1,2e:e3:f5:a:67:bf
+	identifier=1,2e:e3:f5:a:67:bf
+	lease=0x634f7000
+}
+`
+
+func TestParseLeases(t *testing.T) {
+	leases, err := dhcpd.ParseLeases(strings.NewReader(leasesDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 3 {
+		t.Fatalf("want 3 leases but got %d", len(leases))
+	}
+	got := leases[1]
+	if got.Name != "debian" {
+		t.Errorf("want name %q but got %q", "debian", got.Name)
+	}
+	if want := net.ParseIP("192.168.64.2"); !got.IPAddress.Equal(want) {
+		t.Errorf("want ip address %s but got %s", want, got.IPAddress)
+	}
+	if want := "3a:00:01:02:03:04"; got.HardwareAddress.String() != want {
+		t.Errorf("want hardware address %s but got %s", want, got.HardwareAddress)
+	}
+	if want := time.Unix(0x634f0000, 0); !got.Expiry.Equal(want) {
+		t.Errorf("want expiry %s but got %s", want, got.Expiry)
+	}
+}
+
+func TestParseLeasesInvalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+	}{
+		{name: "unterminated", input: "{\n\tname=foo\n"},
+		{name: "nested", input: "{\n{\n}\n"},
+		{name: "outside of entry", input: "name=foo\n"},
+		{name: "invalid hardware address", input: "{\n\thw_address=1,zz:00\n}\n"},
+		{name: "invalid lease", input: "{\n\tlease=0xzz\n}\n"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := dhcpd.ParseLeases(strings.NewReader(tc.input)); err == nil {
+				t.Fatal("want error but got nil")
+			}
+		})
+	}
+}
+
+func TestFindLease(t *testing.T) {
+	leases, err := dhcpd.ParseLeases(strings.NewReader(leasesDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hw, _ := net.ParseMAC("2e:e3:f5:0a:67:bf")
+	got := dhcpd.FindLease(leases, hw)
+	if got == nil {
+		t.Fatal("want lease but got nil")
+	}
+	if want := net.ParseIP("192.168.64.4"); !got.IPAddress.Equal(want) {
+		t.Errorf("want the latest lease %s but got %s", want, got.IPAddress)
+	}
+
+	unknown, _ := net.ParseMAC("00:00:00:00:00:01")
+	if got := dhcpd.FindLease(leases, unknown); got != nil {
+		t.Errorf("want nil but got %+v", got)
+	}
+}
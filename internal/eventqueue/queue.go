@@ -0,0 +1,153 @@
+// Package eventqueue provides an unbounded FIFO queue which delivers the values on its own goroutine.
+//
+// The callbacks from Virtualization.framework are invoked on the dispatch queue of the virtual
+// machine, and blocking them blocks every operation of the virtual machine. Pushing the values to
+// a Queue never blocks, and a slow receiver only makes the queue longer, which is reported by Stats.
+package eventqueue
+
+import (
+	"sync"
+)
+
+// Stats is a snapshot of the statistics of the Queue.
+type Stats struct {
+	// Pushed is the number of the values which are pushed.
+	Pushed uint64 `json:"pushed"`
+
+	// Delivered is the number of the values which are delivered.
+	Delivered uint64 `json:"delivered"`
+
+	// Dropped is the number of the values which are discarded by Close before delivered.
+	Dropped uint64 `json:"dropped"`
+
+	// Depth is the number of the values which are waiting to be delivered.
+	// This includes the value which is being delivered.
+	Depth int `json:"depth"`
+
+	// MaxDepth is the maximum Depth which has been observed.
+	MaxDepth int `json:"maxDepth"`
+}
+
+// Queue delivers the pushed values to the function in the order of Push.
+type Queue struct {
+	deliver func(v interface{})
+
+	mu       sync.Mutex
+	items    []interface{}
+	inFlight bool
+	closed   bool
+	stats    Stats
+
+	notify chan struct{}
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// New creates a new Queue and starts the goroutine which calls deliver for each value.
+//
+// deliver may block. If it waits for something else, it should also wait for Done
+// so that Close can stop it.
+func New(deliver func(v interface{})) *Queue {
+	q := &Queue{
+		deliver: deliver,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Push appends v to the queue. This never blocks.
+// It returns false if the queue is already closed, then v is not delivered.
+func (q *Queue) Push(v interface{}) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.items = append(q.items, v)
+	q.stats.Pushed++
+	if depth := q.depthLocked(); depth > q.stats.MaxDepth {
+		q.stats.MaxDepth = depth
+	}
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Done returns a channel which is closed when Close is called.
+func (q *Queue) Done() <-chan struct{} {
+	return q.done
+}
+
+// Close stops the delivery and discards the values which are not delivered yet.
+// Close does not wait for the running deliver; use Wait for that. It is safe to call Close multiple times.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.stats.Dropped += uint64(len(q.items))
+	q.items = nil
+	close(q.done)
+}
+
+// Wait waits until the delivery goroutine exits after Close is called.
+// Wait must not be called from deliver.
+func (q *Queue) Wait() {
+	<-q.exited
+}
+
+// Stats returns the statistics of the queue.
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Depth = q.depthLocked()
+	return stats
+}
+
+func (q *Queue) depthLocked() int {
+	if q.inFlight {
+		return len(q.items) + 1
+	}
+	return len(q.items)
+}
+
+func (q *Queue) run() {
+	defer close(q.exited)
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.notify:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		v := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.inFlight = true
+		q.mu.Unlock()
+
+		q.deliver(v)
+
+		q.mu.Lock()
+		q.inFlight = false
+		q.stats.Delivered++
+		q.mu.Unlock()
+	}
+}
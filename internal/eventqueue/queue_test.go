@@ -0,0 +1,73 @@
+package eventqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrder(t *testing.T) {
+	got := make(chan interface{}, 100)
+	q := New(func(v interface{}) { got <- v })
+	defer q.Close()
+	for i := 0; i < 100; i++ {
+		if !q.Push(i) {
+			t.Fatal("push failed")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case v := <-got:
+			if v != i {
+				t.Fatalf("want %d but got %v", i, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %d", i)
+		}
+	}
+}
+
+func TestPushDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	q := New(func(v interface{}) { <-release })
+	defer q.Close()
+	defer close(release)
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		q.Push(i)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("push blocked for %s", d)
+	}
+	stats := q.Stats()
+	if stats.Pushed != 1000 {
+		t.Errorf("want pushed 1000 but got %d", stats.Pushed)
+	}
+	if stats.Depth != 1000 || stats.MaxDepth != 1000 {
+		t.Errorf("want depth 1000 but got %d (max %d)", stats.Depth, stats.MaxDepth)
+	}
+}
+
+func TestClose(t *testing.T) {
+	started := make(chan struct{})
+	var q *Queue
+	q = New(func(v interface{}) {
+		if v == 0 {
+			close(started)
+		}
+		<-q.Done()
+	})
+	for i := 0; i < 10; i++ {
+		q.Push(i)
+	}
+	<-started
+	q.Close()
+	q.Close()
+	q.Wait()
+	if q.Push(10) {
+		t.Fatal("push must fail after close")
+	}
+	stats := q.Stats()
+	if stats.Delivered != 1 || stats.Dropped != 9 || stats.Depth != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
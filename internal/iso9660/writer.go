@@ -0,0 +1,314 @@
+// Package iso9660 writes ISO 9660 images with the Joliet extension.
+//
+// Only the files in the root directory are supported, which is enough for the seed images
+// such as the NoCloud data source of cloud-init. The Joliet names keep the case and the
+// characters of the original names, which are used by Linux and macOS when mounting the image.
+// The primary names are converted to the ISO 9660 characters for other readers.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SectorSize is the size of the logical block.
+const SectorSize = 2048
+
+// Fixed locations of the image. The volume descriptors are placed at the sectors 16, 17 and 18.
+const (
+	systemAreaSectors = 16
+	pathTableLSector  = 19
+	pathTableMSector  = 20
+	jolietLSector     = 21
+	jolietMSector     = 22
+	rootDirSector     = 23
+)
+
+const (
+	maxVolumeIDLength   = 32
+	maxPrimaryNameLen   = 30
+	maxJolietNameLength = 64
+)
+
+// Writer builds an image in memory and writes it with WriteTo.
+type Writer struct {
+	// VolumeID is the volume identifier, also known as the label. e.g. "cidata"
+	VolumeID string
+
+	// ModTime is the recording time of the volume and the files.
+	// The current time is used if this is zero.
+	ModTime time.Time
+
+	files []file
+}
+
+type file struct {
+	name string
+	data []byte
+}
+
+// AddFile adds a file to the root directory of the image.
+func (w *Writer) AddFile(name string, data []byte) error {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if n := len(utf16.Encode([]rune(name))); n > maxJolietNameLength {
+		return fmt.Errorf("file name %q is too long: %d > %d", name, n, maxJolietNameLength)
+	}
+	for _, f := range w.files {
+		if f.name == name || primaryName(f.name) == primaryName(name) {
+			return fmt.Errorf("file name %q conflicts with %q", name, f.name)
+		}
+	}
+	w.files = append(w.files, file{name: name, data: data})
+	return nil
+}
+
+// WriteTo writes the image to out.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	if len(w.VolumeID) > maxVolumeIDLength {
+		return 0, fmt.Errorf("volume id %q is too long: %d > %d", w.VolumeID, len(w.VolumeID), maxVolumeIDLength)
+	}
+	modTime := w.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	modTime = modTime.UTC()
+
+	// ISO 9660 requires the records to be sorted by the identifiers.
+	primary := make([]file, len(w.files))
+	copy(primary, w.files)
+	sort.Slice(primary, func(i, j int) bool { return primaryName(primary[i].name) < primaryName(primary[j].name) })
+	joliet := make([]file, len(w.files))
+	copy(joliet, w.files)
+	sort.Slice(joliet, func(i, j int) bool { return string(ucs2(joliet[i].name)) < string(ucs2(joliet[j].name)) })
+
+	primaryDirSize := dirSize(primary, func(name string) []byte { return []byte(primaryName(name)) })
+	jolietDirSize := dirSize(joliet, ucs2)
+	jolietDirSector := rootDirSector + sectors(primaryDirSize)
+
+	// file data follows the directories in the order of AddFile, and it is shared by both trees.
+	extents := make(map[string]uint32, len(w.files))
+	next := jolietDirSector + sectors(jolietDirSize)
+	for _, f := range w.files {
+		extents[f.name] = next
+		next += sectors(int64(len(f.data)))
+	}
+	totalSectors := next
+
+	primaryRoot := dirRecord(rootDirSector, uint32(primaryDirSize), modTime, true, []byte{0})
+	jolietRoot := dirRecord(jolietDirSector, uint32(jolietDirSize), modTime, true, []byte{0})
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, systemAreaSectors*SectorSize))
+	buf.Write(volumeDescriptor(1, w.VolumeID, totalSectors, pathTableLSector, pathTableMSector, primaryRoot, modTime))
+	buf.Write(volumeDescriptor(2, w.VolumeID, totalSectors, jolietLSector, jolietMSector, jolietRoot, modTime))
+	buf.Write(terminator())
+	buf.Write(pathTable(rootDirSector, binary.LittleEndian))
+	buf.Write(pathTable(rootDirSector, binary.BigEndian))
+	buf.Write(pathTable(jolietDirSector, binary.LittleEndian))
+	buf.Write(pathTable(jolietDirSector, binary.BigEndian))
+	buf.Write(directory(primary, rootDirSector, primaryDirSize, rootDirSector, extents, modTime, func(name string) []byte {
+		return []byte(primaryName(name))
+	}))
+	// Linux drops the version number of the Joliet names, so it is not appended.
+	buf.Write(directory(joliet, jolietDirSector, jolietDirSize, jolietDirSector, extents, modTime, ucs2))
+	for _, f := range w.files {
+		buf.Write(f.data)
+		buf.Write(make([]byte, int64(sectors(int64(len(f.data))))*SectorSize-int64(len(f.data))))
+	}
+	if got, want := buf.Len(), int(totalSectors)*SectorSize; got != want {
+		return 0, fmt.Errorf("iso9660: unexpected image size %d, want %d", got, want)
+	}
+	return buf.WriteTo(out)
+}
+
+// sectors returns the number of the sectors to store size bytes.
+func sectors(size int64) uint32 {
+	return uint32((size + SectorSize - 1) / SectorSize)
+}
+
+// primaryName converts name to the ISO 9660 identifier which consists of
+// the upper case letters, digits and underscores with the version number.
+func primaryName(name string) string {
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	conv := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			}
+			return '_'
+		}, s)
+	}
+	base, ext = conv(base), conv(ext)
+	if len(base)+len(ext) > maxPrimaryNameLen {
+		if len(ext) > maxPrimaryNameLen/2 {
+			ext = ext[:maxPrimaryNameLen/2]
+		}
+		base = base[:maxPrimaryNameLen-len(ext)]
+	}
+	return base + "." + ext + ";1"
+}
+
+// ucs2 encodes s as UCS-2 big endian which is the character set of Joliet.
+func ucs2(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.BigEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// dirRecord returns a directory record. The length is padded to an even number.
+func dirRecord(extent, size uint32, t time.Time, isDir bool, ident []byte) []byte {
+	n := 33 + len(ident)
+	if n%2 != 0 {
+		n++
+	}
+	r := make([]byte, n)
+	r[0] = byte(n)
+	putBoth32(r[2:], extent)
+	putBoth32(r[10:], size)
+	r[18] = byte(t.Year() - 1900)
+	r[19] = byte(t.Month())
+	r[20] = byte(t.Day())
+	r[21] = byte(t.Hour())
+	r[22] = byte(t.Minute())
+	r[23] = byte(t.Second())
+	if isDir {
+		r[25] = 0x02
+	}
+	putBoth16(r[28:], 1)
+	r[32] = byte(len(ident))
+	copy(r[33:], ident)
+	return r
+}
+
+// dirSize returns the size of the root directory which contains files. A record does not
+// cross the sector boundary, so the rest of the sector is skipped for such a record.
+func dirSize(files []file, ident func(string) []byte) int64 {
+	var size int64 = 34 * 2 // "." and ".."
+	for _, f := range files {
+		n := int64(len(dirRecord(0, 0, time.Time{}, false, ident(f.name))))
+		if size%SectorSize+n > SectorSize {
+			size += SectorSize - size%SectorSize
+		}
+		size += n
+	}
+	return int64(sectors(size)) * SectorSize
+}
+
+// directory returns the extent of the root directory.
+func directory(files []file, self uint32, size int64, parent uint32, extents map[string]uint32, t time.Time, ident func(string) []byte) []byte {
+	buf := make([]byte, 0, size)
+	buf = append(buf, dirRecord(self, uint32(size), t, true, []byte{0})...)
+	buf = append(buf, dirRecord(parent, uint32(size), t, true, []byte{1})...)
+	for _, f := range files {
+		r := dirRecord(extents[f.name], uint32(len(f.data)), t, false, ident(f.name))
+		if len(buf)%SectorSize+len(r) > SectorSize {
+			buf = append(buf, make([]byte, SectorSize-len(buf)%SectorSize)...)
+		}
+		buf = append(buf, r...)
+	}
+	return append(buf, make([]byte, int(size)-len(buf))...)
+}
+
+// pathTable returns the path table which contains only the root directory.
+func pathTable(rootExtent uint32, order binary.ByteOrder) []byte {
+	b := make([]byte, SectorSize)
+	b[0] = 1 // length of the identifier
+	order.PutUint32(b[2:], rootExtent)
+	order.PutUint16(b[6:], 1) // the parent of the root is itself
+	return b
+}
+
+const pathTableSize = 10
+
+// volumeDescriptor returns the primary (typ 1) or the Joliet supplementary (typ 2) volume descriptor.
+func volumeDescriptor(typ byte, volumeID string, totalSectors, pathL, pathM uint32, root []byte, t time.Time) []byte {
+	d := make([]byte, SectorSize)
+	d[0] = typ
+	copy(d[1:], "CD001")
+	d[6] = 1
+	text := func(off, size int, s string) {
+		if typ == 2 {
+			b := ucs2(s)
+			if len(b) > size {
+				b = b[:size]
+			}
+			copy(d[off:], b)
+			for i := off + len(b); i+1 < off+size; i += 2 {
+				d[i], d[i+1] = 0x00, ' '
+			}
+			return
+		}
+		copy(d[off:off+size], s+strings.Repeat(" ", size))
+	}
+	text(8, 32, "")
+	text(40, 32, volumeID)
+	putBoth32(d[80:], totalSectors)
+	if typ == 2 {
+		// UCS-2 level 3
+		copy(d[88:], "%/E")
+	}
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], SectorSize)
+	putBoth32(d[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], pathL)
+	binary.BigEndian.PutUint32(d[148:], pathM)
+	copy(d[156:156+34], root)
+	text(190, 128, "")
+	text(318, 128, "")
+	text(446, 128, "")
+	text(574, 128, "")
+	text(702, 37, "")
+	text(739, 37, "")
+	text(776, 37, "")
+	copy(d[813:], decDateTime(t))
+	copy(d[830:], decDateTime(t))
+	copy(d[847:], decDateTime(time.Time{}))
+	copy(d[864:], decDateTime(time.Time{}))
+	d[881] = 1
+	return d
+}
+
+// decDateTime formats t as the 17 bytes date and time of the volume descriptor.
+// The zero time means "not specified".
+func decDateTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.Format("20060102150405")+fmt.Sprintf("%02d", t.Nanosecond()/1e7)), 0)
+}
+
+func terminator() []byte {
+	d := make([]byte, SectorSize)
+	d[0] = 255
+	copy(d[1:], "CD001")
+	d[6] = 1
+	return d
+}
@@ -0,0 +1,202 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// readRoot reads the files in the root directory which is described by the volume descriptor at sector.
+func readRoot(t *testing.T, img []byte, sector int) (volumeID string, files map[string]string) {
+	t.Helper()
+	d := img[sector*SectorSize : (sector+1)*SectorSize]
+	if string(d[1:6]) != "CD001" {
+		t.Fatalf("sector %d is not a volume descriptor", sector)
+	}
+	joliet := d[0] == 2
+	decode := func(b []byte) string {
+		if !joliet {
+			return string(b)
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[i*2:])
+		}
+		return string(utf16.Decode(u))
+	}
+	volumeID = strings.TrimRight(decode(d[40:72]), " ")
+	if got := binary.LittleEndian.Uint32(d[80:]); int(got)*SectorSize != len(img) {
+		t.Fatalf("volume space size %d does not match the image size %d", got, len(img))
+	}
+	root := d[156 : 156+34]
+	extent := binary.LittleEndian.Uint32(root[2:])
+	size := binary.LittleEndian.Uint32(root[10:])
+	dir := img[int(extent)*SectorSize : int(extent)*SectorSize+int(size)]
+
+	files = make(map[string]string)
+	for off := 0; off < len(dir); {
+		n := int(dir[off])
+		if n == 0 {
+			// the rest of the sector is padding.
+			off = (off/SectorSize + 1) * SectorSize
+			continue
+		}
+		r := dir[off : off+n]
+		off += n
+		ident := r[33 : 33+int(r[32])]
+		if len(ident) == 1 && ident[0] <= 1 {
+			continue
+		}
+		fextent := binary.LittleEndian.Uint32(r[2:])
+		fsize := binary.LittleEndian.Uint32(r[10:])
+		if binary.BigEndian.Uint32(r[6:]) != fextent || binary.BigEndian.Uint32(r[14:]) != fsize {
+			t.Fatalf("both endian fields of %q do not match", ident)
+		}
+		start := int(fextent) * SectorSize
+		files[decode(ident)] = string(img[start : start+int(fsize)])
+	}
+	return volumeID, files
+}
+
+func TestWriter(t *testing.T) {
+	w := &Writer{
+		VolumeID: "cidata",
+		ModTime:  time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC),
+	}
+	big := strings.Repeat("x", SectorSize*2+1)
+	want := map[string]string{
+		"meta-data":      "instance-id: test\n",
+		"user-data":      "#cloud-config\n",
+		"network-config": big,
+		"empty":          "",
+	}
+	for _, name := range []string{"user-data", "meta-data", "network-config", "empty"} {
+		if err := w.AddFile(name, []byte(want[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != buf.Len() || n%SectorSize != 0 {
+		t.Fatalf("unexpected size %d", n)
+	}
+	img := buf.Bytes()
+
+	volumeID, files := readRoot(t, img, 17)
+	if volumeID != "cidata" {
+		t.Errorf("want joliet volume id %q but got %q", "cidata", volumeID)
+	}
+	if len(files) != len(want) {
+		t.Fatalf("want %d files but got %v", len(want), files)
+	}
+	for name, data := range want {
+		if files[name] != data {
+			t.Errorf("joliet %s: want %q but got %q", name, data, files[name])
+		}
+	}
+
+	volumeID, files = readRoot(t, img, 16)
+	if volumeID != "cidata" {
+		t.Errorf("want primary volume id %q but got %q", "cidata", volumeID)
+	}
+	if got := files["USER_DATA.;1"]; got != want["user-data"] {
+		t.Errorf("primary USER_DATA.;1: want %q but got %q", want["user-data"], got)
+	}
+	if img[18*SectorSize] != 255 {
+		t.Error("volume descriptor set terminator is not found")
+	}
+}
+
+func TestWriterManyFiles(t *testing.T) {
+	w := &Writer{VolumeID: "many"}
+	want := make(map[string]string)
+	// the directory records overflow the first sector of the directory.
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("file-with-a-long-name-%03d", i)
+		want[name] = name
+		if err := w.AddFile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, files := readRoot(t, buf.Bytes(), 17)
+	if len(files) != len(want) {
+		t.Fatalf("want %d files but got %d", len(want), len(files))
+	}
+	for name, data := range want {
+		if files[name] != data {
+			t.Errorf("%s: want %q but got %q", name, data, files[name])
+		}
+	}
+}
+
+func TestAddFileError(t *testing.T) {
+	w := &Writer{}
+	if err := w.AddFile("user-data", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "dir/file", "user-data", "USER_DATA", strings.Repeat("a", 65)} {
+		if err := w.AddFile(name, nil); err == nil {
+			t.Errorf("want error for %q", name)
+		}
+	}
+}
+
+func TestPrimaryName(t *testing.T) {
+	cases := map[string]string{
+		"user-data":   "USER_DATA.;1",
+		"README.md":   "README.MD;1",
+		".hidden":     "_HIDDEN.;1",
+		"a.tar.gz":    "A_TAR.GZ;1",
+		"bootx64.efi": "BOOTX64.EFI;1",
+	}
+	for in, want := range cases {
+		if got := primaryName(in); got != want {
+			t.Errorf("primaryName(%q): want %q but got %q", in, want, got)
+		}
+	}
+	if got := primaryName(strings.Repeat("a", 40)); len(got) != maxPrimaryNameLen+3 {
+		t.Errorf("want the long name to be truncated but got %q", got)
+	}
+}
+
+// TestIsoInfo checks the image with isoinfo(1) if it is installed.
+func TestIsoInfo(t *testing.T) {
+	isoinfo, err := exec.LookPath("isoinfo")
+	if err != nil {
+		t.Skip("isoinfo is not installed")
+	}
+	w := &Writer{VolumeID: "cidata"}
+	if err := w.AddFile("user-data", []byte("#cloud-config\n")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "seed.iso")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	out, err := exec.Command(isoinfo, "-J", "-i", path, "-x", "/user-data").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if string(out) != "#cloud-config\n" {
+		t.Fatalf("unexpected content: %q", out)
+	}
+}
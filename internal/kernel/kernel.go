@@ -0,0 +1,208 @@
+// Package kernel detects the format of Linux kernel images and concatenates initrd files.
+package kernel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format is a format of the Linux kernel image.
+type Format int
+
+const (
+	// FormatUnknown is an unknown format.
+	FormatUnknown Format = iota
+
+	// FormatARM64Image is the uncompressed arm64 Image.
+	FormatARM64Image
+
+	// FormatBzImage is the x86 bzImage.
+	FormatBzImage
+
+	// FormatELF is an ELF binary such as vmlinux.
+	FormatELF
+
+	// FormatGzip is a gzip compressed image such as Image.gz.
+	FormatGzip
+
+	// FormatZstd is a zstd compressed image.
+	FormatZstd
+
+	// FormatXZ is a xz compressed image.
+	FormatXZ
+
+	// FormatEFIZBoot is the EFI zboot image which is a compressed image wrapped by an EFI application.
+	FormatEFIZBoot
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatARM64Image:
+		return "arm64 Image"
+	case FormatBzImage:
+		return "bzImage"
+	case FormatELF:
+		return "ELF"
+	case FormatGzip:
+		return "gzip compressed"
+	case FormatZstd:
+		return "zstd compressed"
+	case FormatXZ:
+		return "xz compressed"
+	case FormatEFIZBoot:
+		return "EFI zboot"
+	}
+	return "unknown"
+}
+
+// Compressed reports whether the format is a compressed kernel image.
+func (f Format) Compressed() bool {
+	switch f {
+	case FormatGzip, FormatZstd, FormatXZ, FormatEFIZBoot:
+		return true
+	}
+	return false
+}
+
+var (
+	magicARM64  = []byte("ARM\x64")
+	magicBzImg  = []byte("HdrS")
+	magicELF    = []byte("\x7fELF")
+	magicGzip   = []byte{0x1f, 0x8b}
+	magicZstd   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicXZ     = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicMZ     = []byte("MZ")
+	magicZImage = []byte("zimg")
+)
+
+// offsets of the magic numbers.
+const (
+	// see: https://www.kernel.org/doc/html/latest/arm64/booting.html
+	offsetARM64 = 0x38
+	// see: https://www.kernel.org/doc/html/latest/x86/boot.html
+	offsetBzImage = 0x202
+	// see: drivers/firmware/efi/libstub/zboot-header.S
+	offsetZImage = 0x4
+)
+
+// DetectFormat detects the format of the kernel image.
+func DetectFormat(r io.ReaderAt) (Format, error) {
+	header := make([]byte, offsetBzImage+len(magicBzImg))
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return FormatUnknown, err
+	}
+	header = header[:n]
+	at := func(off int, magic []byte) bool {
+		return len(header) >= off+len(magic) && bytes.Equal(header[off:off+len(magic)], magic)
+	}
+	switch {
+	case at(0, magicMZ) && at(offsetZImage, magicZImage):
+		return FormatEFIZBoot, nil
+	case at(offsetARM64, magicARM64):
+		// the arm64 Image may start with "MZ" when it is built with EFI stub.
+		return FormatARM64Image, nil
+	case at(offsetBzImage, magicBzImg):
+		return FormatBzImage, nil
+	case at(0, magicELF):
+		return FormatELF, nil
+	case at(0, magicGzip):
+		return FormatGzip, nil
+	case at(0, magicZstd):
+		return FormatZstd, nil
+	case at(0, magicXZ):
+		return FormatXZ, nil
+	}
+	return FormatUnknown, nil
+}
+
+// FormatError is an error which is returned when the kernel image is not bootable.
+type FormatError struct {
+	Path   string
+	Arch   string
+	Format Format
+}
+
+// Error implements error interface.
+func (e *FormatError) Error() string {
+	msg := fmt.Sprintf("kernel %q is %s which can not be booted on %s", e.Path, e.Format, e.Arch)
+	switch e.Arch {
+	case "arm64":
+		if e.Format.Compressed() {
+			msg += ": the kernel must be an uncompressed Image, decompress it first (e.g. gunzip Image.gz)"
+		} else {
+			msg += ": the kernel must be an uncompressed Image"
+		}
+	case "amd64":
+		msg += ": the kernel must be a bzImage"
+	}
+	return msg
+}
+
+// Validate checks whether the kernel image at path can be booted on arch by VZLinuxBootLoader.
+//
+// arm64 requires the uncompressed Image. amd64 requires bzImage.
+func Validate(path, arch string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	format, err := DetectFormat(f)
+	if err != nil {
+		return err
+	}
+	var want Format
+	switch arch {
+	case "arm64":
+		want = FormatARM64Image
+	case "amd64":
+		want = FormatBzImage
+	default:
+		return fmt.Errorf("unsupported architecture %q", arch)
+	}
+	if format != want {
+		return &FormatError{Path: path, Arch: arch, Format: format}
+	}
+	return nil
+}
+
+// Concat concatenates the initrd files to w.
+//
+// The Linux kernel can unpack the concatenated cpio archives (compressed or not) as one
+// initramfs. Each file is padded with zeros to be aligned to 4 bytes which is required by
+// the cpio format.
+func Concat(w io.Writer, paths ...string) error {
+	if len(paths) == 0 {
+		return errors.New("no initrd files")
+	}
+	var written int64
+	for _, path := range paths {
+		if pad := (4 - written%4) % 4; pad > 0 {
+			n, err := w.Write(make([]byte, pad))
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+		n, err := copyFile(w, path)
+		written += n
+		if err != nil {
+			return fmt.Errorf("failed to concatenate %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func copyFile(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
@@ -0,0 +1,114 @@
+package kernel_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v2/internal/kernel"
+)
+
+func image(size int, magics map[int]string) []byte {
+	b := make([]byte, size)
+	for off, magic := range magics {
+		copy(b[off:], magic)
+	}
+	return b
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want kernel.Format
+	}{
+		{"arm64 Image", image(1024, map[int]string{0x38: "ARM\x64"}), kernel.FormatARM64Image},
+		{"arm64 Image with EFI stub", image(1024, map[int]string{0: "MZ", 0x38: "ARM\x64"}), kernel.FormatARM64Image},
+		{"EFI zboot", image(1024, map[int]string{0: "MZ", 4: "zimg"}), kernel.FormatEFIZBoot},
+		{"bzImage", image(1024, map[int]string{0x202: "HdrS"}), kernel.FormatBzImage},
+		{"ELF", image(1024, map[int]string{0: "\x7fELF"}), kernel.FormatELF},
+		{"gzip", image(16, map[int]string{0: "\x1f\x8b"}), kernel.FormatGzip},
+		{"zstd", image(16, map[int]string{0: "\x28\xb5\x2f\xfd"}), kernel.FormatZstd},
+		{"xz", image(16, map[int]string{0: "\xfd7zXZ\x00"}), kernel.FormatXZ},
+		{"unknown", image(1024, nil), kernel.FormatUnknown},
+		{"empty", nil, kernel.FormatUnknown},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := kernel.DetectFormat(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %s but got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	arm64 := writeFile(t, "Image", image(1024, map[int]string{0x38: "ARM\x64"}))
+	gzip := writeFile(t, "Image.gz", image(16, map[int]string{0: "\x1f\x8b"}))
+	bzImage := writeFile(t, "bzImage", image(1024, map[int]string{0x202: "HdrS"}))
+
+	cases := []struct {
+		path    string
+		arch    string
+		wantErr bool
+	}{
+		{arm64, "arm64", false},
+		{gzip, "arm64", true},
+		{bzImage, "arm64", true},
+		{bzImage, "amd64", false},
+		{arm64, "amd64", true},
+	}
+	for _, tc := range cases {
+		t.Run(filepath.Base(tc.path)+"/"+tc.arch, func(t *testing.T) {
+			err := kernel.Validate(tc.path, tc.arch)
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var formatErr *kernel.FormatError
+			if !errors.As(err, &formatErr) {
+				t.Fatalf("want *kernel.FormatError but got %v", err)
+			}
+		})
+	}
+
+	if err := kernel.Validate(filepath.Join(t.TempDir(), "not-found"), "arm64"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want os.ErrNotExist but got %v", err)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	a := writeFile(t, "a", []byte("abc"))
+	b := writeFile(t, "b", []byte("defgh"))
+	c := writeFile(t, "c", []byte("i"))
+
+	var buf bytes.Buffer
+	if err := kernel.Concat(&buf, a, b, c); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("abc\x00defgh\x00\x00\x00i")
+	if !bytes.Equal(want, buf.Bytes()) {
+		t.Fatalf("want %q but got %q", want, buf.Bytes())
+	}
+
+	if err := kernel.Concat(&buf); err == nil {
+		t.Fatal("want error for no files")
+	}
+}
@@ -0,0 +1,202 @@
+// Package leak provides the accounting of the objects which are retained by the package
+// and must be released. This is used to detect leaks of the objective-c objects.
+package leak
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Object is an object which is not released yet.
+type Object struct {
+	// Ptr is the address of the object.
+	Ptr uintptr
+
+	// Refs is the number of the references which are not released yet.
+	// This is more than 1 if the same object is retained multiple times.
+	Refs int
+
+	// Stack is the stack trace where the object was tracked for the first time.
+	Stack string
+}
+
+// Stats is the statistics of the Tracker.
+type Stats struct {
+	// Tracked is the total number of the tracked references.
+	Tracked uint64
+
+	// Released is the total number of the released references.
+	Released uint64
+
+	// Live is the number of the references which are not released yet.
+	Live uint64
+
+	// Unbalanced is the number of the releases of the objects which are not tracked.
+	// This indicates over-releases (or the objects which are not created by Track).
+	Unbalanced uint64
+
+	// Unowned is the number of the tracks and the releases where the retain count of the object
+	// is less than its references which are tracked. This indicates that the object is tracked
+	// without being retained, so it is released one time too many. This is counted only if the
+	// Tracker is created with WithRetainCount.
+	Unowned uint64
+}
+
+// Tracker tracks the retained objects. A Tracker is safe for concurrent use.
+type Tracker struct {
+	mu          sync.Mutex
+	objects     map[uintptr]*Object
+	retainCount func(ptr uintptr) int
+	tracked     uint64
+	released    uint64
+	unbalanced  uint64
+	unowned     uint64
+}
+
+// Option is an option for NewTracker.
+type Option func(*Tracker)
+
+// WithRetainCount makes the Tracker compare the references which are tracked with the
+// retain count of the object which is returned by fn, e.g. CFGetRetainCount.
+//
+// The references which are tracked are owned by the caller of Track, so the retain count
+// must not be less than them while they are not released.
+func WithRetainCount(fn func(ptr uintptr) int) Option {
+	return func(t *Tracker) {
+		t.retainCount = fn
+	}
+}
+
+// NewTracker creates a new Tracker.
+func NewTracker(opts ...Option) *Tracker {
+	t := &Tracker{
+		objects: make(map[uintptr]*Object),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// checkRetainCount counts the object as unowned if its retain count is less than refs.
+// This must be called with t.mu held.
+func (t *Tracker) checkRetainCount(ptr uintptr, refs int) {
+	if t.retainCount != nil && t.retainCount(ptr) < refs {
+		t.unowned++
+	}
+}
+
+// Track records that the object ptr is retained. skip is the number of the stack frames
+// to skip in the recorded stack trace, 0 identifies the caller of Track.
+func (t *Tracker) Track(ptr uintptr, skip int) {
+	if ptr == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tracked++
+	if obj, ok := t.objects[ptr]; ok {
+		obj.Refs++
+		t.checkRetainCount(ptr, obj.Refs)
+		return
+	}
+	t.objects[ptr] = &Object{
+		Ptr:   ptr,
+		Refs:  1,
+		Stack: stack(skip + 2),
+	}
+	t.checkRetainCount(ptr, 1)
+}
+
+// Untrack records that the object ptr is released. It reports false if ptr is not tracked.
+// This must be called before the object is actually released.
+func (t *Tracker) Untrack(ptr uintptr) bool {
+	if ptr == 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	obj, ok := t.objects[ptr]
+	if !ok {
+		t.unbalanced++
+		return false
+	}
+	t.checkRetainCount(ptr, obj.Refs)
+	t.released++
+	obj.Refs--
+	if obj.Refs == 0 {
+		delete(t.objects, ptr)
+	}
+	return true
+}
+
+// Stats returns the current statistics.
+func (t *Tracker) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Stats{
+		Tracked:    t.tracked,
+		Released:   t.released,
+		Live:       t.tracked - t.released,
+		Unbalanced: t.unbalanced,
+		Unowned:    t.unowned,
+	}
+}
+
+// Live returns the objects which are not released yet in the order of the address.
+func (t *Tracker) Live() []Object {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	objs := make([]Object, 0, len(t.objects))
+	for _, obj := range t.objects {
+		objs = append(objs, *obj)
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Ptr < objs[j].Ptr })
+	return objs
+}
+
+// Report writes the objects which are not released yet to w and returns the number of them.
+// The objects which are tracked at the same stack trace are grouped.
+func (t *Tracker) Report(w io.Writer) int {
+	groups := make(map[string]int)
+	n := 0
+	for _, obj := range t.Live() {
+		groups[obj.Stack] += obj.Refs
+		n += obj.Refs
+	}
+	if n == 0 {
+		return 0
+	}
+	stacks := make([]string, 0, len(groups))
+	for s := range groups {
+		stacks = append(stacks, s)
+	}
+	sort.Strings(stacks)
+	fmt.Fprintf(w, "%d objects are not released:\n", n)
+	for _, s := range stacks {
+		fmt.Fprintf(w, "\n%d objects created at:\n%s", groups[s], s)
+	}
+	return n
+}
+
+func stack(skip int) string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var b strings.Builder
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "runtime.") {
+			break
+		}
+		fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
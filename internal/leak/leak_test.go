@@ -0,0 +1,109 @@
+package leak_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v2/internal/leak"
+)
+
+func newObject(tr *leak.Tracker, ptr uintptr) {
+	tr.Track(ptr, 0)
+}
+
+func TestTracker(t *testing.T) {
+	tr := leak.NewTracker()
+	for i := uintptr(1); i <= 3; i++ {
+		newObject(tr, i)
+	}
+	// retain the same object again.
+	newObject(tr, 1)
+
+	if !tr.Untrack(1) || !tr.Untrack(2) {
+		t.Fatal("tracked object is not untracked")
+	}
+	if tr.Untrack(100) {
+		t.Fatal("untracked object is released")
+	}
+	// nil is ignored.
+	tr.Track(0, 0)
+	tr.Untrack(0)
+
+	want := leak.Stats{
+		Tracked:    4,
+		Released:   2,
+		Live:       2,
+		Unbalanced: 1,
+	}
+	if got := tr.Stats(); got != want {
+		t.Fatalf("want %+v but got %+v", want, got)
+	}
+
+	live := tr.Live()
+	if len(live) != 2 {
+		t.Fatalf("want 2 live objects but got %d", len(live))
+	}
+	if live[0].Ptr != 1 || live[0].Refs != 1 || live[1].Ptr != 3 || live[1].Refs != 1 {
+		t.Fatalf("unexpected live objects: %+v", live)
+	}
+	if !strings.Contains(live[0].Stack, "leak_test.newObject") {
+		t.Fatalf("stack does not contain the caller:\n%s", live[0].Stack)
+	}
+	if strings.Contains(live[0].Stack, "leak.(*Tracker).Track") {
+		t.Fatalf("stack contains Track:\n%s", live[0].Stack)
+	}
+
+	var buf bytes.Buffer
+	if n := tr.Report(&buf); n != 2 {
+		t.Fatalf("want 2 but got %d", n)
+	}
+	if !strings.HasPrefix(buf.String(), "2 objects are not released:") {
+		t.Fatalf("unexpected report:\n%s", buf.String())
+	}
+}
+
+func TestTrackerBalanced(t *testing.T) {
+	tr := leak.NewTracker()
+	for cycle := 0; cycle < 10; cycle++ {
+		for i := uintptr(1); i <= 5; i++ {
+			tr.Track(i, 0)
+		}
+		for i := uintptr(1); i <= 5; i++ {
+			tr.Untrack(i)
+		}
+	}
+	if got := tr.Stats(); got.Live != 0 || got.Tracked != 50 || got.Released != 50 {
+		t.Fatalf("unbalanced: %+v", got)
+	}
+	var buf bytes.Buffer
+	if n := tr.Report(&buf); n != 0 || buf.Len() != 0 {
+		t.Fatalf("want no report but got %d:\n%s", n, buf.String())
+	}
+}
+
+func TestTrackerRetainCount(t *testing.T) {
+	// retained has the retain count of each object, 2 is retained for the tracker and
+	// 3 is borrowed from its owner without being retained.
+	retained := map[uintptr]int{1: 1, 2: 2, 3: 1}
+	tr := leak.NewTracker(leak.WithRetainCount(func(ptr uintptr) int {
+		return retained[ptr]
+	}))
+	tr.Track(1, 0)
+	tr.Track(2, 0)
+	tr.Track(2, 0)
+	if got := tr.Stats().Unowned; got != 0 {
+		t.Fatalf("want no unowned objects but got %d", got)
+	}
+	tr.Track(3, 0)
+	// the second reference to the borrowed object is detected even if the first one is not.
+	tr.Track(3, 0)
+	if got := tr.Stats().Unowned; got != 1 {
+		t.Fatalf("want 1 unowned object but got %d", got)
+	}
+	tr.Untrack(3)
+	tr.Untrack(3)
+	if got := tr.Stats().Unowned; got != 2 {
+		t.Fatalf("want 2 unowned objects but got %d", got)
+	}
+}
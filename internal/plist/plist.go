@@ -0,0 +1,190 @@
+// Package plist decodes XML property lists.
+//
+// Only the XML format is supported, which is used by the manifests in the restore images.
+// The values are decoded to the Go values:
+//
+//	dict    map[string]interface{}
+//	array   []interface{}
+//	string  string
+//	integer int64
+//	real    float64
+//	true    bool
+//	false   bool
+//	date    time.Time
+//	data    []byte
+package plist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBinary is returned when the property list is in the binary format.
+var ErrBinary = errors.New("plist: binary property list is not supported")
+
+// binaryMagic is the header of the binary property lists.
+var binaryMagic = []byte("bplist")
+
+// Unmarshal decodes the property list in data.
+func Unmarshal(data []byte) (interface{}, error) {
+	if bytes.HasPrefix(data, binaryMagic) {
+		return nil, ErrBinary
+	}
+	return Decode(bytes.NewReader(data))
+}
+
+// Decode decodes the XML property list which is read from r.
+func Decode(r io.Reader) (interface{}, error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("plist: no plist element")
+			}
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "plist" {
+			return nil, fmt.Errorf("plist: unexpected element <%s>", start.Name.Local)
+		}
+		start, err = nextStart(d)
+		if err != nil {
+			return nil, err
+		}
+		return decodeValue(d, start)
+	}
+}
+
+// nextStart returns the next start element, skipping the character data and the comments.
+func nextStart(d *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return xml.StartElement{}, fmt.Errorf("plist: %w", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return tok, nil
+		case xml.EndElement:
+			return xml.StartElement{}, fmt.Errorf("plist: unexpected </%s>", tok.Name.Local)
+		}
+	}
+}
+
+func decodeValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		return decodeDict(d)
+	case "array":
+		return decodeArray(d)
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return nil, fmt.Errorf("plist: %w", err)
+	}
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		text = strings.TrimSpace(text)
+		if strings.HasPrefix(text, "0x") {
+			v, err := strconv.ParseUint(text[2:], 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("plist: invalid integer %q", text)
+			}
+			return int64(v), nil
+		}
+		v, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("plist: invalid integer %q", text)
+		}
+		return v, nil
+	case "real":
+		v, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("plist: invalid real %q", text)
+		}
+		return v, nil
+	case "date":
+		v, err := time.Parse(time.RFC3339, strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("plist: invalid date %q", text)
+		}
+		return v, nil
+	case "data":
+		v, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		if err != nil {
+			return nil, fmt.Errorf("plist: invalid data: %w", err)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("plist: unknown element <%s>", start.Name.Local)
+}
+
+func decodeDict(d *xml.Decoder) (map[string]interface{}, error) {
+	dict := make(map[string]interface{})
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			return dict, nil
+		case xml.StartElement:
+			if tok.Name.Local != "key" {
+				return nil, fmt.Errorf("plist: unexpected <%s> in dict, want <key>", tok.Name.Local)
+			}
+			var key string
+			if err := d.DecodeElement(&key, &tok); err != nil {
+				return nil, fmt.Errorf("plist: %w", err)
+			}
+			start, err := nextStart(d)
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeValue(d, start)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+		}
+	}
+}
+
+func decodeArray(d *xml.Decoder) ([]interface{}, error) {
+	array := []interface{}{}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			return array, nil
+		case xml.StartElement:
+			v, err := decodeValue(d, tok)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package plist
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnmarshal(t *testing.T) {
+	data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<!-- a comment -->
+	<key>ProductVersion</key>
+	<string>14.2</string>
+	<key>Empty</key>
+	<string/>
+	<key>Count</key>
+	<integer>42</integer>
+	<key>Hex</key>
+	<integer>0x20</integer>
+	<key>Ratio</key>
+	<real>1.5</real>
+	<key>Enabled</key>
+	<true/>
+	<key>Disabled</key>
+	<false/>
+	<key>Date</key>
+	<date>2023-12-11T10:00:00Z</date>
+	<key>Data</key>
+	<data>
+	aGVs
+	bG8=
+	</data>
+	<key>Types</key>
+	<array>
+		<string>VirtualMac2,1</string>
+		<dict/>
+	</array>
+</dict>
+</plist>`)
+	got, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"ProductVersion": "14.2",
+		"Empty":          "",
+		"Count":          int64(42),
+		"Hex":            int64(0x20),
+		"Ratio":          1.5,
+		"Enabled":        true,
+		"Disabled":       false,
+		"Date":           time.Date(2023, 12, 11, 10, 0, 0, 0, time.UTC),
+		"Data":           []byte("hello"),
+		"Types":          []interface{}{"VirtualMac2,1", map[string]interface{}{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unmarshal() =\n%#v\nwant\n%#v", got, want)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := map[string]string{
+		"no plist":       `<?xml version="1.0"?>`,
+		"not plist":      `<dict></dict>`,
+		"missing key":    `<plist><dict><string>a</string></dict></plist>`,
+		"bad integer":    `<plist><integer>abc</integer></plist>`,
+		"unknown":        `<plist><uid>1</uid></plist>`,
+		"unterminated":   `<plist><dict><key>a</key>`,
+		"bad base64":     `<plist><data>!!!</data></plist>`,
+		"unexpected end": `<plist></plist>`,
+	}
+	for name, data := range tests {
+		if _, err := Unmarshal([]byte(data)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestUnmarshalBinary(t *testing.T) {
+	if _, err := Unmarshal([]byte("bplist00\x00")); !errors.Is(err, ErrBinary) {
+		t.Fatalf("Unmarshal() = %v, want %v", err, ErrBinary)
+	}
+}
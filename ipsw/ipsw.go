@@ -0,0 +1,228 @@
+// Package ipsw reads the metadata of the macOS restore images (.ipsw) without Virtualization.framework.
+//
+// vz.LoadMacOSRestoreImageFromPath asks the framework to load the image, which takes seconds.
+// Open reads only the manifests in the image, so the tools can list the images which are
+// downloaded and pick the one to install quickly:
+//
+//	info, err := ipsw.Open("UniversalMac_14.2_23C64_Restore.ipsw")
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Println(info.ProductVersion, info.ProductBuildVersion, info.SupportsVirtualMachine())
+//
+// The image is a zip archive. Only its central directory and the manifests are read, so Open is
+// fast even for the images of more than 10 GB.
+package ipsw
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Code-Hex/vz/v2/internal/plist"
+)
+
+// ErrNoManifest is returned when the image has neither BuildManifest.plist nor Restore.plist.
+var ErrNoManifest = errors.New("ipsw: no manifest in the restore image")
+
+// maxManifestSize is the maximum size of a manifest. The manifests of the actual images are a few MB.
+const maxManifestSize = 64 << 20
+
+// The names of the manifests at the root of the image.
+const (
+	buildManifestName = "BuildManifest.plist"
+	restoreName       = "Restore.plist"
+)
+
+// Info is the metadata of a restore image.
+type Info struct {
+	// ProductVersion is the version of the operating system, e.g. "14.2".
+	ProductVersion string
+
+	// ProductBuildVersion is the build of the operating system, e.g. "23C64".
+	ProductBuildVersion string
+
+	// SupportedProductTypes is the list of the hardware which the image can be installed to,
+	// e.g. "Mac14,2" or "VirtualMac2,1" for the virtual machines.
+	SupportedProductTypes []string
+
+	// BuildIdentities is the list of the builds for the hardware in BuildManifest.plist.
+	// This is empty if the image has only Restore.plist.
+	BuildIdentities []BuildIdentity
+}
+
+// BuildIdentity is a build for a hardware in the restore image.
+type BuildIdentity struct {
+	// BoardID is the board of the hardware, e.g. "0x20".
+	BoardID string
+
+	// ChipID is the chip of the hardware, e.g. "0xFE00" for the virtual machines.
+	ChipID string
+
+	// DeviceClass is the class of the hardware, e.g. "vma2macosap" for the virtual machines.
+	DeviceClass string
+
+	// Variant is the variant of the build, e.g. "macOS Customer".
+	Variant string
+
+	// RestoreBehavior is how the build is installed, "Erase" or "Update".
+	RestoreBehavior string
+
+	// BuildNumber is the build of the operating system.
+	BuildNumber string
+}
+
+// virtualMachineProductPrefix is the prefix of the product types of the virtual machines.
+const virtualMachineProductPrefix = "VirtualMac"
+
+// virtualMachineDeviceClassPrefix is the prefix of the device classes of the virtual machines.
+const virtualMachineDeviceClassPrefix = "vma"
+
+// SupportsVirtualMachine reports whether the image can be installed to a virtual machine.
+// This does not tell whether the host supports the version, which only the framework knows.
+func (i *Info) SupportsVirtualMachine() bool {
+	for _, p := range i.SupportedProductTypes {
+		if strings.HasPrefix(p, virtualMachineProductPrefix) {
+			return true
+		}
+	}
+	return len(i.VirtualMachineBuildIdentities()) > 0
+}
+
+// VirtualMachineBuildIdentities returns the build identities for the virtual machines.
+func (i *Info) VirtualMachineBuildIdentities() []BuildIdentity {
+	var ids []BuildIdentity
+	for _, id := range i.BuildIdentities {
+		if strings.HasPrefix(id.DeviceClass, virtualMachineDeviceClassPrefix) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Open reads the metadata of the restore image at path.
+func Open(path string) (*Info, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("ipsw: %w", err)
+	}
+	defer r.Close()
+	return read(&r.Reader)
+}
+
+// Read reads the metadata of the restore image from r which has size bytes. r can be a
+// reader of a remote image which supports the range requests, because only the end of the
+// image and the manifests are read.
+func Read(r io.ReaderAt, size int64) (*Info, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("ipsw: %w", err)
+	}
+	return read(zr)
+}
+
+func read(zr *zip.Reader) (*Info, error) {
+	var buildManifest, restore *zip.File
+	for _, f := range zr.File {
+		switch f.Name {
+		case buildManifestName:
+			buildManifest = f
+		case restoreName:
+			restore = f
+		}
+	}
+	if buildManifest == nil && restore == nil {
+		return nil, ErrNoManifest
+	}
+
+	info := &Info{}
+	if buildManifest != nil {
+		dict, err := readManifest(buildManifest)
+		if err != nil {
+			return nil, err
+		}
+		info.ProductVersion = stringValue(dict["ProductVersion"])
+		info.ProductBuildVersion = stringValue(dict["ProductBuildVersion"])
+		info.SupportedProductTypes = stringsValue(dict["SupportedProductTypes"])
+		ids, _ := dict["BuildIdentities"].([]interface{})
+		for _, v := range ids {
+			id, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			idInfo, _ := id["Info"].(map[string]interface{})
+			info.BuildIdentities = append(info.BuildIdentities, BuildIdentity{
+				BoardID:         stringValue(id["ApBoardID"]),
+				ChipID:          stringValue(id["ApChipID"]),
+				DeviceClass:     stringValue(idInfo["DeviceClass"]),
+				Variant:         stringValue(idInfo["Variant"]),
+				RestoreBehavior: stringValue(idInfo["RestoreBehavior"]),
+				BuildNumber:     stringValue(idInfo["BuildNumber"]),
+			})
+		}
+	}
+	if restore != nil && (info.ProductVersion == "" || info.ProductBuildVersion == "" || len(info.SupportedProductTypes) == 0) {
+		dict, err := readManifest(restore)
+		if err != nil {
+			return nil, err
+		}
+		if info.ProductVersion == "" {
+			info.ProductVersion = stringValue(dict["ProductVersion"])
+		}
+		if info.ProductBuildVersion == "" {
+			info.ProductBuildVersion = stringValue(dict["ProductBuildVersion"])
+		}
+		if len(info.SupportedProductTypes) == 0 {
+			info.SupportedProductTypes = stringsValue(dict["SupportedProductTypes"])
+		}
+	}
+	return info, nil
+}
+
+func readManifest(f *zip.File) (map[string]interface{}, error) {
+	if f.UncompressedSize64 > maxManifestSize {
+		return nil, fmt.Errorf("ipsw: %s is too large: %d bytes", f.Name, f.UncompressedSize64)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("ipsw: %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("ipsw: %s: %w", f.Name, err)
+	}
+	v, err := plist.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("ipsw: %s: %w", f.Name, err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ipsw: %s is not a dictionary", f.Name)
+	}
+	return dict, nil
+}
+
+// stringValue returns v as a string. The integers are formatted in hex as the IDs in the manifests.
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return fmt.Sprintf("0x%X", v)
+	}
+	return ""
+}
+
+func stringsValue(v interface{}) []string {
+	array, _ := v.([]interface{})
+	var ss []string
+	for _, e := range array {
+		if s, ok := e.(string); ok {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
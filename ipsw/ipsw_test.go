@@ -0,0 +1,153 @@
+package ipsw_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Code-Hex/vz/v2/ipsw"
+)
+
+const buildManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>BuildIdentities</key>
+	<array>
+		<dict>
+			<key>ApBoardID</key>
+			<string>0x20</string>
+			<key>ApChipID</key>
+			<string>0xFE00</string>
+			<key>Info</key>
+			<dict>
+				<key>BuildNumber</key>
+				<string>23C64</string>
+				<key>DeviceClass</key>
+				<string>vma2macosap</string>
+				<key>RestoreBehavior</key>
+				<string>Erase</string>
+				<key>Variant</key>
+				<string>macOS Customer</string>
+			</dict>
+		</dict>
+		<dict>
+			<key>ApBoardID</key>
+			<string>0x24</string>
+			<key>ApChipID</key>
+			<string>0x8112</string>
+			<key>Info</key>
+			<dict>
+				<key>DeviceClass</key>
+				<string>j413ap</string>
+			</dict>
+		</dict>
+	</array>
+	<key>ProductBuildVersion</key>
+	<string>23C64</string>
+	<key>ProductVersion</key>
+	<string>14.2</string>
+</dict>
+</plist>`
+
+const restorePlist = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>ProductVersion</key>
+	<string>14.2</string>
+	<key>SupportedProductTypes</key>
+	<array>
+		<string>Mac14,2</string>
+		<string>VirtualMac2,1</string>
+	</array>
+</dict>
+</plist>`
+
+func newImage(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "UniversalMac_14.2_23C64_Restore.ipsw")
+	image := newImage(t, map[string]string{
+		"BuildManifest.plist": buildManifest,
+		"Restore.plist":       restorePlist,
+		"Firmware/all_flash/": "",
+	})
+	if err := os.WriteFile(path, image, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ipsw.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ProductVersion != "14.2" || info.ProductBuildVersion != "23C64" {
+		t.Fatalf("version = %s (%s)", info.ProductVersion, info.ProductBuildVersion)
+	}
+	if want := []string{"Mac14,2", "VirtualMac2,1"}; !reflect.DeepEqual(info.SupportedProductTypes, want) {
+		t.Fatalf("SupportedProductTypes = %v, want %v", info.SupportedProductTypes, want)
+	}
+	if len(info.BuildIdentities) != 2 {
+		t.Fatalf("got %d build identities, want 2", len(info.BuildIdentities))
+	}
+	if !info.SupportsVirtualMachine() {
+		t.Fatal("SupportsVirtualMachine() = false")
+	}
+	want := []ipsw.BuildIdentity{{
+		BoardID:         "0x20",
+		ChipID:          "0xFE00",
+		DeviceClass:     "vma2macosap",
+		Variant:         "macOS Customer",
+		RestoreBehavior: "Erase",
+		BuildNumber:     "23C64",
+	}}
+	if got := info.VirtualMachineBuildIdentities(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("VirtualMachineBuildIdentities() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadRestorePlistOnly(t *testing.T) {
+	image := newImage(t, map[string]string{"Restore.plist": restorePlist})
+	info, err := ipsw.Read(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ProductVersion != "14.2" || len(info.BuildIdentities) != 0 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if !info.SupportsVirtualMachine() {
+		t.Fatal("SupportsVirtualMachine() = false")
+	}
+}
+
+func TestReadNoManifest(t *testing.T) {
+	image := newImage(t, map[string]string{"kernelcache": "x"})
+	if _, err := ipsw.Read(bytes.NewReader(image), int64(len(image))); !errors.Is(err, ipsw.ErrNoManifest) {
+		t.Fatalf("Read() = %v, want %v", err, ipsw.ErrNoManifest)
+	}
+}
+
+func TestReadNotZip(t *testing.T) {
+	data := []byte("not a zip archive")
+	if _, err := ipsw.Read(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatal("want error")
+	}
+}
@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -31,9 +34,7 @@ var _ KeyboardConfiguration = (*USBKeyboardConfiguration)(nil)
 // NewUSBKeyboardConfiguration creates a new USB keyboard configuration.
 func NewUSBKeyboardConfiguration() *USBKeyboardConfiguration {
 	config := &USBKeyboardConfiguration{
-		pointer: pointer{
-			ptr: C.newVZUSBKeyboardConfiguration(),
-		},
+		pointer: newPointer(C.newVZUSBKeyboardConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *USBKeyboardConfiguration) {
 		self.Release()
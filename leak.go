@@ -0,0 +1,10 @@
+//go:build darwin && !vzdebug
+// +build darwin,!vzdebug
+
+package vz
+
+import "unsafe"
+
+func trackObject(ptr unsafe.Pointer) {}
+
+func untrackObject(ptr unsafe.Pointer) {}
@@ -0,0 +1,104 @@
+//go:build darwin && vzdebug
+// +build darwin,vzdebug
+
+package vz
+
+/*
+#cgo darwin LDFLAGS: -framework CoreFoundation
+#include <CoreFoundation/CoreFoundation.h>
+
+static long retainCount(uintptr_t ptr)
+{
+	return (long)CFGetRetainCount((CFTypeRef)ptr);
+}
+*/
+import "C"
+import (
+	"io"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"github.com/Code-Hex/vz/v2/internal/leak"
+)
+
+// objectTracker compares the references with the retain counts, so the objects which are
+// wrapped by newPointer without being retained are reported as Unowned.
+var objectTracker = leak.NewTracker(leak.WithRetainCount(func(ptr uintptr) int {
+	return int(C.retainCount(C.uintptr_t(ptr)))
+}))
+
+func trackObject(ptr unsafe.Pointer) {
+	// skip trackObject and newPointer, so the stack starts at the constructor.
+	objectTracker.Track(uintptr(ptr), 2)
+}
+
+func untrackObject(ptr unsafe.Pointer) {
+	objectTracker.Untrack(uintptr(ptr))
+}
+
+// ObjectStats is the statistics of the objective-c objects which are retained by this package.
+// This is available only when the package is built with the vzdebug tag.
+type ObjectStats struct {
+	// Retained is the total number of the objects which have been retained.
+	Retained uint64
+
+	// Released is the total number of the objects which have been released.
+	Released uint64
+
+	// Live is the number of the objects which are not released yet.
+	Live uint64
+
+	// Unbalanced is the number of the releases of the objects which are not retained by this package.
+	// This must be 0, otherwise the object is released twice.
+	Unbalanced uint64
+
+	// Unowned is the number of the retains and the releases where the retain count of the object
+	// is less than the references of this package. This must be 0, otherwise the object is wrapped
+	// without being retained, and released one time too many.
+	Unowned uint64
+}
+
+// DebugObjectStats returns the statistics of the objective-c objects which are retained by this package.
+//
+// The objects are released by the finalizers of the Go objects, so call runtime.GC before this
+// to release the unreachable objects. This is available only when the package is built with
+// the vzdebug tag.
+func DebugObjectStats() ObjectStats {
+	s := objectTracker.Stats()
+	return ObjectStats{
+		Retained:   s.Tracked,
+		Released:   s.Released,
+		Live:       s.Live,
+		Unbalanced: s.Unbalanced,
+		Unowned:    s.Unowned,
+	}
+}
+
+// ReportLeaks writes the objective-c objects which are not released yet to w with the stack
+// traces where they were created, and returns the number of them.
+//
+// This runs the garbage collector and waits a moment for the finalizers before the report,
+// so it is intended to be called at the exit of the process.
+//
+//	func main() {
+//		defer vz.ReportLeaks(os.Stderr)
+//		...
+//	}
+//
+// This is available only when the package is built with the vzdebug tag.
+func ReportLeaks(w io.Writer) int {
+	collectGarbage()
+	return objectTracker.Report(w)
+}
+
+// collectGarbage runs the garbage collector until the finalizers which release
+// the objects have been run.
+func collectGarbage() {
+	// finalizers are run in a goroutine after the GC, and the objects which are referred by
+	// the finalized objects are collected by the next GC.
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
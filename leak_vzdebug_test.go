@@ -0,0 +1,136 @@
+//go:build darwin && vzdebug
+// +build darwin,vzdebug
+
+package vz
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConfiguration creates a configuration which has the most kinds of the devices.
+func newTestConfiguration(t *testing.T, kernel string) *VirtualMachineConfiguration {
+	t.Helper()
+	bootLoader := NewLinuxBootLoader(kernel, WithCommandLine("console=hvc0"))
+	config := NewVirtualMachineConfiguration(bootLoader, 1, 512*1024*1024)
+
+	serial := NewVirtioConsoleDeviceSerialPortConfiguration(
+		NewFileHandleSerialPortAttachment(os.Stdin, os.Stdout),
+	)
+	config.SetSerialPortsVirtualMachineConfiguration([]*VirtioConsoleDeviceSerialPortConfiguration{serial})
+
+	network := NewVirtioNetworkDeviceConfiguration(NewNATNetworkDeviceAttachment())
+	network.SetMACAddress(NewRandomLocallyAdministeredMACAddress())
+	config.SetNetworkDevicesVirtualMachineConfiguration([]*VirtioNetworkDeviceConfiguration{network})
+
+	config.SetEntropyDevicesVirtualMachineConfiguration([]*VirtioEntropyDeviceConfiguration{
+		NewVirtioEntropyDeviceConfiguration(),
+	})
+	config.SetMemoryBalloonDevicesVirtualMachineConfiguration([]MemoryBalloonDeviceConfiguration{
+		NewVirtioTraditionalMemoryBalloonDeviceConfiguration(),
+	})
+	config.SetSocketDevicesVirtualMachineConfiguration([]SocketDeviceConfiguration{
+		NewVirtioSocketDeviceConfiguration(),
+	})
+	return config
+}
+
+func waitState(t *testing.T, vm *VirtualMachine, want VirtualMachineState) {
+	t.Helper()
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case got := <-vm.StateChangedNotify():
+			if got == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s, current state is %s", want, vm.State())
+		}
+	}
+}
+
+func assertBalanced(t *testing.T, base ObjectStats) {
+	t.Helper()
+	collectGarbage()
+	got := DebugObjectStats()
+	if got.Unbalanced != base.Unbalanced {
+		t.Errorf("%d objects are released but not retained", got.Unbalanced-base.Unbalanced)
+	}
+	if got.Unowned != base.Unowned {
+		t.Errorf("%d objects are wrapped without being retained", got.Unowned-base.Unowned)
+	}
+	if got.Live > base.Live {
+		var buf strings.Builder
+		ReportLeaks(&buf)
+		t.Fatalf("%d objects are leaked:\n%s", got.Live-base.Live, buf.String())
+	}
+}
+
+// TestObjectLifetime needs the same environment as TestObjectLifetimeStartStop, because
+// NewVirtualMachine panics if the configuration is not valid.
+func TestObjectLifetime(t *testing.T) {
+	kernel := os.Getenv("VZ_TEST_KERNEL")
+	if kernel == "" {
+		t.Skip("VZ_TEST_KERNEL is not set")
+	}
+	if _, err := newTestConfiguration(t, kernel).Validate(); err != nil {
+		t.Skipf("configuration is not valid, the test binary may not be entitled: %v", err)
+	}
+	collectGarbage()
+	base := DebugObjectStats()
+
+	for i := 0; i < 10; i++ {
+		config := newTestConfiguration(t, kernel)
+		vm, err := NewVirtualMachineWithError(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the devices are taken twice, so the references of this package exceed the retain
+		// count if the devices are not retained for them.
+		socketDevices, balloonDevices := vm.SocketDevices(), vm.MemoryBalloonDevices()
+		_, _ = vm.SocketDevices(), vm.MemoryBalloonDevices()
+		runtime.KeepAlive(socketDevices)
+		runtime.KeepAlive(balloonDevices)
+	}
+	assertBalanced(t, base)
+}
+
+// TestObjectLifetimeStartStop needs a Linux kernel at $VZ_TEST_KERNEL and the test binary
+// which is signed with the com.apple.security.virtualization entitlement.
+func TestObjectLifetimeStartStop(t *testing.T) {
+	kernel := os.Getenv("VZ_TEST_KERNEL")
+	if kernel == "" {
+		t.Skip("VZ_TEST_KERNEL is not set")
+	}
+	collectGarbage()
+	base := DebugObjectStats()
+
+	for i := 0; i < 3; i++ {
+		config := newTestConfiguration(t, kernel)
+		if _, err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		vm := NewVirtualMachine(config)
+		var startErr error
+		vm.Start(func(err error) {
+			startErr = err
+		})
+		if startErr != nil {
+			t.Fatal(startErr)
+		}
+		waitState(t, vm, VirtualMachineStateRunning)
+		var stopErr error
+		vm.Stop(func(err error) {
+			stopErr = err
+		})
+		if stopErr != nil {
+			t.Fatal(stopErr)
+		}
+		waitState(t, vm, VirtualMachineStateStopped)
+	}
+	assertBalanced(t, base)
+}
@@ -0,0 +1,278 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// NoLimit is set to the fields of Limits when no limit is known for the value.
+// The configuration is still validated by Virtualization.framework in Validate.
+const NoLimit = -1
+
+// Limits is the limits of the virtual machine configuration which are supported on a host.
+// CurrentLimits returns the limits of the current host, and LimitsFor returns the ones of a TargetPlatform.
+//
+// The limits of the CPU count and the memory size are reported by Virtualization.framework.
+// The framework does not report the others, so these are the limits which are documented by Apple
+// for the running macOS. Validate checks the configuration against these limits before it is
+// validated by the framework, so the reason is reported as ValidationError.
+type Limits struct {
+	// MinCPUCount and MaxCPUCount are the range of the number of CPUs.
+	MinCPUCount uint
+	MaxCPUCount uint
+
+	// MinMemorySize and MaxMemorySize are the range of the memory size in bytes.
+	MinMemorySize uint64
+	MaxMemorySize uint64
+
+	// MaxNetworkDevices is the maximum number of the network devices.
+	MaxNetworkDevices int
+
+	// MaxStorageDevices is the maximum number of the storage devices.
+	MaxStorageDevices int
+
+	// MaxDirectorySharingDevices is the maximum number of the directory sharing devices.
+	MaxDirectorySharingDevices int
+
+	// MaxSocketDevices is the maximum number of the socket devices.
+	MaxSocketDevices int
+
+	// MaxMemoryBalloonDevices is the maximum number of the memory balloon devices.
+	MaxMemoryBalloonDevices int
+
+	// MaxGraphicsDevices is the maximum number of the graphics devices.
+	MaxGraphicsDevices int
+
+	// MaxDisplays is the maximum number of the displays of a graphics device.
+	MaxDisplays int
+
+	// MinSocketPort and MaxSocketPort are the range of the port number of the Virtio socket device.
+	MinSocketPort uint32
+	MaxSocketPort uint32
+}
+
+// CurrentLimits returns the limits of the virtual machine configuration on the current host.
+func CurrentLimits() Limits {
+	return newLimits(
+		VirtualMachineConfigurationMinimumAllowedCPUCount(),
+		VirtualMachineConfigurationMaximumAllowedCPUCount(),
+		VirtualMachineConfigurationMinimumAllowedMemorySize(),
+		VirtualMachineConfigurationMaximumAllowedMemorySize(),
+	)
+}
+
+// newLimits returns the limits with the range of the CPU count and the memory size.
+// The limits of the devices are the same on all hosts.
+func newLimits(minCPUCount, maxCPUCount uint, minMemorySize, maxMemorySize uint64) Limits {
+	return Limits{
+		MinCPUCount:                minCPUCount,
+		MaxCPUCount:                maxCPUCount,
+		MinMemorySize:              minMemorySize,
+		MaxMemorySize:              maxMemorySize,
+		MaxNetworkDevices:          NoLimit,
+		MaxStorageDevices:          NoLimit,
+		MaxDirectorySharingDevices: NoLimit,
+		// see: https://developer.apple.com/documentation/virtualization/vzvirtualmachineconfiguration/3656729-socketdevices?language=objc
+		MaxSocketDevices: 1,
+		// see: https://developer.apple.com/documentation/virtualization/vzvirtualmachineconfiguration/3656726-memoryballoondevices?language=objc
+		MaxMemoryBalloonDevices: 1,
+		// see: https://developer.apple.com/documentation/virtualization/vzvirtualmachineconfiguration/3795757-graphicsdevices?language=objc
+		MaxGraphicsDevices: 1,
+		// see: https://developer.apple.com/documentation/virtualization/vzmacgraphicsdeviceconfiguration/3795745-displays?language=objc
+		MaxDisplays: 1,
+		// VMADDR_PORT_ANY can not be used.
+		MinSocketPort: 0,
+		MaxSocketPort: unix.VMADDR_PORT_ANY - 1,
+	}
+}
+
+// GuestOS is the operating system of the guest.
+type GuestOS string
+
+const (
+	// GuestOSLinux is a Linux guest (or any other guest which is booted by the Linux or EFI boot loader).
+	GuestOSLinux GuestOS = "linux"
+
+	// GuestOSMacOS is a macOS guest which is only supported on Apple silicon hosts.
+	GuestOSMacOS GuestOS = "macos"
+)
+
+// ErrUnsupportedTargetPlatform is returned by LimitsFor when the guest can not run on the host.
+var ErrUnsupportedTargetPlatform = errors.New("unsupported target platform")
+
+// The minimums of Virtualization.framework which are documented by Apple. These are used
+// instead of the reported ones when the target host is not the current host.
+// See minimumAllowedCPUCount and minimumAllowedMemorySize of VZVirtualMachineConfiguration.
+const (
+	frameworkMinCPUCount   = 1
+	frameworkMinMemorySize = 128 * 1024 * 1024
+)
+
+// The minimum requirements of the macOS restore images (macOS 12 to 14) which are reported by
+// MacOSConfigurationRequirements. Use the requirements of the image for the exact values.
+const (
+	macOSGuestMinCPUCount   = 2
+	macOSGuestMinMemorySize = 4 * 1024 * 1024 * 1024
+)
+
+// TargetPlatform describes the host and the guest which a configuration is generated for.
+// It may be different from the current host.
+type TargetPlatform struct {
+	// GuestOS is the operating system of the guest. If empty, GuestOSLinux is used.
+	GuestOS GuestOS
+
+	// HostArch is the architecture of the host as GOARCH, "arm64" or "amd64".
+	// If empty, the architecture of the current host is used.
+	HostArch string
+
+	// Rosetta is true if the guest runs x86_64 binaries through Rosetta, which is only
+	// supported for Linux guests on arm64 hosts. Rosetta does not change the limits.
+	Rosetta bool
+
+	// HostCPUCount is the number of the CPUs of the host. If zero, the maximum CPU count
+	// of the current host is used, so this must be set when HostArch is not the architecture
+	// of the current host.
+	HostCPUCount uint
+
+	// HostMemorySize is the physical memory size of the host in bytes. If zero, the maximum
+	// memory size of the current host is used, so this must be set when HostArch is not the
+	// architecture of the current host.
+	HostMemorySize uint64
+}
+
+// LimitsFor returns the limits of the virtual machine configuration for the target platform,
+// so the configurations which are generated for other hosts can be checked by ValidateLimits.
+//
+// The minimums are the ones which are reported by Virtualization.framework for the current
+// host, or the documented ones for a host of the other architecture, raised to the minimum
+// requirements of the restore images for macOS guests. The maximums are the CPU count and the
+// memory size of the target host. The limits of the devices do not depend on the host.
+//
+// ErrUnsupportedTargetPlatform is returned if the guest can not run on the host. e.g. a macOS
+// guest on an Intel host, or if HostCPUCount or HostMemorySize is not set for a host of the
+// other architecture.
+func LimitsFor(p TargetPlatform) (Limits, error) {
+	guest := p.GuestOS
+	if guest == "" {
+		guest = GuestOSLinux
+	}
+	arch := p.HostArch
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	switch arch {
+	case "arm64", "amd64":
+	default:
+		return Limits{}, fmt.Errorf("%w: unknown host architecture %q", ErrUnsupportedTargetPlatform, arch)
+	}
+	switch guest {
+	case GuestOSLinux:
+	case GuestOSMacOS:
+		if arch != "arm64" {
+			return Limits{}, fmt.Errorf("%w: macOS guests require an arm64 host", ErrUnsupportedTargetPlatform)
+		}
+	default:
+		return Limits{}, fmt.Errorf("%w: unknown guest OS %q", ErrUnsupportedTargetPlatform, guest)
+	}
+	if p.Rosetta && (guest != GuestOSLinux || arch != "arm64") {
+		return Limits{}, fmt.Errorf("%w: Rosetta requires a Linux guest on an arm64 host", ErrUnsupportedTargetPlatform)
+	}
+
+	var limits Limits
+	if arch == runtime.GOARCH {
+		limits = CurrentLimits()
+	} else {
+		if p.HostCPUCount == 0 || p.HostMemorySize == 0 {
+			return Limits{}, fmt.Errorf("%w: the CPU count and the memory size of the %s host must be specified", ErrUnsupportedTargetPlatform, arch)
+		}
+		limits = newLimits(frameworkMinCPUCount, 0, frameworkMinMemorySize, 0)
+	}
+	if p.HostCPUCount != 0 {
+		limits.MaxCPUCount = p.HostCPUCount
+	}
+	if p.HostMemorySize != 0 {
+		limits.MaxMemorySize = p.HostMemorySize
+	}
+	if guest == GuestOSMacOS {
+		if limits.MinCPUCount < macOSGuestMinCPUCount {
+			limits.MinCPUCount = macOSGuestMinCPUCount
+		}
+		if limits.MinMemorySize < macOSGuestMinMemorySize {
+			limits.MinMemorySize = macOSGuestMinMemorySize
+		}
+	}
+	if limits.MinCPUCount > limits.MaxCPUCount || limits.MinMemorySize > limits.MaxMemorySize {
+		return Limits{}, fmt.Errorf("%w: the host does not have enough resources for the guest", ErrUnsupportedTargetPlatform)
+	}
+	return limits, nil
+}
+
+// ValidateLimits validates the CPU count, the memory size and the number of the devices
+// against limits, without asking Virtualization.framework. Use it with LimitsFor to check the
+// configurations which are generated for other hosts. The error is ValidationErrors.
+func (v *VirtualMachineConfiguration) ValidateLimits(limits Limits) error {
+	if errs := v.validateLimits(limits); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateLimits validates the CPU count, the memory size and the number of the devices against the limits.
+func (v *VirtualMachineConfiguration) validateLimits(limits Limits) ValidationErrors {
+	var errs ValidationErrors
+	if v.cpuCount < limits.MinCPUCount || v.cpuCount > limits.MaxCPUCount {
+		errs = append(errs, &ValidationError{
+			Device: "cpu",
+			Index:  -1,
+			Reason: fmt.Sprintf("invalid CPU count %d: must be between %d and %d", v.cpuCount, limits.MinCPUCount, limits.MaxCPUCount),
+		})
+	}
+	if v.memorySize < limits.MinMemorySize || v.memorySize > limits.MaxMemorySize {
+		errs = append(errs, &ValidationError{
+			Device: "memory",
+			Index:  -1,
+			Reason: fmt.Sprintf("invalid memory size %d: must be between %d and %d", v.memorySize, limits.MinMemorySize, limits.MaxMemorySize),
+		})
+	} else if v.memorySize%(1024*1024) != 0 {
+		errs = append(errs, &ValidationError{
+			Device: "memory",
+			Index:  -1,
+			Reason: fmt.Sprintf("invalid memory size %d: must be a multiple of 1 MiB", v.memorySize),
+		})
+	}
+	check := func(device string, n, max int) {
+		if max != NoLimit && n > max {
+			errs = append(errs, &ValidationError{
+				Device: device,
+				Index:  -1,
+				Reason: fmt.Sprintf("too many devices %d: must be at most %d", n, max),
+			})
+		}
+	}
+	check("network", len(v.networkDevices), limits.MaxNetworkDevices)
+	check("storage", len(v.storageDevices), limits.MaxStorageDevices)
+	check("directorySharing", len(v.directorySharingDevices), limits.MaxDirectorySharingDevices)
+	check("socket", len(v.socketDevices), limits.MaxSocketDevices)
+	check("memoryBalloon", len(v.memoryBalloonDevices), limits.MaxMemoryBalloonDevices)
+	check("graphics", len(v.graphicsDevices), limits.MaxGraphicsDevices)
+	for i, device := range v.graphicsDevices {
+		d, ok := device.(interface{ displayCount() int })
+		if !ok {
+			continue
+		}
+		if n := d.displayCount(); limits.MaxDisplays != NoLimit && n > limits.MaxDisplays {
+			errs = append(errs, &ValidationError{
+				Device: "graphics",
+				Index:  i,
+				Reason: fmt.Sprintf("too many displays %d: must be at most %d", n, limits.MaxDisplays),
+			})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,49 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// errLocked is returned by lockFile when the file is locked by another process.
+var errLocked = errors.New("locked by another process")
+
+// lockFile opens the file or the directory at path and takes the exclusive advisory lock
+// by flock(2). The lock is released when the returned file is closed.
+//
+// If the file is already locked, errLocked is returned without blocking.
+func lockFile(path string) (*os.File, error) {
+	return flockFile(path, unix.LOCK_EX)
+}
+
+// lockFileShared is same as lockFile but takes the shared lock, which can be held by multiple
+// readers at the same time.
+func lockFileShared(path string) (*os.File, error) {
+	return flockFile(path, unix.LOCK_SH)
+}
+
+func flockFile(path string, how int) (*os.File, error) {
+	return flockOpenFile(path, os.O_RDONLY, 0, how)
+}
+
+// flockOpenFile opens the file at path with the flag and the perm as os.OpenFile, then locks the
+// same file descriptor, e.g. with os.O_CREATE to create the lock file without a race.
+func flockOpenFile(path string, flag int, perm os.FileMode, how int) (*os.File, error) {
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	return f, nil
+}
@@ -0,0 +1,40 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+// Logger is the interface to emit structured events of the virtual machine.
+//
+// Each event is a message with alternating key-value pairs. The keys are string.
+// *slog.Logger satisfies this interface.
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// VirtualMachineOption is an option for NewVirtualMachine.
+type VirtualMachineOption func(*virtualMachineOptions)
+
+type virtualMachineOptions struct {
+	logger        Logger
+	dispatchQueue *DispatchQueue
+}
+
+// WithLogger is an option to emit structured events of the virtual machine to the logger.
+//
+// The events are emitted on every state change, completion of the operations (e.g. Start, Stop),
+// the delegate callbacks when the virtual machine is stopped and the errors reported by Virtualization.framework.
+// Every event has the "id" key which identifies the virtual machine.
+//
+// The logger may be called on the dispatch queue of the virtual machine, so it must not block
+// and must not call the methods of the virtual machine.
+func WithLogger(logger Logger) VirtualMachineOption {
+	return func(o *virtualMachineOptions) {
+		o.logger = logger
+	}
+}
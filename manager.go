@@ -0,0 +1,317 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/internal/eventqueue"
+)
+
+// ErrVirtualMachineExists is returned by (*Manager).Add when the name is already used.
+var ErrVirtualMachineExists = errors.New("virtual machine already exists")
+
+// ErrVirtualMachineNotFound is returned when the virtual machine is not found in the Manager.
+var ErrVirtualMachineNotFound = errors.New("virtual machine not found")
+
+// ManagerEvent is an event of the virtual machine which is managed by Manager.
+type ManagerEvent struct {
+	// Name is the name of the virtual machine.
+	Name string
+
+	// VirtualMachine is the virtual machine which changed the state.
+	VirtualMachine *VirtualMachine
+
+	// State is the new state of the virtual machine.
+	State VirtualMachineState
+
+	// Time is the time when the state was changed.
+	Time time.Time
+}
+
+// ManagerError is an error of the virtual machine which is managed by Manager.
+type ManagerError struct {
+	// Name is the name of the virtual machine.
+	Name string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error interface.
+func (e *ManagerError) Error() string {
+	return fmt.Sprintf("virtual machine %q: %v", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ManagerError) Unwrap() error { return e.Err }
+
+// ManagerErrors is the list of the errors which are occurred by the operations for
+// multiple virtual machines. e.g. StartAll and StopAll.
+type ManagerErrors []*ManagerError
+
+// Error implements error interface.
+func (e ManagerErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the first error. This allows errors.Is and errors.As to inspect it.
+func (e ManagerErrors) Unwrap() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e[0]
+}
+
+// Manager owns multiple virtual machines which run in the same process.
+//
+// Each virtual machine has its own dispatch queue which is created by NewVirtualMachine,
+// so the operations on different virtual machines do not block each other.
+// A Manager is safe for concurrent use.
+type Manager struct {
+	mu       sync.Mutex
+	machines map[string]*managedMachine
+	subs     map[*eventSubscription]struct{}
+}
+
+type managedMachine struct {
+	vm     *VirtualMachine
+	remove func()
+}
+
+// NewManager creates a new Manager.
+func NewManager() *Manager {
+	return &Manager{
+		machines: make(map[string]*managedMachine),
+		subs:     make(map[*eventSubscription]struct{}),
+	}
+}
+
+// Add creates a new virtual machine with the configuration and adds it as name.
+//
+// ErrVirtualMachineExists is returned if name is already used. The error of the framework which
+// rejects the configuration is also returned, see NewVirtualMachine.
+func (m *Manager) Add(name string, config *VirtualMachineConfiguration, opts ...VirtualMachineOption) (*VirtualMachine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.machines[name]; ok {
+		return nil, &ManagerError{Name: name, Err: ErrVirtualMachineExists}
+	}
+	vm, err := NewVirtualMachineWithError(config, opts...)
+	if err != nil {
+		return nil, &ManagerError{Name: name, Err: err}
+	}
+	remove := vm.addStateObserver(func(state VirtualMachineState) {
+		m.publish(ManagerEvent{
+			Name:           name,
+			VirtualMachine: vm,
+			State:          state,
+			Time:           time.Now(),
+		})
+	})
+	m.machines[name] = &managedMachine{
+		vm:     vm,
+		remove: remove,
+	}
+	return vm, nil
+}
+
+// Remove removes the virtual machine which is named name from the Manager.
+//
+// The virtual machine must be stopped. It is not stopped by Remove.
+func (m *Manager) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	machine, ok := m.machines[name]
+	if !ok {
+		return &ManagerError{Name: name, Err: ErrVirtualMachineNotFound}
+	}
+	if state := machine.vm.State(); !isStoppedState(state) {
+		return &ManagerError{Name: name, Err: fmt.Errorf("virtual machine is %s", state)}
+	}
+	machine.remove()
+	delete(m.machines, name)
+	return nil
+}
+
+// Get returns the virtual machine which is named name.
+func (m *Manager) Get(name string) (*VirtualMachine, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	machine, ok := m.machines[name]
+	if !ok {
+		return nil, false
+	}
+	return machine.vm, true
+}
+
+// List returns the sorted names of the virtual machines.
+func (m *Manager) List() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.machines))
+	for name := range m.machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start starts the virtual machine which is named name.
+func (m *Manager) Start(name string) error {
+	vm, ok := m.Get(name)
+	if !ok {
+		return &ManagerError{Name: name, Err: ErrVirtualMachineNotFound}
+	}
+	var startErr error
+	vm.Start(func(err error) {
+		startErr = err
+	})
+	if startErr != nil {
+		return &ManagerError{Name: name, Err: startErr}
+	}
+	return nil
+}
+
+// Stop stops the virtual machine which is named name gracefully.
+//
+// The guest is asked to stop with RequestStop, and the virtual machine is stopped forcibly
+// if it is not stopped until ctx is done.
+func (m *Manager) Stop(ctx context.Context, name string) error {
+	vm, ok := m.Get(name)
+	if !ok {
+		return &ManagerError{Name: name, Err: ErrVirtualMachineNotFound}
+	}
+	if err := stopGracefully(ctx, vm, nil); err != nil {
+		return &ManagerError{Name: name, Err: err}
+	}
+	return nil
+}
+
+// StartAll starts all of the virtual machines which can be started concurrently.
+//
+// The returned error is ManagerErrors if any of the virtual machines failed to start.
+func (m *Manager) StartAll() error {
+	return m.each(func(name string, vm *VirtualMachine) error {
+		if !vm.CanStart() {
+			return nil
+		}
+		return m.Start(name)
+	})
+}
+
+// StopAll stops all of the virtual machines concurrently in the same way as Stop.
+//
+// The returned error is ManagerErrors if any of the virtual machines failed to stop.
+func (m *Manager) StopAll(ctx context.Context) error {
+	return m.each(func(name string, vm *VirtualMachine) error {
+		return m.Stop(ctx, name)
+	})
+}
+
+func (m *Manager) each(fn func(name string, vm *VirtualMachine) error) error {
+	m.mu.Lock()
+	machines := make(map[string]*VirtualMachine, len(m.machines))
+	for name, machine := range m.machines {
+		machines[name] = machine.vm
+	}
+	m.mu.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs ManagerErrors
+	)
+	for name, vm := range machines {
+		wg.Add(1)
+		go func(name string, vm *VirtualMachine) {
+			defer wg.Done()
+			if err := fn(name, vm); err != nil {
+				var managerErr *ManagerError
+				if !errors.As(err, &managerErr) {
+					managerErr = &ManagerError{Name: name, Err: err}
+				}
+				mu.Lock()
+				errs = append(errs, managerErr)
+				mu.Unlock()
+			}
+		}(name, vm)
+	}
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Name < errs[j].Name })
+	return errs
+}
+
+// Events returns a channel which receives the state changes of all of the virtual machines
+// in the Manager. The events of a virtual machine are delivered in the order of the changes.
+//
+// The events are buffered without limit, so a slow receiver does not block the virtual machines.
+// Call the returned function to stop receiving the events, then the channel is closed.
+func (m *Manager) Events() (<-chan ManagerEvent, func()) {
+	sub := newEventSubscription()
+	m.mu.Lock()
+	m.subs[sub] = struct{}{}
+	m.mu.Unlock()
+	var once sync.Once
+	return sub.out, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subs, sub)
+			m.mu.Unlock()
+			sub.close()
+		})
+	}
+}
+
+func (m *Manager) publish(ev ManagerEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for sub := range m.subs {
+		sub.push(ev)
+	}
+}
+
+// eventSubscription is an unbounded queue of the events which is drained to out.
+type eventSubscription struct {
+	queue *eventqueue.Queue
+	out   chan ManagerEvent
+}
+
+func newEventSubscription() *eventSubscription {
+	sub := &eventSubscription{
+		out: make(chan ManagerEvent),
+	}
+	sub.queue = eventqueue.New(sub.send)
+	return sub
+}
+
+func (s *eventSubscription) push(ev ManagerEvent) {
+	s.queue.Push(ev)
+}
+
+func (s *eventSubscription) close() {
+	s.queue.Close()
+	s.queue.Wait()
+	close(s.out)
+}
+
+func (s *eventSubscription) send(ev interface{}) {
+	select {
+	case s.out <- ev.(ManagerEvent):
+	case <-s.queue.Done():
+	}
+}
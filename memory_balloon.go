@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -6,7 +9,10 @@ package vz
 # include "virtualization.h"
 */
 import "C"
-import "runtime"
+import (
+	"runtime"
+	"unsafe"
+)
 
 // MemoryBalloonDeviceConfiguration for a memory balloon device configuration.
 type MemoryBalloonDeviceConfiguration interface {
@@ -33,12 +39,74 @@ type VirtioTraditionalMemoryBalloonDeviceConfiguration struct {
 // NewVirtioTraditionalMemoryBalloonDeviceConfiguration creates a new VirtioTraditionalMemoryBalloonDeviceConfiguration.
 func NewVirtioTraditionalMemoryBalloonDeviceConfiguration() *VirtioTraditionalMemoryBalloonDeviceConfiguration {
 	config := &VirtioTraditionalMemoryBalloonDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioTraditionalMemoryBalloonDeviceConfiguration(),
-		},
+		pointer: newPointer(C.newVZVirtioTraditionalMemoryBalloonDeviceConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *VirtioTraditionalMemoryBalloonDeviceConfiguration) {
 		self.Release()
 	})
 	return config
 }
+
+// MemoryBalloonDevice is the base interface for memory balloon devices.
+//
+// see: https://developer.apple.com/documentation/virtualization/vzmemoryballoondevice?language=objc
+type MemoryBalloonDevice interface {
+	NSObject
+
+	memoryBalloonDevice()
+}
+
+type baseMemoryBalloonDevice struct{}
+
+func (*baseMemoryBalloonDevice) memoryBalloonDevice() {}
+
+var _ MemoryBalloonDevice = (*VirtioTraditionalMemoryBalloonDevice)(nil)
+
+// VirtioTraditionalMemoryBalloonDevice is a struct that represents a Virtio traditional memory balloon device.
+//
+// The balloon device allows for cooperative memory management between the host and guest.
+// You use it to request the guest to return some of its memory to the host.
+//
+// Don't create a VirtioTraditionalMemoryBalloonDevice struct directly. Instead, when you request a memory balloon device
+// in your configuration, the virtual machine creates it and you can get it via MemoryBalloonDevices method.
+//
+// The framework does not provide the statistics of the balloon device (e.g. the actual amount of memory
+// the guest has returned). Only the target memory size which is requested to the guest can be observed.
+//
+// see: https://developer.apple.com/documentation/virtualization/vzvirtiotraditionalmemoryballoondevice?language=objc
+type VirtioTraditionalMemoryBalloonDevice struct {
+	dispatchQueue unsafe.Pointer
+	pointer
+
+	*baseMemoryBalloonDevice
+}
+
+func newVirtioTraditionalMemoryBalloonDevice(ptr, dispatchQueue unsafe.Pointer) *VirtioTraditionalMemoryBalloonDevice {
+	balloonDevice := &VirtioTraditionalMemoryBalloonDevice{
+		dispatchQueue: dispatchQueue,
+		pointer:       newPointer(ptr),
+	}
+	runtime.SetFinalizer(balloonDevice, func(self *VirtioTraditionalMemoryBalloonDevice) {
+		self.Release()
+	})
+	return balloonDevice
+}
+
+// TargetVirtualMachineMemorySize returns the target amount of memory for the guest in bytes.
+//
+// The value is the memory size most recently requested by SetTargetVirtualMachineMemorySize, or
+// the configured memory size if no request has been made.
+func (v *VirtioTraditionalMemoryBalloonDevice) TargetVirtualMachineMemorySize() uint64 {
+	return uint64(C.VZVirtioTraditionalMemoryBalloonDevice_getTargetVirtualMachineMemorySize(v.Ptr(), v.dispatchQueue))
+}
+
+// SetTargetVirtualMachineMemorySize sets the target amount of memory for the guest in bytes.
+//
+// The target memory size must be a multiple of 1 megabyte (1024 * 1024 bytes) and between
+// VirtualMachineConfigurationMinimumAllowedMemorySize and the configured memory size.
+// The framework will round the value down to the nearest megabyte and clamp it.
+//
+// The guest is not required to reach the target. This is a request to the guest to return memory to the host.
+func (v *VirtioTraditionalMemoryBalloonDevice) SetTargetVirtualMachineMemorySize(memorySize uint64) {
+	C.VZVirtioTraditionalMemoryBalloonDevice_setTargetVirtualMachineMemorySize(v.Ptr(), v.dispatchQueue, C.ulonglong(memorySize))
+}
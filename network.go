@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -7,9 +10,12 @@ package vz
 */
 import "C"
 import (
+	"fmt"
 	"net"
 	"os"
 	"runtime"
+	"sync"
+	"unsafe"
 )
 
 // BridgedNetwork defines a network interface that bridges a physical interface with a virtual machine.
@@ -50,9 +56,7 @@ var _ NetworkDeviceAttachment = (*NATNetworkDeviceAttachment)(nil)
 // NewNATNetworkDeviceAttachment creates a new NATNetworkDeviceAttachment.
 func NewNATNetworkDeviceAttachment() *NATNetworkDeviceAttachment {
 	attachment := &NATNetworkDeviceAttachment{
-		pointer: pointer{
-			ptr: C.newVZNATNetworkDeviceAttachment(),
-		},
+		pointer: newPointer(C.newVZNATNetworkDeviceAttachment()),
 	}
 	runtime.SetFinalizer(attachment, func(self *NATNetworkDeviceAttachment) {
 		self.Release()
@@ -74,6 +78,8 @@ type BridgedNetworkDeviceAttachment struct {
 	pointer
 
 	*baseNetworkDeviceAttachment
+
+	interfaceIdentifier string
 }
 
 var _ NetworkDeviceAttachment = (*BridgedNetworkDeviceAttachment)(nil)
@@ -81,11 +87,10 @@ var _ NetworkDeviceAttachment = (*BridgedNetworkDeviceAttachment)(nil)
 // NewBridgedNetworkDeviceAttachment creates a new BridgedNetworkDeviceAttachment with networkInterface.
 func NewBridgedNetworkDeviceAttachment(networkInterface BridgedNetwork) *BridgedNetworkDeviceAttachment {
 	attachment := &BridgedNetworkDeviceAttachment{
-		pointer: pointer{
-			ptr: C.newVZBridgedNetworkDeviceAttachment(
-				networkInterface.Ptr(),
-			),
-		},
+		pointer: newPointer(C.newVZBridgedNetworkDeviceAttachment(
+			networkInterface.Ptr(),
+		)),
+		interfaceIdentifier: networkInterface.Identifier(),
 	}
 	runtime.SetFinalizer(attachment, func(self *BridgedNetworkDeviceAttachment) {
 		self.Release()
@@ -102,6 +107,9 @@ type FileHandleNetworkDeviceAttachment struct {
 	pointer
 
 	*baseNetworkDeviceAttachment
+
+	fd  uintptr
+	mtu int
 }
 
 var _ NetworkDeviceAttachment = (*FileHandleNetworkDeviceAttachment)(nil)
@@ -111,11 +119,11 @@ var _ NetworkDeviceAttachment = (*FileHandleNetworkDeviceAttachment)(nil)
 // file parameter is holding a connected datagram socket.
 func NewFileHandleNetworkDeviceAttachment(file *os.File) *FileHandleNetworkDeviceAttachment {
 	attachment := &FileHandleNetworkDeviceAttachment{
-		pointer: pointer{
-			ptr: C.newVZFileHandleNetworkDeviceAttachment(
-				C.int(file.Fd()),
-			),
-		},
+		pointer: newPointer(C.newVZFileHandleNetworkDeviceAttachment(
+			C.int(file.Fd()),
+		)),
+		fd:  file.Fd(),
+		mtu: 1500, // The default MTU is 1500.
 	}
 	runtime.SetFinalizer(attachment, func(self *FileHandleNetworkDeviceAttachment) {
 		self.Release()
@@ -123,6 +131,28 @@ func NewFileHandleNetworkDeviceAttachment(file *os.File) *FileHandleNetworkDevic
 	return attachment
 }
 
+// SetMaximumTransmissionUnit sets the maximum transmission unit (MTU) associated with this attachment.
+//
+// The host MTU on the socket must be at least as large as the MTU used in the guest.
+// The default MTU is 1500. The maximum MTU allowed is 65535, and the minimum MTU allowed is 1500.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (f *FileHandleNetworkDeviceAttachment) SetMaximumTransmissionUnit(mtu int) error {
+	if err := macOSAvailable(13, 0); err != nil {
+		return err
+	}
+	if mtu < 1500 || mtu > 65535 {
+		return fmt.Errorf("invalid MTU %d: must be between 1500 and 65535", mtu)
+	}
+	C.setMaximumTransmissionUnitVZFileHandleNetworkDeviceAttachment(f.Ptr(), C.NSInteger(mtu))
+	f.mtu = mtu
+	return nil
+}
+
+// MaximumTransmissionUnit returns the maximum transmission unit (MTU) associated with this attachment.
+func (f *FileHandleNetworkDeviceAttachment) MaximumTransmissionUnit() int { return f.mtu }
+
 // NetworkDeviceAttachment for a network device attachment.
 // see: https://developer.apple.com/documentation/virtualization/vznetworkdeviceattachment?language=objc
 type NetworkDeviceAttachment interface {
@@ -145,16 +175,21 @@ func (*baseNetworkDeviceAttachment) networkDeviceAttachment() {}
 // see: https://developer.apple.com/documentation/virtualization/vzvirtionetworkdeviceconfiguration?language=objc
 type VirtioNetworkDeviceConfiguration struct {
 	pointer
+
+	attachment NetworkDeviceAttachment
+	macAddress *MACAddress
 }
 
 // NewVirtioNetworkDeviceConfiguration creates a new VirtioNetworkDeviceConfiguration with NetworkDeviceAttachment.
+//
+// Any kind of attachments can be mixed in the network devices of a virtual machine.
+// e.g. the first device uses NATNetworkDeviceAttachment and the second one uses FileHandleNetworkDeviceAttachment.
 func NewVirtioNetworkDeviceConfiguration(attachment NetworkDeviceAttachment) *VirtioNetworkDeviceConfiguration {
 	config := &VirtioNetworkDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioNetworkDeviceConfiguration(
-				attachment.Ptr(),
-			),
-		},
+		pointer: newPointer(C.newVZVirtioNetworkDeviceConfiguration(
+			attachment.Ptr(),
+		)),
+		attachment: attachment,
 	}
 	runtime.SetFinalizer(config, func(self *VirtioNetworkDeviceConfiguration) {
 		self.Release()
@@ -162,10 +197,156 @@ func NewVirtioNetworkDeviceConfiguration(attachment NetworkDeviceAttachment) *Vi
 	return config
 }
 
+// SetMACAddress sets the media access control address of the device.
+//
+// If the MAC address is not set, a random locally administered MAC address is used by default.
 func (v *VirtioNetworkDeviceConfiguration) SetMACAddress(macAddress *MACAddress) {
+	v.macAddress = macAddress
 	C.setNetworkDevicesVZMACAddress(v.Ptr(), macAddress.Ptr())
 }
 
+// Attachment returns the network device attachment of this device.
+func (v *VirtioNetworkDeviceConfiguration) Attachment() NetworkDeviceAttachment { return v.attachment }
+
+// SetMaximumTransmissionUnit sets the maximum transmission unit (MTU) of this device.
+//
+// The MTU can be set only if the attachment supports it. Currently only FileHandleNetworkDeviceAttachment
+// supports that on macOS 13 and newer. Returns error if the attachment does not support.
+func (v *VirtioNetworkDeviceConfiguration) SetMaximumTransmissionUnit(mtu int) error {
+	attachment, ok := v.attachment.(*FileHandleNetworkDeviceAttachment)
+	if !ok {
+		return fmt.Errorf("%T does not support to set MTU", v.attachment)
+	}
+	return attachment.SetMaximumTransmissionUnit(mtu)
+}
+
+// NetworkDevice is a network device which is attached to the running virtual machine.
+//
+// Don't create a NetworkDevice struct directly. Use (*VirtualMachine).NetworkDevices method instead.
+// see: https://developer.apple.com/documentation/virtualization/vznetworkdevice?language=objc
+type NetworkDevice struct {
+	dispatchQueue unsafe.Pointer
+	pointer
+
+	index       int
+	attachments *networkAttachments
+}
+
+// networkAttachments tracks the current attachments of the network devices of a virtual machine.
+type networkAttachments struct {
+	mu          sync.Mutex
+	attachments []NetworkDeviceAttachment
+}
+
+func newNetworkAttachments(devices []*VirtioNetworkDeviceConfiguration) *networkAttachments {
+	attachments := make([]NetworkDeviceAttachment, len(devices))
+	for i, device := range devices {
+		if device != nil {
+			attachments[i] = device.attachment
+		}
+	}
+	return &networkAttachments{attachments: attachments}
+}
+
+func (n *networkAttachments) get(i int) NetworkDeviceAttachment {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if i < len(n.attachments) {
+		return n.attachments[i]
+	}
+	return nil
+}
+
+func (n *networkAttachments) set(i int, attachment NetworkDeviceAttachment) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if i < len(n.attachments) {
+		n.attachments[i] = attachment
+	}
+}
+
+func newNetworkDevice(ptr, dispatchQueue unsafe.Pointer, index int, attachments *networkAttachments) *NetworkDevice {
+	networkDevice := &NetworkDevice{
+		dispatchQueue: dispatchQueue,
+		pointer:       newPointer(ptr),
+		index:         index,
+		attachments:   attachments,
+	}
+	runtime.SetFinalizer(networkDevice, func(self *NetworkDevice) {
+		self.Release()
+	})
+	return networkDevice
+}
+
+// Attachment returns the network device attachment which is set to this device.
+//
+// This returns the attachment which is set via the configuration or SetAttachment method
+// and returns nil if the network device is disconnected.
+func (n *NetworkDevice) Attachment() NetworkDeviceAttachment { return n.attachments.get(n.index) }
+
+// SetAttachment replaces the network device attachment of this device.
+//
+// The attachment can be replaced while the virtual machine is running. e.g. replace NAT attachment to
+// file handle attachment to restart the network backend without stopping the guest.
+// If attachment is nil, the network device is disconnected from the host.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (n *NetworkDevice) SetAttachment(attachment NetworkDeviceAttachment) error {
+	if err := macOSAvailable(13, 0); err != nil {
+		return err
+	}
+	var attachmentPtr unsafe.Pointer
+	if attachment != nil {
+		attachmentPtr = attachment.Ptr()
+	}
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	C.VZNetworkDevice_setAttachment(n.Ptr(), n.dispatchQueue, attachmentPtr, &nserrPtr)
+	if err := newNSError(nserrPtr); err != nil {
+		return err
+	}
+	n.attachments.set(n.index, attachment)
+	return nil
+}
+
+// validateNetworkDevices validates network devices which are not checked by the framework
+// before the virtual machine starts.
+func validateNetworkDevices(devices []*VirtioNetworkDeviceConfiguration) ValidationErrors {
+	var errs ValidationErrors
+	invalid := func(i int, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{
+			Device: "network",
+			Index:  i,
+			Reason: fmt.Sprintf(format, args...),
+		})
+	}
+	macAddresses := make(map[string]int, len(devices))
+	fileDescriptors := make(map[uintptr]int, len(devices))
+	for i, device := range devices {
+		if device == nil || device.attachment == nil {
+			invalid(i, "attachment is not set")
+			continue
+		}
+		if device.macAddress != nil {
+			mac := device.macAddress.String()
+			if j, ok := macAddresses[mac]; ok {
+				invalid(i, "MAC address %s is already used by network device %d", mac, j)
+			} else {
+				macAddresses[mac] = i
+			}
+		}
+		if attachment, ok := device.attachment.(*FileHandleNetworkDeviceAttachment); ok {
+			if j, ok := fileDescriptors[attachment.fd]; ok {
+				invalid(i, "file handle is already used by network device %d", j)
+			} else {
+				fileDescriptors[attachment.fd] = i
+			}
+		}
+	}
+	return errs
+}
+
 // MACAddress represents a media access control address (MAC address), the 48-bit ethernet address.
 // see: https://developer.apple.com/documentation/virtualization/vzmacaddress?language=objc
 type MACAddress struct {
@@ -177,9 +358,7 @@ func NewMACAddress(macAddr net.HardwareAddr) *MACAddress {
 	macAddrChar := charWithGoString(macAddr.String())
 	defer macAddrChar.Free()
 	ma := &MACAddress{
-		pointer: pointer{
-			ptr: C.newVZMACAddress(macAddrChar.CString()),
-		},
+		pointer: newPointer(C.newVZMACAddress(macAddrChar.CString())),
 	}
 	runtime.SetFinalizer(ma, func(self *MACAddress) {
 		self.Release()
@@ -190,9 +369,7 @@ func NewMACAddress(macAddr net.HardwareAddr) *MACAddress {
 // NewRandomLocallyAdministeredMACAddress creates a valid, random, unicast, locally administered address.
 func NewRandomLocallyAdministeredMACAddress() *MACAddress {
 	ma := &MACAddress{
-		pointer: pointer{
-			ptr: C.newRandomLocallyAdministeredVZMACAddress(),
-		},
+		pointer: newPointer(C.newRandomLocallyAdministeredVZMACAddress()),
 	}
 	runtime.SetFinalizer(ma, func(self *MACAddress) {
 		self.Release()
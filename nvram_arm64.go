@@ -0,0 +1,174 @@
+//go:build darwin && arm64 && vzprivate
+// +build darwin,arm64,vzprivate
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization.h"
+# include "virtualization_arm64.h"
+
+// These methods are not public API. They may be changed or removed in any macOS versions.
+@interface VZMacAuxiliaryStorage (NVRAM)
+- (id)_valueForNVRAMVariableNamed:(NSString *)name error:(NSError **)error;
+- (BOOL)_setValue:(id)value forNVRAMVariableNamed:(NSString *)name error:(NSError **)error;
+- (BOOL)_removeNVRAMVariableNamed:(NSString *)name error:(NSError **)error;
+@end
+
+bool respondsToNVRAMVariablesVZMacAuxiliaryStorage(void *storage)
+{
+	VZMacAuxiliaryStorage *auxiliaryStorage = (VZMacAuxiliaryStorage *)storage;
+	return [auxiliaryStorage respondsToSelector:@selector(_valueForNVRAMVariableNamed:error:)] &&
+		[auxiliaryStorage respondsToSelector:@selector(_setValue:forNVRAMVariableNamed:error:)] &&
+		[auxiliaryStorage respondsToSelector:@selector(_removeNVRAMVariableNamed:error:)];
+}
+
+void *valueForNVRAMVariableNamedVZMacAuxiliaryStorage(void *storage, const char *name, void **error)
+{
+	NSData *ret = nil;
+	@autoreleasepool {
+		NSString *nameNSString = [NSString stringWithUTF8String:name];
+		id value = [(VZMacAuxiliaryStorage *)storage _valueForNVRAMVariableNamed:nameNSString
+			error:(NSError *_Nullable *_Nullable)error];
+		if ([value isKindOfClass:[NSData class]]) {
+			ret = [(NSData *)value copy];
+		} else if ([value isKindOfClass:[NSString class]]) {
+			ret = [[(NSString *)value dataUsingEncoding:NSUTF8StringEncoding] copy];
+		}
+	}
+	return ret;
+}
+
+nbyteslice bytesNSData(void *data)
+{
+	nbyteslice ret = {
+		.ptr = (void *)[(NSData *)data bytes],
+		.len = (int)[(NSData *)data length],
+	};
+	return ret;
+}
+
+bool setValueForNVRAMVariableNamedVZMacAuxiliaryStorage(void *storage, const char *name, void *value, int len, void **error)
+{
+	bool ret;
+	@autoreleasepool {
+		NSString *nameNSString = [NSString stringWithUTF8String:name];
+		NSData *data = [NSData dataWithBytes:value length:(NSUInteger)len];
+		ret = (bool)[(VZMacAuxiliaryStorage *)storage _setValue:data
+			forNVRAMVariableNamed:nameNSString
+			error:(NSError *_Nullable *_Nullable)error];
+	}
+	return ret;
+}
+
+bool removeNVRAMVariableNamedVZMacAuxiliaryStorage(void *storage, const char *name, void **error)
+{
+	bool ret;
+	@autoreleasepool {
+		NSString *nameNSString = [NSString stringWithUTF8String:name];
+		ret = (bool)[(VZMacAuxiliaryStorage *)storage _removeNVRAMVariableNamed:nameNSString
+			error:(NSError *_Nullable *_Nullable)error];
+	}
+	return ret;
+}
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// ErrNVRAMUnsupported is returned when the NVRAM variables can not be accessed on this host.
+var ErrNVRAMUnsupported = errors.New("NVRAM variables are not supported on this host")
+
+// ErrNVRAMVariableNotFound is returned when the NVRAM variable does not exist.
+var ErrNVRAMVariableNotFound = errors.New("NVRAM variable is not found")
+
+// NVRAMVariable returns the value of the NVRAM variable which is named name in the auxiliary storage.
+//
+// e.g. "boot-args" or "csr-active-config".
+//
+// This method uses the private API of Virtualization.framework, so this is available only when
+// built with the "vzprivate" build tag. The virtual machine which uses this auxiliary storage
+// must not be running.
+func (m *MacAuxiliaryStorage) NVRAMVariable(name string) ([]byte, error) {
+	if !bool(C.respondsToNVRAMVariablesVZMacAuxiliaryStorage(m.Ptr())) {
+		return nil, ErrNVRAMUnsupported
+	}
+	cs := charWithGoString(name)
+	defer cs.Free()
+
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	value := newPointer(C.valueForNVRAMVariableNamedVZMacAuxiliaryStorage(m.Ptr(), cs.CString(), &nserrPtr))
+	if err := newNSError(nserrPtr); err != nil {
+		return nil, err
+	}
+	if value.ptr == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNVRAMVariableNotFound, name)
+	}
+	defer value.Release()
+	return goBytes(C.bytesNSData(value.Ptr())), nil
+}
+
+// SetNVRAMVariable sets the value to the NVRAM variable which is named name in the auxiliary storage.
+//
+// e.g. set "boot-args" to "amfi_get_out_of_my_way=1" for the guest which System Integrity Protection is disabled.
+//
+// This method uses the private API of Virtualization.framework, so this is available only when
+// built with the "vzprivate" build tag. The virtual machine which uses this auxiliary storage
+// must not be running. ErrAuxiliaryStorageReadOnly is returned if the storage is opened with WithReadOnlyStorage.
+func (m *MacAuxiliaryStorage) SetNVRAMVariable(name string, value []byte) error {
+	if m.readOnly {
+		return ErrAuxiliaryStorageReadOnly
+	}
+	if !bool(C.respondsToNVRAMVariablesVZMacAuxiliaryStorage(m.Ptr())) {
+		return ErrNVRAMUnsupported
+	}
+	cs := charWithGoString(name)
+	defer cs.Free()
+
+	var ptr unsafe.Pointer
+	if len(value) > 0 {
+		ptr = unsafe.Pointer(&value[0])
+	}
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	ok := C.setValueForNVRAMVariableNamedVZMacAuxiliaryStorage(m.Ptr(), cs.CString(), ptr, C.int(len(value)), &nserrPtr)
+	if err := newNSError(nserrPtr); err != nil {
+		return err
+	}
+	if !bool(ok) {
+		return fmt.Errorf("failed to set NVRAM variable %q", name)
+	}
+	return nil
+}
+
+// RemoveNVRAMVariable removes the NVRAM variable which is named name from the auxiliary storage.
+//
+// This method uses the private API of Virtualization.framework, so this is available only when
+// built with the "vzprivate" build tag.
+// ErrAuxiliaryStorageReadOnly is returned if the storage is opened with WithReadOnlyStorage.
+func (m *MacAuxiliaryStorage) RemoveNVRAMVariable(name string) error {
+	if m.readOnly {
+		return ErrAuxiliaryStorageReadOnly
+	}
+	if !bool(C.respondsToNVRAMVariablesVZMacAuxiliaryStorage(m.Ptr())) {
+		return ErrNVRAMUnsupported
+	}
+	cs := charWithGoString(name)
+	defer cs.Free()
+
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	ok := C.removeNVRAMVariableNamedVZMacAuxiliaryStorage(m.Ptr(), cs.CString(), &nserrPtr)
+	if err := newNSError(nserrPtr); err != nil {
+		return err
+	}
+	if !bool(ok) {
+		return fmt.Errorf("failed to remove NVRAM variable %q", name)
+	}
+	return nil
+}
@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -33,10 +36,42 @@ NSInteger getNSErrorCode(void *err)
 	return (NSInteger)[(NSError *)err code];
 }
 
+const char *getNSErrorLocalizedFailureReason(void *err)
+{
+	NSString *fr = (NSString *)[(NSError *)err localizedFailureReason];
+	return [fr UTF8String];
+}
+
+void *getNSErrorUnderlyingError(void *err)
+{
+	id underlying = [[(NSError *)err userInfo] objectForKey:NSUnderlyingErrorKey];
+	if ([underlying isKindOfClass:[NSError class]]) {
+		return underlying;
+	}
+	return nil;
+}
+
+const char *getNSErrorFilePath(void *err)
+{
+	NSDictionary<NSErrorUserInfoKey, id> *ui = [(NSError *)err userInfo];
+	id path = [ui objectForKey:NSFilePathErrorKey];
+	if ([path isKindOfClass:[NSString class]]) {
+		return [(NSString *)path UTF8String];
+	}
+	id url = [ui objectForKey:NSURLErrorKey];
+	if ([url isKindOfClass:[NSURL class]] && [(NSURL *)url isFileURL]) {
+		return [[(NSURL *)url path] UTF8String];
+	}
+	return NULL;
+}
+
 typedef struct NSErrorFlat {
 	const char *domain;
     const char *localizedDescription;
 	const char *userinfo;
+	const char *localizedFailureReason;
+	const char *filePath;
+	void *underlyingError;
     int code;
 } NSErrorFlat;
 
@@ -46,21 +81,14 @@ NSErrorFlat convertNSError2Flat(void *err)
 	ret.domain = getNSErrorDomain(err);
 	ret.localizedDescription = getNSErrorLocalizedDescription(err);
 	ret.userinfo = getNSErrorUserInfo(err);
+	ret.localizedFailureReason = getNSErrorLocalizedFailureReason(err);
+	ret.filePath = getNSErrorFilePath(err);
+	ret.underlyingError = getNSErrorUnderlyingError(err);
 	ret.code = (int)getNSErrorCode(err);
 
 	return ret;
 }
 
-void *makeNSMutableArray(unsigned long cap)
-{
-	return [[NSMutableArray alloc] initWithCapacity:(NSUInteger)cap];
-}
-
-void addNSMutableArrayVal(void *ary, void *val)
-{
-	[(NSMutableArray *)ary addObject:(NSObject *)val];
-}
-
 void *makeNSMutableDictionary()
 {
 	return [[NSMutableDictionary alloc] init];
@@ -108,6 +136,12 @@ void* getNSArrayItem(void *ptr, int i)
 	return [arr objectAtIndex:i];
 }
 
+void* getNSArrayItemRetained(void *ptr, int i)
+{
+	NSArray *arr = (NSArray *)ptr;
+	return [[arr objectAtIndex:i] retain];
+}
+
 const char *getUUID()
 {
 	const char *ret;
@@ -120,6 +154,7 @@ const char *getUUID()
 */
 import "C"
 import (
+	"errors"
 	"fmt"
 	"runtime"
 	"unsafe"
@@ -158,8 +193,18 @@ type pointer struct {
 	ptr unsafe.Pointer
 }
 
+// newPointer makes pointer which owns the objective-c object ptr.
+//
+// The ownership must be given up by Release (or releaseOnMainThread for AppKit objects). When the package is built
+// with the vzdebug tag, the object is tracked until then to detect leaks.
+func newPointer(ptr unsafe.Pointer) pointer {
+	trackObject(ptr)
+	return pointer{ptr: ptr}
+}
+
 // Release releases allocated resources in objective-c world.
 func (p *pointer) Release() {
+	untrackObject(p.Ptr())
 	C.releaseNSObject(p.Ptr())
 	runtime.KeepAlive(p)
 }
@@ -192,12 +237,35 @@ func (n *NSArray) ToPointerSlice() []unsafe.Pointer {
 	return ret
 }
 
+// toRetainedPointerSlice is same as ToPointerSlice, but the objects are retained, so
+// these can be owned by newPointer and released by the finalizers.
+func (n *NSArray) toRetainedPointerSlice() []unsafe.Pointer {
+	count := int(C.getNSArrayCount(n.Ptr()))
+	ret := make([]unsafe.Pointer, count)
+	for i := 0; i < count; i++ {
+		ret[i] = C.getNSArrayItemRetained(n.Ptr(), C.int(i))
+	}
+	return ret
+}
+
 // NSError indicates NSError.
 type NSError struct {
 	Domain               string
 	Code                 int
 	LocalizedDescription string
 	UserInfo             string
+
+	// LocalizedFailureReason is a string containing the localized explanation of the reason for the error.
+	// This is empty if the reason is not provided.
+	LocalizedFailureReason string
+
+	// FilePath is the path of the file which the error is related to. It is taken from
+	// NSFilePathErrorKey or the file URL of NSURLErrorKey of the user info. This is empty if there is no path.
+	FilePath string
+
+	// Underlying is the error which caused this error. It is taken from NSUnderlyingErrorKey of
+	// the user info. This is nil if there is no underlying error.
+	Underlying *NSError
 	pointer
 }
 
@@ -233,25 +301,55 @@ func newNSError(p unsafe.Pointer) *NSError {
 	}
 	nsError := C.convertNSError2Flat(p)
 	return &NSError{
-		Domain:               (*char)(nsError.domain).String(),
-		Code:                 int((nsError.code)),
-		LocalizedDescription: (*char)(nsError.localizedDescription).String(),
-		UserInfo:             (*char)(nsError.userinfo).String(), // NOTE(codehex): maybe we can convert to map[string]interface{}
+		Domain:                 (*char)(nsError.domain).String(),
+		Code:                   int((nsError.code)),
+		LocalizedDescription:   (*char)(nsError.localizedDescription).String(),
+		UserInfo:               (*char)(nsError.userinfo).String(), // NOTE(codehex): maybe we can convert to map[string]interface{}
+		LocalizedFailureReason: (*char)(nsError.localizedFailureReason).String(),
+		FilePath:               (*char)(nsError.filePath).String(),
+		Underlying:             newNSError(nsError.underlyingError),
 	}
 }
 
-// convertToNSMutableArray converts to NSMutableArray from NSObject slice in Go world.
-func convertToNSMutableArray(s []NSObject) *pointer {
-	ln := len(s)
-	ary := C.makeNSMutableArray(C.ulong(ln))
-	for _, v := range s {
-		C.addNSMutableArrayVal(ary, v.Ptr())
+// objcExceptionErrorDomain is the domain of the errors which are converted from NSException.
+// This is VZ_OBJC_EXCEPTION_ERROR_DOMAIN in virtualization.h.
+const objcExceptionErrorDomain = "VZObjCExceptionErrorDomain"
+
+// ErrObjCException is matched by errors.Is for *NSError which is converted from an NSException
+// raised by the framework, e.g. for an invalid configuration. The exceptions would abort the process
+// if they were not caught. LocalizedDescription of the NSError is the name and the reason of the exception.
+//
+// The exceptions are caught by the functions and the methods which return an error or take a completion
+// handler, e.g. NewVirtualMachineWithError, Validate, Start and the keyboard and pointer events. The setters
+// and the getters of the configurations do not raise for the arguments which are accepted by their Go types,
+// so they do not catch the exceptions.
+var ErrObjCException = errors.New("Objective-C exception")
+
+// Is reports whether n is converted from an NSException if target is ErrObjCException.
+func (n *NSError) Is(target error) bool {
+	return target == ErrObjCException && n != nil && n.Domain == objcExceptionErrorDomain
+}
+
+// Unwrap returns the underlying error.
+func (n *NSError) Unwrap() error {
+	if n == nil || n.Underlying == nil {
+		return nil
 	}
-	p := &pointer{ptr: ary}
-	runtime.SetFinalizer(p, func(self *pointer) {
-		self.Release()
-	})
-	return p
+	return n.Underlying
+}
+
+// pointerArray returns the pointer to the first element of ptrs to pass the objects to the
+// Objective-C side with the count in a single call, where newNSArrayWithObjects converts them
+// to NSArray. Building NSMutableArray from Go needs a cgo call for each element, which is
+// measurable when many configurations are created. Returns nil if ptrs is empty.
+//
+// ptrs must only hold the pointers of Objective-C objects and must be kept alive by the caller
+// during the call.
+func pointerArray(ptrs []unsafe.Pointer) *unsafe.Pointer {
+	if len(ptrs) == 0 {
+		return nil
+	}
+	return &ptrs[0]
 }
 
 func convertToNSMutableDictionary(d map[string]NSObject) *pointer {
@@ -261,11 +359,11 @@ func convertToNSMutableDictionary(d map[string]NSObject) *pointer {
 		C.insertNSMutableDictionary(dict, cs.CString(), value.Ptr())
 		cs.Free()
 	}
-	p := &pointer{ptr: dict}
-	runtime.SetFinalizer(p, func(self *pointer) {
+	p := newPointer(dict)
+	runtime.SetFinalizer(&p, func(self *pointer) {
 		self.Release()
 	})
-	return p
+	return &p
 }
 
 func getUUID() *char {
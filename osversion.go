@@ -0,0 +1,76 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrUnsupportedOSVersion is returned when calling a method which is only supported in the latest macOS version.
+var ErrUnsupportedOSVersion = errors.New("unsupported macOS version")
+
+// macOSAvailable returns ErrUnsupportedOSVersion if the running macOS version is older than
+// the specified version, e.g. macOSAvailable(13, 0) or macOSAvailable(12, 3).
+func macOSAvailable(major, minor int) error {
+	if !macOSMajorMinorVersion().atLeast(major, minor) {
+		return ErrUnsupportedOSVersion
+	}
+	return nil
+}
+
+// osVersion is the "<major>.<minor>" version of macOS.
+type osVersion struct {
+	major, minor int
+}
+
+// atLeast reports whether v is the same or newer than major.minor.
+func (v osVersion) atLeast(major, minor int) bool {
+	if v.major != major {
+		return v.major > major
+	}
+	return v.minor >= minor
+}
+
+var (
+	majorMinorVersion     osVersion
+	majorMinorVersionOnce sync.Once
+)
+
+// macOSMajorMinorVersion returns the running macOS version.
+// Returns the zero version if the version could not be fetched.
+func macOSMajorMinorVersion() osVersion {
+	majorMinorVersionOnce.Do(func() {
+		osver, err := unix.Sysctl("kern.osproductversion")
+		if err != nil {
+			return
+		}
+		majorMinorVersion = parseMajorMinorVersion(osver)
+	})
+	return majorMinorVersion
+}
+
+// parseMajorMinorVersion parses the product version like "12.6.1" to 12 and 6.
+// The minor version is compared as an integer, so "12.10" is newer than "12.9".
+// Returns the zero version if the version could not be parsed.
+func parseMajorMinorVersion(version string) osVersion {
+	parts := strings.SplitN(version, ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return osVersion{}
+	}
+	v := osVersion{major: major}
+	if len(parts) > 1 {
+		minor, err := strconv.Atoi(parts[1])
+		if err != nil || minor < 0 {
+			return osVersion{}
+		}
+		v.minor = minor
+	}
+	return v
+}
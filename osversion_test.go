@@ -0,0 +1,47 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import "testing"
+
+func TestParseMajorMinorVersion(t *testing.T) {
+	cases := []struct {
+		version string
+		want    osVersion
+	}{
+		{"13", osVersion{13, 0}},
+		{"12.6", osVersion{12, 6}},
+		{"12.6.1", osVersion{12, 6}},
+		{"12.10", osVersion{12, 10}},
+		{"14.2.1", osVersion{14, 2}},
+		{"", osVersion{}},
+		{"x.1", osVersion{}},
+		{"12.x", osVersion{}},
+	}
+	for _, c := range cases {
+		if got := parseMajorMinorVersion(c.version); got != c.want {
+			t.Errorf("parseMajorMinorVersion(%q) = %v, want %v", c.version, got, c.want)
+		}
+	}
+}
+
+func TestOSVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		v            osVersion
+		major, minor int
+		want         bool
+	}{
+		{osVersion{12, 10}, 12, 3, true},
+		{osVersion{12, 3}, 12, 3, true},
+		{osVersion{12, 2}, 12, 3, false},
+		{osVersion{13, 0}, 12, 3, true},
+		{osVersion{12, 6}, 13, 0, false},
+		{osVersion{}, 11, 0, false},
+	}
+	for _, c := range cases {
+		if got := c.v.atLeast(c.major, c.minor); got != c.want {
+			t.Errorf("%v.atLeast(%d, %d) = %v, want %v", c.v, c.major, c.minor, got, c.want)
+		}
+	}
+}
@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -6,7 +9,10 @@ package vz
 # include "virtualization.h"
 */
 import "C"
-import "runtime"
+import (
+	"errors"
+	"runtime"
+)
 
 // PlatformConfiguration is an interface for a platform configuration.
 type PlatformConfiguration interface {
@@ -31,12 +37,31 @@ var _ PlatformConfiguration = (*GenericPlatformConfiguration)(nil)
 // NewGenericPlatformConfiguration creates a new generic platform configuration.
 func NewGenericPlatformConfiguration() *GenericPlatformConfiguration {
 	platformConfig := &GenericPlatformConfiguration{
-		pointer: pointer{
-			ptr: C.newVZGenericPlatformConfiguration(),
-		},
+		pointer: newPointer(C.newVZGenericPlatformConfiguration()),
 	}
 	runtime.SetFinalizer(platformConfig, func(self *GenericPlatformConfiguration) {
 		self.Release()
 	})
 	return platformConfig
 }
+
+// ErrSecureBootUnsupported is returned when the secure boot is required but it is not supported.
+var ErrSecureBootUnsupported = errors.New("secure boot is not supported by Virtualization.framework")
+
+// SecureBootSupported reports whether the secure boot of the guest can be configured.
+//
+// Virtualization.framework does not provide any API to configure or require the verified boot
+// of the guest, neither for LinuxBootLoader nor for MacOSBootLoader, so this always returns false
+// on the supported macOS versions. Use RequireSecureBoot to fail closed when the verified boot is
+// a requirement, so the caller notices once the framework supports it.
+func SecureBootSupported() bool {
+	return false
+}
+
+// RequireSecureBoot returns ErrSecureBootUnsupported if the secure boot is not supported.
+func RequireSecureBoot() error {
+	if !SecureBootSupported() {
+		return ErrSecureBootUnsupported
+	}
+	return nil
+}
@@ -69,9 +69,7 @@ func WithAuxiliaryStorage(m *MacAuxiliaryStorage) MacPlatformConfigurationOption
 // NewMacPlatformConfiguration creates a new MacPlatformConfiguration. see also it's document.
 func NewMacPlatformConfiguration(opts ...MacPlatformConfigurationOption) *MacPlatformConfiguration {
 	platformConfig := &MacPlatformConfiguration{
-		pointer: pointer{
-			ptr: C.newVZMacPlatformConfiguration(),
-		},
+		pointer: newPointer(C.newVZMacPlatformConfiguration()),
 	}
 	for _, optFunc := range opts {
 		optFunc(platformConfig)
@@ -83,12 +81,37 @@ func NewMacPlatformConfiguration(opts ...MacPlatformConfigurationOption) *MacPla
 }
 
 // HardwareModel returns the Mac hardware model.
+// This returns nil if WithHardwareModel is not specified.
 func (m *MacPlatformConfiguration) HardwareModel() *MacHardwareModel { return m.hardwareModel }
 
 // MachineIdentifier returns the Mac machine identifier.
+//
+// If WithMachineIdentifier is not specified, this returns the new unique identifier which
+// Virtualization.framework assigns by default. Store its DataRepresentation to boot the same
+// virtual machine again.
 func (m *MacPlatformConfiguration) MachineIdentifier() *MacMachineIdentifier {
+	if m.machineIdentifier == nil {
+		m.machineIdentifier = newMacMachineIdentifier(C.getMachineIdentifierVZMacPlatformConfiguration(m.Ptr()))
+	}
 	return m.machineIdentifier
 }
 
-// AuxiliaryStorage returns the Mac auxiliary storage.
+// AuxiliaryStorage returns the Mac auxiliary storage. Its Path is the location of the storage.
+// This returns nil if WithAuxiliaryStorage is not specified.
 func (m *MacPlatformConfiguration) AuxiliaryStorage() *MacAuxiliaryStorage { return m.auxiliaryStorage }
+
+func (m *MacPlatformConfiguration) diskFiles() []diskFile {
+	if m.auxiliaryStorage == nil {
+		return nil
+	}
+	return []diskFile{{path: m.auxiliaryStorage.Path()}}
+}
+
+// identity returns the data representations which identify the macOS guest.
+// This is used by SavedStateInfo.
+func (m *MacPlatformConfiguration) identity() (hardwareModel, machineIdentifier []byte) {
+	if m.hardwareModel != nil {
+		hardwareModel = m.hardwareModel.DataRepresentation()
+	}
+	return hardwareModel, m.MachineIdentifier().DataRepresentation()
+}
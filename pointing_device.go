@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -32,9 +35,7 @@ var _ PointingDeviceConfiguration = (*USBScreenCoordinatePointingDeviceConfigura
 // NewUSBScreenCoordinatePointingDeviceConfiguration creates a new USBScreenCoordinatePointingDeviceConfiguration.
 func NewUSBScreenCoordinatePointingDeviceConfiguration() *USBScreenCoordinatePointingDeviceConfiguration {
 	config := &USBScreenCoordinatePointingDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZUSBScreenCoordinatePointingDeviceConfiguration(),
-		},
+		pointer: newPointer(C.newVZUSBScreenCoordinatePointingDeviceConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *USBScreenCoordinatePointingDeviceConfiguration) {
 		self.Release()
@@ -0,0 +1,201 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ SerialPortAttachment = (*PTYSerialPortAttachment)(nil)
+
+// PTYSerialPortAttachment is a serial port attachment which is backed by a pseudo terminal.
+//
+// The slave side of the pseudo terminal is attached to the serial port of the virtual machine, and
+// the master side is exposed by Master. Data written to the master goes to the guest and data sent
+// from the guest can be read from the master. This is useful to provide an interactive terminal,
+// e.g. by connecting the master to os.Stdin and os.Stdout, or by running `screen` with Name.
+//
+// Note that Virtualization.framework does not provide any way to notify the guest of the terminal
+// size, neither for the serial port nor for the virtio console device. Use WatchWindowSize to track
+// the size of the host terminal and propagate it by another channel, e.g. by running
+// `stty rows <rows> cols <cols>` in the guest.
+type PTYSerialPortAttachment struct {
+	*FileHandleSerialPortAttachment
+
+	master *os.File
+	slave  *os.File
+	name   string
+}
+
+// NewPTYSerialPortAttachment allocates a new pseudo terminal and creates a serial port attachment
+// for the slave side of it.
+//
+// The slave side is set to raw mode, so the data is passed through without any line discipline.
+// Close must be called after the virtual machine is stopped to release the pseudo terminal.
+func NewPTYSerialPortAttachment() (_ *PTYSerialPortAttachment, retErr error) {
+	master, name, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			master.Close()
+		}
+	}()
+	slave, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			slave.Close()
+		}
+	}()
+	if err := makeRaw(int(slave.Fd())); err != nil {
+		return nil, fmt.Errorf("failed to set raw mode to %s: %w", name, err)
+	}
+	return &PTYSerialPortAttachment{
+		FileHandleSerialPortAttachment: NewFileHandleSerialPortAttachment(slave, slave),
+		master:                         master,
+		slave:                          slave,
+		name:                           name,
+	}, nil
+}
+
+// Master returns the master side of the pseudo terminal.
+func (a *PTYSerialPortAttachment) Master() *os.File { return a.master }
+
+// Name returns the path of the slave side of the pseudo terminal. e.g. "/dev/ttys003"
+func (a *PTYSerialPortAttachment) Name() string { return a.name }
+
+// Close closes the both sides of the pseudo terminal.
+func (a *PTYSerialPortAttachment) Close() error {
+	err := a.master.Close()
+	if serr := a.slave.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// openPTY opens a new pseudo terminal master and returns it with the path of the slave.
+// This is same as posix_openpt(3), grantpt(3), unlockpt(3) and ptsname(3).
+func openPTY() (*os.File, string, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: err}
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	if err := unix.IoctlSetInt(fd, unix.TIOCPTYGRANT, 0); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("grantpt: %w", err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.TIOCPTYUNLK, 0); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("unlockpt: %w", err)
+	}
+	// see: TIOCPTYGNAME in <sys/ttycom.h>
+	var buf [128]byte
+	if _, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(unix.TIOCPTYGNAME),
+		uintptr(unsafe.Pointer(&buf[0])),
+	); errno != 0 {
+		master.Close()
+		return nil, "", fmt.Errorf("ptsname: %w", errno)
+	}
+	if i := bytes.IndexByte(buf[:], 0); i >= 0 {
+		return master, string(buf[:i]), nil
+	}
+	return master, string(buf[:]), nil
+}
+
+// makeRaw sets the terminal to raw mode. This is same as cfmakeraw(3).
+func makeRaw(fd int) error {
+	termios, err := unix.IoctlGetTermios(fd, unix.TIOCGETA)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TIOCSETA, termios)
+}
+
+// WindowSize is the size of a terminal.
+type WindowSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// GetWindowSize returns the size of the terminal f.
+func GetWindowSize(f *os.File) (WindowSize, error) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return WindowSize{}, err
+	}
+	return WindowSize{Rows: ws.Row, Cols: ws.Col}, nil
+}
+
+// WatchWindowSize watches the size of the terminal f by SIGWINCH.
+//
+// The returned channel receives the current size first, and then the new size every time
+// the size is changed. If the receiver is slow, only the latest size is kept.
+// Call the returned function to stop watching, then the channel is closed.
+func WatchWindowSize(f *os.File) (<-chan WindowSize, func()) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+	sizeCh := make(chan WindowSize, 1)
+	done := make(chan struct{})
+
+	send := func() {
+		ws, err := GetWindowSize(f)
+		if err != nil {
+			return
+		}
+		// drop the stale size.
+		select {
+		case <-sizeCh:
+		default:
+		}
+		sizeCh <- ws
+	}
+	send()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-sigCh:
+				send()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return sizeCh, func() {
+		once.Do(func() {
+			signal.Stop(sigCh)
+			close(done)
+			wg.Wait()
+			close(sizeCh)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCPUCountUnchangeable is returned when the CPU count of the running virtual machine is changed.
+// Virtualization.framework does not support CPU hotplug nor any hint to offline CPUs.
+var ErrCPUCountUnchangeable = errors.New("CPU count can not be changed while the virtual machine is running")
+
+// ErrNoMemoryBalloonDevice is returned when the memory size is changed without a memory balloon device.
+var ErrNoMemoryBalloonDevice = errors.New("memory balloon device is not configured")
+
+// ResourceError is an error which is returned by SetResources.
+// Each field is the reason why the resource could not be changed, or nil if it was applied.
+type ResourceError struct {
+	CPU    error
+	Memory error
+}
+
+// Error implements error interface.
+func (e *ResourceError) Error() string {
+	var msgs []string
+	if e.CPU != nil {
+		msgs = append(msgs, "cpu: "+e.CPU.Error())
+	}
+	if e.Memory != nil {
+		msgs = append(msgs, "memory: "+e.Memory.Error())
+	}
+	return "failed to set resources: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the errors matches target.
+func (e *ResourceError) Is(target error) bool {
+	return errors.Is(e.CPU, target) || errors.Is(e.Memory, target)
+}
+
+// SetResources changes the resources which are available to the running guest.
+//
+// Zero means that the resource is not changed. The memory size is changed by the target memory size
+// of the memory balloon device, so the guest must have the driver of the balloon device, and the memory
+// size can not exceed the size in the configuration. The CPU count can not be changed at all, so only
+// the configured CPU count is accepted.
+//
+// SetResources applies what is possible. If some resources could not be changed, *ResourceError
+// is returned which reports the reason of each resource:
+//
+//	err := vm.SetResources(0, 2*1024*1024*1024)
+//	if errors.Is(err, vz.ErrNoMemoryBalloonDevice) {
+//		// the virtual machine must be restarted with a balloon device.
+//	}
+func (v *VirtualMachine) SetResources(cpuCount uint, memorySize uint64) error {
+	var resErr ResourceError
+	if cpuCount != 0 && cpuCount != v.cpuCount {
+		resErr.CPU = ErrCPUCountUnchangeable
+	}
+	if memorySize != 0 {
+		resErr.Memory = v.setMemorySize(memorySize)
+	}
+	if resErr.CPU != nil || resErr.Memory != nil {
+		return &resErr
+	}
+	return nil
+}
+
+func (v *VirtualMachine) setMemorySize(memorySize uint64) error {
+	if memorySize%(1024*1024) != 0 {
+		return fmt.Errorf("memory size %d is not a multiple of 1 MiB", memorySize)
+	}
+	if memorySize > v.memorySize {
+		return fmt.Errorf("memory size %d exceeds the configured memory size %d", memorySize, v.memorySize)
+	}
+	if min := VirtualMachineConfigurationMinimumAllowedMemorySize(); memorySize < min {
+		return fmt.Errorf("memory size %d is less than the minimum allowed memory size %d", memorySize, min)
+	}
+	if v.State() != VirtualMachineStateRunning {
+		return ErrNotRunning
+	}
+	devices := v.MemoryBalloonDevices()
+	if len(devices) == 0 {
+		return ErrNoMemoryBalloonDevice
+	}
+	devices[0].SetTargetVirtualMachineMemorySize(memorySize)
+	return nil
+}
@@ -0,0 +1,222 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization.h"
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/cgo"
+	"time"
+	"unsafe"
+)
+
+// ValidateSaveRestoreSupport validates that a virtual machine with the configuration
+// can be saved and restored.
+//
+// This is only supported on macOS 14 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (v *VirtualMachineConfiguration) ValidateSaveRestoreSupport() error {
+	if err := macOSAvailable(14, 0); err != nil {
+		return err
+	}
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	C.validateSaveRestoreSupportVZVirtualMachineConfiguration(v.Ptr(), &nserrPtr)
+	return newNSError(nserrPtr)
+}
+
+// SaveMachineStateToPath saves the state of the virtual machine to the file at path.
+//
+// The virtual machine must be in the Paused state. The saved state can be restored
+// with RestoreMachineStateFromPath by a virtual machine which has the same configuration.
+// fn is called after the state has been saved or on error.
+// If the file at path exists and is being restored by another virtual machine, an error which
+// wraps ErrDiskInUse is returned without calling fn.
+// Use Snapshot to pause, save and resume the virtual machine in the right order.
+//
+// This is only supported on macOS 14 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions without calling fn.
+func (v *VirtualMachine) SaveMachineStateToPath(path string, fn func(error)) error {
+	if err := macOSAvailable(14, 0); err != nil {
+		return err
+	}
+	lock, err := lockSavedState(path, false)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	cs := charWithGoString(path)
+	defer cs.Free()
+	h, wait := makeHandler(v.recordErrorHandler("saveMachineState", fn))
+	handler := cgo.NewHandle(h)
+	defer handler.Delete()
+	C.saveMachineStateToPath(v.Ptr(), v.dispatchQueue, cs.CString(), unsafe.Pointer(&handler))
+	wait()
+	return nil
+}
+
+// RestoreMachineStateFromPath restores the state of the virtual machine from the file at path
+// which is written by SaveMachineStateToPath or Snapshot.
+//
+// The virtual machine must be in the Stopped state, and it is in the Paused state after
+// the state has been restored. Call Resume to continue running the guest.
+// fn is called after the state has been restored or on error.
+//
+// The saved state file is locked while it is restored, and the disks are locked as same as Start.
+// If the saved state file is being written by another virtual machine, an error which wraps
+// ErrDiskInUse is returned without calling fn. If the disks are in use, fn is called with it.
+//
+// If the state has SavedStateInfo which is written by Snapshot, it is compared with the
+// configuration which the virtual machine is created with first, and *IncompatibleSavedStateError is returned
+// without calling fn if they are different. See CheckSavedStateCompatibility.
+//
+// This is only supported on macOS 14 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions without calling fn.
+func (v *VirtualMachine) RestoreMachineStateFromPath(path string, fn func(error)) error {
+	if err := macOSAvailable(14, 0); err != nil {
+		return err
+	}
+	if v.savedStateInfo != nil {
+		if err := checkSavedStateCompatibility(path, v.savedStateInfo); err != nil {
+			return err
+		}
+	}
+	lock, err := lockSavedState(path, true)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	restore, ok := v.diskLockedHandler("restoreMachineState", fn)
+	if !ok {
+		return nil
+	}
+	cs := charWithGoString(path)
+	defer cs.Free()
+	h, wait := makeHandler(restore)
+	handler := cgo.NewHandle(h)
+	defer handler.Delete()
+	C.restoreMachineStateFromPath(v.Ptr(), v.dispatchQueue, cs.CString(), unsafe.Pointer(&handler))
+	wait()
+	return nil
+}
+
+// Snapshot saves the state of the running or paused virtual machine to the file at path.
+//
+// The operations are done in this order:
+//
+//  1. validate that the configuration supports save and restore
+//  2. pause the virtual machine if it is running
+//  3. save the state to a temporary file in the same directory as path
+//  4. rename the temporary file to path, and write SavedStateInfo to SavedStateInfoPath(path)
+//  5. resume the virtual machine if it was paused by Snapshot
+//
+// SavedStateInfo is not written for the virtual machine which is adopted by AdoptVirtualMachine,
+// because its configuration is unknown.
+//
+// If any step fails, the temporary files are removed and the virtual machine is resumed if it
+// was paused by Snapshot, so path is either left untouched or replaced by a complete state.
+// ctx is checked before pausing and before saving; the save in progress is not interrupted.
+//
+// This is only supported on macOS 14 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (v *VirtualMachine) Snapshot(ctx context.Context, path string) (retErr error) {
+	if err := macOSAvailable(14, 0); err != nil {
+		return err
+	}
+	if v.config != nil {
+		if err := v.config.ValidateSaveRestoreSupport(); err != nil {
+			return fmt.Errorf("configuration does not support save and restore: %w", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch state := v.State(); state {
+	case VirtualMachineStatePaused:
+	case VirtualMachineStateRunning:
+		var pauseErr error
+		v.Pause(func(err error) {
+			pauseErr = err
+		})
+		if pauseErr != nil {
+			return fmt.Errorf("failed to pause virtual machine: %w", pauseErr)
+		}
+		defer func() {
+			var resumeErr error
+			v.Resume(func(err error) {
+				resumeErr = err
+			})
+			if resumeErr == nil {
+				return
+			}
+			if retErr == nil {
+				retErr = fmt.Errorf("failed to resume virtual machine: %w", resumeErr)
+				return
+			}
+			v.logger().Error("failed to resume virtual machine after snapshot error", "id", v.id, "err", resumeErr)
+		}()
+	default:
+		return fmt.Errorf("virtual machine must be running or paused to snapshot: %s", state)
+	}
+
+	// Virtualization.framework creates the file by itself, so only the unique name is reserved here.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	if err := os.Remove(tmpPath); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(tmpPath)
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var saveErr error
+	if err := v.SaveMachineStateToPath(tmpPath, func(err error) {
+		saveErr = err
+	}); err != nil {
+		return err
+	}
+	if saveErr != nil {
+		return fmt.Errorf("failed to save virtual machine state: %w", saveErr)
+	}
+
+	if v.savedStateInfo == nil {
+		// the configuration of the adopted virtual machine is unknown, so the info of the old
+		// saved state must not be left.
+		return renameSavedState(tmpPath, "", path)
+	}
+	info := *v.savedStateInfo
+	info.SavedAt = time.Now()
+	tmpInfoPath, err := writeSavedStateInfo(path, &info)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.Remove(tmpInfoPath)
+		}
+	}()
+	return renameSavedState(tmpPath, tmpInfoPath, path)
+}
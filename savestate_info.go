@@ -0,0 +1,266 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SavedStateInfoVersion is the version of SavedStateInfo which is written by this package.
+const SavedStateInfoVersion = 1
+
+// ErrIncompatibleSavedState is wrapped by the errors which report that the saved state can not be
+// restored by the configuration. Use errors.As with *IncompatibleSavedStateError for the details.
+var ErrIncompatibleSavedState = errors.New("saved state is incompatible with the configuration")
+
+// SavedStateInfo is the fingerprint of the configuration which the saved state requires.
+//
+// The saved state file of Virtualization.framework is opaque, and restoring it with a different
+// configuration fails with an error which does not tell the difference. Snapshot writes this info
+// to the file at SavedStateInfoPath, so the compatibility can be checked before restoring.
+type SavedStateInfo struct {
+	// Version is the version of this format.
+	Version int `json:"version"`
+
+	// SavedAt is the time when the state was saved.
+	SavedAt time.Time `json:"savedAt"`
+
+	// CPUCount is the number of the virtual CPUs.
+	CPUCount uint `json:"cpuCount"`
+
+	// MemorySize is the memory size in bytes.
+	MemorySize uint64 `json:"memorySize"`
+
+	// Devices is the list of the kinds and the types of the devices in the order of the configuration.
+	// e.g. "storage:*vz.VirtioBlockDeviceConfiguration"
+	Devices []string `json:"devices"`
+
+	// HardwareModel is the data representation of the hardware model of the macOS guest.
+	// This is empty for other guests.
+	HardwareModel []byte `json:"hardwareModel,omitempty"`
+
+	// ConfigurationHash is the SHA-256 hash of the fields above (except SavedAt) and the
+	// machine identifier of the macOS guest, in hex.
+	ConfigurationHash string `json:"configurationHash"`
+}
+
+// IncompatibleSavedStateError describes the difference between the saved state and the configuration.
+type IncompatibleSavedStateError struct {
+	// Field is the name of the field of SavedStateInfo which is different.
+	Field string
+
+	// Saved is the value which the saved state requires.
+	Saved string
+
+	// Configured is the value of the configuration.
+	Configured string
+}
+
+// Error implements error interface.
+func (e *IncompatibleSavedStateError) Error() string {
+	return fmt.Sprintf("%v: %s is %s, but saved state requires %s", ErrIncompatibleSavedState, e.Field, e.Configured, e.Saved)
+}
+
+// Is reports whether target is ErrIncompatibleSavedState.
+func (e *IncompatibleSavedStateError) Is(target error) bool {
+	return target == ErrIncompatibleSavedState
+}
+
+// SavedStateInfoPath returns the path of the info of the saved state at path.
+func SavedStateInfoPath(path string) string {
+	return path + ".json"
+}
+
+// ReadSavedStateInfo reads the info of the saved state at path which is written by Snapshot.
+// The error satisfies errors.Is(err, os.ErrNotExist) if the state has no info.
+func ReadSavedStateInfo(path string) (*SavedStateInfo, error) {
+	infoPath := SavedStateInfoPath(path)
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return nil, err
+	}
+	var info SavedStateInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", infoPath, err)
+	}
+	if info.Version > SavedStateInfoVersion {
+		return nil, fmt.Errorf("unsupported saved state info version %d", info.Version)
+	}
+	return &info, nil
+}
+
+// SavedStateInfo returns the fingerprint of the configuration which is compared with
+// the one of the saved state.
+func (v *VirtualMachineConfiguration) SavedStateInfo() *SavedStateInfo {
+	info := &SavedStateInfo{
+		Version:    SavedStateInfoVersion,
+		CPUCount:   v.cpuCount,
+		MemorySize: v.memorySize,
+	}
+	add := func(kind string, device interface{}) {
+		info.Devices = append(info.Devices, fmt.Sprintf("%s:%T", kind, device))
+	}
+	for _, d := range v.entropyDevices {
+		add("entropy", d)
+	}
+	for _, d := range v.memoryBalloonDevices {
+		add("memoryBalloon", d)
+	}
+	for _, d := range v.networkDevices {
+		add("network", d)
+	}
+	for _, d := range v.serialPorts {
+		add("serial", d)
+	}
+	for _, d := range v.socketDevices {
+		add("socket", d)
+	}
+	for _, d := range v.storageDevices {
+		add("storage", d)
+	}
+	for _, d := range v.directorySharingDevices {
+		add("directorySharing", d)
+	}
+	for _, d := range v.graphicsDevices {
+		add("graphics", d)
+	}
+	for _, d := range v.pointingDevices {
+		add("pointing", d)
+	}
+	for _, d := range v.keyboards {
+		add("keyboard", d)
+	}
+	for _, d := range v.audioDevices {
+		add("audio", d)
+	}
+	if v.platform != nil {
+		add("platform", v.platform)
+	}
+
+	var machineIdentifier []byte
+	if p, ok := v.platform.(interface {
+		identity() (hardwareModel, machineIdentifier []byte)
+	}); ok {
+		info.HardwareModel, machineIdentifier = p.identity()
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "cpu=%d\nmemory=%d\n", info.CPUCount, info.MemorySize)
+	for _, d := range info.Devices {
+		fmt.Fprintf(h, "device=%s\n", d)
+	}
+	fmt.Fprintf(h, "hardwareModel=%x\nmachineIdentifier=%x\n", info.HardwareModel, machineIdentifier)
+	info.ConfigurationHash = hex.EncodeToString(h.Sum(nil))
+	return info
+}
+
+// CheckSavedStateCompatibility checks that the saved state at path can be restored
+// by a virtual machine with the configuration.
+//
+// The returned error is *IncompatibleSavedStateError if they are different. The saved
+// state which has no info is not checked, then nil is returned.
+func (v *VirtualMachineConfiguration) CheckSavedStateCompatibility(path string) error {
+	return checkSavedStateCompatibility(path, v.SavedStateInfo())
+}
+
+// checkSavedStateCompatibility compares the info of the saved state at path with configured.
+func checkSavedStateCompatibility(path string, configured *SavedStateInfo) error {
+	saved, err := ReadSavedStateInfo(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return saved.compare(configured)
+}
+
+func (s *SavedStateInfo) compare(c *SavedStateInfo) error {
+	if s.CPUCount != c.CPUCount {
+		return &IncompatibleSavedStateError{
+			Field:      "CPUCount",
+			Saved:      fmt.Sprint(s.CPUCount),
+			Configured: fmt.Sprint(c.CPUCount),
+		}
+	}
+	if s.MemorySize != c.MemorySize {
+		return &IncompatibleSavedStateError{
+			Field:      "MemorySize",
+			Saved:      fmt.Sprint(s.MemorySize),
+			Configured: fmt.Sprint(c.MemorySize),
+		}
+	}
+	if fmt.Sprint(s.Devices) != fmt.Sprint(c.Devices) {
+		return &IncompatibleSavedStateError{
+			Field:      "Devices",
+			Saved:      fmt.Sprint(s.Devices),
+			Configured: fmt.Sprint(c.Devices),
+		}
+	}
+	if string(s.HardwareModel) != string(c.HardwareModel) {
+		return &IncompatibleSavedStateError{
+			Field:      "HardwareModel",
+			Saved:      fmt.Sprintf("%x", sha256.Sum256(s.HardwareModel)),
+			Configured: fmt.Sprintf("%x", sha256.Sum256(c.HardwareModel)),
+		}
+	}
+	if s.ConfigurationHash != c.ConfigurationHash {
+		// the only field which is not stored is the machine identifier.
+		return &IncompatibleSavedStateError{
+			Field:      "ConfigurationHash (machine identifier)",
+			Saved:      s.ConfigurationHash,
+			Configured: c.ConfigurationHash,
+		}
+	}
+	return nil
+}
+
+// writeSavedStateInfo writes info to a temporary file in the directory of the saved state at
+// path, and returns the path of the temporary file which should be renamed to SavedStateInfoPath.
+func writeSavedStateInfo(path string, info *SavedStateInfo) (string, error) {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(SavedStateInfoPath(path))+".*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// renameSavedState renames the temporary saved state and its info to path and SavedStateInfoPath.
+// The info of the old saved state is removed first and the new info is renamed last, so the
+// saved state at path is never paired with the info of the other saved state. It may have no
+// info in between, or if the renaming fails, which is same as the saved state of an unknown
+// configuration. If tmpInfoPath is empty, the saved state is left without the info.
+func renameSavedState(tmpPath, tmpInfoPath, path string) error {
+	infoPath := SavedStateInfoPath(path)
+	if err := os.Remove(infoPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if tmpInfoPath == "" {
+		return nil
+	}
+	return os.Rename(tmpInfoPath, infoPath)
+}
@@ -0,0 +1,109 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRenameSavedState(t *testing.T) {
+	t.Run("rename", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "state.vzvmsave")
+		writeTestFile(t, path, "old state")
+		writeTestFile(t, SavedStateInfoPath(path), "old info")
+		tmpPath, tmpInfoPath := filepath.Join(dir, ".state.tmp"), filepath.Join(dir, ".info.tmp")
+		writeTestFile(t, tmpPath, "new state")
+		writeTestFile(t, tmpInfoPath, "new info")
+
+		if err := renameSavedState(tmpPath, tmpInfoPath, path); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, path); got != "new state" {
+			t.Fatalf("want new state but got %q", got)
+		}
+		if got := readTestFile(t, SavedStateInfoPath(path)); got != "new info" {
+			t.Fatalf("want new info but got %q", got)
+		}
+	})
+
+	t.Run("failed to rename state", func(t *testing.T) {
+		dir := t.TempDir()
+		// a non-empty directory can not be replaced by rename(2).
+		path := filepath.Join(dir, "state.vzvmsave")
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Join(path, "old"), "old state")
+		writeTestFile(t, SavedStateInfoPath(path), "old info")
+		tmpPath, tmpInfoPath := filepath.Join(dir, ".state.tmp"), filepath.Join(dir, ".info.tmp")
+		writeTestFile(t, tmpPath, "new state")
+		writeTestFile(t, tmpInfoPath, "new info")
+
+		if err := renameSavedState(tmpPath, tmpInfoPath, path); err == nil {
+			t.Fatal("want error")
+		}
+		if _, err := os.Stat(SavedStateInfoPath(path)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("want the stale info to be removed but got %v", err)
+		}
+	})
+
+	t.Run("failed to rename info", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "state.vzvmsave")
+		writeTestFile(t, path, "old state")
+		writeTestFile(t, SavedStateInfoPath(path), "old info")
+		tmpPath := filepath.Join(dir, ".state.tmp")
+		writeTestFile(t, tmpPath, "new state")
+
+		// the temporary info does not exist.
+		if err := renameSavedState(tmpPath, filepath.Join(dir, ".info.tmp"), path); err == nil {
+			t.Fatal("want error")
+		}
+		if got := readTestFile(t, path); got != "new state" {
+			t.Fatalf("want new state but got %q", got)
+		}
+		if _, err := os.Stat(SavedStateInfoPath(path)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("want the stale info to be removed but got %v", err)
+		}
+	})
+
+	t.Run("without info", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "state.vzvmsave")
+		writeTestFile(t, path, "old state")
+		writeTestFile(t, SavedStateInfoPath(path), "old info")
+		tmpPath := filepath.Join(dir, ".state.tmp")
+		writeTestFile(t, tmpPath, "new state")
+
+		if err := renameSavedState(tmpPath, "", path); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, path); got != "new state" {
+			t.Fatalf("want new state but got %q", got)
+		}
+		if _, err := os.Stat(SavedStateInfoPath(path)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("want the stale info to be removed but got %v", err)
+		}
+	})
+}
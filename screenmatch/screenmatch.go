@@ -0,0 +1,250 @@
+// Package screenmatch detects the known screens of the guest, e.g. Setup Assistant of macOS, by
+// comparing the framebuffer with reference screenshots.
+//
+// Virtualization.framework has no option for the language or the keyboard layout of the first boot
+// of the macOS guests, so an automated install always stops at Setup Assistant. The tools which
+// build the images can take a reference screenshot of Setup Assistant once, and detect it in the
+// later installs to report the stall or to drive it by (*vz.VirtualMachine).TypeText and KeyPress.
+//
+// This package does not ship the reference screenshots, because Setup Assistant looks different
+// for each version of macOS and each size of the display. Record one from the guest which shows
+// Setup Assistant, e.g. after the first install while the window of StartGraphicApplication shows it:
+//
+//	ref, err := screenmatch.Record(ctx, vm, screenmatch.SetupAssistant, "setup-assistant.png")
+//
+// Then load it in the later installs of the same version of macOS with the same display:
+//
+//	ref, err := screenmatch.Load(screenmatch.SetupAssistant, "setup-assistant.png")
+//	...
+//	screen, err := screenmatch.Wait(ctx, vm, 5*time.Second, ref)
+//	if err == nil {
+//		w.Report(bootwatch.StageUserspace, screen.Name) // the install is finished.
+//	}
+//
+// The screens are compared by their small grayscale fingerprints, so the size and the scale
+// of the display do not matter as long as the aspect ratio is the same, and the small changes,
+// e.g. the clock or the cursor, are tolerated.
+package screenmatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"time"
+)
+
+// SetupAssistant is the conventional name of the screen of Setup Assistant of macOS.
+// See the package documentation to record the reference screenshot of it.
+const SetupAssistant = "setup-assistant"
+
+// DefaultThreshold is the similarity at which a screen matches if Screen.Threshold is zero.
+const DefaultThreshold = 0.95
+
+// The size of the fingerprints. 16:10 is the aspect ratio of the displays of most Macs.
+const (
+	fingerprintWidth  = 64
+	fingerprintHeight = 40
+)
+
+// ErrUnavailable is returned by Wait when the screen can not be captured before ctx is done,
+// e.g. because the virtual machine has no graphics device.
+var ErrUnavailable = errors.New("screenmatch: screen is unavailable")
+
+// Fingerprint is a reduced grayscale copy of a screen.
+type Fingerprint struct {
+	pix [fingerprintWidth * fingerprintHeight]uint8
+}
+
+// NewFingerprint returns the fingerprint of img. Each pixel of the fingerprint is the average of
+// the area of img which it covers.
+func NewFingerprint(img image.Image) *Fingerprint {
+	f := &Fingerprint{}
+	b := img.Bounds()
+	if b.Empty() {
+		return f
+	}
+	var sum [fingerprintWidth * fingerprintHeight]uint64
+	var count [fingerprintWidth * fingerprintHeight]uint64
+	rgba, _ := img.(*image.RGBA)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		fy := (y - b.Min.Y) * fingerprintHeight / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			fx := (x - b.Min.X) * fingerprintWidth / b.Dx()
+			var r, g, bl uint32
+			if rgba != nil {
+				i := rgba.PixOffset(x, y)
+				r, g, bl = uint32(rgba.Pix[i])<<8, uint32(rgba.Pix[i+1])<<8, uint32(rgba.Pix[i+2])<<8
+			} else {
+				r, g, bl, _ = img.At(x, y).RGBA()
+			}
+			// ITU-R BT.601 luma in 16 bits.
+			i := fy*fingerprintWidth + fx
+			sum[i] += uint64((299*r + 587*g + 114*bl) / 1000)
+			count[i]++
+		}
+	}
+	for i := range f.pix {
+		if count[i] > 0 {
+			f.pix[i] = uint8(sum[i] / count[i] >> 8)
+		}
+	}
+	return f
+}
+
+// Similarity returns the similarity of f and g from 0 to 1, where 1 means they are identical.
+func (f *Fingerprint) Similarity(g *Fingerprint) float64 {
+	var diff uint64
+	for i := range f.pix {
+		d := int(f.pix[i]) - int(g.pix[i])
+		if d < 0 {
+			d = -d
+		}
+		diff += uint64(d)
+	}
+	return 1 - float64(diff)/float64(len(f.pix)*255)
+}
+
+// Screen is a known screen of the guest.
+type Screen struct {
+	// Name is the name of the screen, e.g. SetupAssistant.
+	Name string
+
+	// Fingerprint is the fingerprint of the reference screenshot.
+	Fingerprint *Fingerprint
+
+	// Threshold is the minimum similarity at which a screenshot matches. If zero, DefaultThreshold is used.
+	Threshold float64
+}
+
+// NewScreen returns the screen with the name whose reference screenshot is img.
+func NewScreen(name string, img image.Image) *Screen {
+	return &Screen{Name: name, Fingerprint: NewFingerprint(img)}
+}
+
+// Load returns the screen with the name whose reference screenshot is the PNG image at path,
+// e.g. the one which is captured by (*vz.VirtualMachine).TakeScreenshot and encoded by png.Encode.
+func Load(name, path string) (*Screen, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("screenmatch: %w", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("screenmatch: failed to decode %s: %w", path, err)
+	}
+	return NewScreen(name, img), nil
+}
+
+// Record captures the current screen of c and writes it to path as a PNG image, which can be loaded
+// by Load later. It returns the screen with the name whose reference screenshot is the captured one.
+func Record(ctx context.Context, c Capturer, name, path string) (*Screen, error) {
+	img, err := capture(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("screenmatch: failed to capture %s: %w", name, err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("screenmatch: %w", err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("screenmatch: failed to encode %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("screenmatch: %w", err)
+	}
+	return NewScreen(name, img), nil
+}
+
+// Matches reports whether img matches the screen.
+func (s *Screen) Matches(img image.Image) bool {
+	return s.match(NewFingerprint(img))
+}
+
+func (s *Screen) match(f *Fingerprint) bool {
+	threshold := s.Threshold
+	if threshold == 0 {
+		threshold = DefaultThreshold
+	}
+	return s.Fingerprint.Similarity(f) >= threshold
+}
+
+// Match returns the first screen which img matches, or nil if none of them matches.
+func Match(img image.Image, screens ...*Screen) *Screen {
+	f := NewFingerprint(img)
+	for _, s := range screens {
+		if s.match(f) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Capturer captures the screen of the guest. *vz.VirtualMachine implements it unless it is built
+// with the vzheadless tag.
+type Capturer interface {
+	TakeScreenshot() (image.Image, error)
+}
+
+// Wait captures the screen of c every interval until it matches any of the screens, and returns
+// the matched screen. The errors of the capture are ignored while the guest is booting, and
+// the last one is returned wrapped in ErrUnavailable if no screen has been captured when ctx is done.
+// Otherwise ctx.Err() is returned.
+//
+// Wait returns when ctx is done even if a capture is blocked, e.g. on the main thread of the host.
+// The blocked capture is left running and its result is discarded.
+func Wait(ctx context.Context, c Capturer, interval time.Duration, screens ...*Screen) (*Screen, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	captured := false
+	done := func() (*Screen, error) {
+		if !captured && lastErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnavailable, lastErr)
+		}
+		return nil, ctx.Err()
+	}
+	for {
+		img, err := capture(ctx, c)
+		if ctx.Err() != nil {
+			return done()
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			captured = true
+			if s := Match(img, screens...); s != nil {
+				return s, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return done()
+		case <-ticker.C:
+		}
+	}
+}
+
+// capture captures the screen of c until ctx is done.
+func capture(ctx context.Context, c Capturer) (image.Image, error) {
+	type result struct {
+		img image.Image
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		img, err := c.TakeScreenshot()
+		ch <- result{img, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.img, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
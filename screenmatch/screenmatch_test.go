@@ -0,0 +1,160 @@
+package screenmatch_test
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/screenmatch"
+)
+
+// testScreen returns a screen of the size which has a light panel at the center on a dark background.
+func testScreen(width, height int, panel color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.Color(color.RGBA{0x20, 0x30, 0x60, 0xff})
+			if x > width/4 && x < width*3/4 && y > height/4 && y < height*3/4 {
+				c = panel
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestMatch(t *testing.T) {
+	white := color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+	setup := screenmatch.NewScreen(screenmatch.SetupAssistant, testScreen(1920, 1200, white))
+	desktop := screenmatch.NewScreen("desktop", testScreen(1920, 1200, color.RGBA{0x20, 0x30, 0x60, 0xff}))
+
+	// The same screen on a Retina display, with a cursor.
+	retina := testScreen(3840, 2400, white)
+	for y := 100; y < 140; y++ {
+		for x := 100; x < 120; x++ {
+			retina.Set(x, y, color.Black)
+		}
+	}
+	if got := screenmatch.Match(retina, desktop, setup); got != setup {
+		t.Fatalf("want %s but got %v", setup.Name, got)
+	}
+	if got := screenmatch.Match(testScreen(1920, 1200, color.RGBA{0x80, 0x20, 0x20, 0xff}), setup); got != nil {
+		t.Fatalf("want no match but got %s", got.Name)
+	}
+	if !desktop.Matches(testScreen(640, 400, color.RGBA{0x20, 0x30, 0x60, 0xff})) {
+		t.Fatal("want desktop to match")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	img := testScreen(320, 200, color.White)
+	path := filepath.Join(t.TempDir(), "setup.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err := screenmatch.Load(screenmatch.SetupAssistant, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Fingerprint.Similarity(screenmatch.NewFingerprint(img)); got != 1 {
+		t.Fatalf("want similarity 1 but got %v", got)
+	}
+	if _, err := screenmatch.Load("missing", filepath.Join(t.TempDir(), "missing.png")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want ErrNotExist but got %v", err)
+	}
+}
+
+type captureFunc func() (image.Image, error)
+
+func (f captureFunc) TakeScreenshot() (image.Image, error) { return f() }
+
+func TestWait(t *testing.T) {
+	white := color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+	setup := screenmatch.NewScreen(screenmatch.SetupAssistant, testScreen(320, 200, white))
+
+	calls := 0
+	c := captureFunc(func() (image.Image, error) {
+		calls++
+		switch {
+		case calls == 1:
+			return nil, errors.New("not running")
+		case calls < 4:
+			return testScreen(320, 200, color.Black), nil
+		}
+		return testScreen(320, 200, white), nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := screenmatch.Wait(ctx, c, time.Millisecond, setup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != setup || calls != 4 {
+		t.Fatalf("want %s after 4 captures but got %v after %d", setup.Name, got, calls)
+	}
+}
+
+func TestWaitUnavailable(t *testing.T) {
+	setup := screenmatch.NewScreen(screenmatch.SetupAssistant, testScreen(320, 200, color.White))
+	c := captureFunc(func() (image.Image, error) {
+		return nil, errors.New("no graphics device")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := screenmatch.Wait(ctx, c, time.Millisecond, setup); !errors.Is(err, screenmatch.ErrUnavailable) {
+		t.Fatalf("want ErrUnavailable but got %v", err)
+	}
+}
+
+func TestWaitBlockedCapture(t *testing.T) {
+	setup := screenmatch.NewScreen(screenmatch.SetupAssistant, testScreen(320, 200, color.White))
+	block := make(chan struct{})
+	defer close(block)
+	c := captureFunc(func() (image.Image, error) {
+		<-block
+		return nil, errors.New("unreachable")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := screenmatch.Wait(ctx, c, time.Millisecond, setup); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded but got %v", err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	img := testScreen(320, 200, color.White)
+	c := captureFunc(func() (image.Image, error) { return img, nil })
+	path := filepath.Join(t.TempDir(), "setup.png")
+
+	recorded, err := screenmatch.Record(context.Background(), c, screenmatch.SetupAssistant, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := screenmatch.Load(screenmatch.SetupAssistant, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Fingerprint.Similarity(recorded.Fingerprint); got != 1 {
+		t.Fatalf("want similarity 1 but got %v", got)
+	}
+	if !loaded.Matches(img) {
+		t.Fatal("want the recorded screen to match")
+	}
+
+	failing := captureFunc(func() (image.Image, error) { return nil, errors.New("no graphics device") })
+	if _, err := screenmatch.Record(context.Background(), failing, screenmatch.SetupAssistant, path); err == nil {
+		t.Fatal("want error")
+	}
+}
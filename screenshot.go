@@ -0,0 +1,69 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization_appkit.h"
+*/
+import "C"
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// ErrScreenshotUnavailable is returned when the screen of the virtual machine could not be captured.
+var ErrScreenshotUnavailable = errors.New("screenshot is not available")
+
+// TakeScreenshot captures the current screen of the first display of the virtual machine.
+//
+// The screen is rendered by a VZVirtualMachineView which is attached to a hidden window, so no
+// window is displayed. This is useful to capture the screen of the guest on CI for debugging.
+// The virtual machine must be configured with a graphics device.
+//
+// The returned image is *image.RGBA. Its size is the size of the display, which may be scaled
+// by the backing scale factor of the host screen (e.g. twice on Retina displays).
+// ErrNotRunning is returned if the virtual machine is not running, and ErrScreenshotUnavailable
+// is returned if the screen could not be captured, including when the captured image is
+// fully transparent because the window server did not have the contents of the window.
+//
+// See KeyDown for the requirement of the main thread. ErrMainQueueNotServiced is returned instead of
+// blocking if the main dispatch queue is not serviced.
+func (v *VirtualMachine) TakeScreenshot() (image.Image, error) {
+	view, err := v.headlessView()
+	if err != nil {
+		return nil, err
+	}
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	screenshot := C.VZHeadlessView_takeScreenshot(view.Ptr(), &nserrPtr)
+	if err := newNSError(nserrPtr); err != nil {
+		return nil, err
+	}
+	if screenshot.pixels == nil {
+		return nil, ErrScreenshotUnavailable
+	}
+	defer C.free(screenshot.pixels)
+
+	width, height := int(screenshot.width), int(screenshot.height)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	copy(img.Pix, unsafe.Slice((*byte)(screenshot.pixels), width*height*4))
+	if isBlankImage(img) {
+		return nil, ErrScreenshotUnavailable
+	}
+	return img, nil
+}
+
+// isBlankImage reports whether all pixels of img are fully transparent. The screen of the guest
+// is opaque even if it is black, so such an image means that nothing is captured.
+func isBlankImage(img *image.RGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
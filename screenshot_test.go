@@ -0,0 +1,21 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
+package vz
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestIsBlankImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if !isBlankImage(img) {
+		t.Fatal("transparent image must be blank")
+	}
+	img.Set(3, 3, color.RGBA{A: 0xff})
+	if isBlankImage(img) {
+		t.Fatal("image with an opaque black pixel must not be blank")
+	}
+}
@@ -0,0 +1,130 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ SerialPortAttachment = (*WriterSerialPortAttachment)(nil)
+
+// WriterSerialPortAttachment is a serial port attachment which writes the data sent from the guest
+// to an io.Writer. No data is sent to the guest over serial with this attachment.
+//
+// This is useful to stream the console output into the logging systems. The writer can be replaced
+// by SetWriter while the virtual machine is running, e.g. to rotate the log file.
+type WriterSerialPortAttachment struct {
+	*FileHandleSerialPortAttachment
+
+	// the guest reads from stdinR, and nothing is written to stdinW.
+	stdinR, stdinW *os.File
+	// the guest writes to stdoutW, and the data is copied from stdoutR to w.
+	stdoutR, stdoutW *os.File
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWriterSerialPortAttachment creates a new serial port attachment which writes the data sent from
+// the guest to w.
+//
+// The data is written to w from a goroutine, so w does not need to be safe for concurrent use with
+// the virtual machine. Close must be called after the virtual machine is stopped to release the pipes.
+func NewWriterSerialPortAttachment(w io.Writer) (*WriterSerialPortAttachment, error) {
+	if w == nil {
+		return nil, errors.New("writer must not be nil")
+	}
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	a := &WriterSerialPortAttachment{
+		FileHandleSerialPortAttachment: NewFileHandleSerialPortAttachment(stdinR, stdoutW),
+		stdinR:                         stdinR,
+		stdinW:                         stdinW,
+		stdoutR:                        stdoutR,
+		stdoutW:                        stdoutW,
+		w:                              w,
+		done:                           make(chan struct{}),
+	}
+	go a.copy()
+	return a, nil
+}
+
+func (a *WriterSerialPortAttachment) copy() {
+	defer close(a.done)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := a.stdoutR.Read(buf)
+		if n > 0 {
+			a.mu.Lock()
+			// keep reading even if the writer fails, so the guest is not blocked.
+			if _, werr := a.w.Write(buf[:n]); werr != nil && a.err == nil {
+				a.err = werr
+			}
+			a.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// SetWriter replaces the writer and returns the previous one.
+//
+// The data which is sent from the guest after SetWriter returns is written to w, and the previous
+// writer is not used anymore, so it can be closed safely. e.g. to rotate the log file:
+//
+//	f, _ := os.Create("console.log.new")
+//	old := attachment.SetWriter(f)
+//	old.(io.Closer).Close()
+func (a *WriterSerialPortAttachment) SetWriter(w io.Writer) io.Writer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old := a.w
+	a.w = w
+	return old
+}
+
+// writerSerialPortCloseTimeout is how long Close waits for the remaining data.
+const writerSerialPortCloseTimeout = time.Second
+
+// Close closes the pipes and waits for the remaining data to be written to the writer. It returns
+// the first error which is returned by the writer, if any. The writer itself is not closed.
+//
+// The write end of the pipe may still be held by the virtual machine, e.g. when it is not
+// stopped, so the remaining data is waited for at most one second and then discarded.
+func (a *WriterSerialPortAttachment) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		a.stdoutW.Close()
+		select {
+		case <-a.done:
+		case <-time.After(writerSerialPortCloseTimeout):
+		}
+		// closing the read end unblocks the copy goroutine if it is still reading.
+		a.stdoutR.Close()
+		<-a.done
+		a.stdinR.Close()
+		a.stdinW.Close()
+		a.mu.Lock()
+		err = a.err
+		a.mu.Unlock()
+	})
+	return err
+}
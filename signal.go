@@ -0,0 +1,269 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultGracePeriod is the default duration to wait for the guest to stop itself
+// after RequestStop in HandleSignals.
+const DefaultGracePeriod = 30 * time.Second
+
+// SignalOption is an option for HandleSignals.
+type SignalOption func(*signalOptions)
+
+type signalOptions struct {
+	gracePeriod time.Duration
+	signals     []os.Signal
+	fallback    *shutdownFallback
+}
+
+// shutdownFallback asks the guest to shut down by other means than RequestStop.
+type shutdownFallback struct {
+	after    time.Duration
+	shutdown func(ctx context.Context) error
+}
+
+// WithGracePeriod sets the duration to wait for the guest to stop itself before
+// the virtual machine is stopped forcibly. The default is DefaultGracePeriod.
+func WithGracePeriod(d time.Duration) SignalOption {
+	return func(o *signalOptions) {
+		o.gracePeriod = d
+	}
+}
+
+// WithSignals sets the signals to be handled. The default is SIGTERM and SIGINT.
+func WithSignals(sigs ...os.Signal) SignalOption {
+	return func(o *signalOptions) {
+		o.signals = sigs
+	}
+}
+
+// WithShutdownFallback sets the function which asks the guest to shut down when RequestStop is
+// not available, fails, or the guest is not stopped within after since RequestStop.
+//
+// Virtualization.framework provides no other signal to the guest than RequestStop, which is the
+// power button event for Linux guests. Headless guests without the handler of it, e.g. without
+// acpid or systemd-logind, ignore it, so shutdown typically asks the agent in the guest:
+//
+//	h := vz.HandleSignals(vm, vz.WithShutdownFallback(5*time.Second, func(ctx context.Context) error {
+//		return client.Shutdown(ctx) // client is *agent.Client
+//	}))
+//
+// ctx of shutdown is done when the grace period expires. The virtual machine is stopped
+// forcibly if it is still not stopped at that time.
+func WithShutdownFallback(after time.Duration, shutdown func(ctx context.Context) error) SignalOption {
+	return func(o *signalOptions) {
+		o.fallback = &shutdownFallback{
+			after:    after,
+			shutdown: shutdown,
+		}
+	}
+}
+
+// SignalHandler stops the virtual machine gracefully when the process receives a signal.
+//
+// See HandleSignals.
+type SignalHandler struct {
+	vm      *VirtualMachine
+	opts    signalOptions
+	sigCh   chan os.Signal
+	closeCh chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	// err is written before done is closed.
+	err error
+}
+
+// HandleSignals installs the handlers of SIGTERM and SIGINT which stop the virtual machine.
+//
+// When the signal is received, the guest is asked to stop with RequestStop, and with the function
+// which is set by WithShutdownFallback if the guest does not respond to it. If the guest
+// does not stop within the grace period, or the signal is received again, the virtual
+// machine is stopped forcibly with Stop. The returned SignalHandler reports when the
+// virtual machine has been stopped, so the process can exit after that.
+//
+//	h := vz.HandleSignals(vm, vz.WithGracePeriod(10*time.Second))
+//	defer h.Close()
+//	<-h.Done()
+//	if err := h.Err(); err != nil {
+//		log.Println(err)
+//	}
+//
+// The handlers are installed until Close is called or the virtual machine is stopped, either by
+// the handler or by the guest itself, e.g. when it powers off. Done is closed in both cases.
+func HandleSignals(vm *VirtualMachine, opts ...SignalOption) *SignalHandler {
+	o := signalOptions{
+		gracePeriod: DefaultGracePeriod,
+		signals:     []os.Signal{syscall.SIGTERM, syscall.SIGINT},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	h := &SignalHandler{
+		vm:      vm,
+		opts:    o,
+		sigCh:   make(chan os.Signal, 1),
+		closeCh: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// The observer is added before the goroutine starts, so the stop of the virtual machine
+	// right after HandleSignals returns is not missed.
+	stopped := make(chan struct{}, 1)
+	remove := vm.addStateObserver(func(state VirtualMachineState) {
+		if isStoppedState(state) {
+			select {
+			case stopped <- struct{}{}:
+			default:
+			}
+		}
+	})
+	signal.Notify(h.sigCh, o.signals...)
+	go h.run(stopped, remove)
+	return h
+}
+
+// Done returns a channel which is closed when the virtual machine has been stopped by the handler,
+// or has stopped without a signal, e.g. when the guest powered itself off. It is not closed by Close.
+func (h *SignalHandler) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns the error which is occurred while stopping the virtual machine.
+// This must be called after Done is closed.
+func (h *SignalHandler) Err() error {
+	return h.err
+}
+
+// Close uninstalls the handlers. The virtual machine is not stopped by Close.
+func (h *SignalHandler) Close() {
+	h.once.Do(func() {
+		signal.Stop(h.sigCh)
+		close(h.closeCh)
+	})
+}
+
+// run waits for the signal, Close or the stop of the virtual machine which is reported to stopped.
+func (h *SignalHandler) run(stopped <-chan struct{}, remove func()) {
+	defer remove()
+	select {
+	case sig := <-h.sigCh:
+		h.vm.logger().Info("received signal, stopping virtual machine", "id", h.vm.id, "signal", sig.String())
+	case <-stopped:
+		h.vm.logger().Info("virtual machine stopped, uninstalling signal handlers", "id", h.vm.id)
+		h.Close()
+		close(h.done)
+		return
+	case <-h.closeCh:
+		return
+	}
+	defer h.Close()
+	defer close(h.done)
+	h.err = h.shutdown()
+}
+
+func (h *SignalHandler) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.opts.gracePeriod)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-h.sigCh:
+			h.vm.logger().Info("received signal again", "id", h.vm.id, "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return stopGracefully(ctx, h.vm, h.opts.fallback)
+}
+
+// stopGracefully asks the guest to stop with RequestStop and waits for the virtual machine
+// to be stopped. If fallback is not nil, it is used when RequestStop is not available or the guest
+// is not stopped within fallback.after. If ctx is done before that, the virtual machine is
+// stopped forcibly with Stop.
+func stopGracefully(ctx context.Context, v *VirtualMachine, fallback *shutdownFallback) error {
+	stopped := make(chan struct{}, 1)
+	remove := v.addStateObserver(func(state VirtualMachineState) {
+		if isStoppedState(state) {
+			select {
+			case stopped <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer remove()
+
+	if isStoppedState(v.State()) {
+		return nil
+	}
+	requested := false
+	if v.CanRequestStop() {
+		if _, err := v.RequestStop(); err == nil {
+			requested = true
+		}
+	}
+	// waitStopped reports whether the virtual machine is stopped within d, or until ctx is done if d is negative.
+	waitStopped := func(d time.Duration) bool {
+		var timeout <-chan time.Time
+		if d >= 0 {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-stopped:
+			return true
+		case <-ctx.Done():
+		case <-timeout:
+		}
+		return false
+	}
+	if fallback != nil {
+		after := time.Duration(0)
+		if requested {
+			after = fallback.after
+		}
+		if waitStopped(after) {
+			return nil
+		}
+		if ctx.Err() == nil {
+			v.logger().Info("asking guest to shut down with fallback", "id", v.id, "requested", requested)
+			if err := fallback.shutdown(ctx); err != nil {
+				v.logger().Error("failed to ask guest to shut down with fallback", "id", v.id, "err", err)
+			} else {
+				requested = true
+			}
+		}
+	}
+	if requested && ctx.Err() == nil {
+		if waitStopped(-1) {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		v.logger().Info("stopping virtual machine forcibly", "id", v.id, "reason", ctx.Err().Error())
+	}
+	if isStoppedState(v.State()) || !v.CanStop() {
+		return nil
+	}
+	var stopErr error
+	v.Stop(func(err error) {
+		stopErr = err
+	})
+	return stopErr
+}
+
+func isStoppedState(state VirtualMachineState) bool {
+	switch state {
+	case VirtualMachineStateStopped, VirtualMachineStateError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+//go:build darwin && arm64 && vzprivate
+// +build darwin,arm64,vzprivate
+
+package vz
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CSRActiveConfig is the value of the "csr-active-config" NVRAM variable. Each bit disables
+// a protection of the System Integrity Protection.
+//
+// On Apple silicon, SIP is controlled by the LocalPolicy of the boot policy, which is stored in
+// the guest's disk, and the NVRAM variable only mirrors what `csrutil` last wrote. So the value
+// does not tell whether SIP is actually enabled in the guest.
+type CSRActiveConfig uint32
+
+// These flags are defined in <sys/csr.h> of XNU.
+const (
+	CSRAllowUntrustedKexts           CSRActiveConfig = 1 << 0
+	CSRAllowUnrestrictedFS           CSRActiveConfig = 1 << 1
+	CSRAllowTaskForPID               CSRActiveConfig = 1 << 2
+	CSRAllowKernelDebugger           CSRActiveConfig = 1 << 3
+	CSRAllowAppleInternal            CSRActiveConfig = 1 << 4
+	CSRAllowUnrestrictedDTrace       CSRActiveConfig = 1 << 5
+	CSRAllowUnrestrictedNVRAM        CSRActiveConfig = 1 << 6
+	CSRAllowDeviceConfiguration      CSRActiveConfig = 1 << 7
+	CSRAllowAnyRecoveryOS            CSRActiveConfig = 1 << 8
+	CSRAllowUnapprovedKexts          CSRActiveConfig = 1 << 9
+	CSRAllowExecutablePolicyOverride CSRActiveConfig = 1 << 10
+	CSRAllowUnauthenticatedRoot      CSRActiveConfig = 1 << 11
+)
+
+// CSRActiveConfig returns the "csr-active-config" NVRAM variable which is stored in the
+// auxiliary storage. If the variable is not set, 0 is returned.
+//
+// See CSRActiveConfig for why this can not be used to inspect the SIP status of the guest.
+func (m *MacAuxiliaryStorage) CSRActiveConfig() (CSRActiveConfig, error) {
+	value, err := m.NVRAMVariable("csr-active-config")
+	if err != nil {
+		if errors.Is(err, ErrNVRAMVariableNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(value) < 4 {
+		return 0, fmt.Errorf("invalid csr-active-config length: %d", len(value))
+	}
+	return CSRActiveConfig(binary.LittleEndian.Uint32(value)), nil
+}
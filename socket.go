@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -12,6 +15,7 @@ import (
 	"os"
 	"runtime"
 	"runtime/cgo"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -46,9 +50,7 @@ type VirtioSocketDeviceConfiguration struct {
 // NewVirtioSocketDeviceConfiguration creates a new VirtioSocketDeviceConfiguration.
 func NewVirtioSocketDeviceConfiguration() *VirtioSocketDeviceConfiguration {
 	config := &VirtioSocketDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioSocketDeviceConfiguration(),
-		},
+		pointer: newPointer(C.newVZVirtioSocketDeviceConfiguration()),
 	}
 	runtime.SetFinalizer(config, func(self *VirtioSocketDeviceConfiguration) {
 		self.Release()
@@ -69,9 +71,7 @@ type VirtioSocketDevice struct {
 func newVirtioSocketDevice(ptr, dispatchQueue unsafe.Pointer) *VirtioSocketDevice {
 	socketDevice := &VirtioSocketDevice{
 		dispatchQueue: dispatchQueue,
-		pointer: pointer{
-			ptr: ptr,
-		},
+		pointer:       newPointer(ptr),
 	}
 	runtime.SetFinalizer(socketDevice, func(self *VirtioSocketDevice) {
 		self.Release()
@@ -98,13 +98,15 @@ func connectionHandler(connPtr, errPtr, cgoHandlerPtr unsafe.Pointer) {
 	cgoHandler := *(*cgo.Handle)(cgoHandlerPtr)
 	handler := cgoHandler.Value().(func(*VirtioSocketConnection, error))
 	defer cgoHandler.Delete()
-	// see: startHandler
-	conn := newVirtioSocketConnection(connPtr)
 	if err := newNSError(errPtr); err != nil {
-		handler(conn, err)
-	} else {
-		handler(conn, nil)
+		go handler(nil, err)
+		return
 	}
+	// see: startHandler
+	// The connection must be created here because connPtr is valid only in this callback.
+	conn, err := newVirtioSocketConnection(connPtr)
+	// handler is called on a new goroutine not to block the dispatch queue.
+	go handler(conn, err)
 }
 
 // ConnectToPort Initiates a connection to the specified port of the guest operating system.
@@ -113,6 +115,7 @@ func connectionHandler(connPtr, errPtr, cgoHandlerPtr unsafe.Pointer) {
 // If the guest operating system doesn’t listen for connections to the specifed port, this method does nothing.
 //
 // For a successful connection, this method sets the sourcePort property of the resulting VZVirtioSocketConnection object to a random port number.
+// fn is called on a new goroutine, so it may block without blocking the virtual machine.
 // see: https://developer.apple.com/documentation/virtualization/vzvirtiosocketdevice/3656677-connecttoport?language=objc
 func (v *VirtioSocketDevice) ConnectToPort(port uint32, fn func(conn *VirtioSocketConnection, err error)) {
 	cgoHandler := cgo.NewHandle(fn)
@@ -124,6 +127,8 @@ func (v *VirtioSocketDevice) ConnectToPort(port uint32, fn func(conn *VirtioSock
 // see: https://developer.apple.com/documentation/virtualization/vzvirtiosocketlistener?language=objc
 type VirtioSocketListener struct {
 	pointer
+
+	filter *acceptFilter
 }
 
 type dup struct {
@@ -131,50 +136,260 @@ type dup struct {
 	err  error
 }
 
-var shouldAcceptNewConnectionHandlers = map[unsafe.Pointer]func(conn *VirtioSocketConnection) bool{}
+// shouldAcceptNewConnectionHandlers are the handlers of the listeners which are called by the delegate
+// on the dispatch queues of the virtual machines, so these are guarded by mu.
+var shouldAcceptNewConnectionHandlers = struct {
+	mu       sync.RWMutex
+	handlers map[unsafe.Pointer]func(conn *VirtioSocketConnection, err error) bool
+}{
+	handlers: map[unsafe.Pointer]func(conn *VirtioSocketConnection, err error) bool{},
+}
+
+func setShouldAcceptNewConnectionHandler(ptr unsafe.Pointer, fn func(conn *VirtioSocketConnection, err error) bool) {
+	shouldAcceptNewConnectionHandlers.mu.Lock()
+	defer shouldAcceptNewConnectionHandlers.mu.Unlock()
+	shouldAcceptNewConnectionHandlers.handlers[ptr] = fn
+}
+
+func deleteShouldAcceptNewConnectionHandler(ptr unsafe.Pointer) {
+	shouldAcceptNewConnectionHandlers.mu.Lock()
+	defer shouldAcceptNewConnectionHandlers.mu.Unlock()
+	delete(shouldAcceptNewConnectionHandlers.handlers, ptr)
+}
+
+func getShouldAcceptNewConnectionHandler(ptr unsafe.Pointer) (func(conn *VirtioSocketConnection, err error) bool, bool) {
+	shouldAcceptNewConnectionHandlers.mu.RLock()
+	defer shouldAcceptNewConnectionHandlers.mu.RUnlock()
+	fn, ok := shouldAcceptNewConnectionHandlers.handlers[ptr]
+	return fn, ok
+}
+
+// acceptFilter is the handler which is set by SetShouldAcceptNewConnectionHandler.
+type acceptFilter struct {
+	mu sync.RWMutex
+	fn func(conn *VirtioSocketConnection) bool
+}
+
+func (f *acceptFilter) set(fn func(conn *VirtioSocketConnection) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fn = fn
+}
+
+func (f *acceptFilter) accept(conn *VirtioSocketConnection) bool {
+	f.mu.RLock()
+	fn := f.fn
+	f.mu.RUnlock()
+	return fn == nil || fn(conn)
+}
 
 // NewVirtioSocketListener creates a new VirtioSocketListener with connection handler.
 //
 // The handler is executed asynchronously. Be sure to close the connection used in the handler by calling `conn.Close`.
 // This is to prevent connection leaks.
 func NewVirtioSocketListener(handler func(conn *VirtioSocketConnection, err error)) *VirtioSocketListener {
-	ptr := C.newVZVirtioSocketListener()
-	listener := &VirtioSocketListener{
-		pointer: pointer{
-			ptr: ptr,
-		},
-	}
-
 	dupCh := make(chan dup, 1)
 	go func() {
 		for dup := range dupCh {
 			go handler(dup.conn, dup.err)
 		}
 	}()
-	shouldAcceptNewConnectionHandlers[ptr] = func(conn *VirtioSocketConnection) bool {
-		dupConn, err := conn.dup()
+	return newVirtioSocketListener(func(conn *VirtioSocketConnection, err error) bool {
 		dupCh <- dup{
-			conn: dupConn,
+			conn: conn,
 			err:  err,
 		}
 		return true // must be connected
-	}
+	})
+}
 
+// newVirtioSocketListener creates a new VirtioSocketListener which calls accept for the new connections
+// which pass the handler set by SetShouldAcceptNewConnectionHandler.
+//
+// accept is called on the dispatch queue of the virtual machine. The connection is rejected
+// if accept returns false, then accept must close the connection.
+func newVirtioSocketListener(accept func(conn *VirtioSocketConnection, err error) bool) *VirtioSocketListener {
+	ptr := C.newVZVirtioSocketListener()
+	listener := &VirtioSocketListener{
+		pointer: newPointer(ptr),
+		filter:  &acceptFilter{},
+	}
+	filter := listener.filter
+	setShouldAcceptNewConnectionHandler(ptr, func(conn *VirtioSocketConnection, err error) bool {
+		if err == nil && !filter.accept(conn) {
+			conn.Close()
+			return false
+		}
+		return accept(conn, err)
+	})
 	runtime.SetFinalizer(listener, func(self *VirtioSocketListener) {
 		self.Release()
 	})
 	return listener
 }
 
+// SetShouldAcceptNewConnectionHandler sets the handler which decides whether the new connection
+// from the guest is accepted. If fn returns false, the connection is rejected and closed, and
+// the handler of the listener is not called. fn can inspect the connection, e.g. by SourcePort.
+//
+// fn is called synchronously on the dispatch queue of the virtual machine, so it must return quickly
+// and must not call the methods of the virtual machine. All of connections are accepted by default.
+//
+// see: https://developer.apple.com/documentation/virtualization/vzvirtiosocketlistenerdelegate/3656691-listener?language=objc
+func (v *VirtioSocketListener) SetShouldAcceptNewConnectionHandler(fn func(conn *VirtioSocketConnection) bool) {
+	v.filter.set(fn)
+}
+
 //export shouldAcceptNewConnectionHandler
 func shouldAcceptNewConnectionHandler(listenerPtr, connPtr, devicePtr unsafe.Pointer) C.bool {
 	_ = devicePtr // NOTO(codehex): Is this really required? How to use?
 
+	handler, ok := getShouldAcceptNewConnectionHandler(listenerPtr)
+	if !ok {
+		return false
+	}
 	// see: startHandler
-	conn := newVirtioSocketConnection(connPtr)
-	return (C.bool)(shouldAcceptNewConnectionHandlers[listenerPtr](conn))
+	conn, err := newVirtioSocketConnection(connPtr)
+	return (C.bool)(handler(conn, err))
 }
 
+// DefaultListenBacklog is the default number of the connections which are accepted by the
+// virtual machine but not yet accepted by Accept of VirtioSocketPortListener.
+const DefaultListenBacklog = 128
+
+// ListenOption is an option for (*VirtioSocketDevice).Listen.
+type ListenOption func(*listenOptions)
+
+type listenOptions struct {
+	backlog int
+}
+
+// WithListenBacklog sets the maximum number of the pending connections which are not yet accepted
+// by Accept. The new connections are rejected while the backlog is full. The default is DefaultListenBacklog.
+func WithListenBacklog(n int) ListenOption {
+	return func(o *listenOptions) {
+		o.backlog = n
+	}
+}
+
+var _ net.Listener = (*VirtioSocketPortListener)(nil)
+
+// VirtioSocketPortListener is a listener for the connections from the guest to a port of
+// the Virtio socket device. This is implemented net.Listener interface, so it can be used
+// with the servers in Go. e.g. http.Serve.
+//
+// Create it by (*VirtioSocketDevice).Listen.
+type VirtioSocketPortListener struct {
+	device   *VirtioSocketDevice
+	listener *VirtioSocketListener
+	port     uint32
+	addr     *Addr
+	connCh   chan dup
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// Listen listens for the connections from the guest to the port.
+//
+// The connections are queued up to the backlog until Accept is called, so many connections can be
+// accepted concurrently. Any existing listener of the port is replaced. Close must be called to
+// stop listening.
+func (v *VirtioSocketDevice) Listen(port uint32, opts ...ListenOption) (*VirtioSocketPortListener, error) {
+	o := listenOptions{backlog: DefaultListenBacklog}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.backlog < 1 {
+		return nil, fmt.Errorf("invalid backlog: %d", o.backlog)
+	}
+	l := &VirtioSocketPortListener{
+		device: v,
+		port:   port,
+		addr: &Addr{
+			CID:  unix.VMADDR_CID_HOST,
+			Port: port,
+		},
+		connCh: make(chan dup, o.backlog),
+		done:   make(chan struct{}),
+	}
+	l.listener = newVirtioSocketListener(l.enqueue)
+	v.SetSocketListenerForPort(l.listener, port)
+	return l, nil
+}
+
+// enqueue is called on the dispatch queue of the virtual machine.
+//
+// The connection is refused if its file descriptor could not be duplicated, because there is no
+// connection to be accepted. The error is not returned from Accept so that the server loops which
+// stop on the errors of Accept keep serving.
+func (l *VirtioSocketPortListener) enqueue(conn *VirtioSocketConnection, err error) bool {
+	if err != nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		select {
+		case l.connCh <- dup{conn: conn}:
+			return true
+		default:
+			// backlog is full.
+		}
+	}
+	conn.Close()
+	return false
+}
+
+// SetShouldAcceptNewConnectionHandler sets the handler which decides whether the new connection
+// is accepted. See (*VirtioSocketListener).SetShouldAcceptNewConnectionHandler.
+func (l *VirtioSocketPortListener) SetShouldAcceptNewConnectionHandler(fn func(conn *VirtioSocketConnection) bool) {
+	l.listener.SetShouldAcceptNewConnectionHandler(fn)
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *VirtioSocketPortListener) Accept() (net.Conn, error) {
+	return l.AcceptVirtioSocketConnection()
+}
+
+// AcceptVirtioSocketConnection waits for and returns the next connection to the listener.
+func (l *VirtioSocketPortListener) AcceptVirtioSocketConnection() (*VirtioSocketConnection, error) {
+	select {
+	case dup := <-l.connCh:
+		return dup.conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops listening on the port. Any blocked Accept operations will be unblocked and
+// return errors. The pending connections which are not yet accepted are closed.
+func (l *VirtioSocketPortListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return &net.OpError{Op: "close", Net: "vsock", Addr: l.addr, Err: net.ErrClosed}
+	}
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+
+	l.device.RemoveSocketListenerForPort(l.listener, l.port)
+	deleteShouldAcceptNewConnectionHandler(l.listener.Ptr())
+	for {
+		select {
+		case dup := <-l.connCh:
+			dup.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Addr returns the listener's network address.
+func (l *VirtioSocketPortListener) Addr() net.Addr { return l.addr }
+
 // VirtioSocketConnection is a port-based connection between the guest operating system and the host computer.
 //
 // You don’t create connection objects directly. When the guest operating system initiates a connection, the virtual machine creates
@@ -196,51 +411,49 @@ type VirtioSocketConnection struct {
 	raddr           net.Addr // remote
 }
 
-var _ net.Conn = (*VirtioSocketConnection)(nil)
+var (
+	_ net.Conn     = (*VirtioSocketConnection)(nil)
+	_ syscall.Conn = (*VirtioSocketConnection)(nil)
+)
 
-func newVirtioSocketConnection(ptr unsafe.Pointer) *VirtioSocketConnection {
+// newVirtioSocketConnection creates a new VirtioSocketConnection from VZVirtioSocketConnection.
+//
+// The file descriptor of VZVirtioSocketConnection is closed when the object is deallocated,
+// so the file descriptor is duplicated to be owned by the Go world.
+func newVirtioSocketConnection(ptr unsafe.Pointer) (*VirtioSocketConnection, error) {
 	vzVirtioSocketConnection := C.convertVZVirtioSocketConnection2Flat(ptr)
-	err := unix.SetNonblock(int(vzVirtioSocketConnection.fileDescriptor), true)
-	if err != nil {
-		fmt.Printf("set nonblock: %s\n", err.Error())
+	laddr := &Addr{
+		CID:  unix.VMADDR_CID_HOST,
+		Port: (uint32)(vzVirtioSocketConnection.destinationPort),
 	}
-	conn := &VirtioSocketConnection{
-		sourcePort:      (uint32)(vzVirtioSocketConnection.sourcePort),
-		destinationPort: (uint32)(vzVirtioSocketConnection.destinationPort),
-		fileDescriptor:  (uintptr)(vzVirtioSocketConnection.fileDescriptor),
-		file:            os.NewFile((uintptr)(vzVirtioSocketConnection.fileDescriptor), ""),
-		laddr: &Addr{
-			CID:  unix.VMADDR_CID_HOST,
-			Port: (uint32)(vzVirtioSocketConnection.destinationPort),
-		},
-		raddr: &Addr{
-			CID:  unix.VMADDR_CID_HYPERVISOR,
-			Port: (uint32)(vzVirtioSocketConnection.sourcePort),
-		},
+	raddr := &Addr{
+		CID:  unix.VMADDR_CID_HYPERVISOR,
+		Port: (uint32)(vzVirtioSocketConnection.sourcePort),
 	}
-	return conn
-}
-
-func (v *VirtioSocketConnection) dup() (*VirtioSocketConnection, error) {
-	nfd, err := syscall.Dup(int(v.fileDescriptor))
+	nfd, err := syscall.Dup(int(vzVirtioSocketConnection.fileDescriptor))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dup",
 			Net:    "vsock",
-			Source: v.laddr,
-			Addr:   v.raddr,
+			Source: laddr,
+			Addr:   raddr,
 			Err:    err,
 		}
 	}
-
-	dupConn := new(VirtioSocketConnection)
-	*dupConn = *v
-	dupConn.fileDescriptor = uintptr(nfd)
-	dupConn.file = os.NewFile(uintptr(nfd), v.file.Name())
-	dupConn.laddr = v.laddr
-	dupConn.raddr = v.raddr
-
-	return dupConn, nil
+	syscall.CloseOnExec(nfd)
+	// must be set before os.NewFile to use the runtime poller.
+	if err := unix.SetNonblock(nfd, true); err != nil {
+		fmt.Printf("set nonblock: %s\n", err.Error())
+	}
+	conn := &VirtioSocketConnection{
+		sourcePort:      (uint32)(vzVirtioSocketConnection.sourcePort),
+		destinationPort: (uint32)(vzVirtioSocketConnection.destinationPort),
+		fileDescriptor:  uintptr(nfd),
+		file:            os.NewFile(uintptr(nfd), fmt.Sprintf("vsock:%s->%s", laddr, raddr)),
+		laddr:           laddr,
+		raddr:           raddr,
+	}
+	return conn, nil
 }
 
 // Read reads data from connection of the vsock protocol.
@@ -249,11 +462,41 @@ func (v *VirtioSocketConnection) Read(b []byte) (n int, err error) { return v.fi
 // Write writes data to the connection of the vsock protocol.
 func (v *VirtioSocketConnection) Write(b []byte) (n int, err error) { return v.file.Write(b) }
 
-// Close will be called when caused something error in socket.
+// Close closes the connection.
+//
+// The file descriptor of the connection is closed, so FileDescriptor must not be used after Close.
+// The files which are returned by File method are not closed.
 func (v *VirtioSocketConnection) Close() error {
 	return v.file.Close()
 }
 
+// File returns a copy of the underlying os.File.
+// It is the caller's responsibility to close the file when finished.
+// Closing the connection does not affect the file, and closing the file does not affect the connection.
+//
+// The file descriptor of the returned file can be passed to another process.
+// e.g. via SCM_RIGHTS control message of unix domain socket or ExtraFiles of exec.Cmd.
+func (v *VirtioSocketConnection) File() (*os.File, error) {
+	nfd, err := syscall.Dup(int(v.fileDescriptor))
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "file",
+			Net:    "vsock",
+			Source: v.laddr,
+			Addr:   v.raddr,
+			Err:    os.NewSyscallError("dup", err),
+		}
+	}
+	syscall.CloseOnExec(nfd)
+	return os.NewFile(uintptr(nfd), v.file.Name()), nil
+}
+
+// SyscallConn returns a raw network connection.
+// This implements the syscall.Conn interface.
+func (v *VirtioSocketConnection) SyscallConn() (syscall.RawConn, error) {
+	return v.file.SyscallConn()
+}
+
 // LocalAddr returns the local network address.
 func (v *VirtioSocketConnection) LocalAddr() net.Addr { return v.laddr }
 
@@ -295,7 +538,9 @@ func (v *VirtioSocketConnection) SourcePort() uint32 {
 //
 // Data is sent by writing to the file descriptor.
 // Data is received by reading from the file descriptor.
-// A file descriptor of -1 indicates a closed connection.
+//
+// The file descriptor is owned by the connection and is valid until Close is called.
+// Use File method to get the file descriptor which lives longer than the connection.
 func (v *VirtioSocketConnection) FileDescriptor() uintptr {
 	return v.fileDescriptor
 }
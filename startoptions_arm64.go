@@ -0,0 +1,62 @@
+//go:build darwin && arm64
+// +build darwin,arm64
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization.h"
+# include "virtualization_arm64.h"
+*/
+import "C"
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// MacOSVirtualMachineStartOptions is the options to start the macOS virtual machine.
+//
+// see: https://developer.apple.com/documentation/virtualization/vzmacosvirtualmachinestartoptions?language=objc
+type MacOSVirtualMachineStartOptions struct {
+	// StartUpFromMacOSRecovery boots the guest into the macOS Recovery instead of the installed macOS.
+	// This is the way to change the security settings of the guest, e.g. `csrutil disable` in Terminal
+	// of the macOS Recovery to disable System Integrity Protection.
+	StartUpFromMacOSRecovery bool
+}
+
+// StartWithOptions starts the macOS virtual machine that is in either Stopped or Error state with the options.
+//
+// The virtual machine must be configured with MacOSBootLoader.
+// fn is called after the virtual machine has been successfully started or on error as same as Start,
+// and the files are locked as same as Start.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions without calling fn.
+func (v *VirtualMachine) StartWithOptions(opts MacOSVirtualMachineStartOptions, fn func(error)) error {
+	if err := macOSAvailable(13, 0); err != nil {
+		return err
+	}
+	start, ok := v.diskLockedHandler("start", fn)
+	if !ok {
+		return nil
+	}
+	h, wait := makeHandler(start)
+	handler := cgo.NewHandle(h)
+	defer handler.Delete()
+	C.startWithMacOSOptionsCompletionHandler(
+		v.Ptr(),
+		v.dispatchQueue,
+		C.bool(opts.StartUpFromMacOSRecovery),
+		unsafe.Pointer(&handler),
+	)
+	wait()
+	return nil
+}
+
+// StartInRecovery starts the macOS virtual machine in the macOS Recovery.
+//
+// This is same as StartWithOptions with StartUpFromMacOSRecovery.
+func (v *VirtualMachine) StartInRecovery(fn func(error)) error {
+	return v.StartWithOptions(MacOSVirtualMachineStartOptions{StartUpFromMacOSRecovery: true}, fn)
+}
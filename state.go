@@ -0,0 +1,65 @@
+package vz
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotRunning is returned when the operation requires the running virtual machine.
+var ErrNotRunning = errors.New("virtual machine is not running")
+
+// VirtualMachineState represents execution state of the virtual machine.
+type VirtualMachineState int
+
+const (
+	// VirtualMachineStateStopped Initial state before the virtual machine is started.
+	VirtualMachineStateStopped VirtualMachineState = iota
+
+	// VirtualMachineStateRunning Running virtual machine.
+	VirtualMachineStateRunning
+
+	// VirtualMachineStatePaused A started virtual machine is paused.
+	// This state can only be transitioned from VirtualMachineStatePausing.
+	VirtualMachineStatePaused
+
+	// VirtualMachineStateError The virtual machine has encountered an internal error.
+	VirtualMachineStateError
+
+	// VirtualMachineStateStarting The virtual machine is configuring the hardware and starting.
+	VirtualMachineStateStarting
+
+	// VirtualMachineStatePausing The virtual machine is being paused.
+	// This is the intermediate state between VirtualMachineStateRunning and VirtualMachineStatePaused.
+	VirtualMachineStatePausing
+
+	// VirtualMachineStateResuming The virtual machine is being resumed.
+	// This is the intermediate state between VirtualMachineStatePaused and VirtualMachineStateRunning.
+	VirtualMachineStateResuming
+
+	// VZVirtualMachineStateStopping The virtual machine is being stopped.
+	// This is the intermediate state between VZVirtualMachineStateRunning and VZVirtualMachineStateStop.
+	VirtualMachineStateStopping
+)
+
+// String returns the name of the state.
+func (s VirtualMachineState) String() string {
+	switch s {
+	case VirtualMachineStateStopped:
+		return "stopped"
+	case VirtualMachineStateRunning:
+		return "running"
+	case VirtualMachineStatePaused:
+		return "paused"
+	case VirtualMachineStateError:
+		return "error"
+	case VirtualMachineStateStarting:
+		return "starting"
+	case VirtualMachineStatePausing:
+		return "pausing"
+	case VirtualMachineStateResuming:
+		return "resuming"
+	case VirtualMachineStateStopping:
+		return "stopping"
+	}
+	return fmt.Sprintf("VirtualMachineState(%d)", int(s))
+}
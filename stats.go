@@ -0,0 +1,184 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/internal/eventqueue"
+)
+
+// VirtualMachineStats is a snapshot of the statistics of the virtual machine.
+//
+// The statistics include the host-side CPU and memory usage of the process which runs the
+// virtual machine (see HostUsage), and the statistics which are observed by this package.
+type VirtualMachineStats struct {
+	// State is the current execution state of the virtual machine.
+	State VirtualMachineState `json:"state"`
+
+	// StateChangedAt is the time when the state was changed at last.
+	StateChangedAt time.Time `json:"stateChangedAt"`
+
+	// StartedAt is the time when the virtual machine was started at last.
+	// This is zero if the virtual machine has never been started.
+	StartedAt time.Time `json:"startedAt"`
+
+	// Uptime is the duration since StartedAt while the virtual machine is running or paused.
+	// This is zero if the virtual machine is stopped or in the error state.
+	Uptime time.Duration `json:"uptime"`
+
+	// StateTransitions is the number of times the state has been changed.
+	StateTransitions uint64 `json:"stateTransitions"`
+
+	// LastError is the error most recently reported by the operations of the virtual machine.
+	// e.g. Start, Stop and RequestStop.
+	LastError error `json:"-"`
+
+	// StateNotifyQueue is the statistics of the queue which delivers the states to the
+	// channel of StateChangedNotify. The depth grows when nobody receives from the channel.
+	StateNotifyQueue EventQueueStats `json:"stateNotifyQueue"`
+
+	// ObserverQueue is the statistics of the queue which delivers the states to the
+	// internal observers such as Manager and HandleSignals.
+	ObserverQueue EventQueueStats `json:"observerQueue"`
+
+	// Host is the resource usage of the host process which runs the virtual machine.
+	//
+	// This is nil while the virtual machine is stopped or in the error state, or if the process is
+	// not found. The process is found as the only new XPC service process of this process since
+	// the virtual machine was created, so it may not be found until the other virtual machines
+	// which are starting at the same time are found. This is also nil for the virtual machine
+	// which is adopted by AdoptVirtualMachine.
+	Host *HostUsage `json:"host,omitempty"`
+}
+
+// EventQueueStats is the statistics of the queue which delivers the events of the virtual machine.
+//
+// The callbacks of Virtualization.framework are invoked on the dispatch queue of the virtual machine.
+// These never wait for the receivers; the events are queued and delivered in order on another goroutine.
+type EventQueueStats struct {
+	// Pushed is the number of the events which are queued.
+	Pushed uint64 `json:"pushed"`
+
+	// Delivered is the number of the events which are delivered.
+	Delivered uint64 `json:"delivered"`
+
+	// Dropped is the number of the events which are discarded before delivered.
+	// This happens only when the virtual machine is released.
+	Dropped uint64 `json:"dropped"`
+
+	// Depth is the number of the events which are waiting to be delivered.
+	Depth int `json:"depth"`
+
+	// MaxDepth is the maximum Depth which has been observed.
+	MaxDepth int `json:"maxDepth"`
+}
+
+func newEventQueueStats(s eventqueue.Stats) EventQueueStats {
+	return EventQueueStats{
+		Pushed:    s.Pushed,
+		Delivered: s.Delivered,
+		Dropped:   s.Dropped,
+		Depth:     s.Depth,
+		MaxDepth:  s.MaxDepth,
+	}
+}
+
+// Stats returns the statistics of the virtual machine.
+func (v *VirtualMachine) Stats() VirtualMachineStats {
+	// I expected it will not cause panic.
+	// if caused panic, that's unexpected behavior.
+	val, _ := v.status.Value().(*machineStatus)
+	val.mu.RLock()
+	stats := VirtualMachineStats{
+		State:            val.state,
+		StateChangedAt:   val.stateChangedAt,
+		StartedAt:        val.startedAt,
+		StateTransitions: val.stateTransitions,
+		LastError:        val.lastError,
+		StateNotifyQueue: newEventQueueStats(val.notifyQueue.Stats()),
+		ObserverQueue:    newEventQueueStats(val.observerQueue.Stats()),
+	}
+	switch val.state {
+	case VirtualMachineStateStopped, VirtualMachineStateError, VirtualMachineStateStarting:
+	default:
+		if !val.startedAt.IsZero() {
+			stats.Uptime = time.Since(val.startedAt)
+		}
+	}
+	val.mu.RUnlock()
+
+	if !isStoppedState(stats.State) {
+		stats.Host = v.host.usage()
+	}
+	return stats
+}
+
+// Expvar returns expvar.Var which reports the statistics of the virtual machine as JSON.
+//
+// This can be published with expvar.Publish.
+//
+//	expvar.Publish("vm", vm.Expvar())
+func (v *VirtualMachine) Expvar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		stats := v.Stats()
+		ret := map[string]interface{}{
+			"state":            int(stats.State),
+			"stateChangedAt":   stats.StateChangedAt,
+			"startedAt":        stats.StartedAt,
+			"uptimeSeconds":    stats.Uptime.Seconds(),
+			"stateTransitions": stats.StateTransitions,
+			"stateNotifyQueue": stats.StateNotifyQueue,
+			"observerQueue":    stats.ObserverQueue,
+		}
+		if stats.LastError != nil {
+			ret["lastError"] = stats.LastError.Error()
+		}
+		if stats.Host != nil {
+			ret["host"] = stats.Host
+		}
+		return ret
+	})
+}
+
+// recordStateLocked records the statistics for the new state.
+// The caller must hold the lock of the machineStatus.
+func (m *machineStatus) recordStateLocked(newState VirtualMachineState) {
+	now := time.Now()
+	if newState == VirtualMachineStateRunning && m.state == VirtualMachineStateStarting {
+		m.startedAt = now
+	}
+	m.stateChangedAt = now
+	m.stateTransitions++
+}
+
+func (v *VirtualMachine) recordError(op string, err error) {
+	// I expected it will not cause panic.
+	// if caused panic, that's unexpected behavior.
+	val, _ := v.status.Value().(*machineStatus)
+	val.mu.Lock()
+	val.lastError = err
+	val.mu.Unlock()
+	val.logger.Error("virtual machine operation failed", "id", v.id, "op", op, "err", err)
+}
+
+// recordErrorHandler wraps the completion handler of the op to record the error for Stats method.
+func (v *VirtualMachine) recordErrorHandler(op string, fn func(error)) func(error) {
+	return func(err error) {
+		if err != nil {
+			v.recordError(op, err)
+		} else {
+			v.logger().Info("virtual machine operation completed", "id", v.id, "op", op)
+		}
+		fn(err)
+	}
+}
+
+func (v *VirtualMachine) logger() Logger {
+	// I expected it will not cause panic.
+	// if caused panic, that's unexpected behavior.
+	val, _ := v.status.Value().(*machineStatus)
+	return val.logger
+}
@@ -0,0 +1,195 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prometheusStates are the states which are reported by vz_vm_state.
+var prometheusStates = []VirtualMachineState{
+	VirtualMachineStateStopped,
+	VirtualMachineStateRunning,
+	VirtualMachineStatePaused,
+	VirtualMachineStateError,
+	VirtualMachineStateStarting,
+	VirtualMachineStatePausing,
+	VirtualMachineStateResuming,
+	VirtualMachineStateStopping,
+}
+
+type prometheusSample struct {
+	labels string
+	value  float64
+}
+
+type prometheusFamily struct {
+	name, help, typ string
+	samples         func(name string, s VirtualMachineStats) []prometheusSample
+}
+
+var prometheusFamilies = []prometheusFamily{
+	{
+		name: "vz_vm_state",
+		help: "Whether the virtual machine is in the state.",
+		typ:  "gauge",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			ret := make([]prometheusSample, 0, len(prometheusStates))
+			for _, state := range prometheusStates {
+				value := 0.0
+				if s.State == state {
+					value = 1
+				}
+				ret = append(ret, prometheusSample{labels: prometheusLabels("vm", name, "state", state.String()), value: value})
+			}
+			return ret
+		},
+	},
+	{
+		name: "vz_vm_uptime_seconds",
+		help: "Duration since the virtual machine was started.",
+		typ:  "gauge",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			return []prometheusSample{{labels: prometheusLabels("vm", name), value: s.Uptime.Seconds()}}
+		},
+	},
+	{
+		name: "vz_vm_state_transitions_total",
+		help: "Number of times the state of the virtual machine has been changed.",
+		typ:  "counter",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			return []prometheusSample{{labels: prometheusLabels("vm", name), value: float64(s.StateTransitions)}}
+		},
+	},
+	{
+		name: "vz_vm_event_queue_depth",
+		help: "Number of the events which are waiting to be delivered.",
+		typ:  "gauge",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			return []prometheusSample{
+				{labels: prometheusLabels("vm", name, "queue", "state_notify"), value: float64(s.StateNotifyQueue.Depth)},
+				{labels: prometheusLabels("vm", name, "queue", "observer"), value: float64(s.ObserverQueue.Depth)},
+			}
+		},
+	},
+	{
+		name: "vz_vm_host_cpu_seconds_total",
+		help: "CPU time of the host process which runs the virtual machine.",
+		typ:  "counter",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			if s.Host == nil {
+				return nil
+			}
+			return []prometheusSample{
+				{labels: prometheusLabels("vm", name, "mode", "user"), value: s.Host.UserTime.Seconds()},
+				{labels: prometheusLabels("vm", name, "mode", "system"), value: s.Host.SystemTime.Seconds()},
+			}
+		},
+	},
+	{
+		name: "vz_vm_host_resident_memory_bytes",
+		help: "Resident memory size of the host process which runs the virtual machine.",
+		typ:  "gauge",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			if s.Host == nil {
+				return nil
+			}
+			return []prometheusSample{{labels: prometheusLabels("vm", name), value: float64(s.Host.ResidentSize)}}
+		},
+	},
+	{
+		name: "vz_vm_host_phys_footprint_bytes",
+		help: "Physical memory footprint of the host process which runs the virtual machine.",
+		typ:  "gauge",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			if s.Host == nil {
+				return nil
+			}
+			return []prometheusSample{{labels: prometheusLabels("vm", name), value: float64(s.Host.PhysFootprint)}}
+		},
+	},
+	{
+		name: "vz_vm_host_wired_memory_bytes",
+		help: "Wired memory size of the host process which runs the virtual machine.",
+		typ:  "gauge",
+		samples: func(name string, s VirtualMachineStats) []prometheusSample {
+			if s.Host == nil {
+				return nil
+			}
+			return []prometheusSample{{labels: prometheusLabels("vm", name), value: float64(s.Host.WiredSize)}}
+		},
+	},
+}
+
+// prometheusLabels formats the pairs of the names and the values as the labels.
+func prometheusLabels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(prometheusLabelReplacer.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var prometheusLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the statistics in the Prometheus text exposition format.
+// stats is keyed by the name of the virtual machine, which is reported as the "vm" label.
+//
+// The metrics of the host process (vz_vm_host_*) are written only for the virtual machines
+// whose Host is known. See VirtualMachineStats.Host.
+func WritePrometheus(w io.Writer, stats map[string]VirtualMachineStats) error {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, f := range prometheusFamilies {
+		var samples []prometheusSample
+		for _, name := range names {
+			samples = append(samples, f.samples(name, stats[name])...)
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range samples {
+			fmt.Fprintf(bw, "%s%s %s\n", f.name, s.labels, strconv.FormatFloat(s.value, 'f', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+// PrometheusHandler returns http.Handler which serves the statistics of the virtual machines
+// of the Manager in the Prometheus text exposition format. The names of the virtual machines are
+// reported as the "vm" label.
+//
+//	http.Handle("/metrics", m.PrometheusHandler())
+func (m *Manager) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]VirtualMachineStats)
+		for _, name := range m.List() {
+			if vm, ok := m.Get(name); ok {
+				stats[name] = vm.Stats()
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w, stats)
+	})
+}
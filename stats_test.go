@@ -0,0 +1,74 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectHostProcess(t *testing.T) {
+	baseline := map[int]bool{10: true}
+	claimed := map[int]bool{20: true}
+	cases := []struct {
+		candidates []int
+		want       int
+	}{
+		{nil, 0},
+		{[]int{10, 20}, 0},
+		{[]int{10, 20, 30}, 30},
+		{[]int{30, 40}, 0},
+	}
+	for _, tc := range cases {
+		if got := selectHostProcess(tc.candidates, baseline, claimed); got != tc.want {
+			t.Errorf("%v: want %d but got %d", tc.candidates, tc.want, got)
+		}
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	stats := map[string]VirtualMachineStats{
+		"b": {State: VirtualMachineStateStopped},
+		`a"1`: {
+			State:            VirtualMachineStateRunning,
+			Uptime:           90 * time.Second,
+			StateTransitions: 2,
+			Host: &HostUsage{
+				PID:        100,
+				UserTime:   1500 * time.Millisecond,
+				SystemTime: 250 * time.Millisecond,
+				WiredSize:  4 << 30,
+			},
+		},
+	}
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE vz_vm_state gauge\n",
+		`vz_vm_state{vm="a\"1",state="running"} 1` + "\n",
+		`vz_vm_state{vm="a\"1",state="stopped"} 0` + "\n",
+		`vz_vm_state{vm="b",state="stopped"} 1` + "\n",
+		`vz_vm_uptime_seconds{vm="a\"1"} 90` + "\n",
+		`vz_vm_state_transitions_total{vm="a\"1"} 2` + "\n",
+		`vz_vm_host_cpu_seconds_total{vm="a\"1",mode="user"} 1.5` + "\n",
+		`vz_vm_host_cpu_seconds_total{vm="a\"1",mode="system"} 0.25` + "\n",
+		`vz_vm_host_wired_memory_bytes{vm="a\"1"} 4294967296` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q is not written:\n%s", want, out)
+		}
+	}
+	// the host metrics are not written for the virtual machine whose Host is unknown.
+	if strings.Contains(out, `vz_vm_host_cpu_seconds_total{vm="b"`) {
+		t.Errorf("host metrics of b are written:\n%s", out)
+	}
+	if strings.Index(out, `state{vm="a\"1"`) > strings.Index(out, `state{vm="b"`) {
+		t.Errorf("samples are not sorted by the name:\n%s", out)
+	}
+}
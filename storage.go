@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
@@ -6,7 +9,14 @@ package vz
 # include "virtualization.h"
 */
 import "C"
-import "runtime"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unicode"
+)
 
 type baseStorageDeviceAttachment struct{}
 
@@ -33,6 +43,9 @@ type DiskImageStorageDeviceAttachment struct {
 	pointer
 
 	*baseStorageDeviceAttachment
+
+	diskPath string
+	readOnly bool
 }
 
 // NewDiskImageStorageDeviceAttachment initialize the attachment from a local file path.
@@ -40,6 +53,9 @@ type DiskImageStorageDeviceAttachment struct {
 //
 // - diskPath is local file URL to the disk image in RAW format.
 // - readOnly if YES, the device attachment is read-only, otherwise the device can write data to the disk image.
+//
+// This blocks until the disk image is opened. Use NewDiskImageStorageDeviceAttachmentContext for the disk
+// images on network file systems.
 func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool) (*DiskImageStorageDeviceAttachment, error) {
 	nserr := newNSErrorAsNil()
 	nserrPtr := nserr.Ptr()
@@ -47,13 +63,13 @@ func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool) (*DiskI
 	diskPathChar := charWithGoString(diskPath)
 	defer diskPathChar.Free()
 	attachment := &DiskImageStorageDeviceAttachment{
-		pointer: pointer{
-			ptr: C.newVZDiskImageStorageDeviceAttachment(
-				diskPathChar.CString(),
-				C.bool(readOnly),
-				&nserrPtr,
-			),
-		},
+		pointer: newPointer(C.newVZDiskImageStorageDeviceAttachment(
+			diskPathChar.CString(),
+			C.bool(readOnly),
+			&nserrPtr,
+		)),
+		diskPath: diskPath,
+		readOnly: readOnly,
 	}
 	if err := newNSError(nserrPtr); err != nil {
 		return nil, err
@@ -64,6 +80,161 @@ func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool) (*DiskI
 	return attachment, nil
 }
 
+// DiskPath returns the path of the disk image.
+func (d *DiskImageStorageDeviceAttachment) DiskPath() string { return d.diskPath }
+
+// ReadOnly reports whether the disk image is attached read-only.
+func (d *DiskImageStorageDeviceAttachment) ReadOnly() bool { return d.readOnly }
+
+func (d *DiskImageStorageDeviceAttachment) diskFiles() []diskFile {
+	return []diskFile{{path: d.diskPath, readOnly: d.readOnly}}
+}
+
+// DiskImageCachingMode describes the disk image caching mode.
+//
+// The caching mode affects the performance and the consistency of the data which are written to the disk image.
+// see: https://developer.apple.com/documentation/virtualization/vzdiskimagecachingmode?language=objc
+type DiskImageCachingMode int
+
+const (
+	// DiskImageCachingModeAutomatic lets the framework decide the caching mode.
+	DiskImageCachingModeAutomatic DiskImageCachingMode = iota
+
+	// DiskImageCachingModeUncached disables the caching of the host, so the data are read and written
+	// directly. This reduces the memory pressure on the host with many virtual machines.
+	DiskImageCachingModeUncached
+
+	// DiskImageCachingModeCached enables the caching of the host.
+	DiskImageCachingModeCached
+)
+
+// DiskImageSynchronizationMode describes the disk image synchronization mode.
+//
+// see: https://developer.apple.com/documentation/virtualization/vzdiskimagesynchronizationmode?language=objc
+type DiskImageSynchronizationMode int
+
+const (
+	// DiskImageSynchronizationModeFull synchronizes the data to the permanent storage when the guest flushes.
+	// This is the safest mode.
+	DiskImageSynchronizationModeFull DiskImageSynchronizationMode = 1 + iota
+
+	// DiskImageSynchronizationModeFsync synchronizes the data to the drive with fsync(2) when the guest flushes.
+	// The data may not be written to the permanent storage of the drive.
+	DiskImageSynchronizationModeFsync
+
+	// DiskImageSynchronizationModeNone does not synchronize the data when the guest flushes.
+	// This is the fastest mode, but the data may be lost by a crash of the host.
+	DiskImageSynchronizationModeNone
+)
+
+// NewDiskImageStorageDeviceAttachmentWithCacheAndSync initialize the attachment from a local file path
+// with the caching and synchronization modes.
+// Returns error is not nil, assigned with the error if the initialization failed.
+//
+// - diskPath is local file URL to the disk image in RAW format.
+// - readOnly if YES, the device attachment is read-only, otherwise the device can write data to the disk image.
+// - cachingMode is whether to enable or disable caching.
+// - syncMode is how the disk image synchronizes with the underlying storage when the guest flushes data.
+//
+// Virtualization.framework does not provide any option to limit the throughput or the number of requests
+// of the disk. DiskImageCachingModeUncached at least prevents the guests from competing for the page
+// cache of the host.
+func NewDiskImageStorageDeviceAttachmentWithCacheAndSync(diskPath string, readOnly bool, cachingMode DiskImageCachingMode, syncMode DiskImageSynchronizationMode) (*DiskImageStorageDeviceAttachment, error) {
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+
+	diskPathChar := charWithGoString(diskPath)
+	defer diskPathChar.Free()
+	attachment := &DiskImageStorageDeviceAttachment{
+		pointer: newPointer(C.newVZDiskImageStorageDeviceAttachmentWithCacheAndSync(
+			diskPathChar.CString(),
+			C.bool(readOnly),
+			C.int(cachingMode),
+			C.int(syncMode),
+			&nserrPtr,
+		)),
+		diskPath: diskPath,
+		readOnly: readOnly,
+	}
+	if err := newNSError(nserrPtr); err != nil {
+		return nil, err
+	}
+	runtime.SetFinalizer(attachment, func(self *DiskImageStorageDeviceAttachment) {
+		self.Release()
+	})
+	return attachment, nil
+}
+
+// ErrAttachmentTimeout is returned by the constructors of the attachments which take a context when
+// the context is done before the attachment is created, e.g. when the disk image is on a network
+// file system which does not respond.
+var ErrAttachmentTimeout = errors.New("timed out creating storage device attachment")
+
+// NewDiskImageStorageDeviceAttachmentContext is same as NewDiskImageStorageDeviceAttachment but returns
+// ErrAttachmentTimeout when ctx is done before the attachment is created.
+//
+// Virtualization.framework opens the disk image synchronously in the constructor, and it can block
+// indefinitely on SMB or NFS shares which do not respond. The framework call can not be canceled, so it
+// is performed on another goroutine which keeps blocking after ErrAttachmentTimeout is returned, and the
+// attachment is released when the call returns eventually. The other operations of the attachment are
+// performed when the virtual machine starts, and these are bounded by the completion handler of Start.
+func NewDiskImageStorageDeviceAttachmentContext(ctx context.Context, diskPath string, readOnly bool) (*DiskImageStorageDeviceAttachment, error) {
+	return newDiskImageStorageDeviceAttachmentContext(ctx, diskPath, func() (*DiskImageStorageDeviceAttachment, error) {
+		return NewDiskImageStorageDeviceAttachment(diskPath, readOnly)
+	})
+}
+
+// NewDiskImageStorageDeviceAttachmentWithCacheAndSyncContext is same as
+// NewDiskImageStorageDeviceAttachmentWithCacheAndSync but returns ErrAttachmentTimeout when ctx is done
+// before the attachment is created. See NewDiskImageStorageDeviceAttachmentContext.
+func NewDiskImageStorageDeviceAttachmentWithCacheAndSyncContext(ctx context.Context, diskPath string, readOnly bool, cachingMode DiskImageCachingMode, syncMode DiskImageSynchronizationMode) (*DiskImageStorageDeviceAttachment, error) {
+	return newDiskImageStorageDeviceAttachmentContext(ctx, diskPath, func() (*DiskImageStorageDeviceAttachment, error) {
+		return NewDiskImageStorageDeviceAttachmentWithCacheAndSync(diskPath, readOnly, cachingMode, syncMode)
+	})
+}
+
+func newDiskImageStorageDeviceAttachmentContext(ctx context.Context, diskPath string, fn func() (*DiskImageStorageDeviceAttachment, error)) (*DiskImageStorageDeviceAttachment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrAttachmentTimeout, diskPath, err)
+	}
+	type result struct {
+		attachment *DiskImageStorageDeviceAttachment
+		err        error
+	}
+	// buffered, so the goroutine does not leak when nobody receives the result.
+	ch := make(chan result, 1)
+	var mu sync.Mutex
+	abandoned := false
+	go func() {
+		attachment, err := fn()
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned {
+			if attachment != nil {
+				runtime.SetFinalizer(attachment, nil)
+				attachment.Release()
+			}
+			return
+		}
+		ch <- result{attachment: attachment, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.attachment, r.err
+	case <-ctx.Done():
+		mu.Lock()
+		defer mu.Unlock()
+		select {
+		case r := <-ch:
+			// created while ctx is being done.
+			return r.attachment, r.err
+		default:
+		}
+		abandoned = true
+		return nil, fmt.Errorf("%w: %s: %v", ErrAttachmentTimeout, diskPath, ctx.Err())
+	}
+}
+
 // StorageDeviceConfiguration for a storage device configuration.
 type StorageDeviceConfiguration interface {
 	NSObject
@@ -88,6 +259,11 @@ var _ StorageDeviceConfiguration = (*VirtioBlockDeviceConfiguration)(nil)
 type VirtioBlockDeviceConfiguration struct {
 	pointer
 
+	attachment            StorageDeviceAttachment
+	blockDeviceIdentifier string
+	queueOptions          BlockDeviceQueueOptions
+	label                 string
+
 	*baseStorageDeviceConfiguration
 }
 
@@ -96,14 +272,168 @@ type VirtioBlockDeviceConfiguration struct {
 // - attachment The storage device attachment. This defines how the virtualized device operates on the host side.
 func NewVirtioBlockDeviceConfiguration(attachment StorageDeviceAttachment) *VirtioBlockDeviceConfiguration {
 	config := &VirtioBlockDeviceConfiguration{
-		pointer: pointer{
-			ptr: C.newVZVirtioBlockDeviceConfiguration(
-				attachment.Ptr(),
-			),
-		},
+		pointer: newPointer(C.newVZVirtioBlockDeviceConfiguration(
+			attachment.Ptr(),
+		)),
+		attachment: attachment,
 	}
 	runtime.SetFinalizer(config, func(self *VirtioBlockDeviceConfiguration) {
 		self.Release()
 	})
 	return config
 }
+
+// Attachment returns the storage device attachment of the device.
+func (v *VirtioBlockDeviceConfiguration) Attachment() StorageDeviceAttachment { return v.attachment }
+
+func (v *VirtioBlockDeviceConfiguration) diskFiles() []diskFile {
+	if u, ok := v.attachment.(diskFileUser); ok {
+		return u.diskFiles()
+	}
+	return nil
+}
+
+// maxBlockDeviceIdentifierLength is the maximum length of the block device identifier in bytes.
+// This is the size of the serial number of the Virtio block device.
+const maxBlockDeviceIdentifierLength = 20
+
+// ErrInvalidBlockDeviceIdentifier is returned when the block device identifier is not valid.
+var ErrInvalidBlockDeviceIdentifier = errors.New("invalid block device identifier")
+
+// ValidateBlockDeviceIdentifier checks whether identifier is a valid block device identifier.
+//
+// The identifier must be an ASCII string of up to 20 bytes. The error wraps ErrInvalidBlockDeviceIdentifier.
+//
+// This is only supported on macOS 12.3 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func ValidateBlockDeviceIdentifier(identifier string) error {
+	if err := macOSAvailable(12, 3); err != nil {
+		return err
+	}
+	if len(identifier) > maxBlockDeviceIdentifierLength {
+		return fmt.Errorf("%w %q: must be at most %d bytes", ErrInvalidBlockDeviceIdentifier, identifier, maxBlockDeviceIdentifierLength)
+	}
+	for _, r := range identifier {
+		if r > unicode.MaxASCII {
+			return fmt.Errorf("%w %q: must be ASCII", ErrInvalidBlockDeviceIdentifier, identifier)
+		}
+	}
+	cs := charWithGoString(identifier)
+	defer cs.Free()
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	C.validateBlockDeviceIdentifierVZVirtioBlockDeviceConfiguration(cs.CString(), &nserrPtr)
+	if err := newNSError(nserrPtr); err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidBlockDeviceIdentifier, identifier, err)
+	}
+	return nil
+}
+
+// SetBlockDeviceIdentifier sets the device identifier which is exposed to the guest as the serial
+// number of the block device. The guest can identify the disk by it deterministically, e.g. Linux
+// creates /dev/disk/by-id/virtio-<identifier>. This is useful when multiple block devices are attached.
+//
+// The identifier is validated by ValidateBlockDeviceIdentifier. The default is empty.
+//
+// This is only supported on macOS 12.3 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (v *VirtioBlockDeviceConfiguration) SetBlockDeviceIdentifier(identifier string) error {
+	if err := ValidateBlockDeviceIdentifier(identifier); err != nil {
+		return err
+	}
+	cs := charWithGoString(identifier)
+	defer cs.Free()
+	C.setBlockDeviceIdentifierVZVirtioBlockDeviceConfiguration(v.Ptr(), cs.CString())
+	v.blockDeviceIdentifier = identifier
+	return nil
+}
+
+// BlockDeviceIdentifier returns the device identifier which is set by SetBlockDeviceIdentifier.
+func (v *VirtioBlockDeviceConfiguration) BlockDeviceIdentifier() string {
+	return v.blockDeviceIdentifier
+}
+
+// ErrQueueOptionsUnsupported is returned by SetQueueOptions when the storage device attachment
+// does not support tuning the queues.
+var ErrQueueOptionsUnsupported = errors.New("queue options are not supported by the storage device attachment")
+
+// ErrInvalidQueueOptions is returned by SetQueueOptions when the queue options are not valid.
+var ErrInvalidQueueOptions = errors.New("invalid queue options")
+
+// maxVirtqueueSize is the maximum size of a virtqueue in the Virtio specification.
+const maxVirtqueueSize = 32768
+
+// BlockDeviceQueueOptions is the parallelism of the requests of a Virtio block device.
+//
+// Virtualization.framework does not expose the number of the queues nor the depth of them, neither
+// publicly nor by the private configuration, and decides them itself for the disk image attachments.
+// The options are used by the storage device attachments whose requests are served by backends in Go,
+// e.g. NBD or file handles, so they can be tuned for fast NVMe hosts.
+type BlockDeviceQueueOptions struct {
+	// Queues is the number of the request queues, which is the number of the workers which process
+	// the requests in parallel. Zero means the default of the attachment.
+	Queues int
+
+	// Depth is the maximum number of the in-flight requests of each queue. It must be a power of
+	// two up to 32768. Zero means the default of the attachment.
+	Depth int
+}
+
+// Validate checks whether the queue options are valid. The error wraps ErrInvalidQueueOptions.
+func (o BlockDeviceQueueOptions) Validate() error {
+	if o.Queues < 0 || o.Queues > 0xffff {
+		return fmt.Errorf("%w: queues %d must be between 0 and %d", ErrInvalidQueueOptions, o.Queues, 0xffff)
+	}
+	if o.Depth < 0 || o.Depth > maxVirtqueueSize || o.Depth&(o.Depth-1) != 0 {
+		return fmt.Errorf("%w: depth %d must be a power of two up to %d", ErrInvalidQueueOptions, o.Depth, maxVirtqueueSize)
+	}
+	return nil
+}
+
+// QueueOptionsAttachment is implemented by the storage device attachments which serve the requests
+// in Go and can tune their queues, e.g. the NBD or file handle backends. Such a backend embeds the
+// attachment of this package which connects it to the device, and implements SetQueueOptions:
+//
+//	type nbdAttachment struct {
+//		*vz.DiskImageStorageDeviceAttachment
+//		workers int
+//	}
+//
+//	func (a *nbdAttachment) SetQueueOptions(opts vz.BlockDeviceQueueOptions) error {
+//		a.workers = opts.Queues
+//		return nil
+//	}
+//
+// The attachments of this package do not implement it, because their queues are managed by
+// Virtualization.framework.
+type QueueOptionsAttachment interface {
+	StorageDeviceAttachment
+
+	// SetQueueOptions applies the options which have been validated by BlockDeviceQueueOptions.Validate.
+	SetQueueOptions(opts BlockDeviceQueueOptions) error
+}
+
+// SetQueueOptions sets the number of the queues and the depth of them which are used by the attachment.
+//
+// ErrQueueOptionsUnsupported is returned if the attachment does not implement QueueOptionsAttachment,
+// e.g. the disk image attachments whose queues are managed by Virtualization.framework.
+func (v *VirtioBlockDeviceConfiguration) SetQueueOptions(opts BlockDeviceQueueOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	a, ok := v.attachment.(QueueOptionsAttachment)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrQueueOptionsUnsupported, v.attachment)
+	}
+	if err := a.SetQueueOptions(opts); err != nil {
+		return err
+	}
+	v.queueOptions = opts
+	return nil
+}
+
+// QueueOptions returns the queue options which are set by SetQueueOptions.
+// The zero value is returned if they are not set, so the defaults of the attachment are used.
+func (v *VirtioBlockDeviceConfiguration) QueueOptions() BlockDeviceQueueOptions {
+	return v.queueOptions
+}
@@ -0,0 +1,140 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"fmt"
+	"path"
+)
+
+// storageDeviceLabeler is implemented by the storage device configurations which can be labeled.
+type storageDeviceLabeler interface {
+	Label() string
+}
+
+// SetLabel sets the label which identifies the device on the host, e.g. "root" or "data".
+// The label is not visible to the guest. Use StorageDeviceInfo to map the label to the
+// name of the device in the guest. The labels must be unique in a configuration. The default is empty.
+func (v *VirtioBlockDeviceConfiguration) SetLabel(label string) { v.label = label }
+
+// Label returns the label which is set by SetLabel.
+func (v *VirtioBlockDeviceConfiguration) Label() string { return v.label }
+
+// StorageDeviceInfo describes how a storage device of the configuration appears in the guest.
+type StorageDeviceInfo struct {
+	// Index is the index of the device in StorageDevices.
+	Index int
+
+	// Label is the label which is set by SetLabel.
+	Label string
+
+	// DiskPath is the path of the disk image on the host. Empty if the attachment is not a disk image.
+	DiskPath string
+
+	// BlockDeviceIdentifier is the serial number of the Virtio block device. Empty if it is not set.
+	BlockDeviceIdentifier string
+
+	// LinuxDevicePath is the name which Linux gives to the Virtio block device, e.g. "/dev/vdb".
+	// This is predicted from the order of the devices, so it is wrong if the guest has other virtio
+	// block devices, e.g. by hotplug. Empty if the device is not a Virtio block device.
+	LinuxDevicePath string
+
+	// LinuxByIDPath is the stable path of the device in Linux guests, which is created by udev
+	// from BlockDeviceIdentifier, e.g. "/dev/disk/by-id/virtio-data". Empty if the identifier is not set.
+	LinuxByIDPath string
+}
+
+// StorageDeviceInfo returns the information of the storage devices in the order of StorageDevices.
+//
+// The guest can map the devices back to the disk images on the host with it. The most reliable way
+// is BlockDeviceIdentifier, which is visible to the guest as the serial number of the device.
+func (v *VirtualMachineConfiguration) StorageDeviceInfo() []StorageDeviceInfo {
+	infos := make([]StorageDeviceInfo, len(v.storageDevices))
+	virtioBlockIndex := 0
+	for i, d := range v.storageDevices {
+		info := StorageDeviceInfo{Index: i}
+		if l, ok := d.(storageDeviceLabeler); ok {
+			info.Label = l.Label()
+		}
+		if a, ok := d.(interface {
+			Attachment() StorageDeviceAttachment
+		}); ok {
+			if disk, ok := a.Attachment().(interface{ DiskPath() string }); ok {
+				info.DiskPath = disk.DiskPath()
+			}
+		}
+		if block, ok := d.(*VirtioBlockDeviceConfiguration); ok {
+			info.BlockDeviceIdentifier = block.blockDeviceIdentifier
+			info.LinuxDevicePath = "/dev/vd" + linuxDiskSuffix(virtioBlockIndex)
+			virtioBlockIndex++
+			if info.BlockDeviceIdentifier != "" {
+				info.LinuxByIDPath = path.Join("/dev/disk/by-id", "virtio-"+info.BlockDeviceIdentifier)
+			}
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// StorageDeviceByLabel returns the information of the storage device which is labeled label.
+func (v *VirtualMachineConfiguration) StorageDeviceByLabel(label string) (StorageDeviceInfo, bool) {
+	for _, info := range v.StorageDeviceInfo() {
+		if label != "" && info.Label == label {
+			return info, true
+		}
+	}
+	return StorageDeviceInfo{}, false
+}
+
+// linuxDiskSuffix returns the suffix of the name of the i-th disk in Linux, e.g. "a", "z", "aa".
+func linuxDiskSuffix(i int) string {
+	var suffix []byte
+	for n := i; n >= 0; n = n/26 - 1 {
+		suffix = append([]byte{byte('a' + n%26)}, suffix...)
+	}
+	return string(suffix)
+}
+
+// validateStorageDevices validates storage devices which are not checked by the framework
+// before the virtual machine starts. The same device can not be used twice, because the
+// position of a device in the list decides its name in the guest.
+func validateStorageDevices(devices []StorageDeviceConfiguration) ValidationErrors {
+	var errs ValidationErrors
+	invalid := func(i int, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{
+			Device: "storage",
+			Index:  i,
+			Reason: fmt.Sprintf(format, args...),
+		})
+	}
+	seen := make(map[StorageDeviceConfiguration]int, len(devices))
+	labels := make(map[string]int, len(devices))
+	identifiers := make(map[string]int, len(devices))
+	for i, device := range devices {
+		if device == nil {
+			invalid(i, "device is not set")
+			continue
+		}
+		if j, ok := seen[device]; ok {
+			invalid(i, "device is already used as storage device %d", j)
+			continue
+		}
+		seen[device] = i
+		if l, ok := device.(storageDeviceLabeler); ok && l.Label() != "" {
+			if j, ok := labels[l.Label()]; ok {
+				invalid(i, "label %q is already used by storage device %d", l.Label(), j)
+			} else {
+				labels[l.Label()] = i
+			}
+		}
+		if block, ok := device.(*VirtioBlockDeviceConfiguration); ok && block.blockDeviceIdentifier != "" {
+			if j, ok := identifiers[block.blockDeviceIdentifier]; ok {
+				invalid(i, "block device identifier %q is already used by storage device %d", block.blockDeviceIdentifier, j)
+			} else {
+				identifiers[block.blockDeviceIdentifier] = i
+			}
+		}
+	}
+	return errs
+}
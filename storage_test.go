@@ -0,0 +1,66 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBlockDeviceQueueOptionsValidate(t *testing.T) {
+	cases := []struct {
+		opts  BlockDeviceQueueOptions
+		valid bool
+	}{
+		{BlockDeviceQueueOptions{}, true},
+		{BlockDeviceQueueOptions{Queues: 4, Depth: 128}, true},
+		{BlockDeviceQueueOptions{Queues: 0xffff, Depth: maxVirtqueueSize}, true},
+		{BlockDeviceQueueOptions{Depth: 1}, true},
+		{BlockDeviceQueueOptions{Queues: -1}, false},
+		{BlockDeviceQueueOptions{Queues: 0x10000}, false},
+		{BlockDeviceQueueOptions{Depth: -2}, false},
+		{BlockDeviceQueueOptions{Depth: 100}, false},
+		{BlockDeviceQueueOptions{Depth: maxVirtqueueSize * 2}, false},
+	}
+	for _, tc := range cases {
+		err := tc.opts.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: want valid but got %v", tc.opts, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidQueueOptions) {
+			t.Errorf("%+v: want ErrInvalidQueueOptions but got %v", tc.opts, err)
+		}
+	}
+}
+
+type testQueueOptionsAttachment struct {
+	*DiskImageStorageDeviceAttachment
+	opts BlockDeviceQueueOptions
+}
+
+func (a *testQueueOptionsAttachment) SetQueueOptions(opts BlockDeviceQueueOptions) error {
+	a.opts = opts
+	return nil
+}
+
+func TestSetQueueOptions(t *testing.T) {
+	opts := BlockDeviceQueueOptions{Queues: 4, Depth: 256}
+
+	diskImage := &VirtioBlockDeviceConfiguration{attachment: &DiskImageStorageDeviceAttachment{}}
+	if err := diskImage.SetQueueOptions(opts); !errors.Is(err, ErrQueueOptionsUnsupported) {
+		t.Fatalf("want ErrQueueOptionsUnsupported but got %v", err)
+	}
+
+	attachment := &testQueueOptionsAttachment{DiskImageStorageDeviceAttachment: &DiskImageStorageDeviceAttachment{}}
+	device := &VirtioBlockDeviceConfiguration{attachment: attachment}
+	if err := device.SetQueueOptions(BlockDeviceQueueOptions{Depth: 3}); !errors.Is(err, ErrInvalidQueueOptions) {
+		t.Fatalf("want ErrInvalidQueueOptions but got %v", err)
+	}
+	if err := device.SetQueueOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	if attachment.opts != opts || device.QueueOptions() != opts {
+		t.Fatalf("want %+v but got %+v and %+v", opts, attachment.opts, device.QueueOptions())
+	}
+}
@@ -0,0 +1,172 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ValidationError is an error which describes why the virtual machine configuration is invalid.
+type ValidationError struct {
+	// Device is the kind of the device or the property which is invalid.
+	// e.g. "network", "storage", "cpu", "memory" and "bootLoader".
+	// "configuration" is used if the invalid part could not be identified.
+	Device string
+
+	// Index is the index of the invalid device in the list which is set to the configuration.
+	// -1 if the error is not related to a specific device.
+	Index int
+
+	// Reason is the explanation of the reason for the error.
+	Reason string
+
+	// Err is the error which caused this error. e.g. *NSError reported by Virtualization.framework.
+	// This may be nil.
+	Err error
+}
+
+// Error implements error interface.
+func (e *ValidationError) Error() string {
+	if e.Index >= 0 {
+		return fmt.Sprintf("%s device %d: %s", e.Device, e.Index, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s", e.Device, e.Reason)
+}
+
+// Unwrap returns the error which caused this error.
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// ValidationErrors is a list of ValidationError which is returned by (*VirtualMachineConfiguration).Validate.
+//
+// Use errors.As to get the details of each error.
+type ValidationErrors []*ValidationError
+
+// Error implements error interface.
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid virtual machine configuration: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the first error. So errors.As can be used to get *NSError reported by
+// Virtualization.framework.
+func (e ValidationErrors) Unwrap() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e[0]
+}
+
+// The codes of VZErrorDomain which identify the invalid part of the configuration.
+// see: https://developer.apple.com/documentation/virtualization/vzerror/code?language=objc
+const (
+	vzErrorDomain           = "VZErrorDomain"
+	vzErrorInvalidDiskImage = 5
+	vzErrorNetworkError     = 7
+	vzErrorOutOfDiskSpace   = 8
+)
+
+// validationErrorCodeDevices maps the codes of VZErrorDomain to the devices.
+var validationErrorCodeDevices = map[int]string{
+	vzErrorInvalidDiskImage: "storage",
+	vzErrorNetworkError:     "network",
+	vzErrorOutOfDiskSpace:   "storage",
+}
+
+// validationDeviceKeywords is used to guess which part of the configuration is reported
+// as invalid by Virtualization.framework when the error has no structured information.
+// The descriptions are localized, so this works only in English.
+var validationDeviceKeywords = []struct {
+	keyword string
+	device  string
+}{
+	{"boot loader", "bootLoader"},
+	{"cpu", "cpu"},
+	{"memory balloon", "memoryBalloon"},
+	{"memory", "memory"},
+	{"network", "network"},
+	{"storage", "storage"},
+	{"serial port", "serialPort"},
+	{"socket", "socket"},
+	{"entropy", "entropy"},
+	{"directory sharing", "directorySharing"},
+	{"graphics", "graphics"},
+	{"pointing", "pointing"},
+	{"keyboard", "keyboard"},
+	{"audio", "audio"},
+	{"platform", "platform"},
+}
+
+// validationFile is a file on the host which is used by a part of the configuration.
+type validationFile struct {
+	device string
+	index  int
+	path   string
+}
+
+// validationFiles returns the files which are used by the storage devices and the platform.
+func (v *VirtualMachineConfiguration) validationFiles() []validationFile {
+	var files []validationFile
+	for i, d := range v.storageDevices {
+		if u, ok := d.(diskFileUser); ok {
+			for _, f := range u.diskFiles() {
+				files = append(files, validationFile{device: "storage", index: i, path: f.path})
+			}
+		}
+	}
+	if u, ok := v.platform.(diskFileUser); ok {
+		for _, f := range u.diskFiles() {
+			files = append(files, validationFile{device: "platform", index: -1, path: f.path})
+		}
+	}
+	return files
+}
+
+// newValidationErrorFromNSError converts the error which is reported by Virtualization.framework.
+//
+// The error and its underlying errors are walked for the structured information: the file path in
+// the user info identifies the device which uses the file, and the code of VZErrorDomain identifies
+// the kind of the device. The localized description is used only if neither is found.
+func newValidationErrorFromNSError(err *NSError, files []validationFile) *ValidationError {
+	reason := err.LocalizedFailureReason
+	if reason == "" {
+		reason = err.LocalizedDescription
+	}
+	ret := &ValidationError{
+		Device: "configuration",
+		Index:  -1,
+		Reason: reason,
+		Err:    err,
+	}
+	codeDevice := ""
+	for e := err; e != nil; e = e.Underlying {
+		if e.FilePath != "" {
+			for _, f := range files {
+				if filepath.Clean(f.path) == filepath.Clean(e.FilePath) {
+					ret.Device, ret.Index = f.device, f.index
+					return ret
+				}
+			}
+		}
+		if d, ok := validationErrorCodeDevices[e.Code]; ok && e.Domain == vzErrorDomain && codeDevice == "" {
+			codeDevice = d
+		}
+	}
+	if codeDevice != "" {
+		ret.Device = codeDevice
+		return ret
+	}
+	text := strings.ToLower(err.LocalizedDescription + " " + err.LocalizedFailureReason)
+	for _, kw := range validationDeviceKeywords {
+		if strings.Contains(text, kw.keyword) {
+			ret.Device = kw.device
+			break
+		}
+	}
+	return ret
+}
@@ -0,0 +1,74 @@
+//go:build darwin
+// +build darwin
+
+package vz
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewValidationErrorFromNSError(t *testing.T) {
+	files := []validationFile{
+		{device: "storage", index: 0, path: "/vm/root.img"},
+		{device: "storage", index: 1, path: "/vm/data.img"},
+		{device: "platform", index: -1, path: "/vm/aux.img"},
+	}
+	cases := []struct {
+		name   string
+		err    *NSError
+		device string
+		index  int
+	}{
+		{
+			name:   "file path",
+			err:    &NSError{Domain: "NSCocoaErrorDomain", Code: 260, FilePath: "/vm/data.img"},
+			device: "storage",
+			index:  1,
+		},
+		{
+			name: "file path of underlying error",
+			err: &NSError{Domain: vzErrorDomain, Code: 2, LocalizedDescription: "Die Konfiguration ist ungültig.",
+				Underlying: &NSError{Domain: "NSPOSIXErrorDomain", Code: 2, FilePath: "/vm/../vm/aux.img"}},
+			device: "platform",
+			index:  -1,
+		},
+		{
+			name: "code of underlying error",
+			err: &NSError{Domain: vzErrorDomain, Code: 2,
+				Underlying: &NSError{Domain: vzErrorDomain, Code: vzErrorInvalidDiskImage}},
+			device: "storage",
+			index:  -1,
+		},
+		{
+			name:   "structured information is preferred to the description",
+			err:    &NSError{Domain: vzErrorDomain, Code: vzErrorNetworkError, LocalizedDescription: "Invalid storage device."},
+			device: "network",
+			index:  -1,
+		},
+		{
+			name:   "keyword",
+			err:    &NSError{Domain: vzErrorDomain, Code: 2, LocalizedDescription: "Invalid virtual machine configuration.", LocalizedFailureReason: "The memory size is too small."},
+			device: "memory",
+			index:  -1,
+		},
+		{
+			name:   "unknown",
+			err:    &NSError{Domain: vzErrorDomain, Code: 2, LocalizedDescription: "Ungültige Konfiguration."},
+			device: "configuration",
+			index:  -1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := newValidationErrorFromNSError(c.err, files)
+			if got.Device != c.device || got.Index != c.index {
+				t.Fatalf("want %s device %d but got %s device %d", c.device, c.index, got.Device, got.Index)
+			}
+			var nserr *NSError
+			if !errors.As(got, &nserr) || nserr != c.err {
+				t.Fatal("want the error to wrap the NSError")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
+package vz
+
+/*
+#cgo darwin CFLAGS: -x objective-c -fno-objc-arc
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
+# include "virtualization_appkit.h"
+*/
+import "C"
+import "runtime"
+
+// VirtualMachineView is a VZVirtualMachineView which displays the virtual machine.
+//
+// This is for the applications which already run their own AppKit event loop, and therefore can not
+// use StartGraphicApplication. The view is not attached to any window. Add it to a window of the
+// application with the pointer which is returned by Ptr. The pointer is an NSView * (precisely
+// VZVirtualMachineView *), so it can be passed to the other Objective-C bindings such as purego
+// or darwinkit. e.g. with darwinkit:
+//
+//	view := vz.NewVirtualMachineView(vm)
+//	window.SetContentView(appkit.ViewFrom(view.Ptr()))
+//
+// The window retains the view while it is added, and the VirtualMachineView keeps its own reference
+// until it is garbage collected.
+//
+// AppKit requires the view to be used on the main thread. If the methods of VirtualMachineView are not
+// called on the main thread, the main dispatch queue must be serviced by the event loop of the application.
+// Otherwise the methods block forever.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtualmachineview?language=objc
+type VirtualMachineView struct {
+	pointer
+}
+
+// NewVirtualMachineView creates a new VirtualMachineView which displays the virtual machine.
+func NewVirtualMachineView(vm *VirtualMachine) *VirtualMachineView {
+	view := &VirtualMachineView{
+		pointer: newPointer(C.newVZVirtualMachineView(vm.Ptr())),
+	}
+	runtime.SetFinalizer(view, func(self *VirtualMachineView) {
+		self.releaseOnMainThread()
+	})
+	return view
+}
+
+// SetCapturesSystemKeys sets whether the system hot keys (e.g. Command+Tab) are sent to the guest
+// instead of the host while the view is focused. The default is false.
+func (v *VirtualMachineView) SetCapturesSystemKeys(capturesSystemKeys bool) {
+	C.setCapturesSystemKeysVZVirtualMachineView(v.Ptr(), C.bool(capturesSystemKeys))
+}
+
+// CapturesSystemKeys returns whether the system hot keys are sent to the guest.
+func (v *VirtualMachineView) CapturesSystemKeys() bool {
+	return bool(C.capturesSystemKeysVZVirtualMachineView(v.Ptr()))
+}
+
+// SetAutomaticallyReconfiguresDisplay sets whether the display of the guest is reconfigured to the
+// size of the view when the view is resized. The default is false.
+//
+// This is only supported on macOS 14 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (v *VirtualMachineView) SetAutomaticallyReconfiguresDisplay(automaticallyReconfiguresDisplay bool) error {
+	if err := macOSAvailable(14, 0); err != nil {
+		return err
+	}
+	C.setAutomaticallyReconfiguresDisplayVZVirtualMachineView(v.Ptr(), C.bool(automaticallyReconfiguresDisplay))
+	return nil
+}
+
+// AutomaticallyReconfiguresDisplay returns whether the display of the guest is reconfigured to the size of the view.
+//
+// This is only supported on macOS 14 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+func (v *VirtualMachineView) AutomaticallyReconfiguresDisplay() (bool, error) {
+	if err := macOSAvailable(14, 0); err != nil {
+		return false, err
+	}
+	return bool(C.automaticallyReconfiguresDisplayVZVirtualMachineView(v.Ptr())), nil
+}
+
+// Detach detaches the virtual machine from the view. The view displays nothing after that,
+// and the virtual machine keeps running.
+func (v *VirtualMachineView) Detach() {
+	C.detachVirtualMachineVZVirtualMachineView(v.Ptr())
+}
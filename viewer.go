@@ -0,0 +1,99 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
+package vz
+
+import (
+	"fmt"
+	"image"
+	"net"
+
+	"github.com/Code-Hex/vz/v2/viewer"
+)
+
+// ServeViewer serves the display of the virtual machine to the viewers which connect to l, e.g. a
+// unix domain socket, so a viewer in another process can see and control a virtual machine which
+// runs headless. See the viewer package for the protocol and the client.
+//
+// The requests are not authenticated. Restrict the access to l, or use viewer.Server with
+// ReadOnly to serve only the frames. The frames are captured by TakeScreenshot and the input is
+// sent by KeyDown and the other methods, so the virtual machine must be configured with a graphics
+// device, a keyboard and a pointing device, and the main dispatch queue must be serviced.
+// See KeyDown for the requirements.
+//
+// ServeViewer always returns a non-nil error which is returned by Accept.
+func (v *VirtualMachine) ServeViewer(l net.Listener) error {
+	s := &viewer.Server{Display: v.ViewerDisplay()}
+	return s.Serve(l)
+}
+
+// ViewerDisplay returns the virtual machine as viewer.Display to be served by viewer.Server.
+func (v *VirtualMachine) ViewerDisplay() viewer.Display {
+	return &viewerDisplay{vm: v}
+}
+
+type viewerDisplay struct {
+	vm *VirtualMachine
+}
+
+var _ viewer.Display = (*viewerDisplay)(nil)
+
+func (d *viewerDisplay) TakeScreenshot() (image.Image, error) {
+	return d.vm.TakeScreenshot()
+}
+
+func (d *viewerDisplay) Key(event viewer.KeyEvent) error {
+	modifiers := viewerKeyModifier(event.Modifiers)
+	switch event.Action {
+	case viewer.KeyDown:
+		return d.vm.KeyDown(event.KeyCode, modifiers)
+	case viewer.KeyUp:
+		return d.vm.KeyUp(event.KeyCode, modifiers)
+	case viewer.KeyPress:
+		return d.vm.KeyPress(event.KeyCode, modifiers)
+	}
+	return fmt.Errorf("unknown key action %q", event.Action)
+}
+
+func (d *viewerDisplay) TypeText(text string) error {
+	return d.vm.TypeText(text)
+}
+
+func (d *viewerDisplay) Mouse(event viewer.MouseEvent) error {
+	button := MouseButtonLeft
+	if event.Button == viewer.MouseButtonRight {
+		button = MouseButtonRight
+	}
+	switch event.Action {
+	case viewer.MouseMove:
+		return d.vm.MouseMove(event.X, event.Y)
+	case viewer.MouseDown:
+		return d.vm.MouseDown(button, event.X, event.Y)
+	case viewer.MouseUp:
+		return d.vm.MouseUp(button, event.X, event.Y)
+	case viewer.MouseDrag:
+		return d.vm.MouseDrag(event.X, event.Y)
+	case viewer.MouseClick:
+		return d.vm.MouseClick(button, event.X, event.Y)
+	}
+	return fmt.Errorf("unknown mouse action %q", event.Action)
+}
+
+// viewerKeyModifier converts the modifier keys of the viewer protocol to KeyModifier.
+func viewerKeyModifier(m viewer.Modifier) KeyModifier {
+	var ret KeyModifier
+	for _, pair := range []struct {
+		viewer viewer.Modifier
+		vz     KeyModifier
+	}{
+		{viewer.ModifierShift, KeyModifierShift},
+		{viewer.ModifierControl, KeyModifierControl},
+		{viewer.ModifierOption, KeyModifierOption},
+		{viewer.ModifierCommand, KeyModifierCommand},
+	} {
+		if m&pair.viewer != 0 {
+			ret |= pair.vz
+		}
+	}
+	return ret
+}
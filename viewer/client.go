@@ -0,0 +1,133 @@
+package viewer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client is a client of the Server which serves the display of a virtual machine.
+//
+// A Client is safe for concurrent use, but the requests are processed one by one
+// on the connection. If the context is done while a request is in progress, the connection
+// is closed because the stream of the messages can not be recovered.
+type Client struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// NewClient creates a new Client with the connection to the Server.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Frame captures the current frame of the display.
+//
+// The size of the frame is the size of the display in pixels. Poll it to follow the display,
+// there is no notification of the changes.
+func (c *Client) Frame(ctx context.Context) (*image.RGBA, error) {
+	var result frameResult
+	if err := c.call(ctx, methodFrame, nil, &result); err != nil {
+		return nil, err
+	}
+	if result.Width < 0 || result.Height < 0 || len(result.Pix) != result.Width*result.Height*4 {
+		return nil, fmt.Errorf("viewer: invalid frame %dx%d with %d bytes", result.Width, result.Height, len(result.Pix))
+	}
+	return &image.RGBA{
+		Pix:    result.Pix,
+		Stride: result.Width * 4,
+		Rect:   image.Rect(0, 0, result.Width, result.Height),
+	}, nil
+}
+
+// Key sends the keyboard event to the virtual machine.
+func (c *Client) Key(ctx context.Context, event KeyEvent) error {
+	return c.call(ctx, methodKey, &event, nil)
+}
+
+// TypeText types the text as if it is typed on the US keyboard layout.
+// See (*vz.VirtualMachine).TypeText for the supported characters.
+func (c *Client) TypeText(ctx context.Context, text string) error {
+	return c.call(ctx, methodTypeText, &typeTextParams{Text: text}, nil)
+}
+
+// Mouse sends the pointer event to the virtual machine.
+func (c *Client) Mouse(ctx context.Context, event MouseEvent) error {
+	return c.call(ctx, methodMouse, &event, nil)
+}
+
+func (c *Client) call(ctx context.Context, method string, params, result interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return roundTrip(ctx, c.conn, method, params, result)
+}
+
+// roundTrip sends a request and receives its response on conn.
+// The deadline of conn is bound to ctx while the round trip.
+func roundTrip(ctx context.Context, conn net.Conn, method string, params, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			// unblock reading and writing.
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+		conn.SetDeadline(time.Time{})
+	}()
+
+	err := func() error {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req := &request{
+			Method: method,
+			Params: b,
+		}
+		if err := writeMessage(conn, req); err != nil {
+			return err
+		}
+		var resp response
+		if err := readMessage(conn, &resp); err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return &RemoteError{Method: method, Message: resp.Error}
+		}
+		if result == nil || len(resp.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	}()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The response of the request may arrive later, so the connection
+			// can not be used anymore.
+			conn.Close()
+			return ctxErr
+		}
+	}
+	return err
+}
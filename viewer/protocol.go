@@ -0,0 +1,196 @@
+// Package viewer provides a small protocol to view and control the display of a running virtual
+// machine from another process over a stream connection such as a unix domain socket.
+//
+// Virtualization.framework only allows a VZVirtualMachineView to display a virtual machine which
+// is owned by the same process, so a virtual machine which runs headless, e.g. under launchd, can
+// not be attached to a window of another process. Instead the process which owns the virtual
+// machine serves the framebuffer and the keyboard and pointer input by
+// (*vz.VirtualMachine).ServeViewer, and a viewer connects to it with NewClient:
+//
+//	// in the process which owns the virtual machine.
+//	l, err := net.Listen("unix", "/path/to/vm.viewer.sock")
+//	go vm.ServeViewer(l)
+//
+//	// in the viewer.
+//	conn, err := net.Dial("unix", "/path/to/vm.viewer.sock")
+//	client := viewer.NewClient(conn)
+//	frame, err := client.Frame(ctx)
+//	err = client.Mouse(ctx, viewer.MouseEvent{Action: viewer.MouseClick, X: 100, Y: 100})
+//
+// Each message is a JSON object which is prefixed by its length as a 4 bytes big endian integer.
+// A request is followed by exactly one response on the same connection.
+package viewer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxMessageSize is the maximum size of a message. A frame of a 5K display in RGBA is about
+// 60 MiB before it is encoded in base64, so this is large enough for it.
+const maxMessageSize = 128 << 20
+
+// Methods of the request.
+const (
+	methodFrame    = "frame"
+	methodKey      = "key"
+	methodTypeText = "typeText"
+	methodMouse    = "mouse"
+)
+
+type request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type frameResult struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Pix    []byte `json:"pix"`
+}
+
+type typeTextParams struct {
+	Text string `json:"text"`
+}
+
+// Modifier is a set of the modifier keys. The values are same as vz.KeyModifier.
+type Modifier uint
+
+const (
+	// ModifierShift is the Shift key.
+	ModifierShift Modifier = 1 << iota
+
+	// ModifierControl is the Control key.
+	ModifierControl
+
+	// ModifierOption is the Option (Alt) key.
+	ModifierOption
+
+	// ModifierCommand is the Command (Windows) key.
+	ModifierCommand
+)
+
+// KeyAction is the action of a KeyEvent.
+type KeyAction string
+
+const (
+	// KeyDown presses the key.
+	KeyDown KeyAction = "down"
+
+	// KeyUp releases the key.
+	KeyUp KeyAction = "up"
+
+	// KeyPress presses and releases the key with the modifier keys.
+	KeyPress KeyAction = "press"
+)
+
+// KeyEvent is an event of the keyboard.
+type KeyEvent struct {
+	Action KeyAction `json:"action"`
+
+	// KeyCode is the virtual key code, e.g. vz.KeyCodeReturn.
+	KeyCode uint16 `json:"keyCode"`
+
+	Modifiers Modifier `json:"modifiers,omitempty"`
+}
+
+// MouseAction is the action of a MouseEvent.
+type MouseAction string
+
+const (
+	// MouseMove moves the pointer to the position.
+	MouseMove MouseAction = "move"
+
+	// MouseDown presses the button at the position.
+	MouseDown MouseAction = "down"
+
+	// MouseUp releases the button at the position.
+	MouseUp MouseAction = "up"
+
+	// MouseDrag moves the pointer to the position while the left button is pressed.
+	MouseDrag MouseAction = "drag"
+
+	// MouseClick moves the pointer to the position, then presses and releases the button.
+	MouseClick MouseAction = "click"
+)
+
+// MouseButton is a button of the pointing device. The values are same as vz.MouseButton.
+type MouseButton int
+
+const (
+	// MouseButtonLeft is the left (primary) button.
+	MouseButtonLeft MouseButton = iota
+
+	// MouseButtonRight is the right (secondary) button.
+	MouseButtonRight
+)
+
+// MouseEvent is an event of the pointing device.
+type MouseEvent struct {
+	Action MouseAction `json:"action"`
+
+	// Button is ignored for MouseMove and MouseDrag.
+	Button MouseButton `json:"button,omitempty"`
+
+	// X and Y are the position from the top-left corner of the display.
+	// See (*vz.VirtualMachine).MouseMove for the unit.
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// RemoteError is an error which is reported by the server.
+type RemoteError struct {
+	Method  string
+	Message string
+}
+
+// Error implements error interface.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("viewer: %s: %s", e.Method, e.Message)
+}
+
+var errMessageTooLarge = errors.New("viewer: message is too large")
+
+// writeMessage writes v as a length-prefixed JSON message.
+func writeMessage(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxMessageSize {
+		return errMessageTooLarge
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readMessage reads a length-prefixed JSON message to v.
+func readMessage(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxMessageSize {
+		return errMessageTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
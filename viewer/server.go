@@ -0,0 +1,149 @@
+package viewer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net"
+)
+
+// Display is the display of a virtual machine which is served by Server.
+//
+// *vz.VirtualMachine is wrapped to a Display by (*vz.VirtualMachine).ServeViewer.
+type Display interface {
+	// TakeScreenshot captures the current frame of the display.
+	TakeScreenshot() (image.Image, error)
+
+	// Key sends the keyboard event.
+	Key(event KeyEvent) error
+
+	// TypeText types the text as if it is typed on the US keyboard layout.
+	TypeText(text string) error
+
+	// Mouse sends the pointer event.
+	Mouse(event MouseEvent) error
+}
+
+// Server serves the frames and the input of a Display to the viewers.
+//
+// The requests are not authenticated, so anyone who can connect to the listener can see the
+// display and control the virtual machine. Restrict the access to the listener, e.g. by the
+// permission of the directory of the unix domain socket.
+type Server struct {
+	Display Display
+
+	// ReadOnly rejects the keyboard and pointer events, so the viewers can only see the frames.
+	ReadOnly bool
+}
+
+// Serve accepts connections on the listener and serves each connection in a new goroutine.
+//
+// Serve always returns a non-nil error which is returned by Accept.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests on the connection until the connection is closed.
+// The connection is closed when ServeConn returns.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	for {
+		var req request
+		if err := readMessage(conn, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		result, err := s.handle(&req)
+		resp := &response{}
+		if err != nil {
+			resp.Error = err.Error()
+		} else if result != nil {
+			b, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			resp.Result = b
+		}
+		if err := writeMessage(conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+var errReadOnly = errors.New("input is disabled")
+
+func (s *Server) handle(req *request) (interface{}, error) {
+	switch req.Method {
+	case methodFrame:
+		img, err := s.Display.TakeScreenshot()
+		if err != nil {
+			return nil, err
+		}
+		rgba := toRGBA(img)
+		return &frameResult{
+			Width:  rgba.Rect.Dx(),
+			Height: rgba.Rect.Dy(),
+			Pix:    rgba.Pix,
+		}, nil
+	case methodKey:
+		if s.ReadOnly {
+			return nil, errReadOnly
+		}
+		var event KeyEvent
+		if err := json.Unmarshal(req.Params, &event); err != nil {
+			return nil, err
+		}
+		switch event.Action {
+		case KeyDown, KeyUp, KeyPress:
+		default:
+			return nil, fmt.Errorf("unknown key action %q", event.Action)
+		}
+		return nil, s.Display.Key(event)
+	case methodTypeText:
+		if s.ReadOnly {
+			return nil, errReadOnly
+		}
+		var params typeTextParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.Display.TypeText(params.Text)
+	case methodMouse:
+		if s.ReadOnly {
+			return nil, errReadOnly
+		}
+		var event MouseEvent
+		if err := json.Unmarshal(req.Params, &event); err != nil {
+			return nil, err
+		}
+		switch event.Action {
+		case MouseMove, MouseDown, MouseUp, MouseDrag, MouseClick:
+		default:
+			return nil, fmt.Errorf("unknown mouse action %q", event.Action)
+		}
+		return nil, s.Display.Mouse(event)
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+// toRGBA returns img as *image.RGBA whose origin is (0, 0) and whose stride is 4 times the width.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) && rgba.Stride == 4*rgba.Rect.Dx() {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
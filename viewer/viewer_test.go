@@ -0,0 +1,171 @@
+package viewer_test
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/viewer"
+)
+
+type testDisplay struct {
+	frame image.Image
+
+	mu     sync.Mutex
+	keys   []viewer.KeyEvent
+	texts  []string
+	events []viewer.MouseEvent
+}
+
+func (d *testDisplay) TakeScreenshot() (image.Image, error) {
+	if d.frame == nil {
+		return nil, errors.New("screenshot is not available")
+	}
+	return d.frame, nil
+}
+
+func (d *testDisplay) Key(event viewer.KeyEvent) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys = append(d.keys, event)
+	return nil
+}
+
+func (d *testDisplay) TypeText(text string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.texts = append(d.texts, text)
+	return nil
+}
+
+func (d *testDisplay) Mouse(event viewer.MouseEvent) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, event)
+	return nil
+}
+
+func newTestClient(t *testing.T, server *viewer.Server) *viewer.Client {
+	t.Helper()
+	c, s := net.Pipe()
+	go server.ServeConn(s)
+	client := viewer.NewClient(c)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestFrame(t *testing.T) {
+	// the frame which is not *image.RGBA and whose origin is not (0, 0) is converted.
+	src := image.NewNRGBA(image.Rect(10, 10, 13, 12))
+	src.Set(10, 10, color.NRGBA{0xff, 0, 0, 0xff})
+	src.Set(12, 11, color.NRGBA{0, 0, 0xff, 0xff})
+	client := newTestClient(t, &viewer.Server{Display: &testDisplay{frame: src}})
+
+	frame, err := client.Frame(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := frame.Bounds(), image.Rect(0, 0, 3, 2); got != want {
+		t.Fatalf("want bounds %v but got %v", want, got)
+	}
+	if got, want := frame.RGBAAt(0, 0), (color.RGBA{0xff, 0, 0, 0xff}); got != want {
+		t.Errorf("want %v at (0, 0) but got %v", want, got)
+	}
+	if got, want := frame.RGBAAt(2, 1), (color.RGBA{0, 0, 0xff, 0xff}); got != want {
+		t.Errorf("want %v at (2, 1) but got %v", want, got)
+	}
+}
+
+func TestFrameUnavailable(t *testing.T) {
+	client := newTestClient(t, &viewer.Server{Display: &testDisplay{}})
+	_, err := client.Frame(context.Background())
+	var remoteErr *viewer.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("want *viewer.RemoteError but got %v", err)
+	}
+}
+
+func TestInput(t *testing.T) {
+	display := &testDisplay{}
+	client := newTestClient(t, &viewer.Server{Display: display})
+	ctx := context.Background()
+
+	key := viewer.KeyEvent{Action: viewer.KeyPress, KeyCode: 0x30, Modifiers: viewer.ModifierCommand | viewer.ModifierShift}
+	if err := client.Key(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.TypeText(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	mouse := viewer.MouseEvent{Action: viewer.MouseClick, Button: viewer.MouseButtonRight, X: 12.5, Y: 34}
+	if err := client.Mouse(ctx, mouse); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []viewer.KeyEvent{key}; !reflect.DeepEqual(display.keys, want) {
+		t.Errorf("want keys %v but got %v", want, display.keys)
+	}
+	if want := []string{"hello"}; !reflect.DeepEqual(display.texts, want) {
+		t.Errorf("want texts %v but got %v", want, display.texts)
+	}
+	if want := []viewer.MouseEvent{mouse}; !reflect.DeepEqual(display.events, want) {
+		t.Errorf("want mouse events %v but got %v", want, display.events)
+	}
+
+	err := client.Mouse(ctx, viewer.MouseEvent{Action: "scroll"})
+	var remoteErr *viewer.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("want *viewer.RemoteError for the unknown action but got %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	display := &testDisplay{frame: image.NewRGBA(image.Rect(0, 0, 1, 1))}
+	client := newTestClient(t, &viewer.Server{Display: display, ReadOnly: true})
+	ctx := context.Background()
+
+	if _, err := client.Frame(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var remoteErr *viewer.RemoteError
+	if err := client.Key(ctx, viewer.KeyEvent{Action: viewer.KeyDown}); !errors.As(err, &remoteErr) {
+		t.Errorf("want *viewer.RemoteError for Key but got %v", err)
+	}
+	if err := client.TypeText(ctx, "a"); !errors.As(err, &remoteErr) {
+		t.Errorf("want *viewer.RemoteError for TypeText but got %v", err)
+	}
+	if err := client.Mouse(ctx, viewer.MouseEvent{Action: viewer.MouseMove}); !errors.As(err, &remoteErr) {
+		t.Errorf("want *viewer.RemoteError for Mouse but got %v", err)
+	}
+	if len(display.keys)+len(display.texts)+len(display.events) != 0 {
+		t.Error("want no input to be sent to the display")
+	}
+}
+
+func TestContextCanceled(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	client := viewer.NewClient(c)
+	defer client.Close()
+
+	// the server never responds.
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := s.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Frame(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled but got %v", err)
+	}
+}
@@ -1,53 +1,24 @@
+//go:build darwin
+// +build darwin
+
 package vz
 
 /*
 #cgo darwin CFLAGS: -x objective-c -fno-objc-arc
-#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization -framework Cocoa
+#cgo darwin LDFLAGS: -lobjc -framework Foundation -framework Virtualization
 # include "virtualization.h"
 */
 import "C"
 import (
+	"fmt"
+	"os"
 	"runtime"
 	"runtime/cgo"
 	"sync"
+	"time"
 	"unsafe"
-)
-
-func init() {
-	C.sharedApplication()
-}
-
-// VirtualMachineState represents execution state of the virtual machine.
-type VirtualMachineState int
-
-const (
-	// VirtualMachineStateStopped Initial state before the virtual machine is started.
-	VirtualMachineStateStopped VirtualMachineState = iota
-
-	// VirtualMachineStateRunning Running virtual machine.
-	VirtualMachineStateRunning
 
-	// VirtualMachineStatePaused A started virtual machine is paused.
-	// This state can only be transitioned from VirtualMachineStatePausing.
-	VirtualMachineStatePaused
-
-	// VirtualMachineStateError The virtual machine has encountered an internal error.
-	VirtualMachineStateError
-
-	// VirtualMachineStateStarting The virtual machine is configuring the hardware and starting.
-	VirtualMachineStateStarting
-
-	// VirtualMachineStatePausing The virtual machine is being paused.
-	// This is the intermediate state between VirtualMachineStateRunning and VirtualMachineStatePaused.
-	VirtualMachineStatePausing
-
-	// VirtualMachineStateResuming The virtual machine is being resumed.
-	// This is the intermediate state between VirtualMachineStatePaused and VirtualMachineStateRunning.
-	VirtualMachineStateResuming
-
-	// VZVirtualMachineStateStopping The virtual machine is being stopped.
-	// This is the intermediate state between VZVirtualMachineStateRunning and VZVirtualMachineStateStop.
-	VirtualMachineStateStopping
+	"github.com/Code-Hex/vz/v2/internal/eventqueue"
 )
 
 // VirtualMachine represents the entire state of a single virtual machine.
@@ -75,13 +46,74 @@ type VirtualMachine struct {
 	dispatchQueue unsafe.Pointer
 	status        cgo.Handle
 
+	// queue owns dispatchQueue, which is released when queue is not reachable.
+	queue *DispatchQueue
+
+	networkAttachments *networkAttachments
+
+	// consoleAttachments are the attachments which are set to the console ports while running.
+	consoleAttachments consolePortAttachments
+
+	// config is the configuration which the virtual machine is created with.
+	config *VirtualMachineConfiguration
+
+	// savedStateInfo, diskFiles and ephemeralDisks are taken from config by NewVirtualMachine,
+	// so the changes of config after that do not affect the saved states and the locks.
+	// These are nil for the adopted virtual machine.
+	savedStateInfo *SavedStateInfo
+	diskFiles      []diskFile
+	ephemeralDisks []*EphemeralDiskAttachment
+
+	// the configured resources which are the upper limits of SetResources.
+	cpuCount   uint
+	memorySize uint64
+
+	// the size of the first display which is used for the headless view.
+	displayWidth  float64
+	displayHeight float64
+
 	mu sync.Mutex
+
+	// headless is created on demand and guarded by mu.
+	headless *headlessView
+
+	// host finds the host process which runs the virtual machine for Stats.
+	// This is nil for the adopted virtual machine.
+	host *hostProcess
 }
 
+var _ VM = (*VirtualMachine)(nil)
+
 type machineStatus struct {
 	state       VirtualMachineState
 	stateNotify chan VirtualMachineState
 
+	// for Stats method.
+	stateChangedAt   time.Time
+	startedAt        time.Time
+	stateTransitions uint64
+	lastError        error
+
+	// observers are called after the state is changed.
+	observers      map[int]func(VirtualMachineState)
+	nextObserverID int
+
+	// observerQueue and notifyQueue deliver the states to the observers and stateNotify.
+	// These are not changed after initialized.
+	observerQueue *eventqueue.Queue
+	notifyQueue   *eventqueue.Queue
+
+	// diskLocks are the locks of the files of the configuration which are held while the
+	// virtual machine is not stopped. nil means that the files are not locked.
+	diskLocks []*os.File
+
+	// ephemeralDisks are removed when the virtual machine is stopped. These are set with diskLocks.
+	ephemeralDisks []*EphemeralDiskAttachment
+
+	// id and logger are not changed after initialized.
+	id     string
+	logger Logger
+
 	mu sync.RWMutex
 }
 
@@ -90,39 +122,122 @@ type machineStatus struct {
 // The configuration must be valid. Validation can be performed at runtime with (*VirtualMachineConfiguration).Validate() method.
 // The configuration is copied by the initializer.
 //
-// A new dispatch queue will create when called this function.
+// A new dispatch queue will create when called this function unless WithDispatchQueue is given.
 // Every operation on the virtual machine must be done on that queue. The callbacks and delegate methods are invoked on that queue.
-func NewVirtualMachine(config *VirtualMachineConfiguration) *VirtualMachine {
+// The completion handlers and the state changes are delivered to Go on other goroutines, so receiving them slowly
+// never blocks the queue. See VirtualMachineStats for the depth of the queued state changes.
+//
+// If the framework rejects the configuration by raising an exception, NewVirtualMachine panics with
+// the error which satisfies errors.Is(err, ErrObjCException) instead of aborting the process.
+// Use NewVirtualMachineWithError to get the error instead.
+func NewVirtualMachine(config *VirtualMachineConfiguration, opts ...VirtualMachineOption) *VirtualMachine {
+	v, err := NewVirtualMachineWithError(config, opts...)
+	if err != nil {
+		panic(fmt.Errorf("vz: NewVirtualMachine: %w", err))
+	}
+	return v
+}
+
+// NewVirtualMachineWithError is same as NewVirtualMachine, but returns the error instead of panicking
+// if the framework rejects the configuration. Manager.Add also returns the error.
+func NewVirtualMachineWithError(config *VirtualMachineConfiguration, opts ...VirtualMachineOption) (*VirtualMachine, error) {
+	options := &virtualMachineOptions{
+		logger: nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+
 	// should not call Free function for this string.
 	cs := getUUID()
-	dispatchQueue := C.makeDispatchQueue(cs.CString())
+	queue := options.dispatchQueue
+	if queue == nil {
+		queue = NewDispatchQueue(cs.String(), DispatchQueueQoSClassDefault)
+	}
+	dispatchQueue := queue.Ptr()
 
-	status := cgo.NewHandle(&machineStatus{
-		state:       VirtualMachineState(0),
-		stateNotify: make(chan VirtualMachineState),
-	})
+	ms := newMachineStatus(cs.String(), options.logger)
+	status := cgo.NewHandle(ms)
+
+	// the process of the virtual machine is spawned after this.
+	host := newHostProcess()
+
+	nserr := newNSErrorAsNil()
+	nserrPtr := nserr.Ptr()
+	ptr := C.newVZVirtualMachineWithDispatchQueue(
+		config.Ptr(),
+		dispatchQueue,
+		unsafe.Pointer(&status),
+		&nserrPtr,
+	)
+	if err := newNSError(nserrPtr); err != nil {
+		ms.observerQueue.Close()
+		ms.notifyQueue.Close()
+		status.Delete()
+		return nil, err
+	}
 
 	v := &VirtualMachine{
-		id: cs.String(),
-		pointer: pointer{
-			ptr: C.newVZVirtualMachineWithDispatchQueue(
-				config.Ptr(),
-				dispatchQueue,
-				unsafe.Pointer(&status),
-			),
-		},
-		dispatchQueue: dispatchQueue,
-		status:        status,
+		id:                 cs.String(),
+		pointer:            newPointer(ptr),
+		dispatchQueue:      dispatchQueue,
+		queue:              queue,
+		status:             status,
+		networkAttachments: newNetworkAttachments(config.networkDevices),
+		config:             config,
+		host:               host,
 	}
+	v.savedStateInfo = config.SavedStateInfo()
+	v.diskFiles, v.ephemeralDisks = config.diskFiles(), config.ephemeralDisks()
+	v.cpuCount, v.memorySize = config.cpuCount, config.memorySize
+	v.displayWidth, v.displayHeight = config.displaySize()
+	setVirtualMachineFinalizer(v)
+	return v, nil
+}
 
+func newMachineStatus(id string, logger Logger) *machineStatus {
+	ms := &machineStatus{
+		state:          VirtualMachineState(0),
+		stateNotify:    make(chan VirtualMachineState),
+		stateChangedAt: time.Now(),
+		id:             id,
+		logger:         logger,
+	}
+	ms.observerQueue = eventqueue.New(ms.notifyObservers)
+	ms.notifyQueue = eventqueue.New(ms.sendStateNotify)
+	return ms
+}
+
+func setVirtualMachineFinalizer(v *VirtualMachine) {
 	runtime.SetFinalizer(v, func(self *VirtualMachine) {
+		if self.headless != nil {
+			self.headless.release()
+		}
+		ms, _ := self.status.Value().(*machineStatus)
+		ms.observerQueue.Close()
+		ms.notifyQueue.Close()
+		unlockDiskFiles(ms.diskLocks)
+		self.host.release()
 		self.status.Delete()
-		releaseDispatch(self.dispatchQueue)
 		self.Release()
 	})
-	return v
 }
 
+// ID returns the identifier of the virtual machine. This is a UUID which is generated by
+// NewVirtualMachine, and also used as the "id" of the logs and the label of the dispatch queue
+// which is created by NewVirtualMachine.
+func (v *VirtualMachine) ID() string { return v.id }
+
+// Configuration returns the configuration which the virtual machine is created with.
+// This is nil for the virtual machine which is adopted by AdoptVirtualMachine.
+//
+// This is the same object which is passed to NewVirtualMachine, not a copy, and its getters return
+// the slices which are shared with the caller of the setters. It must not be mutated: the running
+// virtual machine is not changed by it, but the results of this method are. The devices of the
+// configuration can be inspected by its getters, e.g. StorageDevices and GraphicsDevices. The runtime
+// devices are returned by SocketDevices, MemoryBalloonDevices and NetworkDevices of the virtual machine.
+func (v *VirtualMachine) Configuration() *VirtualMachineConfiguration { return v.config }
+
 // SocketDevices return the list of socket devices configured on this virtual machine.
 // Return an empty array if no socket device is configured.
 //
@@ -135,7 +250,7 @@ func (v *VirtualMachine) SocketDevices() []*VirtioSocketDevice {
 			ptr: C.VZVirtualMachine_socketDevices(v.Ptr()),
 		},
 	}
-	ptrs := nsArray.ToPointerSlice()
+	ptrs := nsArray.toRetainedPointerSlice()
 	socketDevices := make([]*VirtioSocketDevice, len(ptrs))
 	for i, ptr := range ptrs {
 		socketDevices[i] = newVirtioSocketDevice(ptr, v.dispatchQueue)
@@ -143,6 +258,51 @@ func (v *VirtualMachine) SocketDevices() []*VirtioSocketDevice {
 	return socketDevices
 }
 
+// MemoryBalloonDevices return the list of memory balloon devices configured on this virtual machine.
+// Return an empty array if no memory balloon device is configured.
+//
+// Since only NewVirtioTraditionalMemoryBalloonDeviceConfiguration is available in vz package,
+// it will always return VirtioTraditionalMemoryBalloonDevice.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtualmachine/3656701-memoryballoondevices?language=objc
+func (v *VirtualMachine) MemoryBalloonDevices() []*VirtioTraditionalMemoryBalloonDevice {
+	nsArray := &NSArray{
+		pointer: pointer{
+			ptr: C.VZVirtualMachine_memoryBalloonDevices(v.Ptr()),
+		},
+	}
+	ptrs := nsArray.toRetainedPointerSlice()
+	balloonDevices := make([]*VirtioTraditionalMemoryBalloonDevice, len(ptrs))
+	for i, ptr := range ptrs {
+		balloonDevices[i] = newVirtioTraditionalMemoryBalloonDevice(ptr, v.dispatchQueue)
+	}
+	return balloonDevices
+}
+
+// NetworkDevices return the list of network devices configured on this virtual machine.
+// Return an empty array if no network device is configured.
+//
+// The attachment of the returned network device can be replaced while the virtual machine is running.
+//
+// This is only supported on macOS 13 and newer, ErrUnsupportedOSVersion will
+// be returned on older versions.
+// see: https://developer.apple.com/documentation/virtualization/vzvirtualmachine/3999494-networkdevices?language=objc
+func (v *VirtualMachine) NetworkDevices() ([]*NetworkDevice, error) {
+	if err := macOSAvailable(13, 0); err != nil {
+		return nil, err
+	}
+	nsArray := &NSArray{
+		pointer: pointer{
+			ptr: C.VZVirtualMachine_networkDevices(v.Ptr()),
+		},
+	}
+	ptrs := nsArray.toRetainedPointerSlice()
+	networkDevices := make([]*NetworkDevice, len(ptrs))
+	for i, ptr := range ptrs {
+		networkDevices[i] = newNetworkDevice(ptr, v.dispatchQueue, i, v.networkAttachments)
+	}
+	return networkDevices, nil
+}
+
 //export changeStateOnObserver
 func changeStateOnObserver(state C.int, cgoHandlerPtr unsafe.Pointer) {
 	status := *(*cgo.Handle)(cgoHandlerPtr)
@@ -151,10 +311,85 @@ func changeStateOnObserver(state C.int, cgoHandlerPtr unsafe.Pointer) {
 	v, _ := status.Value().(*machineStatus)
 	v.mu.Lock()
 	newState := VirtualMachineState(state)
+	previousState := v.state
+	v.recordStateLocked(newState)
 	v.state = newState
-	// for non-blocking
-	go func() { v.stateNotify <- newState }()
+	var diskLocks []*os.File
+	var ephemeralDisks []*EphemeralDiskAttachment
+	if newState == VirtualMachineStateStopped || newState == VirtualMachineStateError {
+		// this is called on the dispatch queue before the completion handler of the
+		// operation, so the next Start can lock the files again.
+		diskLocks, v.diskLocks = v.diskLocks, nil
+		ephemeralDisks, v.ephemeralDisks = v.ephemeralDisks, nil
+	}
 	v.mu.Unlock()
+	unlockDiskFiles(diskLocks)
+	removeEphemeralDisks(ephemeralDisks)
+	v.logger.Info("virtual machine state changed", "id", v.id, "state", newState.String(), "previous", previousState.String())
+	// This is called on the dispatch queue, so the receivers must not block it.
+	// The queues deliver the states in order on their own goroutines.
+	v.observerQueue.Push(newState)
+	v.notifyQueue.Push(newState)
+}
+
+// notifyObservers calls the observers with state. This is the deliver function of observerQueue.
+func (m *machineStatus) notifyObservers(state interface{}) {
+	m.mu.RLock()
+	observers := make([]func(VirtualMachineState), 0, len(m.observers))
+	for _, fn := range m.observers {
+		observers = append(observers, fn)
+	}
+	m.mu.RUnlock()
+	for _, fn := range observers {
+		fn(state.(VirtualMachineState))
+	}
+}
+
+// sendStateNotify sends state to the channel which is returned by StateChangedNotify.
+// This is the deliver function of notifyQueue, so a slow receiver makes only the queue longer.
+func (m *machineStatus) sendStateNotify(state interface{}) {
+	select {
+	case m.stateNotify <- state.(VirtualMachineState):
+	case <-m.notifyQueue.Done():
+	}
+}
+
+// addStateObserver registers fn which is called every time the state is changed.
+// The observers are called in order on the goroutine of observerQueue, so fn should not block
+// for long. The returned function unregisters fn.
+func (v *VirtualMachine) addStateObserver(fn func(VirtualMachineState)) (remove func()) {
+	// I expected it will not cause panic.
+	// if caused panic, that's unexpected behavior.
+	val, _ := v.status.Value().(*machineStatus)
+	val.mu.Lock()
+	defer val.mu.Unlock()
+	if val.observers == nil {
+		val.observers = make(map[int]func(VirtualMachineState))
+	}
+	id := val.nextObserverID
+	val.nextObserverID++
+	val.observers[id] = fn
+	return func() {
+		val.mu.Lock()
+		defer val.mu.Unlock()
+		delete(val.observers, id)
+	}
+}
+
+//export virtualMachineDidStopHandler
+func virtualMachineDidStopHandler(cgoHandlerPtr, errPtr unsafe.Pointer) {
+	status := *(*cgo.Handle)(cgoHandlerPtr)
+	// I expected it will not cause panic.
+	// if caused panic, that's unexpected behavior.
+	v, _ := status.Value().(*machineStatus)
+	if err := newNSError(errPtr); err != nil {
+		v.mu.Lock()
+		v.lastError = err
+		v.mu.Unlock()
+		v.logger.Error("virtual machine stopped with error", "id", v.id, "err", err)
+		return
+	}
+	v.logger.Info("guest stopped virtual machine", "id", v.id)
 }
 
 // State represents execution state of the virtual machine.
@@ -215,24 +450,43 @@ func virtualMachineCompletionHandler(cgoHandlerPtr, errPtr unsafe.Pointer) {
 	}
 }
 
-func makeHandler(fn func(error)) (func(error), chan struct{}) {
+// makeHandler returns the completion handler which is passed to obj-c and the function to wait for it.
+//
+// The completion handler is called on the dispatch queue, so it only stores the error and wakes
+// up the waiter. fn is called by wait on the goroutine of the caller, so a slow fn never blocks
+// the dispatch queue of the virtual machine.
+func makeHandler(fn func(error)) (handler func(error), wait func()) {
 	done := make(chan struct{})
-	return func(err error) {
-		fn(err)
+	var result error
+	handler = func(err error) {
+		result = err
 		close(done)
-	}, done
+	}
+	wait = func() {
+		<-done
+		fn(result)
+	}
+	return handler, wait
 }
 
 // Start a virtual machine that is in either Stopped or Error state.
 //
 // - fn parameter called after the virtual machine has been successfully started or on error.
 // The error parameter passed to the block is null if the start was successful.
+//
+// The disk images and the auxiliary storage are locked until the virtual machine is stopped.
+// If any of them is used by another virtual machine, fn is called with an error which wraps
+// ErrDiskInUse without starting.
 func (v *VirtualMachine) Start(fn func(error)) {
-	h, done := makeHandler(fn)
+	start, ok := v.diskLockedHandler("start", fn)
+	if !ok {
+		return
+	}
+	h, wait := makeHandler(start)
 	handler := cgo.NewHandle(h)
 	defer handler.Delete()
 	C.startWithCompletionHandler(v.Ptr(), v.dispatchQueue, unsafe.Pointer(&handler))
-	<-done
+	wait()
 }
 
 // Pause a virtual machine that is in Running state.
@@ -240,11 +494,11 @@ func (v *VirtualMachine) Start(fn func(error)) {
 // - fn parameter called after the virtual machine has been successfully paused or on error.
 // The error parameter passed to the block is null if the pause was successful.
 func (v *VirtualMachine) Pause(fn func(error)) {
-	h, done := makeHandler(fn)
+	h, wait := makeHandler(v.recordErrorHandler("pause", fn))
 	handler := cgo.NewHandle(h)
 	defer handler.Delete()
 	C.pauseWithCompletionHandler(v.Ptr(), v.dispatchQueue, unsafe.Pointer(&handler))
-	<-done
+	wait()
 }
 
 // Resume a virtual machine that is in the Paused state.
@@ -252,11 +506,11 @@ func (v *VirtualMachine) Pause(fn func(error)) {
 // - fn parameter called after the virtual machine has been successfully resumed or on error.
 // The error parameter passed to the block is null if the resumption was successful.
 func (v *VirtualMachine) Resume(fn func(error)) {
-	h, done := makeHandler(fn)
+	h, wait := makeHandler(v.recordErrorHandler("resume", fn))
 	handler := cgo.NewHandle(h)
 	defer handler.Delete()
 	C.resumeWithCompletionHandler(v.Ptr(), v.dispatchQueue, unsafe.Pointer(&handler))
-	<-done
+	wait()
 }
 
 // RequestStop requests that the guest turns itself off.
@@ -268,8 +522,10 @@ func (v *VirtualMachine) RequestStop() (bool, error) {
 	nserrPtr := nserr.Ptr()
 	ret := (bool)(C.requestStopVirtualMachine(v.Ptr(), v.dispatchQueue, &nserrPtr))
 	if err := newNSError(nserrPtr); err != nil {
+		v.recordError("requestStop", err)
 		return ret, err
 	}
+	v.logger().Info("virtual machine operation completed", "id", v.id, "op", "requestStop")
 	return ret, nil
 }
 
@@ -281,16 +537,9 @@ func (v *VirtualMachine) RequestStop() (bool, error) {
 // Warning: This is a destructive operation. It stops the VM without
 // giving the guest a chance to stop cleanly.
 func (v *VirtualMachine) Stop(fn func(error)) {
-	h, done := makeHandler(fn)
+	h, wait := makeHandler(v.recordErrorHandler("stop", fn))
 	handler := cgo.NewHandle(h)
 	defer handler.Delete()
 	C.stopWithCompletionHandler(v.Ptr(), v.dispatchQueue, unsafe.Pointer(&handler))
-	<-done
-}
-
-// StartGraphicApplication starts an application to display graphics of the VM.
-//
-// You must to call runtime.LockOSThread before calling this method.
-func (v *VirtualMachine) StartGraphicApplication(width, height float64) {
-	C.startVirtualMachineWindow(v.Ptr(), C.double(width), C.double(height))
+	wait()
 }
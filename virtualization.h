@@ -9,16 +9,74 @@
 #import <Foundation/Foundation.h>
 #import <Virtualization/Virtualization.h>
 
+// The Go side checks the running macOS version before calling the functions which
+// use newer APIs. This exception is raised if the check has been bypassed or the
+// program was built with an older SDK.
+#define RAISE_UNSUPPORTED_MACOS_EXCEPTION() [NSException raise:@"UnhandledAvailabilityException" format:@"your macOS version or SDK may not be supported"]
+
+// newNSArrayWithObjects creates an array of the objects which are passed from Go as a C array,
+// so a list of objects is set in a single cgo call. The caller must release the array.
+static inline NSArray *newNSArrayWithObjects(void **objects, unsigned long count)
+{
+    return [[NSArray alloc] initWithObjects:(id *)objects count:(NSUInteger)count];
+}
+
+// The framework raises NSException for the misuse of the API, e.g. an invalid configuration
+// which is passed to VZVirtualMachine. An uncaught exception aborts the whole process, so the
+// functions which may raise catch it and return it as NSError in this domain to Go.
+//
+// The exceptions are caught by every function which takes a `void **error` parameter or
+// a completion handler, including RAISE_UNSUPPORTED_MACOS_EXCEPTION in them (see
+// SET_UNSUPPORTED_MACOS_ERROR). These are the initializers of the virtual machine, the disk
+// and serial port attachments and the auxiliary storage, the validations, the operations of
+// the virtual machine (start, pause, resume, stop, request stop, save and restore), the
+// connection of the socket device, the replacement of the network attachment, the macOS
+// restore image and installer, and the headless view of AppKit.
+//
+// The other functions, i.e. the setters and getters of the configurations and the
+// constructors which can not fail, are not covered: the Go side passes only the objects of
+// the expected classes and checks the macOS version before calling them, so an exception
+// raised by them is a bug of this package and aborts the process.
+#define VZ_OBJC_EXCEPTION_ERROR_DOMAIN @"VZObjCExceptionErrorDomain"
+
+NSError *newNSErrorWithException(NSException *exception);
+void setErrorWithException(void **error, NSException *exception);
+
+// VZ_CATCH_EXCEPTION runs the statements and assigns the exception which is raised by them to
+// *error as NSError in VZ_OBJC_EXCEPTION_ERROR_DOMAIN. The error is autoreleased, so this must
+// not be used in an @autoreleasepool which is drained before the error is returned to Go.
+#define VZ_CATCH_EXCEPTION(error, ...)                          \
+    do {                                                        \
+        @try {                                                  \
+            __VA_ARGS__                                         \
+        } @catch (NSException * exception) {                    \
+            setErrorWithException((void **)(error), exception); \
+        }                                                       \
+    } while (0)
+
+// SET_UNSUPPORTED_MACOS_ERROR assigns the exception of RAISE_UNSUPPORTED_MACOS_EXCEPTION to
+// *error instead of raising it.
+#define SET_UNSUPPORTED_MACOS_ERROR(error) VZ_CATCH_EXCEPTION((error), RAISE_UNSUPPORTED_MACOS_EXCEPTION();)
+
 /* exported from cgo */
 void virtualMachineCompletionHandler(void *cgoHandler, void *errPtr);
 void connectionHandler(void *connection, void *err, void *cgoHandlerPtr);
 void changeStateOnObserver(int state, void *cgoHandler);
+void virtualMachineDidStopHandler(void *cgoHandler, void *errPtr);
 bool shouldAcceptNewConnectionHandler(void *listener, void *connection, void *socketDevice);
+void dispatchQueueHandler(uintptr_t handle);
 
 @interface Observer : NSObject
 - (void)observeValueForKeyPath:(NSString *)keyPath ofObject:(id)object change:(NSDictionary *)change context:(void *)context;
 @end
 
+/* VZVirtualMachineDelegate */
+@interface VZVirtualMachineDelegateImpl : NSObject <VZVirtualMachineDelegate>
+- (instancetype)initWithStatusHandler:(void *)statusHandler;
+- (void)guestDidStopVirtualMachine:(VZVirtualMachine *)virtualMachine;
+- (void)virtualMachine:(VZVirtualMachine *)virtualMachine didStopWithError:(NSError *)error;
+@end
+
 /* VZVirtioSocketListener */
 @interface VZVirtioSocketListenerDelegateImpl : NSObject <VZVirtioSocketListenerDelegate>
 - (BOOL)listener:(VZVirtioSocketListener *)listener shouldAcceptNewConnection:(VZVirtioSocketConnection *)connection fromSocketDevice:(VZVirtioSocketDevice *)socketDevice;
@@ -38,42 +96,45 @@ unsigned int maximumAllowedCPUCountVZVirtualMachineConfiguration();
 void *newVZVirtualMachineConfiguration(void *bootLoader,
     unsigned int CPUCount,
     unsigned long long memorySize);
-void setEntropyDevicesVZVirtualMachineConfiguration(void *config,
-    void *entropyDevices);
-void setMemoryBalloonDevicesVZVirtualMachineConfiguration(void *config,
-    void *memoryBalloonDevices);
-void setNetworkDevicesVZVirtualMachineConfiguration(void *config,
-    void *networkDevices);
-void setSerialPortsVZVirtualMachineConfiguration(void *config,
-    void *serialPorts);
-void setSocketDevicesVZVirtualMachineConfiguration(void *config,
-    void *socketDevices);
-void setStorageDevicesVZVirtualMachineConfiguration(void *config,
-    void *storageDevices);
-void setDirectorySharingDevicesVZVirtualMachineConfiguration(void *config, void *directorySharingDevices);
+void setBootLoaderVZVirtualMachineConfiguration(void *config, void *bootLoader);
+void setCPUCountVZVirtualMachineConfiguration(void *config, unsigned int CPUCount);
+void setMemorySizeVZVirtualMachineConfiguration(void *config, unsigned long long memorySize);
+void setEntropyDevicesVZVirtualMachineConfiguration(void *config, void **entropyDevices, unsigned long count);
+void setMemoryBalloonDevicesVZVirtualMachineConfiguration(void *config, void **memoryBalloonDevices, unsigned long count);
+void setNetworkDevicesVZVirtualMachineConfiguration(void *config, void **networkDevices, unsigned long count);
+void setSerialPortsVZVirtualMachineConfiguration(void *config, void **serialPorts, unsigned long count);
+void setSocketDevicesVZVirtualMachineConfiguration(void *config, void **socketDevices, unsigned long count);
+void setStorageDevicesVZVirtualMachineConfiguration(void *config, void **storageDevices, unsigned long count);
+void setDirectorySharingDevicesVZVirtualMachineConfiguration(void *config, void **directorySharingDevices, unsigned long count);
 void setPlatformVZVirtualMachineConfiguration(void *config,
     void *platform);
-void setGraphicsDevicesVZVirtualMachineConfiguration(void *config,
-    void *graphicsDevices);
-void setPointingDevicesVZVirtualMachineConfiguration(void *config,
-    void *pointingDevices);
-void setKeyboardsVZVirtualMachineConfiguration(void *config,
-    void *keyboards);
-void setAudioDevicesVZVirtualMachineConfiguration(void *config,
-    void *audioDevices);
+void setGraphicsDevicesVZVirtualMachineConfiguration(void *config, void **graphicsDevices, unsigned long count);
+void setPointingDevicesVZVirtualMachineConfiguration(void *config, void **pointingDevices, unsigned long count);
+void setKeyboardsVZVirtualMachineConfiguration(void *config, void **keyboards, unsigned long count);
+void setAudioDevicesVZVirtualMachineConfiguration(void *config, void **audioDevices, unsigned long count);
+void setConsoleDevicesVZVirtualMachineConfiguration(void *config, void **consoleDevices, unsigned long count);
 
 /* Configurations */
 void *newVZFileHandleSerialPortAttachment(int readFileDescriptor, int writeFileDescriptor);
 void *newVZFileSerialPortAttachment(const char *filePath, bool shouldAppend, void **error);
 void *newVZVirtioConsoleDeviceSerialPortConfiguration(void *attachment);
+void *newVZVirtioConsoleDeviceConfiguration(void);
+unsigned int VZVirtioConsoleDeviceConfiguration_maximumPortCount(void *config);
+void VZVirtioConsoleDeviceConfiguration_setMaximumPortCount(void *config, unsigned int maximumPortCount);
+void VZVirtioConsoleDeviceConfiguration_setPort(void *config, unsigned int index, void *port);
+void *newVZVirtioConsolePortConfiguration(const char *name, bool isConsole, void *attachment);
 void *newVZBridgedNetworkDeviceAttachment(void *networkInterface);
 void *newVZNATNetworkDeviceAttachment(void);
 void *newVZFileHandleNetworkDeviceAttachment(int fileDescriptor);
+void setMaximumTransmissionUnitVZFileHandleNetworkDeviceAttachment(void *attachment, NSInteger mtu);
 void *newVZVirtioNetworkDeviceConfiguration(void *attachment);
 void setNetworkDevicesVZMACAddress(void *config, void *macAddress);
 void *newVZVirtioEntropyDeviceConfiguration(void);
 void *newVZVirtioBlockDeviceConfiguration(void *attachment);
+bool validateBlockDeviceIdentifierVZVirtioBlockDeviceConfiguration(const char *identifier, void **error);
+void setBlockDeviceIdentifierVZVirtioBlockDeviceConfiguration(void *blockDeviceConfiguration, const char *identifier);
 void *newVZDiskImageStorageDeviceAttachment(const char *diskPath, bool readOnly, void **error);
+void *newVZDiskImageStorageDeviceAttachmentWithCacheAndSync(const char *diskPath, bool readOnly, int cacheMode, int syncMode, void **error);
 void *newVZVirtioTraditionalMemoryBalloonDeviceConfiguration();
 void *newVZVirtioSocketDeviceConfiguration();
 void *newVZMACAddress(const char *macAddress);
@@ -86,13 +147,23 @@ void *newVZMultipleDirectoryShare(void *sharedDirectories);
 void *newVZVirtioFileSystemDeviceConfiguration(const char *tag);
 void setVZVirtioFileSystemDeviceConfigurationShare(void *config, void *share);
 void *VZVirtualMachine_socketDevices(void *machine);
+void *VZVirtualMachine_memoryBalloonDevices(void *machine);
+void *VZVirtualMachine_networkDevices(void *machine);
+void VZNetworkDevice_setAttachment(void *networkDevice, void *vmQueue, void *attachment, void **error);
+void *VZVirtualMachine_consoleDevices(void *machine);
+unsigned int VZVirtioConsoleDevice_maximumPortCount(void *consoleDevice, void *vmQueue);
+void *VZVirtioConsoleDevice_port(void *consoleDevice, void *vmQueue, unsigned int index);
+char *VZVirtioConsolePort_name(void *consolePort, void *vmQueue);
+void VZVirtioConsolePort_setAttachment(void *consolePort, void *vmQueue, void *attachment);
+unsigned long long VZVirtioTraditionalMemoryBalloonDevice_getTargetVirtualMachineMemorySize(void *balloonDevice, void *vmQueue);
+void VZVirtioTraditionalMemoryBalloonDevice_setTargetVirtualMachineMemorySize(void *balloonDevice, void *vmQueue, unsigned long long memorySize);
 void VZVirtioSocketDevice_setSocketListenerForPort(void *socketDevice, void *vmQueue, void *listener, uint32_t port);
 void VZVirtioSocketDevice_removeSocketListenerForPort(void *socketDevice, void *vmQueue, uint32_t port);
 void VZVirtioSocketDevice_connectToPort(void *socketDevice, void *vmQueue, uint32_t port, void *cgoHandlerPtr);
 void *newVZUSBScreenCoordinatePointingDeviceConfiguration();
 void *newVZUSBKeyboardConfiguration();
 void *newVZVirtioSoundDeviceConfiguration();
-void setStreamsVZVirtioSoundDeviceConfiguration(void *audioDeviceConfiguration, void *streams);
+void setStreamsVZVirtioSoundDeviceConfiguration(void *audioDeviceConfiguration, void **streams, unsigned long count);
 void *newVZVirtioSoundDeviceInputStreamConfiguration();
 void *newVZVirtioSoundDeviceHostInputStreamConfiguration(); // use in Go
 void *newVZVirtioSoundDeviceOutputStreamConfiguration();
@@ -100,19 +171,28 @@ void *newVZVirtioSoundDeviceHostOutputStreamConfiguration(); // use in Go
 void *newVZGenericPlatformConfiguration();
 
 /* VirtualMachine */
-void *newVZVirtualMachineWithDispatchQueue(void *config, void *queue, void *statusHandler);
+void *newVZVirtualMachineWithDispatchQueue(void *config, void *queue, void *statusHandler, void **error);
+int adoptVZVirtualMachine(void *machine, void *queue, void *statusHandler);
 bool requestStopVirtualMachine(void *machine, void *queue, void **error);
 void startWithCompletionHandler(void *machine, void *queue, void *completionHandler);
 void pauseWithCompletionHandler(void *machine, void *queue, void *completionHandler);
 void resumeWithCompletionHandler(void *machine, void *queue, void *completionHandler);
 void stopWithCompletionHandler(void *machine, void *queue, void *completionHandler);
+bool validateSaveRestoreSupportVZVirtualMachineConfiguration(void *config, void **error);
+void saveMachineStateToPath(void *machine, void *queue, const char *path, void *completionHandler);
+void restoreMachineStateFromPath(void *machine, void *queue, const char *path, void *completionHandler);
 bool vmCanStart(void *machine, void *queue);
 bool vmCanPause(void *machine, void *queue);
 bool vmCanResume(void *machine, void *queue);
 bool vmCanRequestStop(void *machine, void *queue);
 bool vmCanStop(void *machine, void *queue);
 
-void *makeDispatchQueue(const char *label);
+void *makeDispatchQueue(const char *label, int qos);
+void *mainDispatchQueue(void);
+void retainDispatchQueue(void *queue);
+const char *dispatchQueueLabel(void *queue);
+void dispatchSyncGoFunc(void *queue, uintptr_t handle);
+void dispatchAsyncGoFunc(void *queue, uintptr_t handle);
 
 /* VZVirtioSocketConnection */
 typedef struct VZVirtioSocketConnectionFlat {
@@ -122,6 +202,3 @@ typedef struct VZVirtioSocketConnectionFlat {
 } VZVirtioSocketConnectionFlat;
 
 VZVirtioSocketConnectionFlat convertVZVirtioSocketConnection2Flat(void *connection);
-
-void sharedApplication();
-void startVirtualMachineWindow(void *machine, double width, double height);
\ No newline at end of file
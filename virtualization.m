@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 //
 //  virtualization.m
 //
@@ -5,7 +8,6 @@
 //
 
 #import "virtualization.h"
-#import "virtualization_view.h"
 
 char *copyCString(NSString *nss)
 {
@@ -15,6 +17,33 @@ char *copyCString(NSString *nss)
     return c;
 }
 
+/*!
+ @abstract Convert the exception to NSError in VZ_OBJC_EXCEPTION_ERROR_DOMAIN.
+ @discussion
+    The localized description is the name and the reason of the exception, and the name is
+    also stored in the user info with the key "ExceptionName". The error is autoreleased.
+ */
+NSError *newNSErrorWithException(NSException *exception)
+{
+    NSString *reason = exception.reason ?: @"";
+    NSDictionary *userInfo = @{
+        NSLocalizedDescriptionKey : [NSString stringWithFormat:@"%@: %@", exception.name, reason],
+        NSLocalizedFailureReasonErrorKey : reason,
+        @"ExceptionName" : exception.name,
+    };
+    return [NSError errorWithDomain:VZ_OBJC_EXCEPTION_ERROR_DOMAIN code:0 userInfo:userInfo];
+}
+
+/*!
+ @abstract Assign the error which is converted from the exception if error is not NULL.
+ */
+void setErrorWithException(void **error, NSException *exception)
+{
+    if (error != NULL) {
+        *error = newNSErrorWithException(exception);
+    }
+}
+
 @implementation Observer
 - (void)observeValueForKeyPath:(NSString *)keyPath ofObject:(id)object change:(NSDictionary *)change context:(void *)context;
 {
@@ -35,6 +64,27 @@ char *copyCString(NSString *nss)
 }
 @end
 
+@implementation VZVirtualMachineDelegateImpl {
+    void *_statusHandler;
+}
+- (instancetype)initWithStatusHandler:(void *)statusHandler
+{
+    self = [super init];
+    _statusHandler = statusHandler;
+    return self;
+}
+
+- (void)guestDidStopVirtualMachine:(VZVirtualMachine *)virtualMachine
+{
+    virtualMachineDidStopHandler(_statusHandler, nil);
+}
+
+- (void)virtualMachine:(VZVirtualMachine *)virtualMachine didStopWithError:(NSError *)error
+{
+    virtualMachineDidStopHandler(_statusHandler, error);
+}
+@end
+
 @implementation VZVirtioSocketListenerDelegateImpl
 - (BOOL)listener:(VZVirtioSocketListener *)listener shouldAcceptNewConnection:(VZVirtioSocketConnection *)connection fromSocketDevice:(VZVirtioSocketDevice *)socketDevice;
 {
@@ -96,8 +146,11 @@ void setInitialRamdiskURLVZLinuxBootLoader(void *bootLoaderPtr, const char *ramd
  */
 bool validateVZVirtualMachineConfiguration(void *config, void **error)
 {
-    return (bool)[(VZVirtualMachineConfiguration *)config
-        validateWithError:(NSError *_Nullable *_Nullable)error];
+    VZ_CATCH_EXCEPTION(error, {
+        return (bool)[(VZVirtualMachineConfiguration *)config
+            validateWithError:(NSError *_Nullable *_Nullable)error];
+    });
+    return false;
 }
 
 /*!
@@ -169,72 +222,112 @@ void *newVZVirtualMachineConfiguration(void *bootLoaderPtr,
     return config;
 }
 
+/*!
+ @abstract Boot loader used when the virtual machine starts.
+ @see VZLinuxBootLoader
+ @see VZMacOSBootLoader
+ */
+void setBootLoaderVZVirtualMachineConfiguration(void *config, void *bootLoader)
+{
+    [(VZVirtualMachineConfiguration *)config setBootLoader:(VZBootLoader *)bootLoader];
+}
+
+/*!
+ @abstract Number of CPUs.
+ @discussion
+    The number of CPUs must be a value between VZVirtualMachineConfiguration.minimumAllowedCPUCount
+    and VZVirtualMachineConfiguration.maximumAllowedCPUCount.
+ */
+void setCPUCountVZVirtualMachineConfiguration(void *config, unsigned int CPUCount)
+{
+    [(VZVirtualMachineConfiguration *)config setCPUCount:(NSUInteger)CPUCount];
+}
+
+/*!
+ @abstract Virtual machine memory size in bytes.
+ @discussion
+    The memory size must be a multiple of a 1 megabyte (1024 * 1024 bytes) between VZVirtualMachineConfiguration.minimumAllowedMemorySize
+    and VZVirtualMachineConfiguration.maximumAllowedMemorySize.
+ */
+void setMemorySizeVZVirtualMachineConfiguration(void *config, unsigned long long memorySize)
+{
+    [(VZVirtualMachineConfiguration *)config setMemorySize:memorySize];
+}
+
 /*!
  @abstract List of entropy devices. Empty by default.
  @see VZVirtioEntropyDeviceConfiguration
 */
-void setEntropyDevicesVZVirtualMachineConfiguration(void *config,
-    void *entropyDevices)
+void setEntropyDevicesVZVirtualMachineConfiguration(void *config, void **entropyDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setEntropyDevices:[(NSMutableArray *)entropyDevices copy]];
+    NSArray *array = newNSArrayWithObjects(entropyDevices, count);
+    [(VZVirtualMachineConfiguration *)config setEntropyDevices:array];
+    [array release];
 }
 
 /*!
  @abstract List of memory balloon devices. Empty by default.
  @see VZVirtioTraditionalMemoryBalloonDeviceConfiguration
 */
-void setMemoryBalloonDevicesVZVirtualMachineConfiguration(void *config,
-    void *memoryBalloonDevices)
+void setMemoryBalloonDevicesVZVirtualMachineConfiguration(void *config, void **memoryBalloonDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setMemoryBalloonDevices:[(NSMutableArray *)memoryBalloonDevices copy]];
+    NSArray *array = newNSArrayWithObjects(memoryBalloonDevices, count);
+    [(VZVirtualMachineConfiguration *)config setMemoryBalloonDevices:array];
+    [array release];
 }
 
 /*!
  @abstract List of network adapters. Empty by default.
  @see VZVirtioNetworkDeviceConfiguration
  */
-void setNetworkDevicesVZVirtualMachineConfiguration(void *config,
-    void *networkDevices)
+void setNetworkDevicesVZVirtualMachineConfiguration(void *config, void **networkDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setNetworkDevices:[(NSMutableArray *)networkDevices copy]];
+    NSArray *array = newNSArrayWithObjects(networkDevices, count);
+    [(VZVirtualMachineConfiguration *)config setNetworkDevices:array];
+    [array release];
 }
 
 /*!
  @abstract List of serial ports. Empty by default.
  @see VZVirtioConsoleDeviceSerialPortConfiguration
  */
-void setSerialPortsVZVirtualMachineConfiguration(void *config,
-    void *serialPorts)
+void setSerialPortsVZVirtualMachineConfiguration(void *config, void **serialPorts, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setSerialPorts:[(NSMutableArray *)serialPorts copy]];
+    NSArray *array = newNSArrayWithObjects(serialPorts, count);
+    [(VZVirtualMachineConfiguration *)config setSerialPorts:array];
+    [array release];
 }
 
 /*!
  @abstract List of socket devices. Empty by default.
  @see VZVirtioSocketDeviceConfiguration
  */
-void setSocketDevicesVZVirtualMachineConfiguration(void *config,
-    void *socketDevices)
+void setSocketDevicesVZVirtualMachineConfiguration(void *config, void **socketDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setSocketDevices:[(NSMutableArray *)socketDevices copy]];
+    NSArray *array = newNSArrayWithObjects(socketDevices, count);
+    [(VZVirtualMachineConfiguration *)config setSocketDevices:array];
+    [array release];
 }
 
 /*!
  @abstract List of disk devices. Empty by default.
  @see VZVirtioBlockDeviceConfiguration
  */
-void setStorageDevicesVZVirtualMachineConfiguration(void *config,
-    void *storageDevices)
+void setStorageDevicesVZVirtualMachineConfiguration(void *config, void **storageDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setStorageDevices:[(NSMutableArray *)storageDevices copy]];
+    NSArray *array = newNSArrayWithObjects(storageDevices, count);
+    [(VZVirtualMachineConfiguration *)config setStorageDevices:array];
+    [array release];
 }
 /*!
  @abstract List of directory sharing devices. Empty by default.
  @see VZDirectorySharingDeviceConfiguration
  */
-void setDirectorySharingDevicesVZVirtualMachineConfiguration(void *config, void *directorySharingDevices)
+void setDirectorySharingDevicesVZVirtualMachineConfiguration(void *config, void **directorySharingDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setDirectorySharingDevices:[(NSMutableArray *)directorySharingDevices copy]];
+    NSArray *array = newNSArrayWithObjects(directorySharingDevices, count);
+    [(VZVirtualMachineConfiguration *)config setDirectorySharingDevices:array];
+    [array release];
 }
 
 /*!
@@ -251,36 +344,62 @@ void setPlatformVZVirtualMachineConfiguration(void *config, void *platform)
  @abstract List of graphics devices. Empty by default.
  @see VZMacGraphicsDeviceConfiguration
  */
-void setGraphicsDevicesVZVirtualMachineConfiguration(void *config, void *graphicsDevices)
+void setGraphicsDevicesVZVirtualMachineConfiguration(void *config, void **graphicsDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setGraphicsDevices:[(NSMutableArray *)graphicsDevices copy]];
+    NSArray *array = newNSArrayWithObjects(graphicsDevices, count);
+    [(VZVirtualMachineConfiguration *)config setGraphicsDevices:array];
+    [array release];
 }
 
 /*!
  @abstract List of pointing devices. Empty by default.
  @see VZUSBScreenCoordinatePointingDeviceConfiguration
  */
-void setPointingDevicesVZVirtualMachineConfiguration(void *config, void *pointingDevices)
+void setPointingDevicesVZVirtualMachineConfiguration(void *config, void **pointingDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setPointingDevices:[(NSMutableArray *)pointingDevices copy]];
+    NSArray *array = newNSArrayWithObjects(pointingDevices, count);
+    [(VZVirtualMachineConfiguration *)config setPointingDevices:array];
+    [array release];
 }
 
 /*!
  @abstract List of keyboards. Empty by default.
  @see VZUSBKeyboardConfiguration
  */
-void setKeyboardsVZVirtualMachineConfiguration(void *config, void *keyboards)
+void setKeyboardsVZVirtualMachineConfiguration(void *config, void **keyboards, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setKeyboards:[(NSMutableArray *)keyboards copy]];
+    NSArray *array = newNSArrayWithObjects(keyboards, count);
+    [(VZVirtualMachineConfiguration *)config setKeyboards:array];
+    [array release];
 }
 
 /*!
  @abstract List of audio devices. Empty by default.
  @see VZVirtioSoundDeviceConfiguration
  */
-void setAudioDevicesVZVirtualMachineConfiguration(void *config, void *audioDevices)
+void setAudioDevicesVZVirtualMachineConfiguration(void *config, void **audioDevices, unsigned long count)
 {
-    [(VZVirtualMachineConfiguration *)config setAudioDevices:[(NSMutableArray *)audioDevices copy]];
+    NSArray *array = newNSArrayWithObjects(audioDevices, count);
+    [(VZVirtualMachineConfiguration *)config setAudioDevices:array];
+    [array release];
+}
+
+/*!
+ @abstract List of console devices. Empty by default.
+ @discussion This property is available on macOS 13 and newer.
+ @see VZVirtioConsoleDeviceConfiguration
+ */
+void setConsoleDevicesVZVirtualMachineConfiguration(void *config, void **consoleDevices, unsigned long count)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        NSArray *array = newNSArrayWithObjects(consoleDevices, count);
+        [(VZVirtualMachineConfiguration *)config setConsoleDevices:array];
+        [array release];
+        return;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
 }
 
 /*!
@@ -295,9 +414,11 @@ void *newVZVirtioSoundDeviceConfiguration()
 /*!
  @abstract Set the list of audio streams exposed by this device. Empty by default.
 */
-void setStreamsVZVirtioSoundDeviceConfiguration(void *audioDeviceConfiguration, void *streams)
+void setStreamsVZVirtioSoundDeviceConfiguration(void *audioDeviceConfiguration, void **streams, unsigned long count)
 {
-    [(VZVirtioSoundDeviceConfiguration *)audioDeviceConfiguration setStreams:[(NSMutableArray *)streams copy]];
+    NSArray *array = newNSArrayWithObjects(streams, count);
+    [(VZVirtioSoundDeviceConfiguration *)audioDeviceConfiguration setStreams:array];
+    [array release];
 }
 
 /*!
@@ -376,14 +497,23 @@ void *newVZFileHandleSerialPortAttachment(int readFileDescriptor, int writeFileD
  */
 void *newVZFileSerialPortAttachment(const char *filePath, bool shouldAppend, void **error)
 {
-    VZFileSerialPortAttachment *ret;
+    VZFileSerialPortAttachment *ret = nil;
+    NSException *raised = nil;
     @autoreleasepool {
         NSString *filePathNSString = [NSString stringWithUTF8String:filePath];
         NSURL *fileURL = [NSURL fileURLWithPath:filePathNSString];
-        ret = [[VZFileSerialPortAttachment alloc]
-            initWithURL:fileURL
-                 append:(BOOL)shouldAppend
-                  error:(NSError *_Nullable *_Nullable)error];
+        @try {
+            ret = [[VZFileSerialPortAttachment alloc]
+                initWithURL:fileURL
+                     append:(BOOL)shouldAppend
+                      error:(NSError *_Nullable *_Nullable)error];
+        } @catch (NSException *exception) {
+            raised = [exception retain];
+        }
+    }
+    if (raised != nil) {
+        setErrorWithException(error, raised);
+        [raised release];
     }
     return ret;
 }
@@ -403,6 +533,88 @@ void *newVZVirtioConsoleDeviceSerialPortConfiguration(void *attachment)
     return config;
 }
 
+/*!
+ @abstract Create a new Virtio console device configuration.
+ @discussion
+    The device has multiple ports, which are configured by VZVirtioConsolePortConfiguration.
+    This is available on macOS 13 and newer.
+ */
+void *newVZVirtioConsoleDeviceConfiguration(void)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        return [[VZVirtioConsoleDeviceConfiguration alloc] init];
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return nil;
+}
+
+/*!
+ @abstract The maximum number of ports allocated by the device.
+ @discussion The default is the number of the ports which are configured.
+ */
+unsigned int VZVirtioConsoleDeviceConfiguration_maximumPortCount(void *config)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        return (unsigned int)[[(VZVirtioConsoleDeviceConfiguration *)config ports] maximumPortCount];
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return 0;
+}
+
+void VZVirtioConsoleDeviceConfiguration_setMaximumPortCount(void *config, unsigned int maximumPortCount)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        [[(VZVirtioConsoleDeviceConfiguration *)config ports] setMaximumPortCount:maximumPortCount];
+        return;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+}
+
+/*!
+ @abstract Set the port configuration at the index of the device.
+ */
+void VZVirtioConsoleDeviceConfiguration_setPort(void *config, unsigned int index, void *port)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        [(VZVirtioConsoleDeviceConfiguration *)config ports][index] = (VZVirtioConsolePortConfiguration *)port;
+        return;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+}
+
+/*!
+ @abstract Create a new Virtio console port configuration.
+ @param name The name of the port which is exposed to the guest, or NULL.
+ @param isConsole Whether the port is a console port, e.g. /dev/hvc* on Linux.
+ @param attachment The serial port attachment, or nil to leave the port disconnected.
+ */
+void *newVZVirtioConsolePortConfiguration(const char *name, bool isConsole, void *attachment)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        VZVirtioConsolePortConfiguration *port = [[VZVirtioConsolePortConfiguration alloc] init];
+        @autoreleasepool {
+            if (name != NULL) {
+                [port setName:[NSString stringWithUTF8String:name]];
+            }
+        }
+        [port setIsConsole:(BOOL)isConsole];
+        [port setAttachment:(VZSerialPortAttachment *)attachment];
+        return port;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return nil;
+}
+
 /*!
  @abstract Create a new Network device attachment bridging a host physical interface with a virtual network device.
  @param networkInterface a network interface that bridges a physical interface.
@@ -457,6 +669,24 @@ void *newVZFileHandleNetworkDeviceAttachment(int fileDescriptor)
     return ret;
 }
 
+/*!
+ @abstract The maximum transmission unit (MTU) associated with this attachment.
+ @discussion
+    The host MTU on the socket must be at least as large as the MTU used in the guest.
+    The default MTU is 1500. The maximum MTU allowed is 65535, and the minimum MTU allowed is 1500.
+    This property is available on macOS 13 and newer.
+ */
+void setMaximumTransmissionUnitVZFileHandleNetworkDeviceAttachment(void *attachment, NSInteger mtu)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        [(VZFileHandleNetworkDeviceAttachment *)attachment setMaximumTransmissionUnit:mtu];
+        return;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+}
+
 /*!
  @abstract Create  a new Configuration of a paravirtualized network device of type Virtio Network Device.
  @discussion
@@ -506,6 +736,50 @@ void *newVZVirtioBlockDeviceConfiguration(void *attachment)
     return [[VZVirtioBlockDeviceConfiguration alloc] initWithAttachment:(VZStorageDeviceAttachment *)attachment];
 }
 
+/*!
+ @abstract Check if blockDeviceIdentifier is a valid Virtio block device identifier.
+ @discussion
+    The identifier must be encodable as an ASCII string of length at most 20 bytes.
+    This is only supported on macOS 12.3 and newer.
+ @param error If not nil, assigned with an error describing why the device identifier is not valid.
+ */
+bool validateBlockDeviceIdentifierVZVirtioBlockDeviceConfiguration(const char *identifier, void **error)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 120300
+    if (@available(macOS 12.3, *)) {
+        BOOL ret = NO;
+        NSString *identifierNSString = [[NSString alloc] initWithUTF8String:identifier];
+        VZ_CATCH_EXCEPTION(error, {
+            ret = [VZVirtioBlockDeviceConfiguration
+                validateBlockDeviceIdentifier:identifierNSString
+                                        error:(NSError *_Nullable *_Nullable)error];
+        });
+        [identifierNSString release];
+        return (bool)ret;
+    }
+#endif
+    SET_UNSUPPORTED_MACOS_ERROR(error);
+    return false;
+}
+
+/*!
+ @abstract Set the device identifier which is exposed to the guest as the serial number of the block device.
+ @discussion This is only supported on macOS 12.3 and newer.
+ */
+void setBlockDeviceIdentifierVZVirtioBlockDeviceConfiguration(void *blockDeviceConfiguration, const char *identifier)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 120300
+    if (@available(macOS 12.3, *)) {
+        @autoreleasepool {
+            NSString *identifierNSString = [NSString stringWithUTF8String:identifier];
+            [(VZVirtioBlockDeviceConfiguration *)blockDeviceConfiguration setBlockDeviceIdentifier:identifierNSString];
+        }
+        return;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+}
+
 /*!
  @abstract Initialize the attachment from a local file url.
  @param diskPath Local file path to the disk image in RAW format.
@@ -517,10 +791,37 @@ void *newVZDiskImageStorageDeviceAttachment(const char *diskPath, bool readOnly,
 {
     NSString *diskPathNSString = [NSString stringWithUTF8String:diskPath];
     NSURL *diskURL = [NSURL fileURLWithPath:diskPathNSString];
-    return [[VZDiskImageStorageDeviceAttachment alloc]
-        initWithURL:diskURL
-           readOnly:(BOOL)readOnly
-              error:(NSError *_Nullable *_Nullable)error];
+    VZ_CATCH_EXCEPTION(error, {
+        return [[VZDiskImageStorageDeviceAttachment alloc]
+            initWithURL:diskURL
+               readOnly:(BOOL)readOnly
+                  error:(NSError *_Nullable *_Nullable)error];
+    });
+    return nil;
+}
+
+/*!
+ @abstract Initialize the attachment from a local file url with the caching and synchronization modes.
+ @param diskPath Local file path to the disk image in RAW format.
+ @param readOnly If YES, the device attachment is read-only, otherwise the device can write data to the disk image.
+ @param cacheMode Whether to enable or disable caching, the default is automatic.
+ @param syncMode How the disk image synchronizes with the underlying storage when the guest operating system flushes data.
+ @param error If not nil, assigned with the error if the initialization failed.
+ @return A VZDiskImageStorageDeviceAttachment on success. Nil otherwise and the error parameter is populated if set.
+ */
+void *newVZDiskImageStorageDeviceAttachmentWithCacheAndSync(const char *diskPath, bool readOnly, int cacheMode, int syncMode, void **error)
+{
+    NSString *diskPathNSString = [NSString stringWithUTF8String:diskPath];
+    NSURL *diskURL = [NSURL fileURLWithPath:diskPathNSString];
+    VZ_CATCH_EXCEPTION(error, {
+        return [[VZDiskImageStorageDeviceAttachment alloc]
+                    initWithURL:diskURL
+                       readOnly:(BOOL)readOnly
+                    cachingMode:(VZDiskImageCachingMode)cacheMode
+            synchronizationMode:(VZDiskImageSynchronizationMode)syncMode
+                          error:(NSError *_Nullable *_Nullable)error];
+    });
+    return nil;
 }
 
 /*!
@@ -602,10 +903,14 @@ void VZVirtioSocketDevice_removeSocketListenerForPort(void *socketDevice, void *
 void VZVirtioSocketDevice_connectToPort(void *socketDevice, void *vmQueue, uint32_t port, void *cgoHandlerPtr)
 {
     dispatch_sync((dispatch_queue_t)vmQueue, ^{
-        [(VZVirtioSocketDevice *)socketDevice connectToPort:port
-                                          completionHandler:^(VZVirtioSocketConnection *connection, NSError *err) {
-                                              connectionHandler(connection, err, cgoHandlerPtr);
-                                          }];
+        @try {
+            [(VZVirtioSocketDevice *)socketDevice connectToPort:port
+                                              completionHandler:^(VZVirtioSocketConnection *connection, NSError *err) {
+                                                  connectionHandler(connection, err, cgoHandlerPtr);
+                                              }];
+        } @catch (NSException *exception) {
+            connectionHandler(nil, newNSErrorWithException(exception), cgoHandlerPtr);
+        }
     });
 }
 
@@ -627,11 +932,17 @@ VZVirtioSocketConnectionFlat convertVZVirtioSocketConnection2Flat(void *connecti
     Every operation on the virtual machine must be done on that queue. The callbacks and delegate methods are invoked on that queue.
     If the queue is not serial, the behavior is undefined.
  */
-void *newVZVirtualMachineWithDispatchQueue(void *config, void *queue, void *statusHandler)
+void *newVZVirtualMachineWithDispatchQueue(void *config, void *queue, void *statusHandler, void **error)
 {
-    VZVirtualMachine *vm = [[VZVirtualMachine alloc]
-        initWithConfiguration:(VZVirtualMachineConfiguration *)config
-                        queue:(dispatch_queue_t)queue];
+    VZVirtualMachine *vm = nil;
+    VZ_CATCH_EXCEPTION(error, {
+        vm = [[VZVirtualMachine alloc]
+            initWithConfiguration:(VZVirtualMachineConfiguration *)config
+                            queue:(dispatch_queue_t)queue];
+    });
+    if (vm == nil) {
+        return nil;
+    }
     @autoreleasepool {
         Observer *o = [[Observer alloc] init];
         [vm addObserver:o
@@ -639,9 +950,45 @@ void *newVZVirtualMachineWithDispatchQueue(void *config, void *queue, void *stat
                 options:NSKeyValueObservingOptionNew
                 context:statusHandler];
     }
+    // The delegate property is weak, so the delegate is never released
+    // as same as the observer.
+    VZVirtualMachineDelegateImpl *delegate = [[VZVirtualMachineDelegateImpl alloc] initWithStatusHandler:statusHandler];
+    dispatch_sync((dispatch_queue_t)queue, ^{
+        vm.delegate = delegate;
+    });
     return vm;
 }
 
+/*!
+ @abstract Adopt the existing virtual machine which is created by other code.
+ @discussion
+    The virtual machine is retained, and its state is observed as same as newVZVirtualMachineWithDispatchQueue.
+    The delegate is set only if the virtual machine has no delegate, so the delegate of the other code is kept.
+    This must not be called on the queue.
+ @param queue The queue on which the virtual machine operates.
+ @return The current state of the virtual machine.
+ */
+int adoptVZVirtualMachine(void *machine, void *queue, void *statusHandler)
+{
+    VZVirtualMachine *vm = [(VZVirtualMachine *)machine retain];
+    __block int state;
+    dispatch_sync((dispatch_queue_t)queue, ^{
+        @autoreleasepool {
+            Observer *o = [[Observer alloc] init];
+            [vm addObserver:o
+                 forKeyPath:@"state"
+                    options:NSKeyValueObservingOptionNew
+                    context:statusHandler];
+        }
+        if (vm.delegate == nil) {
+            // The delegate property is weak, so the delegate is never released.
+            vm.delegate = [[VZVirtualMachineDelegateImpl alloc] initWithStatusHandler:statusHandler];
+        }
+        state = (int)vm.state;
+    });
+    return state;
+}
+
 /*!
  @abstract Return the list of socket devices configured on this virtual machine. Return an empty array if no socket device is configured.
  @see VZVirtioSocketDeviceConfiguration
@@ -652,6 +999,178 @@ void *VZVirtualMachine_socketDevices(void *machine)
     return [(VZVirtualMachine *)machine socketDevices]; // NSArray<VZSocketDevice *>
 }
 
+/*!
+ @abstract Return the list of memory balloon devices configured on this virtual machine. Return an empty array if no memory balloon device is configured.
+ @see VZVirtioTraditionalMemoryBalloonDeviceConfiguration
+ @see VZVirtualMachineConfiguration
+ */
+void *VZVirtualMachine_memoryBalloonDevices(void *machine)
+{
+    return [(VZVirtualMachine *)machine memoryBalloonDevices]; // NSArray<VZMemoryBalloonDevice *>
+}
+
+/*!
+ @abstract Return the list of network devices configured on this virtual machine. Return an empty array if no network device is configured.
+ @see VZVirtioNetworkDeviceConfiguration
+ @see VZVirtualMachineConfiguration
+ */
+void *VZVirtualMachine_networkDevices(void *machine)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        return [(VZVirtualMachine *)machine networkDevices]; // NSArray<VZNetworkDevice *>
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return nil;
+}
+
+/*!
+ @abstract Set the network attachment of the network device.
+ @discussion
+    The attachment can be replaced while the virtual machine is running.
+    Setting nil disconnects the network device from the host.
+ @see VZNetworkDeviceAttachment
+ */
+void VZNetworkDevice_setAttachment(void *networkDevice, void *vmQueue, void *attachment, void **error)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        dispatch_sync((dispatch_queue_t)vmQueue, ^{
+            VZ_CATCH_EXCEPTION(error, {
+                [(VZNetworkDevice *)networkDevice setAttachment:(VZNetworkDeviceAttachment *)attachment];
+            });
+        });
+        return;
+    }
+#endif
+    SET_UNSUPPORTED_MACOS_ERROR(error);
+}
+
+/*!
+ @abstract Return the list of console devices configured on this virtual machine.
+ @discussion This property is available on macOS 13 and newer.
+ */
+void *VZVirtualMachine_consoleDevices(void *machine)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        return [(VZVirtualMachine *)machine consoleDevices]; // NSArray<VZConsoleDevice *>
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return nil;
+}
+
+/*!
+ @abstract Return the maximum number of ports of the Virtio console device.
+ */
+unsigned int VZVirtioConsoleDevice_maximumPortCount(void *consoleDevice, void *vmQueue)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        __block unsigned int count;
+        dispatch_sync((dispatch_queue_t)vmQueue, ^{
+            count = (unsigned int)[[(VZVirtioConsoleDevice *)consoleDevice ports] maximumPortCount];
+        });
+        return count;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return 0;
+}
+
+/*!
+ @abstract Return the port of the Virtio console device at the index.
+ @return The retained port, or nil if no port is configured at the index.
+ */
+void *VZVirtioConsoleDevice_port(void *consoleDevice, void *vmQueue, unsigned int index)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        __block VZVirtioConsolePort *port = nil;
+        dispatch_sync((dispatch_queue_t)vmQueue, ^{
+            VZVirtioConsolePortArray *ports = [(VZVirtioConsoleDevice *)consoleDevice ports];
+            if (index < [ports maximumPortCount]) {
+                port = [ports[index] retain];
+            }
+        });
+        return port;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return nil;
+}
+
+/*!
+ @abstract Return the name of the console port.
+ @return The copy of the name which must be freed by free(3), or NULL if the port has no name.
+ */
+char *VZVirtioConsolePort_name(void *consolePort, void *vmQueue)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        __block char *name = NULL;
+        dispatch_sync((dispatch_queue_t)vmQueue, ^{
+            NSString *s = [(VZVirtioConsolePort *)consolePort name];
+            if (s != nil) {
+                name = strdup([s UTF8String]);
+            }
+        });
+        return name;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return NULL;
+}
+
+/*!
+ @abstract Set the serial port attachment of the console port.
+ @discussion
+    The attachment can be replaced while the virtual machine is running.
+    Setting nil disconnects the port from the host.
+ */
+void VZVirtioConsolePort_setAttachment(void *consolePort, void *vmQueue, void *attachment)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        dispatch_sync((dispatch_queue_t)vmQueue, ^{
+            [(VZVirtioConsolePort *)consolePort setAttachment:(VZSerialPortAttachment *)attachment];
+        });
+        return;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+}
+
+/*!
+ @abstract Return the target amount of memory for the guest in bytes.
+ @see VZVirtioTraditionalMemoryBalloonDevice
+ */
+unsigned long long VZVirtioTraditionalMemoryBalloonDevice_getTargetVirtualMachineMemorySize(void *balloonDevice, void *vmQueue)
+{
+    __block unsigned long long memorySize;
+    dispatch_sync((dispatch_queue_t)vmQueue, ^{
+        memorySize = [(VZVirtioTraditionalMemoryBalloonDevice *)balloonDevice targetVirtualMachineMemorySize];
+    });
+    return memorySize;
+}
+
+/*!
+ @abstract Set the target amount of memory for the guest in bytes.
+ @discussion
+    The target memory size must be a multiple of 1 megabyte (1024 * 1024 bytes) and
+    between VZVirtualMachineConfiguration.minimumAllowedMemorySize and the configured memory size.
+    The guest is not required to reach the target, it is a request for the guest to free the memory.
+ @see VZVirtioTraditionalMemoryBalloonDevice
+ */
+void VZVirtioTraditionalMemoryBalloonDevice_setTargetVirtualMachineMemorySize(void *balloonDevice, void *vmQueue, unsigned long long memorySize)
+{
+    dispatch_sync((dispatch_queue_t)vmQueue, ^{
+        [(VZVirtioTraditionalMemoryBalloonDevice *)balloonDevice setTargetVirtualMachineMemorySize:memorySize];
+    });
+}
+
 /*!
  @abstract Initialize the VZMACAddress from a string representation of a MAC address.
  @param string
@@ -791,57 +1310,225 @@ void *newVZUSBKeyboardConfiguration()
  */
 bool requestStopVirtualMachine(void *machine, void *queue, void **error)
 {
-    __block BOOL ret;
+    __block BOOL ret = NO;
     dispatch_sync((dispatch_queue_t)queue, ^{
-        ret = [(VZVirtualMachine *)machine requestStopWithError:(NSError *_Nullable *_Nullable)error];
+        VZ_CATCH_EXCEPTION(error, {
+            ret = [(VZVirtualMachine *)machine requestStopWithError:(NSError *_Nullable *_Nullable)error];
+        });
     });
     return (bool)ret;
 }
 
-void *makeDispatchQueue(const char *label)
-{
-    // dispatch_queue_attr_t attr = dispatch_queue_attr_make_with_qos_class(DISPATCH_QUEUE_SERIAL, QOS_CLASS_DEFAULT, 0);
-    dispatch_queue_t queue = dispatch_queue_create(label, DISPATCH_QUEUE_SERIAL);
-    // dispatch_retain(queue);
+/*!
+ @abstract Create a new serial dispatch queue.
+ @param qos The quality of service class of the queue. This is the value of DispatchQueueQoSClass in Go.
+ */
+void *makeDispatchQueue(const char *label, int qos)
+{
+    qos_class_t qosClass;
+    switch (qos) {
+    case 1:
+        qosClass = QOS_CLASS_USER_INTERACTIVE;
+        break;
+    case 2:
+        qosClass = QOS_CLASS_USER_INITIATED;
+        break;
+    case 3:
+        qosClass = QOS_CLASS_UTILITY;
+        break;
+    case 4:
+        qosClass = QOS_CLASS_BACKGROUND;
+        break;
+    default:
+        qosClass = QOS_CLASS_DEFAULT;
+        break;
+    }
+    dispatch_queue_attr_t attr = dispatch_queue_attr_make_with_qos_class(DISPATCH_QUEUE_SERIAL, qosClass, 0);
+    dispatch_queue_t queue = dispatch_queue_create(label, attr);
     return queue;
 }
 
+/*!
+ @abstract Return the main dispatch queue.
+ */
+void *mainDispatchQueue(void)
+{
+    return dispatch_get_main_queue();
+}
+
+/*!
+ @abstract Retain the dispatch queue which is created by other code.
+ */
+void retainDispatchQueue(void *queue)
+{
+    dispatch_retain((dispatch_queue_t)queue);
+}
+
+/*!
+ @abstract Return the label of the dispatch queue. The string is owned by the queue.
+ */
+const char *dispatchQueueLabel(void *queue)
+{
+    return dispatch_queue_get_label((dispatch_queue_t)queue);
+}
+
+/*!
+ @abstract Submit the Go function which is referred by the cgo handle to the queue and wait for it.
+ */
+void dispatchSyncGoFunc(void *queue, uintptr_t handle)
+{
+    dispatch_sync((dispatch_queue_t)queue, ^{
+        dispatchQueueHandler(handle);
+    });
+}
+
+/*!
+ @abstract Submit the Go function which is referred by the cgo handle to the queue.
+ */
+void dispatchAsyncGoFunc(void *queue, uintptr_t handle)
+{
+    dispatch_async((dispatch_queue_t)queue, ^{
+        dispatchQueueHandler(handle);
+    });
+}
+
 void startWithCompletionHandler(void *machine, void *queue, void *completionHandler)
 {
     dispatch_sync((dispatch_queue_t)queue, ^{
-        [(VZVirtualMachine *)machine startWithCompletionHandler:^(NSError *err) {
-            virtualMachineCompletionHandler(completionHandler, err);
-        }];
+        @try {
+            [(VZVirtualMachine *)machine startWithCompletionHandler:^(NSError *err) {
+                virtualMachineCompletionHandler(completionHandler, err);
+            }];
+        } @catch (NSException *exception) {
+            virtualMachineCompletionHandler(completionHandler, newNSErrorWithException(exception));
+        }
     });
 }
 
 void pauseWithCompletionHandler(void *machine, void *queue, void *completionHandler)
 {
     dispatch_sync((dispatch_queue_t)queue, ^{
-        [(VZVirtualMachine *)machine pauseWithCompletionHandler:^(NSError *err) {
-            virtualMachineCompletionHandler(completionHandler, err);
-        }];
+        @try {
+            [(VZVirtualMachine *)machine pauseWithCompletionHandler:^(NSError *err) {
+                virtualMachineCompletionHandler(completionHandler, err);
+            }];
+        } @catch (NSException *exception) {
+            virtualMachineCompletionHandler(completionHandler, newNSErrorWithException(exception));
+        }
     });
 }
 
 void resumeWithCompletionHandler(void *machine, void *queue, void *completionHandler)
 {
     dispatch_sync((dispatch_queue_t)queue, ^{
-        [(VZVirtualMachine *)machine resumeWithCompletionHandler:^(NSError *err) {
-            virtualMachineCompletionHandler(completionHandler, err);
-        }];
+        @try {
+            [(VZVirtualMachine *)machine resumeWithCompletionHandler:^(NSError *err) {
+                virtualMachineCompletionHandler(completionHandler, err);
+            }];
+        } @catch (NSException *exception) {
+            virtualMachineCompletionHandler(completionHandler, newNSErrorWithException(exception));
+        }
     });
 }
 
 void stopWithCompletionHandler(void *machine, void *queue, void *completionHandler)
 {
     dispatch_sync((dispatch_queue_t)queue, ^{
-        [(VZVirtualMachine *)machine stopWithCompletionHandler:^(NSError *err) {
-            virtualMachineCompletionHandler(completionHandler, err);
-        }];
+        @try {
+            [(VZVirtualMachine *)machine stopWithCompletionHandler:^(NSError *err) {
+                virtualMachineCompletionHandler(completionHandler, err);
+            }];
+        } @catch (NSException *exception) {
+            virtualMachineCompletionHandler(completionHandler, newNSErrorWithException(exception));
+        }
     });
 }
 
+/*!
+ @abstract Validate the configuration is savable.
+ @discussion
+    Verify that a virtual machine with this configuration is savable.
+    This is only available on macOS 14 and newer.
+ */
+bool validateSaveRestoreSupportVZVirtualMachineConfiguration(void *config, void **error)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 140000
+    if (@available(macOS 14, *)) {
+        VZ_CATCH_EXCEPTION(error, {
+            return (bool)[(VZVirtualMachineConfiguration *)config
+                validateSaveRestoreSupportWithError:(NSError *_Nullable *_Nullable)error];
+        });
+        return false;
+    }
+#endif
+    SET_UNSUPPORTED_MACOS_ERROR(error);
+    return false;
+}
+
+/*!
+ @abstract Save a virtual machine.
+ @discussion
+    The virtual machine must be paused. The state is written to the file at path.
+    This is only available on macOS 14 and newer.
+ */
+void saveMachineStateToPath(void *machine, void *queue, const char *path, void *completionHandler)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 140000
+    if (@available(macOS 14, *)) {
+        @autoreleasepool {
+            NSString *pathStr = [NSString stringWithUTF8String:path];
+            NSURL *url = [NSURL fileURLWithPath:pathStr];
+            dispatch_sync((dispatch_queue_t)queue, ^{
+                @try {
+                    [(VZVirtualMachine *)machine saveMachineStateToURL:url
+                                                     completionHandler:^(NSError *err) {
+                                                         virtualMachineCompletionHandler(completionHandler, err);
+                                                     }];
+                } @catch (NSException *exception) {
+                    virtualMachineCompletionHandler(completionHandler, newNSErrorWithException(exception));
+                }
+            });
+        }
+        return;
+    }
+#endif
+    NSError *err = nil;
+    SET_UNSUPPORTED_MACOS_ERROR(&err);
+    virtualMachineCompletionHandler(completionHandler, err);
+}
+
+/*!
+ @abstract Restore a virtual machine.
+ @discussion
+    The virtual machine must be stopped. The restored virtual machine is in the paused state.
+    This is only available on macOS 14 and newer.
+ */
+void restoreMachineStateFromPath(void *machine, void *queue, const char *path, void *completionHandler)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 140000
+    if (@available(macOS 14, *)) {
+        @autoreleasepool {
+            NSString *pathStr = [NSString stringWithUTF8String:path];
+            NSURL *url = [NSURL fileURLWithPath:pathStr];
+            dispatch_sync((dispatch_queue_t)queue, ^{
+                @try {
+                    [(VZVirtualMachine *)machine restoreMachineStateFromURL:url
+                                                          completionHandler:^(NSError *err) {
+                                                              virtualMachineCompletionHandler(completionHandler, err);
+                                                          }];
+                } @catch (NSException *exception) {
+                    virtualMachineCompletionHandler(completionHandler, newNSErrorWithException(exception));
+                }
+            });
+        }
+        return;
+    }
+#endif
+    NSError *err = nil;
+    SET_UNSUPPORTED_MACOS_ERROR(&err);
+    virtualMachineCompletionHandler(completionHandler, err);
+}
+
 // TODO(codehex): use KVO
 bool vmCanStart(void *machine, void *queue)
 {
@@ -888,24 +1575,3 @@ bool vmCanStop(void *machine, void *queue)
     return (bool)result;
 }
 // --- TODO end
-
-void sharedApplication()
-{
-    // Create a shared app instance.
-    // This will initialize the global variable
-    // 'NSApp' with the application instance.
-    [VZApplication sharedApplication];
-}
-
-void startVirtualMachineWindow(void *machine, double width, double height)
-{
-    @autoreleasepool {
-        AppDelegate *appDelegate = [[[AppDelegate alloc]
-            initWithVirtualMachine:(VZVirtualMachine *)machine
-                       windowWidth:(CGFloat)width
-                      windowHeight:(CGFloat)height] autorelease];
-
-        NSApp.delegate = appDelegate;
-        [NSApp run];
-    }
-}
\ No newline at end of file
@@ -0,0 +1,43 @@
+//
+//  virtualization_appkit.h
+//
+//  Created by codehex.
+//
+
+#pragma once
+
+#import "virtualization.h"
+
+// These functions use AppKit, so these are not built with the vzheadless build tag.
+
+void sharedApplication();
+void startVirtualMachineWindow(void *machine, void *queue, double width, double height, bool capturesSystemKeys, bool automaticallyReconfiguresDisplay);
+
+void releaseOnMainThread(void *obj);
+bool isMainQueueServiced(double timeout);
+
+/* VZVirtualMachineView */
+void *newVZVirtualMachineView(void *machine);
+void setCapturesSystemKeysVZVirtualMachineView(void *view, bool capturesSystemKeys);
+bool capturesSystemKeysVZVirtualMachineView(void *view);
+void setAutomaticallyReconfiguresDisplayVZVirtualMachineView(void *view, bool automaticallyReconfiguresDisplay);
+bool automaticallyReconfiguresDisplayVZVirtualMachineView(void *view);
+void detachVirtualMachineVZVirtualMachineView(void *view);
+
+/* VZHeadlessView */
+void *newVZHeadlessView(void *machine, double width, double height, void **error);
+void VZHeadlessView_sendKeyEvent(void *view, unsigned long type, unsigned short keyCode, const char *characters, unsigned long modifierFlags, void **error);
+void VZHeadlessView_sendMouseEvent(void *view, unsigned long type, double x, double y, unsigned long modifierFlags, void **error);
+
+typedef struct VZScreenshotImage {
+    void *pixels; // RGBA, 8 bits per component, must be freed by free(3).
+    int width;
+    int height;
+} VZScreenshotImage;
+
+VZScreenshotImage VZHeadlessView_takeScreenshot(void *view, void **error);
+
+#ifdef __arm64__
+/* VZMacGraphicsDisplayConfiguration */
+void *newVZMacGraphicsDisplayConfigurationForScreen(unsigned long screenIndex, double widthInPoints, double heightInPoints, NSInteger *widthInPixels, NSInteger *heightInPixels);
+#endif
@@ -0,0 +1,323 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
+//
+//  virtualization_appkit.m
+//
+//  Created by codehex.
+//
+
+#import "virtualization_appkit.h"
+#import "virtualization_view.h"
+
+void sharedApplication()
+{
+    // Create a shared app instance.
+    // This will initialize the global variable
+    // 'NSApp' with the application instance.
+    [VZApplication sharedApplication];
+}
+
+void startVirtualMachineWindow(void *machine, void *queue, double width, double height, bool capturesSystemKeys, bool automaticallyReconfiguresDisplay)
+{
+    @autoreleasepool {
+        AppDelegate *appDelegate = [[[AppDelegate alloc]
+                      initWithVirtualMachine:(VZVirtualMachine *)machine
+                                       queue:(dispatch_queue_t)queue
+                                 windowWidth:(CGFloat)width
+                                windowHeight:(CGFloat)height
+                          capturesSystemKeys:(BOOL)capturesSystemKeys
+            automaticallyReconfiguresDisplay:(BOOL)automaticallyReconfiguresDisplay] autorelease];
+
+        NSApp.delegate = appDelegate;
+        [NSApp run];
+
+        // The window has been closed but the virtual machine may still be running.
+        [appDelegate detachVirtualMachine];
+        NSApp.delegate = nil;
+    }
+}
+/*!
+ @abstract Run the block on the main thread synchronously.
+ @discussion
+    AppKit objects must be used on the main thread. If the caller is not on the main thread,
+    the main dispatch queue must be serviced (e.g. by the running NSApplication). Otherwise the
+    caller is blocked forever.
+ */
+static void runOnMainThread(dispatch_block_t block)
+{
+    dispatch_block_t blockWithPool = ^{
+        @autoreleasepool {
+            block();
+        }
+    };
+    if ([NSThread isMainThread]) {
+        blockWithPool();
+    } else {
+        dispatch_sync(dispatch_get_main_queue(), blockWithPool);
+    }
+}
+
+/*!
+ @abstract Run the block on the main thread synchronously, and assign the exception raised by it to error.
+ @discussion
+    The exception is retained over the autoreleasepool of runOnMainThread, then converted to NSError.
+ */
+static void runOnMainThreadCatchingException(void **error, dispatch_block_t block)
+{
+    __block NSException *raised = nil;
+    runOnMainThread(^{
+        @try {
+            block();
+        } @catch (NSException *exception) {
+            raised = [exception retain];
+        }
+    });
+    if (raised != nil) {
+        setErrorWithException(error, raised);
+        [raised release];
+    }
+}
+
+/*!
+ @abstract Check whether the main dispatch queue is serviced.
+ @discussion
+    This returns true on the main thread. Otherwise an empty block is submitted to the main queue
+    and this waits for it to be run until the timeout. The block is left in the queue if it is not
+    run, so this is checked before runOnMainThread to not block the caller forever.
+ @param timeout The timeout in seconds.
+ */
+bool isMainQueueServiced(double timeout)
+{
+    if ([NSThread isMainThread]) {
+        return true;
+    }
+    dispatch_semaphore_t sem = dispatch_semaphore_create(0);
+    dispatch_async(dispatch_get_main_queue(), ^{
+        dispatch_semaphore_signal(sem);
+    });
+    long ret = dispatch_semaphore_wait(sem, dispatch_time(DISPATCH_TIME_NOW, (int64_t)(timeout * NSEC_PER_SEC)));
+    dispatch_release(sem);
+    return ret == 0;
+}
+
+/*!
+ @abstract Create a new VZHeadlessView for the virtual machine.
+ @param width The width of the view in points.
+ @param height The height of the view in points.
+ */
+void *newVZHeadlessView(void *machine, double width, double height, void **error)
+{
+    __block VZHeadlessView *view = nil;
+    runOnMainThreadCatchingException(error, ^{
+        view = [[VZHeadlessView alloc] initWithVirtualMachine:(VZVirtualMachine *)machine
+                                                        width:(CGFloat)width
+                                                       height:(CGFloat)height];
+    });
+    return view;
+}
+
+/*!
+ @abstract Release the AppKit object on the main thread.
+ @discussion
+    This is called from the finalizer which runs on an arbitrary thread, so the object is
+    released asynchronously to not block the finalizer.
+ */
+void releaseOnMainThread(void *obj)
+{
+    dispatch_async(dispatch_get_main_queue(), ^{
+        [(NSObject *)obj release];
+    });
+}
+
+/*!
+ @abstract Send a keyboard event to the virtual machine.
+ @param type NSEventTypeKeyDown, NSEventTypeKeyUp or NSEventTypeFlagsChanged.
+ @param keyCode The virtual key code of the key.
+ @param characters The characters which are generated by the key. This can be empty.
+ @param modifierFlags The pressed modifier keys as NSEventModifierFlags.
+ */
+void VZHeadlessView_sendKeyEvent(void *view, unsigned long type, unsigned short keyCode, const char *characters, unsigned long modifierFlags, void **error)
+{
+    NSString *chars = [[NSString alloc] initWithUTF8String:characters];
+    runOnMainThreadCatchingException(error, ^{
+        [(VZHeadlessView *)view sendKeyEventWithType:(NSEventType)type
+                                             keyCode:keyCode
+                                          characters:chars
+                                       modifierFlags:(NSEventModifierFlags)modifierFlags];
+    });
+    [chars release];
+}
+
+/*!
+ @abstract Send a pointer event to the virtual machine.
+ @param type The NSEventType of the mouse event.
+ @param x The horizontal position from the left edge of the view in points.
+ @param y The vertical position from the top edge of the view in points.
+ @param modifierFlags The pressed modifier keys as NSEventModifierFlags.
+ */
+void VZHeadlessView_sendMouseEvent(void *view, unsigned long type, double x, double y, unsigned long modifierFlags, void **error)
+{
+    runOnMainThreadCatchingException(error, ^{
+        [(VZHeadlessView *)view sendMouseEventWithType:(NSEventType)type
+                                              location:NSMakePoint(x, y)
+                                         modifierFlags:(NSEventModifierFlags)modifierFlags];
+    });
+}
+
+/*!
+ @abstract Capture the current image of the headless view.
+ @return The RGBA pixels of the image. If the image could not be captured, pixels is NULL.
+ */
+VZScreenshotImage VZHeadlessView_takeScreenshot(void *view, void **error)
+{
+    __block VZScreenshotImage ret = { NULL, 0, 0 };
+    runOnMainThreadCatchingException(error, ^{
+        CGImageRef image = [(VZHeadlessView *)view takeScreenshot];
+        if (image == NULL) {
+            return;
+        }
+        size_t width = CGImageGetWidth(image);
+        size_t height = CGImageGetHeight(image);
+        void *pixels = calloc(width * height, 4);
+        CGColorSpaceRef colorSpace = CGColorSpaceCreateWithName(kCGColorSpaceSRGB);
+        CGContextRef context = CGBitmapContextCreate(pixels, width, height, 8, width * 4, colorSpace,
+            kCGImageAlphaPremultipliedLast | kCGBitmapByteOrder32Big);
+        CGColorSpaceRelease(colorSpace);
+        if (context == NULL) {
+            free(pixels);
+            CGImageRelease(image);
+            return;
+        }
+        CGContextDrawImage(context, CGRectMake(0, 0, width, height), image);
+        CGContextRelease(context);
+        CGImageRelease(image);
+        ret.pixels = pixels;
+        ret.width = (int)width;
+        ret.height = (int)height;
+    });
+    return ret;
+}
+
+/*!
+ @abstract Create a new VZVirtualMachineView which displays the virtual machine.
+ @discussion
+    The view is not attached to any window. The caller adds it to its own window.
+ */
+void *newVZVirtualMachineView(void *machine)
+{
+    __block VZVirtualMachineView *view;
+    runOnMainThread(^{
+        view = [[VZVirtualMachineView alloc] init];
+        view.virtualMachine = (VZVirtualMachine *)machine;
+    });
+    return view;
+}
+
+void setCapturesSystemKeysVZVirtualMachineView(void *view, bool capturesSystemKeys)
+{
+    runOnMainThread(^{
+        ((VZVirtualMachineView *)view).capturesSystemKeys = (BOOL)capturesSystemKeys;
+    });
+}
+
+bool capturesSystemKeysVZVirtualMachineView(void *view)
+{
+    __block BOOL ret;
+    runOnMainThread(^{
+        ret = ((VZVirtualMachineView *)view).capturesSystemKeys;
+    });
+    return (bool)ret;
+}
+
+/*!
+ @abstract Set whether the display of the guest is reconfigured to the size of the view.
+ @discussion
+    The guest must support the reconfiguration of the display, e.g. macOS 14 and newer guests.
+ */
+void setAutomaticallyReconfiguresDisplayVZVirtualMachineView(void *view, bool automaticallyReconfiguresDisplay)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 140000
+    if (@available(macOS 14, *)) {
+        runOnMainThread(^{
+            ((VZVirtualMachineView *)view).automaticallyReconfiguresDisplay = (BOOL)automaticallyReconfiguresDisplay;
+        });
+        return;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+}
+
+bool automaticallyReconfiguresDisplayVZVirtualMachineView(void *view)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 140000
+    if (@available(macOS 14, *)) {
+        __block BOOL ret;
+        runOnMainThread(^{
+            ret = ((VZVirtualMachineView *)view).automaticallyReconfiguresDisplay;
+        });
+        return (bool)ret;
+    }
+#endif
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+    return false;
+}
+
+/*!
+ @abstract Detach the virtual machine from the view.
+ @discussion
+    The view displays nothing after this. The virtual machine keeps running.
+ */
+void detachVirtualMachineVZVirtualMachineView(void *view)
+{
+    runOnMainThread(^{
+        ((VZVirtualMachineView *)view).virtualMachine = nil;
+    });
+}
+
+#ifdef __arm64__
+/*!
+ @abstract Create a display configuration which is suitable for showing on the screen.
+ @discussion
+    The size in pixels and the pixel density are the ones of the screen, so the guest display has the same
+    scale factor and each pixel of the guest is displayed on a pixel of the screen. On macOS 14 and newer,
+    the configuration is created by Virtualization.framework. On older versions, the pixel density is
+    computed from the physical size of the screen.
+ @param screenIndex The index of the screen in NSScreen.screens. The screen at index 0 has the menu bar.
+ @param widthInPoints The width of the display, in points.
+ @param heightInPoints The height of the display, in points.
+ @return nil if there is no screen at the index.
+ */
+void *newVZMacGraphicsDisplayConfigurationForScreen(unsigned long screenIndex, double widthInPoints, double heightInPoints, NSInteger *widthInPixels, NSInteger *heightInPixels)
+{
+    VZMacGraphicsDisplayConfiguration *config = nil;
+    @autoreleasepool {
+        NSArray<NSScreen *> *screens = [NSScreen screens];
+        if (screenIndex >= [screens count]) {
+            return nil;
+        }
+        NSScreen *screen = screens[screenIndex];
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 140000
+        if (@available(macOS 14, *)) {
+            config = [[VZMacGraphicsDisplayConfiguration alloc] initForScreen:screen sizeInPoints:NSMakeSize(widthInPoints, heightInPoints)];
+        }
+#endif
+        if (config == nil) {
+            CGFloat scale = [screen backingScaleFactor];
+            CGDirectDisplayID displayID = [[[screen deviceDescription] objectForKey:@"NSScreenNumber"] unsignedIntValue];
+            CGSize sizeInMillimeters = CGDisplayScreenSize(displayID);
+            NSInteger pixelsPerInch = (NSInteger)lround(109 * scale);
+            if (sizeInMillimeters.width > 0) {
+                pixelsPerInch = (NSInteger)lround(screen.frame.size.width * scale / (sizeInMillimeters.width / 25.4));
+            }
+            config = [[VZMacGraphicsDisplayConfiguration alloc]
+                initWithWidthInPixels:(NSInteger)lround(widthInPoints * scale)
+                       heightInPixels:(NSInteger)lround(heightInPoints * scale)
+                        pixelsPerInch:pixelsPerInch];
+        }
+    }
+    *widthInPixels = [config widthInPixels];
+    *heightInPixels = [config heightInPixels];
+    return config;
+}
+#endif
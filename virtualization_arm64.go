@@ -11,7 +11,9 @@ package vz
 */
 import "C"
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -39,15 +41,27 @@ func NewMacHardwareModelWithDataPath(pathname string) (*MacHardwareModel, error)
 	if err != nil {
 		return nil, err
 	}
-	return NewMacHardwareModelWithData(b), nil
+	hardwareModel := NewMacHardwareModelWithData(b)
+	if hardwareModel.ptr == nil {
+		return nil, fmt.Errorf("invalid hardware model data representation: %q", pathname)
+	}
+	return hardwareModel, nil
 }
 
 // NewMacHardwareModelWithData initialize a new hardware model described by the specified data representation.
+//
+// The data representation can be obtained via DataRepresentation method, so it can be stored
+// in any places (e.g. keychain, database) instead of a file.
+// If the data is invalid, the returned hardware model is not supported and its
+// DataRepresentation returns nil.
 func NewMacHardwareModelWithData(b []byte) *MacHardwareModel {
-	ptr := C.newVZMacHardwareModelWithBytes(
-		unsafe.Pointer(&b[0]),
-		C.int(len(b)),
-	)
+	var ptr unsafe.Pointer
+	if len(b) > 0 {
+		ptr = C.newVZMacHardwareModelWithBytes(
+			unsafe.Pointer(&b[0]),
+			C.int(len(b)),
+		)
+	}
 	ret := newMacHardwareModel(ptr)
 	runtime.SetFinalizer(ret, func(self *MacHardwareModel) {
 		self.Release()
@@ -57,16 +71,21 @@ func NewMacHardwareModelWithData(b []byte) *MacHardwareModel {
 
 func newMacHardwareModel(ptr unsafe.Pointer) *MacHardwareModel {
 	ret := C.convertVZMacHardwareModel2Struct(ptr)
-	dataRepresentation := ret.dataRepresentation
-	bytePointer := (*byte)(unsafe.Pointer(dataRepresentation.ptr))
 	return &MacHardwareModel{
-		pointer: pointer{
-			ptr: ptr,
-		},
-		supported: bool(ret.supported),
-		// https://github.com/golang/go/wiki/cgo#turning-c-arrays-into-go-slices
-		dataRepresentation: unsafe.Slice(bytePointer, dataRepresentation.len),
+		pointer:            newPointer(ptr),
+		supported:          bool(ret.supported),
+		dataRepresentation: goBytes(ret.dataRepresentation),
+	}
+}
+
+// goBytes copies the bytes which is referred by nbyteslice to Go world.
+// The memory of nbyteslice is owned by the obj-c object, so it must be copied
+// to live longer than the object.
+func goBytes(b C.nbyteslice) []byte {
+	if b.ptr == nil || b.len == 0 {
+		return nil
 	}
+	return C.GoBytes(b.ptr, b.len)
 }
 
 // Supported indicate whether this hardware model is supported by the host.
@@ -76,6 +95,14 @@ func (m *MacHardwareModel) Supported() bool { return m.supported }
 // This can be used to recreate the same hardware model with NewMacHardwareModelWithData function.
 func (m *MacHardwareModel) DataRepresentation() []byte { return m.dataRepresentation }
 
+// Equal reports whether m and other have the same data representation.
+func (m *MacHardwareModel) Equal(other *MacHardwareModel) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return bytes.Equal(m.dataRepresentation, other.dataRepresentation)
+}
+
 // MacMachineIdentifier an identifier to make a virtual machine unique.
 type MacMachineIdentifier struct {
 	pointer
@@ -89,15 +116,26 @@ func NewMacMachineIdentifierWithDataPath(pathname string) (*MacMachineIdentifier
 	if err != nil {
 		return nil, err
 	}
-	return NewMacMachineIdentifierWithData(b), nil
+	machineIdentifier := NewMacMachineIdentifierWithData(b)
+	if machineIdentifier.ptr == nil {
+		return nil, fmt.Errorf("invalid machine identifier data representation: %q", pathname)
+	}
+	return machineIdentifier, nil
 }
 
 // NewMacMachineIdentifierWithData initialize a new machine identifier described by the specified data representation.
+//
+// The data representation can be obtained via DataRepresentation method, so it can be stored
+// in any places (e.g. keychain, database) instead of a file.
+// If the data is invalid, DataRepresentation of the returned machine identifier returns nil.
 func NewMacMachineIdentifierWithData(b []byte) *MacMachineIdentifier {
-	ptr := C.newVZMacMachineIdentifierWithBytes(
-		unsafe.Pointer(&b[0]),
-		C.int(len(b)),
-	)
+	var ptr unsafe.Pointer
+	if len(b) > 0 {
+		ptr = C.newVZMacMachineIdentifierWithBytes(
+			unsafe.Pointer(&b[0]),
+			C.int(len(b)),
+		)
+	}
 	return newMacMachineIdentifier(ptr)
 }
 
@@ -114,57 +152,115 @@ func NewMacMachineIdentifier() *MacMachineIdentifier {
 }
 
 func newMacMachineIdentifier(ptr unsafe.Pointer) *MacMachineIdentifier {
-	dataRepresentation := C.getVZMacMachineIdentifierDataRepresentation(ptr)
-	bytePointer := (*byte)(unsafe.Pointer(dataRepresentation.ptr))
-	return &MacMachineIdentifier{
-		pointer: pointer{
-			ptr: ptr,
-		},
-		// https://github.com/golang/go/wiki/cgo#turning-c-arrays-into-go-slices
-		dataRepresentation: unsafe.Slice(bytePointer, dataRepresentation.len),
+	ret := &MacMachineIdentifier{
+		pointer:            newPointer(ptr),
+		dataRepresentation: goBytes(C.getVZMacMachineIdentifierDataRepresentation(ptr)),
 	}
+	runtime.SetFinalizer(ret, func(self *MacMachineIdentifier) {
+		self.Release()
+	})
+	return ret
 }
 
 // DataRepresentation opaque data representation of the machine identifier.
 // This can be used to recreate the same machine identifier with NewMacMachineIdentifierWithData function.
 func (m *MacMachineIdentifier) DataRepresentation() []byte { return m.dataRepresentation }
 
+// Equal reports whether m and other have the same data representation, that is,
+// they identify the same virtual machine.
+func (m *MacMachineIdentifier) Equal(other *MacMachineIdentifier) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return bytes.Equal(m.dataRepresentation, other.dataRepresentation)
+}
+
 // MacAuxiliaryStorage is a struct that contains information the boot loader
 // needs for booting macOS as a guest operating system.
 type MacAuxiliaryStorage struct {
 	pointer
 
 	storagePath string
+	readOnly    bool
+
+	// create creates the storage file. This is run after all options are applied so that
+	// the file is not created when the options conflict.
+	create func() error
 }
 
+// ErrAuxiliaryStorageReadOnly is returned when modifying the auxiliary storage which is opened
+// with WithReadOnlyStorage.
+var ErrAuxiliaryStorageReadOnly = errors.New("auxiliary storage is opened as read-only")
+
 // NewMacAuxiliaryStorageOption is an option type to initialize a new Mac auxiliary storage
 type NewMacAuxiliaryStorageOption func(*MacAuxiliaryStorage) error
 
+// MacAuxiliaryStorageInitializationOption is an option flag for creating a new Mac auxiliary storage.
+type MacAuxiliaryStorageInitializationOption uint
+
+const (
+	// MacAuxiliaryStorageInitializationOptionAllowOverwrite overwrites an existing auxiliary storage file.
+	// If this option is not specified, creating the storage fails when a file already exists at the storage path.
+	MacAuxiliaryStorageInitializationOptionAllowOverwrite MacAuxiliaryStorageInitializationOption = 1 << 0
+)
+
 // WithCreatingStorage is an option when initialize a new Mac auxiliary storage with data creation
 // to you specified storage path.
+//
+// An existing file at the storage path is overwritten. Use WithCreatingStorageOptions
+// to prevent overwriting it.
 func WithCreatingStorage(hardwareModel *MacHardwareModel) NewMacAuxiliaryStorageOption {
+	return WithCreatingStorageOptions(hardwareModel, MacAuxiliaryStorageInitializationOptionAllowOverwrite)
+}
+
+// WithCreatingStorageOptions is an option when initialize a new Mac auxiliary storage with data creation
+// to you specified storage path with the initialization options.
+//
+// If options is zero, an error is returned when the file already exists at the storage path.
+// The size of the storage is decided by Virtualization.framework and can not be specified.
+func WithCreatingStorageOptions(hardwareModel *MacHardwareModel, options MacAuxiliaryStorageInitializationOption) NewMacAuxiliaryStorageOption {
 	return func(mas *MacAuxiliaryStorage) error {
-		cpath := charWithGoString(mas.storagePath)
-		defer cpath.Free()
+		mas.create = func() error {
+			cpath := charWithGoString(mas.storagePath)
+			defer cpath.Free()
 
-		nserr := newNSErrorAsNil()
-		nserrPtr := nserr.Ptr()
-		mas.pointer = pointer{
-			ptr: C.newVZMacAuxiliaryStorageWithCreating(
+			nserr := newNSErrorAsNil()
+			nserrPtr := nserr.Ptr()
+			mas.pointer = newPointer(C.newVZMacAuxiliaryStorageWithCreating(
 				cpath.CString(),
 				hardwareModel.Ptr(),
+				C.NSUInteger(options),
 				&nserrPtr,
-			),
-		}
-		if err := newNSError(nserrPtr); err != nil {
-			return err
+			))
+			if err := newNSError(nserrPtr); err != nil {
+				return err
+			}
+			return nil
 		}
 		return nil
 	}
 }
 
+// WithReadOnlyStorage is an option to open an existing Mac auxiliary storage for inspection.
+//
+// Virtualization.framework does not support read-only auxiliary storages, so this is advisory:
+// the methods of this package which modify the storage (e.g. SetNVRAMVariable) return
+// ErrAuxiliaryStorageReadOnly, and the file must be readable but not necessarily writable.
+// The storage must not be used to boot a virtual machine, because the boot loader writes to it.
+//
+// This can not be used together with WithCreatingStorage or WithCreatingStorageOptions.
+func WithReadOnlyStorage() NewMacAuxiliaryStorageOption {
+	return func(mas *MacAuxiliaryStorage) error {
+		mas.readOnly = true
+		return nil
+	}
+}
+
 // NewMacAuxiliaryStorage creates a new MacAuxiliaryStorage is based Mac auxiliary storage data from the storagePath
 // of an existing file by default.
+//
+// If no file exists at the storagePath and the storage is not created by WithCreatingStorage,
+// an error is returned.
 func NewMacAuxiliaryStorage(storagePath string, opts ...NewMacAuxiliaryStorageOption) (*MacAuxiliaryStorage, error) {
 	storage := &MacAuxiliaryStorage{storagePath: storagePath}
 	for _, opt := range opts {
@@ -172,22 +268,42 @@ func NewMacAuxiliaryStorage(storagePath string, opts ...NewMacAuxiliaryStorageOp
 			return nil, err
 		}
 	}
-	if storage.pointer.ptr == nil {
+	if storage.readOnly && storage.create != nil {
+		return nil, errors.New("read-only auxiliary storage can not be created")
+	}
+	if storage.create != nil {
+		if err := storage.create(); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := os.Open(storagePath)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
 		cpath := charWithGoString(storagePath)
 		defer cpath.Free()
-		storage.pointer = pointer{
-			ptr: C.newVZMacAuxiliaryStorage(cpath.CString()),
-		}
+		storage.pointer = newPointer(C.newVZMacAuxiliaryStorage(cpath.CString()))
 	}
+	runtime.SetFinalizer(storage, func(self *MacAuxiliaryStorage) {
+		self.Release()
+	})
 	return storage, nil
 }
 
+// Path returns the path of the auxiliary storage file.
+func (m *MacAuxiliaryStorage) Path() string { return m.storagePath }
+
+// ReadOnly reports whether the storage is opened with WithReadOnlyStorage.
+func (m *MacAuxiliaryStorage) ReadOnly() bool { return m.readOnly }
+
 // MacOSRestoreImage is a struct that describes a version of macOS to install on to a virtual machine.
 type MacOSRestoreImage struct {
 	url                                     string
 	buildVersion                            string
 	operatingSystemVersion                  OperatingSystemVersion
 	mostFeaturefulSupportedConfigurationPtr unsafe.Pointer
+	supported                               bool
 }
 
 // URL returns URL of this restore image.
@@ -227,9 +343,21 @@ func (m *MacOSRestoreImage) OperatingSystemVersion() OperatingSystemVersion {
 // configuration requirements that will provide the most complete feature set on the current host.
 // If none of the hardware models are supported on the current host, this property is nil.
 func (m *MacOSRestoreImage) MostFeaturefulSupportedConfiguration() *MacOSConfigurationRequirements {
+	if m.mostFeaturefulSupportedConfigurationPtr == nil {
+		return nil
+	}
 	return newMacOSConfigurationRequirements(m.mostFeaturefulSupportedConfigurationPtr)
 }
 
+// Supported indicates whether this restore image is supported on the current host.
+//
+// Check this before starting to install, an unsupported restore image can not be installed
+// on the current host. On macOS 12, this reports whether MostFeaturefulSupportedConfiguration
+// is available.
+func (m *MacOSRestoreImage) Supported() bool {
+	return m.supported
+}
+
 // MacOSConfigurationRequirements describes the parameter constraints required by a specific configuration of macOS.
 //
 //  When a VZMacOSRestoreImage is loaded, it can be inspected to determine the configurations supported by that restore image.
@@ -287,6 +415,7 @@ func macOSRestoreImageCompletionHandler(cgoHandlerPtr, restoreImagePtr, errPtr u
 			PatchVersion: int64(restoreImageStruct.operatingSystemVersion.patchVersion),
 		},
 		mostFeaturefulSupportedConfigurationPtr: restoreImageStruct.mostFeaturefulSupportedConfiguration,
+		supported:                               bool(restoreImageStruct.supported),
 	}
 
 	if err := newNSError(errPtr); err != nil {
@@ -412,14 +541,10 @@ func NewMacOSInstaller(vm *VirtualMachine, restoreImageIpsw string) *MacOSInstal
 	cs := charWithGoString(restoreImageIpsw)
 	defer cs.Free()
 	ret := &MacOSInstaller{
-		pointer: pointer{
-			ptr: C.newVZMacOSInstaller(vm.Ptr(), vm.dispatchQueue, cs.CString()),
-		},
-		observerPointer: pointer{
-			ptr: C.newProgressObserverVZMacOSInstaller(),
-		},
-		vm:     vm,
-		doneCh: make(chan struct{}),
+		pointer:         newPointer(C.newVZMacOSInstaller(vm.Ptr(), vm.dispatchQueue, cs.CString())),
+		observerPointer: newPointer(C.newProgressObserverVZMacOSInstaller()),
+		vm:              vm,
+		doneCh:          make(chan struct{}),
 	}
 	ret.setFractionCompleted(0)
 	runtime.SetFinalizer(ret, func(self *MacOSInstaller) {
@@ -455,6 +580,14 @@ func macOSInstallFractionCompletedHandler(cgoHandlerPtr unsafe.Pointer, complete
 //
 // This method starts the installation process. The VM must be in a stopped state.
 // During the installation operation, pausing or stopping the VM results in an undefined behavior.
+//
+// If ctx is done before the installation is completed, the installation is cancelled and
+// this method returns an error which wraps ctx.Err() without waiting for the installation
+// process to stop. Wait on Done to know when it is actually stopped. The auxiliary storage and
+// the disk image of the virtual machine are left partially written, so they must be recreated
+// before retrying the installation.
+//
+// The installation can be started only once per MacOSInstaller. Create a new one to retry.
 func (m *MacOSInstaller) Install(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
@@ -463,13 +596,15 @@ func (m *MacOSInstaller) Install(ctx context.Context) error {
 	}
 
 	m.once.Do(func() {
+		fractionCompletedHandler := cgo.NewHandle(func(v float64) {
+			m.setFractionCompleted(v)
+		})
 		completionHandler := cgo.NewHandle(func(err error) {
+			// The progress observer has been removed at this point.
+			fractionCompletedHandler.Delete()
 			m.err = err
 			close(m.doneCh)
 		})
-		fractionCompletedHandler := cgo.NewHandle(func(v float64) {
-			m.setFractionCompleted(v)
-		})
 
 		C.installByVZMacOSInstaller(
 			m.Ptr(),
@@ -483,13 +618,44 @@ func (m *MacOSInstaller) Install(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
 		C.cancelInstallVZMacOSInstaller(m.Ptr())
-		return ctx.Err()
+		select {
+		case <-m.doneCh:
+			if m.err == nil {
+				// The installation has been completed before cancelling.
+				return nil
+			}
+			return &InstallCanceledError{Err: ctx.Err(), InstallErr: m.err}
+		default:
+		}
+		return &InstallCanceledError{Err: ctx.Err()}
 	case <-m.doneCh:
 	}
 
 	return m.err
 }
 
+// InstallCanceledError is returned by (*MacOSInstaller).Install when the context is done
+// before the installation is completed.
+//
+// The auxiliary storage and the disk image used to install are in an incomplete state.
+// Recreate them before retrying the installation.
+type InstallCanceledError struct {
+	// Err is the error returned from the context. e.g. context.Canceled
+	Err error
+
+	// InstallErr is the error reported by the installer after cancelling. This is nil if
+	// the installation process has not stopped yet when Install returns.
+	InstallErr error
+}
+
+// Error implements error interface.
+func (e *InstallCanceledError) Error() string {
+	return fmt.Sprintf("macOS installation is canceled (%v): auxiliary storage and disk image must be recreated: %v", e.Err, e.InstallErr)
+}
+
+// Unwrap returns the error of the context.
+func (e *InstallCanceledError) Unwrap() error { return e.Err }
+
 func (m *MacOSInstaller) setFractionCompleted(completed float64) {
 	m.progress.Store(completed)
 }
@@ -501,4 +667,5 @@ func (m *MacOSInstaller) FractionCompleted() float64 {
 }
 
 // Done recieves a notification that indicates the install process is completed.
+// This is also closed when the install process is stopped after cancelling.
 func (m *MacOSInstaller) Done() <-chan struct{} { return m.doneCh }
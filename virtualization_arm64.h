@@ -26,6 +26,7 @@ typedef struct VZMacOSRestoreImageStruct {
     const char *buildVersion;
     NSOperatingSystemVersion operatingSystemVersion;
     void *mostFeaturefulSupportedConfiguration; // (VZMacOSConfigurationRequirements *)
+    bool supported;
 } VZMacOSRestoreImageStruct;
 
 typedef struct VZMacOSConfigurationRequirementsStruct {
@@ -46,17 +47,18 @@ void macOSInstallFractionCompletedHandler(void *cgoHandlerPtr, double completed)
 
 /* Mac Configurations */
 void *newVZMacPlatformConfiguration();
-void *newVZMacAuxiliaryStorageWithCreating(const char *storagePath, void *hardwareModel, void **error);
+void *newVZMacAuxiliaryStorageWithCreating(const char *storagePath, void *hardwareModel, NSUInteger options, void **error);
 void *newVZMacAuxiliaryStorage(const char *storagePath);
 void *newVZMacPlatformConfiguration();
 void setHardwareModelVZMacPlatformConfiguration(void *config, void *hardwareModel);
 void storeHardwareModelDataVZMacPlatformConfiguration(void *config, const char *filePath);
 void setMachineIdentifierVZMacPlatformConfiguration(void *config, void *machineIdentifier);
 void storeMachineIdentifierDataVZMacPlatformConfiguration(void *config, const char *filePath);
+void *getMachineIdentifierVZMacPlatformConfiguration(void *config);
 void setAuxiliaryStorageVZMacPlatformConfiguration(void *config, void *auxiliaryStorage);
 void *newVZMacOSBootLoader();
 void *newVZMacGraphicsDeviceConfiguration();
-void setDisplaysVZMacGraphicsDeviceConfiguration(void *graphicsConfiguration, void *displays);
+void setDisplaysVZMacGraphicsDeviceConfiguration(void *graphicsConfiguration, void **displays, unsigned long count);
 void *newVZMacGraphicsDisplayConfiguration(NSInteger widthInPixels, NSInteger heightInPixels, NSInteger pixelsPerInch);
 void *newVZMacHardwareModelWithPath(const char *hardwareModelPath);
 void *newVZMacHardwareModelWithBytes(void *hardwareModelBytes, int len);
@@ -77,4 +79,6 @@ void *newProgressObserverVZMacOSInstaller();
 void installByVZMacOSInstaller(void *installerPtr, void *vmQueue, void *progressObserverPtr, void *completionHandler, void *fractionCompletedHandler);
 void cancelInstallVZMacOSInstaller(void *installerPtr);
 
+void startWithMacOSOptionsCompletionHandler(void *machine, void *queue, bool startUpFromMacOSRecovery, void *completionHandler);
+
 #endif
\ No newline at end of file
@@ -1,5 +1,9 @@
+//go:build darwin
+// +build darwin
+
 #ifdef __arm64__
 #import "virtualization_arm64.h"
+#import "virtualization.h"
 
 @implementation ProgressObserver
 - (void)observeValueForKeyPath:(NSString *)keyPath ofObject:(id)object change:(NSDictionary *)change context:(void *)context;
@@ -7,9 +11,6 @@
     if ([keyPath isEqualToString:@"fractionCompleted"] && [object isKindOfClass:[NSProgress class]]) {
         NSProgress *progress = (NSProgress *)object;
         macOSInstallFractionCompletedHandler(context, progress.fractionCompleted);
-        if (progress.finished) {
-            [progress removeObserver:self forKeyPath:@"fractionCompleted"];
-        }
     }
 }
 @end
@@ -22,16 +23,25 @@
  @param error If not nil, used to report errors if creation fails.
  @return A newly initialized VZMacAuxiliaryStorage on success. If an error was encountered returns @c nil, and @c error contains the error.
  */
-void *newVZMacAuxiliaryStorageWithCreating(const char *storagePath, void *hardwareModel, void **error)
+void *newVZMacAuxiliaryStorageWithCreating(const char *storagePath, void *hardwareModel, NSUInteger options, void **error)
 {
-    VZMacAuxiliaryStorage *auxiliaryStorage;
+    VZMacAuxiliaryStorage *auxiliaryStorage = nil;
+    NSException *raised = nil;
     @autoreleasepool {
         NSString *storagePathNSString = [NSString stringWithUTF8String:storagePath];
         NSURL *storageURL = [NSURL fileURLWithPath:storagePathNSString];
-        auxiliaryStorage = [[VZMacAuxiliaryStorage alloc] initCreatingStorageAtURL:storageURL
-                                                                     hardwareModel:(VZMacHardwareModel *)hardwareModel
-                                                                           options:VZMacAuxiliaryStorageInitializationOptionAllowOverwrite
-                                                                             error:(NSError *_Nullable *_Nullable)error];
+        @try {
+            auxiliaryStorage = [[VZMacAuxiliaryStorage alloc] initCreatingStorageAtURL:storageURL
+                                                                         hardwareModel:(VZMacHardwareModel *)hardwareModel
+                                                                               options:(VZMacAuxiliaryStorageInitializationOptions)options
+                                                                                 error:(NSError *_Nullable *_Nullable)error];
+        } @catch (NSException *exception) {
+            raised = [exception retain];
+        }
+    }
+    if (raised != nil) {
+        setErrorWithException(error, raised);
+        [raised release];
     }
     return auxiliaryStorage;
 }
@@ -106,6 +116,16 @@ void setMachineIdentifierVZMacPlatformConfiguration(void *config, void *machineI
     [(VZMacPlatformConfiguration *)config setMachineIdentifier:(VZMacMachineIdentifier *)machineIdentifier];
 }
 
+/*!
+ @abstract Return the Mac machine identifier.
+ @discussion
+    A new unique identifier is used by default if it is not set. The returned object is retained.
+ */
+void *getMachineIdentifierVZMacPlatformConfiguration(void *config)
+{
+    return [[(VZMacPlatformConfiguration *)config machineIdentifier] retain];
+}
+
 // Store the machine identifier to disk so that we can retrieve them for subsequent boots.
 void storeMachineIdentifierDataVZMacPlatformConfiguration(void *config, const char *filePath)
 {
@@ -153,9 +173,11 @@ void *newVZMacGraphicsDeviceConfiguration()
 /*!
  @abstract Set the displays to be attached to this graphics device.
 */
-void setDisplaysVZMacGraphicsDeviceConfiguration(void *graphicsConfiguration, void *displays)
+void setDisplaysVZMacGraphicsDeviceConfiguration(void *graphicsConfiguration, void **displays, unsigned long count)
 {
-    [(VZMacGraphicsDeviceConfiguration *)graphicsConfiguration setDisplays:[(NSMutableArray *)displays copy]];
+    NSArray *array = newNSArrayWithObjects(displays, count);
+    [(VZMacGraphicsDeviceConfiguration *)graphicsConfiguration setDisplays:array];
+    [array release];
 }
 
 /*!
@@ -253,27 +275,51 @@ VZMacOSRestoreImageStruct convertVZMacOSRestoreImage2Struct(VZMacOSRestoreImage
     ret.operatingSystemVersion = [restoreImage operatingSystemVersion];
     // maybe unnecessary CFBridgingRetain. if use CFBridgingRetain, should use CFRelease.
     ret.mostFeaturefulSupportedConfiguration = (void *)CFBridgingRetain([restoreImage mostFeaturefulSupportedConfiguration]);
+    // isSupported is available since macOS 13. On older versions, the restore image is supported
+    // if the current host supports any of the hardware models in the restore image.
+    ret.supported = ret.mostFeaturefulSupportedConfiguration != nil;
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        ret.supported = (bool)[restoreImage isSupported];
+    }
+#endif
     return ret;
 }
 
 void fetchLatestSupportedMacOSRestoreImageWithCompletionHandler(void *cgoHandler)
 {
-    [VZMacOSRestoreImage fetchLatestSupportedWithCompletionHandler:^(VZMacOSRestoreImage *restoreImage, NSError *error) {
-        VZMacOSRestoreImageStruct restoreImageStruct = convertVZMacOSRestoreImage2Struct(restoreImage);
-        macOSRestoreImageCompletionHandler(cgoHandler, &restoreImageStruct, error);
-    }];
+    @try {
+        [VZMacOSRestoreImage fetchLatestSupportedWithCompletionHandler:^(VZMacOSRestoreImage *restoreImage, NSError *error) {
+            VZMacOSRestoreImageStruct restoreImageStruct = convertVZMacOSRestoreImage2Struct(restoreImage);
+            macOSRestoreImageCompletionHandler(cgoHandler, &restoreImageStruct, error);
+        }];
+    } @catch (NSException *exception) {
+        VZMacOSRestoreImageStruct restoreImageStruct = convertVZMacOSRestoreImage2Struct(nil);
+        macOSRestoreImageCompletionHandler(cgoHandler, &restoreImageStruct, newNSErrorWithException(exception));
+    }
 }
 
 void loadMacOSRestoreImageFile(const char *ipswPath, void *cgoHandler)
 {
+    NSException *raised = nil;
     @autoreleasepool {
         NSString *ipswPathNSString = [NSString stringWithUTF8String:ipswPath];
         NSURL *ipswURL = [[NSURL alloc] initFileURLWithPath:ipswPathNSString];
-        [VZMacOSRestoreImage loadFileURL:ipswURL
-                       completionHandler:^(VZMacOSRestoreImage *restoreImage, NSError *error) {
-                           VZMacOSRestoreImageStruct restoreImageStruct = convertVZMacOSRestoreImage2Struct(restoreImage);
-                           macOSRestoreImageCompletionHandler(cgoHandler, &restoreImageStruct, error);
-                       }];
+        @try {
+            [VZMacOSRestoreImage loadFileURL:ipswURL
+                           completionHandler:^(VZMacOSRestoreImage *restoreImage, NSError *error) {
+                               VZMacOSRestoreImageStruct restoreImageStruct = convertVZMacOSRestoreImage2Struct(restoreImage);
+                               macOSRestoreImageCompletionHandler(cgoHandler, &restoreImageStruct, error);
+                           }];
+        } @catch (NSException *exception) {
+            raised = [exception retain];
+        }
+        [ipswURL release];
+    }
+    if (raised != nil) {
+        VZMacOSRestoreImageStruct restoreImageStruct = convertVZMacOSRestoreImage2Struct(nil);
+        macOSRestoreImageCompletionHandler(cgoHandler, &restoreImageStruct, newNSErrorWithException(raised));
+        [raised release];
     }
 }
 
@@ -328,21 +374,40 @@ void *newProgressObserverVZMacOSInstaller()
     return [[ProgressObserver alloc] init];
 }
 
+/*!
+ @abstract Start installing macOS.
+ @discussion
+    The progress observer is removed from the installer's progress before the completion handler is called,
+    even if the installation failed or was cancelled.
+    So the fractionCompletedHandler is never called after the completionHandler is called.
+ */
 void installByVZMacOSInstaller(void *installerPtr, void *vmQueue, void *progressObserverPtr, void *completionHandler, void *fractionCompletedHandler)
 {
     VZMacOSInstaller *installer = (VZMacOSInstaller *)installerPtr;
+    ProgressObserver *observer = (ProgressObserver *)progressObserverPtr;
     dispatch_sync((dispatch_queue_t)vmQueue, ^{
-        [installer installWithCompletionHandler:^(NSError *error) {
-            macOSInstallCompletionHandler(completionHandler, error);
-        }];
+        @try {
+            [installer installWithCompletionHandler:^(NSError *error) {
+                [installer.progress removeObserver:observer forKeyPath:@"fractionCompleted"];
+                macOSInstallCompletionHandler(completionHandler, error);
+            }];
+        } @catch (NSException *exception) {
+            macOSInstallCompletionHandler(completionHandler, newNSErrorWithException(exception));
+            return;
+        }
         [installer.progress
-            addObserver:(ProgressObserver *)progressObserverPtr
+            addObserver:observer
              forKeyPath:@"fractionCompleted"
                 options:NSKeyValueObservingOptionInitial | NSKeyValueObservingOptionNew
                 context:fractionCompletedHandler];
     });
 }
 
+/*!
+ @abstract Cancel the installation if it is cancellable.
+ @discussion
+    The completion handler of the installation is called with an error after the installation is cancelled.
+ */
 void cancelInstallVZMacOSInstaller(void *installerPtr)
 {
     VZMacOSInstaller *installer = (VZMacOSInstaller *)installerPtr;
@@ -351,4 +416,35 @@ void cancelInstallVZMacOSInstaller(void *installerPtr)
     }
 }
 
-#endif
\ No newline at end of file
+/*!
+ @abstract Start a virtual machine with the macOS specific options.
+ @param startUpFromMacOSRecovery Whether to boot the guest into the macOS Recovery.
+ @discussion
+    The virtual machine must be configured with VZMacOSBootLoader.
+    This is only available on macOS 13 and newer.
+ */
+void startWithMacOSOptionsCompletionHandler(void *machine, void *queue, bool startUpFromMacOSRecovery, void *completionHandler)
+{
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 130000
+    if (@available(macOS 13, *)) {
+        VZMacOSVirtualMachineStartOptions *options = [[[VZMacOSVirtualMachineStartOptions alloc] init] autorelease];
+        options.startUpFromMacOSRecovery = (BOOL)startUpFromMacOSRecovery;
+        dispatch_sync((dispatch_queue_t)queue, ^{
+            @try {
+                [(VZVirtualMachine *)machine startWithOptions:options
+                                            completionHandler:^(NSError *err) {
+                                                virtualMachineCompletionHandler(completionHandler, err);
+                                            }];
+            } @catch (NSException *exception) {
+                virtualMachineCompletionHandler(completionHandler, newNSErrorWithException(exception));
+            }
+        });
+        return;
+    }
+#endif
+    NSError *err = nil;
+    SET_UNSUPPORTED_MACOS_ERROR(&err);
+    virtualMachineCompletionHandler(completionHandler, err);
+}
+
+#endif
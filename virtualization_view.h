@@ -11,6 +11,7 @@
 
 @interface VZApplication : NSApplication {
     bool shouldKeepRunning;
+    bool didFinishLaunching;
 }
 @end
 
@@ -24,6 +25,31 @@
 
 @interface AppDelegate : NSObject <NSApplicationDelegate, NSWindowDelegate, VZVirtualMachineDelegate>
 - (instancetype)initWithVirtualMachine:(VZVirtualMachine *)virtualMachine
+                                 queue:(dispatch_queue_t)queue
                            windowWidth:(CGFloat)windowWidth
-                          windowHeight:(CGFloat)windowHeight;
-@end
\ No newline at end of file
+                          windowHeight:(CGFloat)windowHeight
+                    capturesSystemKeys:(BOOL)capturesSystemKeys
+      automaticallyReconfiguresDisplay:(BOOL)automaticallyReconfiguresDisplay;
+- (void)detachVirtualMachine;
+@end
+/*!
+ @abstract A VZVirtualMachineView which is attached to a hidden window.
+ @discussion
+    This is used to send the keyboard and pointer events to the virtual machine without
+    displaying any window. The window is placed out of the screen, so it is never visible.
+    All methods must be called on the main thread.
+ */
+@interface VZHeadlessView : NSObject
+@property (readonly) VZVirtualMachineView *virtualMachineView;
+- (instancetype)initWithVirtualMachine:(VZVirtualMachine *)virtualMachine
+                                 width:(CGFloat)width
+                                height:(CGFloat)height;
+- (void)sendKeyEventWithType:(NSEventType)type
+                     keyCode:(unsigned short)keyCode
+                  characters:(NSString *)characters
+               modifierFlags:(NSEventModifierFlags)modifierFlags;
+- (void)sendMouseEventWithType:(NSEventType)type
+                      location:(NSPoint)location
+                 modifierFlags:(NSEventModifierFlags)modifierFlags;
+- (CGImageRef)takeScreenshot CF_RETURNS_RETAINED;
+@end
@@ -1,3 +1,6 @@
+//go:build darwin && !vzheadless
+// +build darwin,!vzheadless
+
 //
 //  virtualization_view.m
 //
@@ -5,13 +8,23 @@
 //
 
 #import "virtualization_view.h"
+#import <dlfcn.h>
 
 @implementation VZApplication
 
 - (void)run
 {
     @autoreleasepool {
-        [self finishLaunching];
+        if (!didFinishLaunching) {
+            [self finishLaunching];
+            didFinishLaunching = YES;
+        } else {
+            // finishLaunching must be called only once per process. When a new window is
+            // attached to the virtual machine again, notify the current delegate manually.
+            [(id<NSApplicationDelegate>)self.delegate applicationDidFinishLaunching:
+                                                          [NSNotification notificationWithName:NSApplicationDidFinishLaunchingNotification
+                                                                                        object:self]];
+        }
 
         shouldKeepRunning = YES;
         do {
@@ -167,22 +180,40 @@
 
 @implementation AppDelegate {
     VZVirtualMachine *_virtualMachine;
+    dispatch_queue_t _queue;
+    id<VZVirtualMachineDelegate> _previousDelegate;
     VZVirtualMachineView *_virtualMachineView;
     CGFloat _windowWidth;
     CGFloat _windowHeight;
 }
 
 - (instancetype)initWithVirtualMachine:(VZVirtualMachine *)virtualMachine
+                                 queue:(dispatch_queue_t)queue
                            windowWidth:(CGFloat)windowWidth
                           windowHeight:(CGFloat)windowHeight
+                    capturesSystemKeys:(BOOL)capturesSystemKeys
+      automaticallyReconfiguresDisplay:(BOOL)automaticallyReconfiguresDisplay
 {
     self = [super init];
     _virtualMachine = virtualMachine;
-    _virtualMachine.delegate = self;
+    _queue = queue;
+    // The delegate must be set on the virtual machine's queue.
+    // The previous delegate reports the stop of the virtual machine to Go, so the callbacks
+    // are forwarded to it, and it is restored when the window is detached.
+    dispatch_sync(_queue, ^{
+        _previousDelegate = [_virtualMachine.delegate retain];
+        _virtualMachine.delegate = self;
+    });
 
     // Setup virtual machine view configs
     VZVirtualMachineView *view = [[[VZVirtualMachineView alloc] init] autorelease];
-    view.capturesSystemKeys = YES;
+    view.capturesSystemKeys = capturesSystemKeys;
+#if __MAC_OS_X_VERSION_MAX_ALLOWED >= 140000
+    if (@available(macOS 14, *)) {
+        // The guest display follows the size of the window when it is resized.
+        view.automaticallyReconfiguresDisplay = automaticallyReconfiguresDisplay;
+    }
+#endif
     view.virtualMachine = _virtualMachine;
     _virtualMachineView = view;
 
@@ -192,15 +223,39 @@
     return self;
 }
 
+/*!
+ @abstract Detach this delegate from the virtual machine.
+ @discussion
+    The virtual machine keeps running after the window has been closed. So we have to
+    restore the previous delegate to not receive events for a window which no longer exists.
+ */
+- (void)detachVirtualMachine
+{
+    dispatch_sync(_queue, ^{
+        if (_virtualMachine.delegate == self) {
+            _virtualMachine.delegate = _previousDelegate;
+        }
+        [_previousDelegate release];
+        _previousDelegate = nil;
+    });
+    _virtualMachineView.virtualMachine = nil;
+}
+
 /* IMPORTANT: delegate methods are called from VM's queue */
 - (void)guestDidStopVirtualMachine:(VZVirtualMachine *)virtualMachine
 {
+    if ([_previousDelegate respondsToSelector:@selector(guestDidStopVirtualMachine:)]) {
+        [_previousDelegate guestDidStopVirtualMachine:virtualMachine];
+    }
     [NSApp performSelectorOnMainThread:@selector(terminate:) withObject:self waitUntilDone:NO];
 }
 
 - (void)virtualMachine:(VZVirtualMachine *)virtualMachine didStopWithError:(NSError *)error
 {
     NSLog(@"VM %@ didStopWithError: %@", virtualMachine, error);
+    if ([_previousDelegate respondsToSelector:@selector(virtualMachine:didStopWithError:)]) {
+        [_previousDelegate virtualMachine:virtualMachine didStopWithError:error];
+    }
     [NSApp performSelectorOnMainThread:@selector(terminate:) withObject:self waitUntilDone:NO];
 }
 
@@ -372,3 +427,144 @@
     [aboutPanel makeKeyAndOrderFront:nil];
 }
 @end
+
+// CGWindowListCreateImage is obsoleted by the newer SDKs in favor of ScreenCaptureKit, but it is
+// still available at runtime and captures the windows of this process without the permission of
+// the screen recording. So it is looked up at runtime.
+typedef CGImageRef (*windowListCreateImageFunc)(CGRect, CGWindowListOption, CGWindowID, CGWindowImageOption);
+static windowListCreateImageFunc windowListCreateImage = NULL;
+static dispatch_once_t windowListCreateImageOnce;
+
+@implementation VZHeadlessView {
+    NSWindow *_window;
+    VZVirtualMachineView *_virtualMachineView;
+}
+
+- (instancetype)initWithVirtualMachine:(VZVirtualMachine *)virtualMachine
+                                 width:(CGFloat)width
+                                height:(CGFloat)height
+{
+    self = [super init];
+    // Place the window far away from the screens, so it is never visible.
+    NSRect rect = NSMakeRect(-100000, -100000, width, height);
+    _window = [[NSWindow alloc] initWithContentRect:rect
+                                          styleMask:NSWindowStyleMaskBorderless
+                                            backing:NSBackingStoreBuffered
+                                              defer:NO];
+    [_window setReleasedWhenClosed:NO];
+
+    _virtualMachineView = [[VZVirtualMachineView alloc] initWithFrame:NSMakeRect(0, 0, width, height)];
+    _virtualMachineView.capturesSystemKeys = YES;
+    _virtualMachineView.virtualMachine = virtualMachine;
+    [_window setContentView:_virtualMachineView];
+    [_window orderBack:nil];
+    [_window makeFirstResponder:_virtualMachineView];
+    return self;
+}
+
+- (void)dealloc
+{
+    _virtualMachineView.virtualMachine = nil;
+    [_window close];
+    [_virtualMachineView release];
+    [_window release];
+    [super dealloc];
+}
+
+- (VZVirtualMachineView *)virtualMachineView
+{
+    return _virtualMachineView;
+}
+
+- (void)sendKeyEventWithType:(NSEventType)type
+                     keyCode:(unsigned short)keyCode
+                  characters:(NSString *)characters
+               modifierFlags:(NSEventModifierFlags)modifierFlags
+{
+    NSEvent *event = [NSEvent keyEventWithType:type
+                                      location:NSZeroPoint
+                                 modifierFlags:modifierFlags
+                                     timestamp:[[NSProcessInfo processInfo] systemUptime]
+                                  windowNumber:_window.windowNumber
+                                       context:nil
+                                    characters:characters
+                   charactersIgnoringModifiers:characters
+                                     isARepeat:NO
+                                       keyCode:keyCode];
+    switch (type) {
+    case NSEventTypeKeyDown:
+        [_virtualMachineView keyDown:event];
+        break;
+    case NSEventTypeKeyUp:
+        [_virtualMachineView keyUp:event];
+        break;
+    case NSEventTypeFlagsChanged:
+        [_virtualMachineView flagsChanged:event];
+        break;
+    default:
+        break;
+    }
+}
+
+- (void)sendMouseEventWithType:(NSEventType)type
+                      location:(NSPoint)location
+                 modifierFlags:(NSEventModifierFlags)modifierFlags
+{
+    // The origin of the window coordinates is the bottom-left corner.
+    NSPoint point = NSMakePoint(location.x, _virtualMachineView.frame.size.height - location.y);
+    NSEvent *event = [NSEvent mouseEventWithType:type
+                                        location:point
+                                   modifierFlags:modifierFlags
+                                       timestamp:[[NSProcessInfo processInfo] systemUptime]
+                                    windowNumber:_window.windowNumber
+                                         context:nil
+                                     eventNumber:0
+                                      clickCount:1
+                                        pressure:(type == NSEventTypeLeftMouseDown || type == NSEventTypeRightMouseDown) ? 1.0 : 0.0];
+    switch (type) {
+    case NSEventTypeMouseMoved:
+        [_virtualMachineView mouseMoved:event];
+        break;
+    case NSEventTypeLeftMouseDown:
+        [_virtualMachineView mouseDown:event];
+        break;
+    case NSEventTypeLeftMouseUp:
+        [_virtualMachineView mouseUp:event];
+        break;
+    case NSEventTypeLeftMouseDragged:
+        [_virtualMachineView mouseDragged:event];
+        break;
+    case NSEventTypeRightMouseDown:
+        [_virtualMachineView rightMouseDown:event];
+        break;
+    case NSEventTypeRightMouseUp:
+        [_virtualMachineView rightMouseUp:event];
+        break;
+    default:
+        break;
+    }
+}
+
+/*!
+ @abstract Capture the current image of the view.
+ @discussion
+    VZVirtualMachineView renders the guest into a layer which is composited by the window server,
+    so -[NSView cacheDisplayInRect:toBitmapImageRep:] does not capture it. The window is captured
+    by the window server instead. The window is out of the screens but still ordered in, so it has
+    the contents.
+ @return A new CGImage which must be released by the caller, or NULL if the window could not be captured.
+ */
+- (CGImageRef)takeScreenshot
+{
+    dispatch_once(&windowListCreateImageOnce, ^{
+        windowListCreateImage = (windowListCreateImageFunc)dlsym(RTLD_DEFAULT, "CGWindowListCreateImage");
+    });
+    if (windowListCreateImage == NULL) {
+        return NULL;
+    }
+    return windowListCreateImage(CGRectNull,
+        kCGWindowListOptionIncludingWindow,
+        (CGWindowID)_window.windowNumber,
+        kCGWindowImageBoundsIgnoreFraming | kCGWindowImageBestResolution);
+}
+@end
@@ -0,0 +1,35 @@
+package vz
+
+// VM is the lifecycle of a virtual machine which is implemented by *VirtualMachine.
+//
+// The orchestration code which depends on VM instead of *VirtualMachine can be unit tested
+// without Virtualization.framework, e.g. on Linux, with the fake in the vztest package.
+// This file and the state of the virtual machine are the only parts of this package which
+// are built on other platforms than macOS.
+type VM interface {
+	// ID returns the identifier of the virtual machine.
+	ID() string
+
+	// State returns the execution state of the virtual machine.
+	State() VirtualMachineState
+
+	// StateChangedNotify returns the channel which receives the changes of the state.
+	StateChangedNotify() <-chan VirtualMachineState
+
+	// CanStart, CanPause, CanResume, CanRequestStop and CanStop report whether the operation
+	// can be done in the current state.
+	CanStart() bool
+	CanPause() bool
+	CanResume() bool
+	CanRequestStop() bool
+	CanStop() bool
+
+	// Start, Pause, Resume and Stop call fn with the result of the operation.
+	Start(fn func(error))
+	Pause(fn func(error))
+	Resume(fn func(error))
+	Stop(fn func(error))
+
+	// RequestStop requests that the guest turns itself off.
+	RequestStop() (bool, error)
+}
@@ -0,0 +1,126 @@
+package vnet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+
+	dhcpOptionSubnetMask  = 1
+	dhcpOptionRouter      = 3
+	dhcpOptionDNS         = 6
+	dhcpOptionMTU         = 26
+	dhcpOptionRequestedIP = 50
+	dhcpOptionLeaseTime   = 51
+	dhcpOptionMessageType = 53
+	dhcpOptionServerID    = 54
+	dhcpOptionEnd         = 255
+
+	// dhcpLeaseTime is the lease time in seconds. GuestIP is always leased to the same guest,
+	// so the lease only needs to be renewed when the guest is rebooted.
+	dhcpLeaseTime = 24 * 60 * 60
+
+	bootpLen = 236
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// handleDHCP answers DISCOVER with OFFER and REQUEST with ACK of GuestIP.
+func (n *Network) handleDHCP(b []byte) {
+	if len(b) < bootpLen+len(dhcpMagicCookie) || b[0] != 1 || string(b[bootpLen:bootpLen+4]) != string(dhcpMagicCookie) {
+		return
+	}
+	options := parseDHCPOptions(b[bootpLen+4:])
+	msgType := options[dhcpOptionMessageType]
+	if len(msgType) != 1 {
+		return
+	}
+	var reply byte
+	switch msgType[0] {
+	case dhcpDiscover:
+		reply = dhcpOffer
+	case dhcpRequest:
+		reply = dhcpAck
+		requested := options[dhcpOptionRequestedIP]
+		if len(requested) == 0 {
+			requested = b[12:16] // ciaddr
+		}
+		if len(requested) == 4 && string(requested) != string(n.guestIP[:]) && string(requested) != "\x00\x00\x00\x00" {
+			reply = dhcpNak
+		}
+		if id := options[dhcpOptionServerID]; id != nil && string(id) != string(n.gatewayIP[:]) {
+			// the guest chose another server.
+			return
+		}
+	default:
+		return
+	}
+
+	resp := make([]byte, bootpLen, bootpLen+64)
+	resp[0] = 2 // BOOTREPLY
+	copy(resp[1:4], b[1:4])
+	copy(resp[4:8], b[4:8])     // xid
+	copy(resp[10:12], b[10:12]) // flags
+	if reply != dhcpNak {
+		copy(resp[16:20], n.guestIP[:])   // yiaddr
+		copy(resp[20:24], n.gatewayIP[:]) // siaddr
+	}
+	copy(resp[28:44], b[28:44]) // chaddr
+	resp = append(resp, dhcpMagicCookie...)
+	resp = appendDHCPOption(resp, dhcpOptionMessageType, reply)
+	resp = appendDHCPOption(resp, dhcpOptionServerID, n.gatewayIP[:]...)
+	if reply != dhcpNak {
+		lease := make([]byte, 4)
+		binary.BigEndian.PutUint32(lease, dhcpLeaseTime)
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, uint16(n.mtu))
+		resp = appendDHCPOption(resp, dhcpOptionLeaseTime, lease...)
+		resp = appendDHCPOption(resp, dhcpOptionSubnetMask, net.IP(n.subnet.Mask).To4()...)
+		if !n.hostOnly {
+			resp = appendDHCPOption(resp, dhcpOptionRouter, n.gatewayIP[:]...)
+			resp = appendDHCPOption(resp, dhcpOptionDNS, n.gatewayIP[:]...)
+		}
+		resp = appendDHCPOption(resp, dhcpOptionMTU, mtu...)
+	}
+	resp = append(resp, dhcpOptionEnd)
+
+	n.sendIPv4(n.gatewayIP, ipv4{255, 255, 255, 255}, protoUDP, udpDatagram(
+		endpoint{ip: n.gatewayIP, port: dhcpServerPort},
+		endpoint{ip: ipv4{255, 255, 255, 255}, port: dhcpClientPort},
+		resp,
+	))
+}
+
+func parseDHCPOptions(b []byte) map[byte][]byte {
+	options := make(map[byte][]byte)
+	for len(b) > 0 {
+		code := b[0]
+		if code == dhcpOptionEnd {
+			break
+		}
+		if code == 0 {
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			break
+		}
+		options[code] = b[2 : 2+int(b[1])]
+		b = b[2+int(b[1]):]
+	}
+	return options
+}
+
+func appendDHCPOption(b []byte, code byte, value ...byte) []byte {
+	b = append(b, code, byte(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,255 @@
+package vnet
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// EtherTypes and IP protocol numbers which are handled by the stack.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+)
+
+const (
+	ethernetHeaderLen = 14
+	ipv4HeaderLen     = 20
+	udpHeaderLen      = 8
+	tcpHeaderLen      = 20
+)
+
+// ipv4 is an IPv4 address as a comparable value.
+type ipv4 [4]byte
+
+func toIPv4(ip net.IP) ipv4 {
+	var a ipv4
+	copy(a[:], ip.To4())
+	return a
+}
+
+func (a ipv4) IP() net.IP { return net.IPv4(a[0], a[1], a[2], a[3]).To4() }
+
+func (a ipv4) String() string { return a.IP().String() }
+
+// endpoint is an IPv4 address and a port.
+type endpoint struct {
+	ip   ipv4
+	port uint16
+}
+
+func (e endpoint) String() string {
+	return net.JoinHostPort(e.ip.String(), strconv.Itoa(int(e.port)))
+}
+
+// ethernetFrame builds an Ethernet II frame.
+func ethernetFrame(dst, src net.HardwareAddr, etherType uint16, payload []byte) []byte {
+	b := make([]byte, ethernetHeaderLen+len(payload))
+	copy(b[0:6], dst)
+	copy(b[6:12], src)
+	binary.BigEndian.PutUint16(b[12:14], etherType)
+	copy(b[ethernetHeaderLen:], payload)
+	return b
+}
+
+// ipv4Header is the parsed IPv4 header.
+type ipv4Header struct {
+	src, dst ipv4
+	proto    byte
+	ttl      byte
+}
+
+// parseIPv4 parses the IPv4 packet. Fragments are not supported and reported as invalid.
+func parseIPv4(b []byte) (h ipv4Header, payload []byte, ok bool) {
+	if len(b) < ipv4HeaderLen || b[0]>>4 != 4 {
+		return h, nil, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < ipv4HeaderLen || total < ihl || total > len(b) {
+		return h, nil, false
+	}
+	// more fragments flag or fragment offset.
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return h, nil, false
+	}
+	h.ttl = b[8]
+	h.proto = b[9]
+	copy(h.src[:], b[12:16])
+	copy(h.dst[:], b[16:20])
+	return h, b[ihl:total], true
+}
+
+// ipv4Packet builds an IPv4 packet with the "don't fragment" flag.
+func ipv4Packet(src, dst ipv4, proto byte, id uint16, payload []byte) []byte {
+	b := make([]byte, ipv4HeaderLen+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], 0x4000)
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:16], src[:])
+	copy(b[16:20], dst[:])
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:ipv4HeaderLen], 0))
+	copy(b[ipv4HeaderLen:], payload)
+	return b
+}
+
+// checksum returns the internet checksum of b which is added to initial.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 != 0 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum returns the partial sum of the pseudo header of TCP and UDP.
+func pseudoHeaderSum(src, dst ipv4, proto byte, length int) uint32 {
+	var sum uint32
+	sum += uint32(binary.BigEndian.Uint16(src[0:2])) + uint32(binary.BigEndian.Uint16(src[2:4]))
+	sum += uint32(binary.BigEndian.Uint16(dst[0:2])) + uint32(binary.BigEndian.Uint16(dst[2:4]))
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// udpDatagram builds a UDP datagram with the checksum.
+func udpDatagram(src, dst endpoint, payload []byte) []byte {
+	b := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], src.port)
+	binary.BigEndian.PutUint16(b[2:4], dst.port)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	copy(b[udpHeaderLen:], payload)
+	sum := checksum(b, pseudoHeaderSum(src.ip, dst.ip, protoUDP, len(b)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[6:8], sum)
+	return b
+}
+
+// parseUDP parses the UDP datagram and returns the ports and the payload.
+func parseUDP(b []byte) (srcPort, dstPort uint16, payload []byte, ok bool) {
+	if len(b) < udpHeaderLen {
+		return 0, 0, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if length < udpHeaderLen || length > len(b) {
+		return 0, 0, nil, false
+	}
+	return binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4]), b[udpHeaderLen:length], true
+}
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// tcpSegment is the parsed TCP segment.
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	window           uint16
+
+	// mss is the maximum segment size option. Zero if not present.
+	mss uint16
+
+	payload []byte
+}
+
+func (s *tcpSegment) has(flags byte) bool { return s.flags&flags == flags }
+
+// seqLen returns the length of the segment in the sequence space.
+func (s *tcpSegment) seqLen() uint32 {
+	n := uint32(len(s.payload))
+	if s.has(tcpSYN) {
+		n++
+	}
+	if s.has(tcpFIN) {
+		n++
+	}
+	return n
+}
+
+func parseTCP(b []byte) (tcpSegment, bool) {
+	var s tcpSegment
+	if len(b) < tcpHeaderLen {
+		return s, false
+	}
+	off := int(b[12]>>4) * 4
+	if off < tcpHeaderLen || off > len(b) {
+		return s, false
+	}
+	s.srcPort = binary.BigEndian.Uint16(b[0:2])
+	s.dstPort = binary.BigEndian.Uint16(b[2:4])
+	s.seq = binary.BigEndian.Uint32(b[4:8])
+	s.ack = binary.BigEndian.Uint32(b[8:12])
+	s.flags = b[13]
+	s.window = binary.BigEndian.Uint16(b[14:16])
+	opts := b[tcpHeaderLen:off]
+	for len(opts) > 0 {
+		kind := opts[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if kind == 2 && opts[1] == 4 {
+			s.mss = binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+	s.payload = b[off:]
+	return s, true
+}
+
+// marshal builds the TCP segment with the checksum. The MSS option is added if s.mss is not zero.
+func (s *tcpSegment) marshal(src, dst ipv4) []byte {
+	hlen := tcpHeaderLen
+	if s.mss != 0 {
+		hlen += 4
+	}
+	b := make([]byte, hlen+len(s.payload))
+	binary.BigEndian.PutUint16(b[0:2], s.srcPort)
+	binary.BigEndian.PutUint16(b[2:4], s.dstPort)
+	binary.BigEndian.PutUint32(b[4:8], s.seq)
+	binary.BigEndian.PutUint32(b[8:12], s.ack)
+	b[12] = byte(hlen/4) << 4
+	b[13] = s.flags
+	binary.BigEndian.PutUint16(b[14:16], s.window)
+	if s.mss != 0 {
+		b[20], b[21] = 2, 4
+		binary.BigEndian.PutUint16(b[22:24], s.mss)
+	}
+	copy(b[hlen:], s.payload)
+	binary.BigEndian.PutUint16(b[16:18], checksum(b, pseudoHeaderSum(src, dst, protoTCP, len(b))))
+	return b
+}
+
+// seqLT reports whether a < b in the sequence space.
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+
+// seqLEQ reports whether a <= b in the sequence space.
+func seqLEQ(a, b uint32) bool { return int32(a-b) <= 0 }
@@ -0,0 +1,770 @@
+package vnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/forward"
+)
+
+const (
+	// tcpReceiveBufferSize is the size of the buffer of the data from the guest. Window scaling
+	// is not negotiated, so it is also the maximum window which is advertised.
+	tcpReceiveBufferSize = 65535
+
+	// tcpSendBufferSize is the size of the buffer of the data to the guest which is not acknowledged.
+	tcpSendBufferSize = 256 << 10
+
+	tcpInitialRTO = 500 * time.Millisecond
+	tcpMaxRTO     = 10 * time.Second
+	tcpMaxRetries = 10
+
+	// tcpDialTimeout is the timeout to connect to the destination of the guest on the host.
+	tcpDialTimeout = 30 * time.Second
+
+	// tcpLinger is the duration after Close to wait for the guest to finish the connection
+	// before it is reset.
+	tcpLinger = 60 * time.Second
+
+	tcpDefaultMSS = 536
+)
+
+type tcpState int
+
+const (
+	tcpStateDialing tcpState = iota // waiting the connection on the host to answer the guest's SYN.
+	tcpStateSynSent
+	tcpStateSynReceived
+	tcpStateEstablished
+	tcpStateClosed
+)
+
+type tcpKey struct {
+	guestPort uint16
+	remote    endpoint
+}
+
+// tcpConn is a TCP connection with the guest which is terminated by the stack.
+//
+// Only the in-order segments are accepted, and the lost segments are recovered by go-back-N
+// retransmission. This is enough for a virtual link which rarely drops or reorders frames.
+type tcpConn struct {
+	n   *Network
+	key tcpKey
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state tcpState
+	err   error
+
+	// receive sequence space.
+	rcvNxt uint32
+	rcvBuf []byte
+	rcvFin bool
+
+	// send sequence space. sndBuf holds the data from sndUna, and sndMax is the highest
+	// sequence number which has been sent before the retransmission.
+	iss       uint32
+	sndUna    uint32
+	sndNxt    uint32
+	sndMax    uint32
+	sndWnd    uint32
+	sndBuf    []byte
+	finQueued bool
+	finSent   bool
+	finAcked  bool
+	mss       int
+
+	rto     time.Duration
+	retries int
+	timer   *time.Timer
+
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+var _ net.Conn = (*tcpConn)(nil)
+
+func newTCPConn(n *Network, key tcpKey) *tcpConn {
+	iss := rand.Uint32()
+	c := &tcpConn{
+		n:      n,
+		key:    key,
+		iss:    iss,
+		sndUna: iss,
+		sndNxt: iss,
+		sndMax: iss,
+		mss:    tcpDefaultMSS,
+		rto:    tcpInitialRTO,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (n *Network) handleTCP(h ipv4Header, b []byte) {
+	seg, ok := parseTCP(b)
+	if !ok || h.src != n.guestIP {
+		return
+	}
+	key := tcpKey{guestPort: seg.srcPort, remote: endpoint{ip: h.dst, port: seg.dstPort}}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	if c := n.tcpConns[key]; c != nil {
+		n.mu.Unlock()
+		c.input(&seg)
+		return
+	}
+	if !seg.has(tcpSYN) || seg.has(tcpACK) || seg.has(tcpRST) {
+		n.mu.Unlock()
+		n.resetUnknown(key, &seg)
+		return
+	}
+	addr, ok := n.translate(key.remote)
+	if !ok {
+		n.mu.Unlock()
+		n.resetUnknown(key, &seg)
+		return
+	}
+	c := newTCPConn(n, key)
+	c.state = tcpStateDialing
+	c.rcvNxt = seg.seq + 1
+	c.sndWnd = uint32(seg.window)
+	c.mss = n.mssFor(seg.mss)
+	n.tcpConns[key] = c
+	n.mu.Unlock()
+
+	go n.dialTCP(c, addr)
+}
+
+// dialTCP connects to addr on the host, and answers the guest's SYN if it succeeded.
+func (n *Network) dialTCP(c *tcpConn, addr string) {
+	d := net.Dialer{Timeout: tcpDialTimeout}
+	conn, err := d.Dial("tcp4", addr)
+	if err != nil {
+		n.logf("vnet: failed to connect %s: %v", addr, err)
+		c.abort(err, true)
+		return
+	}
+	c.mu.Lock()
+	if c.state != tcpStateDialing {
+		c.mu.Unlock()
+		conn.Close()
+		return
+	}
+	c.state = tcpStateSynReceived
+	syn := c.synLocked()
+	c.mu.Unlock()
+	c.send(syn)
+
+	go relay(c, conn)
+}
+
+// relay copies the data between the guest and the host connections until both directions are finished.
+func relay(guest *tcpConn, host net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(host, guest); err != nil {
+			host.Close()
+			return
+		}
+		if cw, ok := host.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			host.Close()
+		}
+	}()
+	go func() {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(guest, host); err != nil {
+			guest.Close()
+			host.Close()
+			return
+		}
+		guest.CloseWrite()
+	}()
+	<-done
+	<-done
+	guest.Close()
+	host.Close()
+}
+
+// DialContext connects to the address in the guest. This implements forward.Dialer.
+//
+// The host of address must be forward.GuestHost or GuestIP. The connection comes from
+// the gateway address in the guest.
+func (n *Network) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if host != forward.GuestHost && host != n.guestIP.String() {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("vnet: unknown host %q", host)}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("vnet: invalid port %q", portStr)}
+	}
+	raddr := &net.TCPAddr{IP: n.guestIP.IP(), Port: int(port)}
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: ErrClosed}
+	}
+	var key tcpKey
+	for i := 0; ; i++ {
+		if i == 16384 {
+			n.mu.Unlock()
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: syscall.EADDRNOTAVAIL}
+		}
+		n.nextPort++
+		key = tcpKey{
+			guestPort: uint16(port),
+			remote:    endpoint{ip: n.gatewayIP, port: uint16(49152 + n.nextPort%16384)},
+		}
+		if n.tcpConns[key] == nil {
+			break
+		}
+	}
+	c := newTCPConn(n, key)
+	c.state = tcpStateSynSent
+	c.mss = n.mssFor(0)
+	n.tcpConns[key] = c
+	n.mu.Unlock()
+
+	c.mu.Lock()
+	syn := c.synLocked()
+	c.mu.Unlock()
+	c.send(syn)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	c.mu.Lock()
+	for c.state == tcpStateSynSent && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	err = c.err
+	established := c.state == tcpStateEstablished
+	c.mu.Unlock()
+	if established {
+		return c, nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	c.abort(err, true)
+	return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+}
+
+// mssFor returns the MSS which is used with the guest which advertised peer.
+func (n *Network) mssFor(peer uint16) int {
+	mss := n.mtu - ipv4HeaderLen - tcpHeaderLen
+	if peer == 0 {
+		peer = tcpDefaultMSS
+	}
+	if int(peer) < mss {
+		mss = int(peer)
+	}
+	return mss
+}
+
+// resetUnknown answers the segment which does not belong to any connection with RST.
+func (n *Network) resetUnknown(key tcpKey, seg *tcpSegment) {
+	if seg.has(tcpRST) {
+		return
+	}
+	rst := tcpSegment{srcPort: key.remote.port, dstPort: key.guestPort}
+	if seg.has(tcpACK) {
+		rst.seq = seg.ack
+		rst.flags = tcpRST
+	} else {
+		rst.ack = seg.seq + seg.seqLen()
+		rst.flags = tcpRST | tcpACK
+	}
+	n.sendIPv4(key.remote.ip, n.guestIP, protoTCP, rst.marshal(key.remote.ip, n.guestIP))
+}
+
+// send sends the segments to the guest. This must be called without c.mu.
+func (c *tcpConn) send(segs []tcpSegment) {
+	for i := range segs {
+		c.n.sendIPv4(c.key.remote.ip, c.n.guestIP, protoTCP, segs[i].marshal(c.key.remote.ip, c.n.guestIP))
+	}
+}
+
+func (c *tcpConn) segmentLocked(flags byte, seq uint32, payload []byte) tcpSegment {
+	return tcpSegment{
+		srcPort: c.key.remote.port,
+		dstPort: c.key.guestPort,
+		seq:     seq,
+		ack:     c.rcvNxt,
+		flags:   flags,
+		window:  c.windowLocked(),
+		payload: payload,
+	}
+}
+
+func (c *tcpConn) windowLocked() uint16 {
+	if c.closed {
+		return tcpReceiveBufferSize
+	}
+	return uint16(tcpReceiveBufferSize - len(c.rcvBuf))
+}
+
+// synLocked returns SYN or SYN-ACK for the current state, and arms the retransmission timer.
+func (c *tcpConn) synLocked() []tcpSegment {
+	flags := byte(tcpSYN)
+	if c.state == tcpStateSynReceived {
+		flags |= tcpACK
+	}
+	seg := c.segmentLocked(flags, c.iss, nil)
+	if flags&tcpACK == 0 {
+		seg.ack = 0
+	}
+	seg.mss = uint16(c.n.mtu - ipv4HeaderLen - tcpHeaderLen)
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.armTimerLocked()
+	return []tcpSegment{seg}
+}
+
+// outputLocked returns the segments of the data and FIN which can be sent in the window.
+// If probe is true and the window is closed, one byte is sent to probe the window.
+func (c *tcpConn) outputLocked(probe bool) []tcpSegment {
+	if c.state != tcpStateEstablished {
+		return nil
+	}
+	var segs []tcpSegment
+	for !c.finSent {
+		inFlight := int(c.sndNxt - c.sndUna)
+		unsent := len(c.sndBuf) - inFlight
+		if unsent > 0 {
+			wnd := int(c.sndWnd) - inFlight
+			if wnd <= 0 {
+				if !probe || inFlight != 0 {
+					break
+				}
+				wnd = 1
+			}
+			size := unsent
+			if size > wnd {
+				size = wnd
+			}
+			if size > c.mss {
+				size = c.mss
+			}
+			flags := byte(tcpACK)
+			if size == unsent {
+				flags |= tcpPSH
+			}
+			payload := append([]byte(nil), c.sndBuf[inFlight:inFlight+size]...)
+			segs = append(segs, c.segmentLocked(flags, c.sndNxt, payload))
+			c.sndNxt += uint32(size)
+			probe = false
+			continue
+		}
+		if c.finQueued {
+			segs = append(segs, c.segmentLocked(tcpFIN|tcpACK, c.sndNxt, nil))
+			c.sndNxt++
+			c.finSent = true
+		}
+		break
+	}
+	if seqLT(c.sndMax, c.sndNxt) {
+		c.sndMax = c.sndNxt
+	}
+	if c.sndNxt != c.sndUna || len(c.sndBuf) > 0 {
+		c.armTimerLocked()
+	}
+	return segs
+}
+
+func (c *tcpConn) armTimerLocked() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.rto, c.onTimer)
+		return
+	}
+	c.timer.Reset(c.rto)
+}
+
+func (c *tcpConn) stopTimerLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// onTimer retransmits the segments which are not acknowledged, or probes the closed window.
+func (c *tcpConn) onTimer() {
+	c.mu.Lock()
+	var segs []tcpSegment
+	switch c.state {
+	case tcpStateSynSent, tcpStateSynReceived, tcpStateEstablished:
+		if c.sndNxt == c.sndUna && len(c.sndBuf) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		c.retries++
+		if c.retries > tcpMaxRetries {
+			c.mu.Unlock()
+			c.abort(syscall.ETIMEDOUT, true)
+			return
+		}
+		if c.rto *= 2; c.rto > tcpMaxRTO {
+			c.rto = tcpMaxRTO
+		}
+		if c.state != tcpStateEstablished {
+			segs = c.synLocked()
+			break
+		}
+		// go back to the first segment which is not acknowledged.
+		c.sndNxt = c.sndUna
+		c.finSent = c.finAcked
+		segs = c.outputLocked(true)
+	}
+	c.mu.Unlock()
+	c.send(segs)
+}
+
+// input processes the segment from the guest.
+func (c *tcpConn) input(seg *tcpSegment) {
+	c.mu.Lock()
+	if seg.has(tcpRST) {
+		err := error(syscall.ECONNRESET)
+		if c.state == tcpStateSynSent {
+			err = syscall.ECONNREFUSED
+		}
+		c.mu.Unlock()
+		c.abort(err, false)
+		return
+	}
+
+	switch c.state {
+	case tcpStateDialing, tcpStateClosed:
+		c.mu.Unlock()
+		return
+	case tcpStateSynSent:
+		if !seg.has(tcpSYN|tcpACK) || seg.ack != c.iss+1 {
+			c.mu.Unlock()
+			return
+		}
+		c.rcvNxt = seg.seq + 1
+		c.sndUna = seg.ack
+		c.sndWnd = uint32(seg.window)
+		c.mss = c.n.mssFor(seg.mss)
+		c.establishLocked()
+		ack := c.segmentLocked(tcpACK, c.sndNxt, nil)
+		c.mu.Unlock()
+		c.send([]tcpSegment{ack})
+		return
+	case tcpStateSynReceived:
+		if seg.has(tcpSYN) {
+			// the guest did not receive SYN-ACK.
+			syn := c.synLocked()
+			c.mu.Unlock()
+			c.send(syn)
+			return
+		}
+		if !seg.has(tcpACK) || seg.ack != c.iss+1 {
+			c.mu.Unlock()
+			return
+		}
+		c.sndUna = seg.ack
+		c.sndWnd = uint32(seg.window)
+		c.establishLocked()
+	}
+
+	needAck := seg.has(tcpSYN)
+	if seg.has(tcpACK) && seqLEQ(c.sndUna, seg.ack) && seqLEQ(seg.ack, c.sndMax) {
+		if acked := seg.ack - c.sndUna; acked > 0 {
+			dataEnd := c.sndUna + uint32(len(c.sndBuf))
+			if seqLT(dataEnd, seg.ack) {
+				c.finAcked = true
+				acked = uint32(len(c.sndBuf))
+			}
+			c.sndBuf = c.sndBuf[acked:]
+			if len(c.sndBuf) == 0 {
+				c.sndBuf = nil
+			}
+			c.sndUna = seg.ack
+			if seqLT(c.sndNxt, c.sndUna) {
+				c.sndNxt = c.sndUna
+			}
+			if c.finAcked {
+				c.finSent = true
+			}
+			c.retries = 0
+			c.rto = tcpInitialRTO
+			if c.sndNxt == c.sndUna {
+				c.stopTimerLocked()
+			} else {
+				c.armTimerLocked()
+			}
+			c.cond.Broadcast()
+		}
+		c.sndWnd = uint32(seg.window)
+	}
+
+	if len(seg.payload) > 0 || seg.has(tcpFIN) {
+		needAck = true
+		if seg.seq == c.rcvNxt && !c.rcvFin {
+			data := seg.payload
+			if !c.closed {
+				if free := tcpReceiveBufferSize - len(c.rcvBuf); len(data) > free {
+					data = data[:free]
+				}
+				c.rcvBuf = append(c.rcvBuf, data...)
+			}
+			c.rcvNxt += uint32(len(data))
+			if seg.has(tcpFIN) && len(data) == len(seg.payload) {
+				c.rcvNxt++
+				c.rcvFin = true
+			}
+			c.cond.Broadcast()
+		}
+	}
+
+	segs := c.outputLocked(false)
+	if needAck && len(segs) == 0 {
+		segs = append(segs, c.segmentLocked(tcpACK, c.sndNxt, nil))
+	}
+	finished := c.rcvFin && c.finAcked
+	if finished {
+		c.state = tcpStateClosed
+		c.stopTimerLocked()
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	c.send(segs)
+	if finished {
+		c.n.removeTCP(c)
+	}
+}
+
+func (c *tcpConn) establishLocked() {
+	c.state = tcpStateEstablished
+	c.retries = 0
+	c.rto = tcpInitialRTO
+	c.stopTimerLocked()
+	c.cond.Broadcast()
+}
+
+// abort closes the connection with err. The guest is notified by RST if reset is true.
+func (c *tcpConn) abort(err error, reset bool) {
+	c.mu.Lock()
+	if c.state == tcpStateClosed {
+		c.mu.Unlock()
+		return
+	}
+	var segs []tcpSegment
+	if reset {
+		segs = append(segs, c.segmentLocked(tcpRST|tcpACK, c.sndNxt, nil))
+	}
+	c.state = tcpStateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.stopTimerLocked()
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.send(segs)
+	c.n.removeTCP(c)
+}
+
+func (n *Network) removeTCP(c *tcpConn) {
+	n.mu.Lock()
+	if n.tcpConns[c.key] == c {
+		delete(n.tcpConns, c.key)
+	}
+	n.mu.Unlock()
+}
+
+func (c *tcpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.rcvBuf) == 0 && !c.rcvFin && c.err == nil && !c.closed && !deadlineExceeded(c.readDeadline) {
+		c.cond.Wait()
+	}
+	switch {
+	case c.closed:
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	case len(c.rcvBuf) > 0:
+		before := c.windowLocked()
+		nr := copy(b, c.rcvBuf)
+		c.rcvBuf = c.rcvBuf[nr:]
+		if len(c.rcvBuf) == 0 {
+			c.rcvBuf = nil
+		}
+		var segs []tcpSegment
+		// tell the guest that the window is opened.
+		if int(before) < c.mss && int(c.windowLocked()) >= c.mss && c.state == tcpStateEstablished {
+			segs = append(segs, c.segmentLocked(tcpACK, c.sndNxt, nil))
+		}
+		c.mu.Unlock()
+		c.send(segs)
+		return nr, nil
+	case c.rcvFin:
+		c.mu.Unlock()
+		return 0, io.EOF
+	case c.err != nil:
+		err := c.err
+		c.mu.Unlock()
+		return 0, err
+	default:
+		c.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *tcpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	total := 0
+	for len(b) > 0 {
+		for (c.state < tcpStateEstablished || len(c.sndBuf) >= tcpSendBufferSize) &&
+			c.err == nil && !c.closed && !c.finQueued && c.state != tcpStateClosed && !deadlineExceeded(c.writeDeadline) {
+			c.cond.Wait()
+		}
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return total, net.ErrClosed
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return total, err
+		case c.finQueued || c.state == tcpStateClosed:
+			c.mu.Unlock()
+			return total, syscall.EPIPE
+		case deadlineExceeded(c.writeDeadline):
+			c.mu.Unlock()
+			return total, os.ErrDeadlineExceeded
+		}
+		size := tcpSendBufferSize - len(c.sndBuf)
+		if size > len(b) {
+			size = len(b)
+		}
+		c.sndBuf = append(c.sndBuf, b[:size]...)
+		b = b[size:]
+		total += size
+		segs := c.outputLocked(false)
+		c.mu.Unlock()
+		c.send(segs)
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+	return total, nil
+}
+
+// CloseWrite sends FIN to the guest after the buffered data.
+func (c *tcpConn) CloseWrite() error {
+	c.mu.Lock()
+	if c.finQueued {
+		c.mu.Unlock()
+		return nil
+	}
+	c.finQueued = true
+	c.cond.Broadcast()
+	segs := c.outputLocked(false)
+	c.mu.Unlock()
+	c.send(segs)
+	return nil
+}
+
+// Close closes the connection. The buffered data is still sent to the guest, and the
+// connection is reset if the guest does not finish it within tcpLinger.
+func (c *tcpConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.rcvBuf = nil
+	c.cond.Broadcast()
+	if c.state != tcpStateEstablished {
+		c.mu.Unlock()
+		c.abort(net.ErrClosed, true)
+		return nil
+	}
+	c.finQueued = true
+	segs := c.outputLocked(false)
+	c.mu.Unlock()
+	c.send(segs)
+	time.AfterFunc(tcpLinger, func() { c.abort(net.ErrClosed, true) })
+	return nil
+}
+
+func (c *tcpConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: c.key.remote.ip.IP(), Port: int(c.key.remote.port)}
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.n.guestIP.IP(), Port: int(c.key.guestPort)}
+}
+
+func (c *tcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readTimer = c.resetDeadlineTimerLocked(c.readTimer, t)
+	return nil
+}
+
+func (c *tcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.writeTimer = c.resetDeadlineTimerLocked(c.writeTimer, t)
+	return nil
+}
+
+// resetDeadlineTimerLocked returns the timer which wakes up the waiters at t.
+func (c *tcpConn) resetDeadlineTimerLocked(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
+
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
@@ -0,0 +1,122 @@
+package vnet
+
+import (
+	"net"
+	"time"
+)
+
+const dnsPort = 53
+
+type udpKey struct {
+	guestPort uint16
+	remote    endpoint
+}
+
+// udpFlow is a UDP flow of the guest which is translated to a socket on the host.
+type udpFlow struct {
+	key  udpKey
+	conn *net.UDPConn
+
+	// lastActive is the unix nano time when the flow was used last, guarded by Network.mu.
+	lastActive int64
+}
+
+func (n *Network) handleUDP(h ipv4Header, b []byte) {
+	srcPort, dstPort, payload, ok := parseUDP(b)
+	if !ok {
+		return
+	}
+	if dstPort == dhcpServerPort && srcPort == dhcpClientPort {
+		n.handleDHCP(payload)
+		return
+	}
+	if h.src != n.guestIP {
+		return
+	}
+	remote := endpoint{ip: h.dst, port: dstPort}
+	var addr string
+	if remote.ip == n.gatewayIP && remote.port == dnsPort && !n.hostOnly {
+		if len(n.dns) == 0 {
+			n.logf("vnet: dropped DNS query: no upstream DNS server")
+			return
+		}
+		addr = n.dns[0]
+	} else {
+		var ok bool
+		if addr, ok = n.translate(remote); !ok {
+			return
+		}
+	}
+
+	key := udpKey{guestPort: srcPort, remote: remote}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	f := n.udpFlows[key]
+	if f != nil {
+		f.lastActive = time.Now().UnixNano()
+	}
+	n.mu.Unlock()
+
+	if f == nil {
+		raddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			n.logf("vnet: failed to resolve %s: %v", addr, err)
+			return
+		}
+		conn, err := net.DialUDP("udp4", nil, raddr)
+		if err != nil {
+			n.logf("vnet: failed to dial udp %s: %v", addr, err)
+			return
+		}
+		f = &udpFlow{key: key, conn: conn, lastActive: time.Now().UnixNano()}
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			conn.Close()
+			return
+		}
+		n.udpFlows[key] = f
+		n.mu.Unlock()
+		go n.receiveUDP(f)
+	}
+	if _, err := f.conn.Write(payload); err != nil {
+		n.logf("vnet: failed to send udp to %s: %v", addr, err)
+	}
+}
+
+// receiveUDP sends the datagrams which are received on the host socket to the guest
+// until the flow has been idle for idleTimeout.
+func (n *Network) receiveUDP(f *udpFlow) {
+	defer func() {
+		n.mu.Lock()
+		if n.udpFlows[f.key] == f {
+			delete(n.udpFlows, f.key)
+		}
+		n.mu.Unlock()
+		f.conn.Close()
+	}()
+	buf := make([]byte, 65535)
+	guest := endpoint{ip: n.guestIP, port: f.key.guestPort}
+	for {
+		f.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		nr, err := f.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				n.mu.Lock()
+				idle := time.Since(time.Unix(0, f.lastActive)) >= idleTimeout
+				n.mu.Unlock()
+				if !idle {
+					continue
+				}
+			}
+			return
+		}
+		n.mu.Lock()
+		f.lastActive = time.Now().UnixNano()
+		n.mu.Unlock()
+		n.sendIPv4(f.key.remote.ip, guest.ip, protoUDP, udpDatagram(f.key.remote, guest, buf[:nr]))
+	}
+}
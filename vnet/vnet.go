@@ -0,0 +1,415 @@
+// Package vnet provides a minimal userspace network stack which gives the guest NAT networking
+// through the file handle network attachment, without the com.apple.vm.networking entitlement.
+//
+// A Network is one side of a datagram socket pair which carries the Ethernet frames of the guest.
+// The other side is passed to vz.NewFileHandleNetworkDeviceAttachment:
+//
+//	n, err := vnet.New(&vnet.Config{})
+//	...
+//	attachment := vz.NewFileHandleNetworkDeviceAttachment(n.GuestFile())
+//	go n.Run(ctx)
+//
+// The stack serves a single guest. It answers ARP for the gateway, leases GuestIP to the guest
+// by DHCP, relays DNS queries which are sent to the gateway to the upstream servers, and translates
+// the TCP connections and the UDP flows of the guest to the sockets on the host. ICMP is only
+// answered for echo requests to the gateway. IPv6 and IP fragments are not supported.
+//
+// Network implements forward.Dialer, so the ports in the guest can be forwarded from the host:
+//
+//	f := &forward.Forwarder{Dialer: n, Mappings: mappings}
+package vnet
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Default values of Config.
+const (
+	DefaultSubnet = "192.168.127.0/24"
+	DefaultMTU    = 1500
+)
+
+// DefaultGatewayMAC is the MAC address of the gateway if Config.GatewayMAC is nil.
+var DefaultGatewayMAC = net.HardwareAddr{0x7a, 0x76, 0x6e, 0x65, 0x74, 0x01}
+
+// ErrClosed is returned when the network is already closed.
+var ErrClosed = errors.New("vnet: network closed")
+
+// Config is the configuration of Network. The zero value is a valid configuration.
+type Config struct {
+	// Subnet is the IPv4 subnet of the network in CIDR notation. The first address is used by the
+	// gateway and the second one is leased to the guest. If empty, DefaultSubnet is used.
+	Subnet string
+
+	// GatewayMAC is the MAC address of the gateway. If nil, DefaultGatewayMAC is used.
+	GatewayMAC net.HardwareAddr
+
+	// MTU is the MTU of the network which must match the one of the attachment.
+	// If zero, DefaultMTU is used.
+	MTU int
+
+	// DNS is the list of the upstream DNS servers as "host:port". The guest sends the queries to
+	// the gateway, and they are relayed to the first server. If empty, the name servers in
+	// /etc/resolv.conf are used.
+	DNS []string
+
+	// HostLoopback makes the TCP connections and UDP flows to the gateway address reach
+	// 127.0.0.1 on the host, so the guest can connect the services which listen only on the
+	// loopback. If false, they are refused.
+	HostLoopback bool
+
+	// HostOnly isolates the guest from the outside network. The TCP connections and UDP flows to
+	// any address other than the gateway are refused, the DNS queries are not relayed, and DHCP
+	// advertises neither the router nor the DNS server. Set HostLoopback too to let the guest reach
+	// the services on the host. The forwarding from the host by DialContext is not affected.
+	HostOnly bool
+
+	// Logf is used to log the dropped packets and the errors. If nil, nothing is logged.
+	Logf func(format string, args ...interface{})
+}
+
+// Network is a userspace network stack which serves a guest.
+type Network struct {
+	subnet     *net.IPNet
+	gatewayIP  ipv4
+	guestIP    ipv4
+	gatewayMAC net.HardwareAddr
+	mtu        int
+	dns        []string
+	loopback   bool
+	hostOnly   bool
+	logf       func(format string, args ...interface{})
+
+	host      *net.UnixConn
+	guestFile *os.File
+
+	ipID     uint32
+	nextPort uint32
+
+	mu        sync.Mutex
+	guestMAC  net.HardwareAddr
+	tcpConns  map[tcpKey]*tcpConn
+	udpFlows  map[udpKey]*udpFlow
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a new Network.
+func New(cfg *Config) (*Network, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	subnet := cfg.Subnet
+	if subnet == "" {
+		subnet = DefaultSubnet
+	}
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("vnet: invalid subnet: %w", err)
+	}
+	if ipnet.IP.To4() == nil {
+		return nil, fmt.Errorf("vnet: subnet %s is not IPv4", subnet)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("vnet: subnet %s is too small", subnet)
+	}
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	if mtu < 576 || mtu > 65535 {
+		return nil, fmt.Errorf("vnet: invalid MTU %d", mtu)
+	}
+	gatewayMAC := cfg.GatewayMAC
+	if gatewayMAC == nil {
+		gatewayMAC = DefaultGatewayMAC
+	}
+	if len(gatewayMAC) != 6 {
+		return nil, fmt.Errorf("vnet: invalid gateway MAC address %s", gatewayMAC)
+	}
+	dns := cfg.DNS
+	if len(dns) == 0 {
+		dns = resolvConfServers("/etc/resolv.conf")
+	}
+
+	base := toIPv4(ipnet.IP)
+	n := &Network{
+		subnet:     ipnet,
+		gatewayIP:  ipv4{base[0], base[1], base[2], base[3] + 1},
+		guestIP:    ipv4{base[0], base[1], base[2], base[3] + 2},
+		gatewayMAC: gatewayMAC,
+		mtu:        mtu,
+		dns:        dns,
+		loopback:   cfg.HostLoopback,
+		hostOnly:   cfg.HostOnly,
+		logf:       cfg.Logf,
+		tcpConns:   make(map[tcpKey]*tcpConn),
+		udpFlows:   make(map[udpKey]*udpFlow),
+		done:       make(chan struct{}),
+	}
+	if n.logf == nil {
+		n.logf = func(string, ...interface{}) {}
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vnet: failed to create socket pair: %w", err)
+	}
+	// Apple recommends the receive buffer to be at least twice as large as the send buffer.
+	for _, fd := range fds {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, 1<<20)
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 4<<20)
+	}
+	hostFile := os.NewFile(uintptr(fds[0]), "vnet-host")
+	defer hostFile.Close()
+	conn, err := net.FileConn(hostFile)
+	if err != nil {
+		unix.Close(fds[1])
+		return nil, fmt.Errorf("vnet: %w", err)
+	}
+	n.host = conn.(*net.UnixConn)
+	n.guestFile = os.NewFile(uintptr(fds[1]), "vnet-guest")
+	return n, nil
+}
+
+// GuestFile returns the socket which is passed to vz.NewFileHandleNetworkDeviceAttachment.
+//
+// Virtualization.framework does not take the ownership of the file descriptor, so the
+// file must not be closed while the virtual machine is running. Close closes it.
+func (n *Network) GuestFile() *os.File { return n.guestFile }
+
+// GatewayIP returns the address of the gateway.
+func (n *Network) GatewayIP() net.IP { return n.gatewayIP.IP() }
+
+// GuestIP returns the address which is leased to the guest.
+func (n *Network) GuestIP() net.IP { return n.guestIP.IP() }
+
+// Subnet returns the subnet of the network.
+func (n *Network) Subnet() *net.IPNet {
+	return &net.IPNet{IP: n.subnet.IP, Mask: n.subnet.Mask}
+}
+
+// Run processes the frames from the guest until ctx is done or the network is closed.
+//
+// Run closes the network before returning, and returns nil if ctx is done.
+func (n *Network) Run(ctx context.Context) error {
+	defer n.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.Close()
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, n.mtu+ethernetHeaderLen+4)
+	for {
+		nr, err := n.host.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if n.isClosed() {
+				return ErrClosed
+			}
+			return fmt.Errorf("vnet: failed to read frame: %w", err)
+		}
+		n.handleFrame(buf[:nr])
+	}
+}
+
+// Close closes the network, the guest file and all of the translated connections.
+func (n *Network) Close() error {
+	n.closeOnce.Do(func() {
+		n.mu.Lock()
+		n.closed = true
+		close(n.done)
+		conns := make([]*tcpConn, 0, len(n.tcpConns))
+		for _, c := range n.tcpConns {
+			conns = append(conns, c)
+		}
+		flows := make([]*udpFlow, 0, len(n.udpFlows))
+		for _, f := range n.udpFlows {
+			flows = append(flows, f)
+		}
+		n.mu.Unlock()
+
+		for _, c := range conns {
+			c.abort(ErrClosed, false)
+		}
+		for _, f := range flows {
+			f.conn.Close()
+		}
+		n.host.Close()
+		n.guestFile.Close()
+	})
+	return nil
+}
+
+func (n *Network) isClosed() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.closed
+}
+
+func (n *Network) handleFrame(frame []byte) {
+	if len(frame) < ethernetHeaderLen {
+		return
+	}
+	dst := net.HardwareAddr(frame[0:6])
+	src := net.HardwareAddr(frame[6:12])
+	if !isBroadcast(dst) && !macEqual(dst, n.gatewayMAC) {
+		return
+	}
+	n.mu.Lock()
+	if !macEqual(n.guestMAC, src) {
+		n.guestMAC = append(net.HardwareAddr(nil), src...)
+	}
+	n.mu.Unlock()
+
+	payload := frame[ethernetHeaderLen:]
+	switch etherType := uint16(frame[12])<<8 | uint16(frame[13]); etherType {
+	case etherTypeARP:
+		n.handleARP(payload)
+	case etherTypeIPv4:
+		n.handleIPv4(payload)
+	}
+}
+
+func (n *Network) handleIPv4(packet []byte) {
+	h, payload, ok := parseIPv4(packet)
+	if !ok {
+		n.logf("vnet: dropped invalid or fragmented IPv4 packet")
+		return
+	}
+	switch h.proto {
+	case protoUDP:
+		n.handleUDP(h, payload)
+	case protoTCP:
+		n.handleTCP(h, payload)
+	case protoICMP:
+		n.handleICMP(h, payload)
+	}
+}
+
+// handleARP answers the ARP requests for the gateway.
+func (n *Network) handleARP(b []byte) {
+	if len(b) < 28 {
+		return
+	}
+	// Ethernet, IPv4, request
+	if b[0] != 0 || b[1] != 1 || b[2] != 0x08 || b[3] != 0x00 || b[4] != 6 || b[5] != 4 || b[6] != 0 || b[7] != 1 {
+		return
+	}
+	var target ipv4
+	copy(target[:], b[24:28])
+	if target != n.gatewayIP {
+		return
+	}
+	reply := make([]byte, 28)
+	copy(reply[0:6], b[0:6])
+	reply[7] = 2
+	copy(reply[8:14], n.gatewayMAC)
+	copy(reply[14:18], n.gatewayIP[:])
+	copy(reply[18:28], b[8:18])
+	n.writeFrame(ethernetFrame(b[8:14], n.gatewayMAC, etherTypeARP, reply))
+}
+
+// handleICMP answers the echo requests to the gateway.
+func (n *Network) handleICMP(h ipv4Header, b []byte) {
+	if h.dst != n.gatewayIP || len(b) < 8 || b[0] != 8 {
+		return
+	}
+	reply := append([]byte(nil), b...)
+	reply[0] = 0
+	reply[2], reply[3] = 0, 0
+	sum := checksum(reply, 0)
+	reply[2], reply[3] = byte(sum>>8), byte(sum)
+	n.sendIPv4(n.gatewayIP, h.src, protoICMP, reply)
+}
+
+// sendIPv4 sends the IPv4 packet to the guest.
+func (n *Network) sendIPv4(src, dst ipv4, proto byte, payload []byte) error {
+	if ipv4HeaderLen+len(payload) > n.mtu {
+		n.logf("vnet: dropped %d bytes packet which exceeds MTU", ipv4HeaderLen+len(payload))
+		return nil
+	}
+	id := uint16(atomic.AddUint32(&n.ipID, 1))
+	n.mu.Lock()
+	dstMAC := n.guestMAC
+	n.mu.Unlock()
+	if dstMAC == nil || dst == (ipv4{255, 255, 255, 255}) {
+		dstMAC = broadcastMAC
+	}
+	return n.writeFrame(ethernetFrame(dstMAC, n.gatewayMAC, etherTypeIPv4, ipv4Packet(src, dst, proto, id, payload)))
+}
+
+func (n *Network) writeFrame(frame []byte) error {
+	_, err := n.host.Write(frame)
+	if err != nil && !n.isClosed() {
+		n.logf("vnet: failed to write frame: %v", err)
+	}
+	return err
+}
+
+// translate returns the address on the host which the guest connects to as dst.
+// It returns false if the connection is refused.
+func (n *Network) translate(dst endpoint) (string, bool) {
+	if dst.ip == n.gatewayIP {
+		if !n.loopback {
+			return "", false
+		}
+		return endpoint{ip: ipv4{127, 0, 0, 1}, port: dst.port}.String(), true
+	}
+	if n.hostOnly {
+		return "", false
+	}
+	if n.subnet.Contains(dst.ip.IP()) || dst.ip[0] == 127 || dst.ip == (ipv4{255, 255, 255, 255}) {
+		return "", false
+	}
+	return dst.String(), true
+}
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func isBroadcast(mac net.HardwareAddr) bool { return macEqual(mac, broadcastMAC) }
+
+func macEqual(a, b net.HardwareAddr) bool { return string(a) == string(b) }
+
+// resolvConfServers returns the name servers in the resolv.conf at path as "host:53".
+func resolvConfServers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && ip.To4() != nil {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+// idleTimeout is the duration after which an idle UDP flow is removed.
+const idleTimeout = 60 * time.Second
@@ -0,0 +1,421 @@
+package vnet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var testGuestMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+
+type testGuest struct {
+	t    *testing.T
+	n    *Network
+	conn net.Conn
+}
+
+func newTestGuest(t *testing.T, cfg *Config) *testGuest {
+	t.Helper()
+	if cfg.DNS == nil {
+		cfg.DNS = []string{"127.0.0.1:53"}
+	}
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.FileConn(n.GuestFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- n.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run returned error: %v", err)
+		}
+		conn.Close()
+	})
+	return &testGuest{t: t, n: n, conn: conn}
+}
+
+func (g *testGuest) sendIPv4(dst ipv4, proto byte, payload []byte) {
+	g.t.Helper()
+	frame := ethernetFrame(g.n.gatewayMAC, testGuestMAC, etherTypeIPv4, ipv4Packet(g.n.guestIP, dst, proto, 1, payload))
+	if _, err := g.conn.Write(frame); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+func (g *testGuest) sendTCP(dst endpoint, seg tcpSegment) {
+	g.t.Helper()
+	g.sendIPv4(dst.ip, protoTCP, seg.marshal(g.n.guestIP, dst.ip))
+}
+
+// recv returns the next frame which has the ether type.
+func (g *testGuest) recv(etherType uint16) []byte {
+	g.t.Helper()
+	buf := make([]byte, 65535)
+	g.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		nr, err := g.conn.Read(buf)
+		if err != nil {
+			g.t.Fatalf("failed to receive frame: %v", err)
+		}
+		if nr >= ethernetHeaderLen && uint16(buf[12])<<8|uint16(buf[13]) == etherType {
+			return append([]byte(nil), buf[:nr]...)
+		}
+	}
+}
+
+func (g *testGuest) recvIPv4(proto byte) (ipv4Header, []byte) {
+	g.t.Helper()
+	for {
+		frame := g.recv(etherTypeIPv4)
+		h, payload, ok := parseIPv4(frame[ethernetHeaderLen:])
+		if !ok {
+			g.t.Fatal("received invalid IPv4 packet")
+		}
+		if checksum(frame[ethernetHeaderLen:ethernetHeaderLen+ipv4HeaderLen], 0) != 0 {
+			g.t.Fatal("invalid IPv4 header checksum")
+		}
+		if h.proto == proto {
+			return h, payload
+		}
+	}
+}
+
+func (g *testGuest) recvTCP() tcpSegment {
+	g.t.Helper()
+	h, payload := g.recvIPv4(protoTCP)
+	if checksum(payload, pseudoHeaderSum(h.src, h.dst, protoTCP, len(payload))) != 0 {
+		g.t.Fatal("invalid TCP checksum")
+	}
+	seg, ok := parseTCP(payload)
+	if !ok {
+		g.t.Fatal("received invalid TCP segment")
+	}
+	return seg
+}
+
+func TestARP(t *testing.T) {
+	g := newTestGuest(t, &Config{})
+	req := make([]byte, 28)
+	copy(req, []byte{0, 1, 8, 0, 6, 4, 0, 1})
+	copy(req[8:14], testGuestMAC)
+	copy(req[14:18], g.n.guestIP[:])
+	copy(req[24:28], g.n.gatewayIP[:])
+	if _, err := g.conn.Write(ethernetFrame(broadcastMAC, testGuestMAC, etherTypeARP, req)); err != nil {
+		t.Fatal(err)
+	}
+	reply := g.recv(etherTypeARP)[ethernetHeaderLen:]
+	if reply[7] != 2 {
+		t.Fatalf("want ARP reply but got op %d", reply[7])
+	}
+	if got := net.HardwareAddr(reply[8:14]); !macEqual(got, DefaultGatewayMAC) {
+		t.Fatalf("want gateway MAC %s but got %s", DefaultGatewayMAC, got)
+	}
+}
+
+// discover sends DHCPDISCOVER and returns the reply and its options.
+func (g *testGuest) discover() ([]byte, map[byte][]byte) {
+	g.t.Helper()
+	req := make([]byte, bootpLen)
+	req[0], req[1], req[2] = 1, 1, 6
+	copy(req[4:8], []byte{1, 2, 3, 4})
+	copy(req[28:34], testGuestMAC)
+	req = append(req, dhcpMagicCookie...)
+	req = appendDHCPOption(req, dhcpOptionMessageType, dhcpDiscover)
+	req = append(req, dhcpOptionEnd)
+	frame := ethernetFrame(broadcastMAC, testGuestMAC, etherTypeIPv4, ipv4Packet(ipv4{}, ipv4{255, 255, 255, 255}, protoUDP, 1,
+		udpDatagram(endpoint{port: dhcpClientPort}, endpoint{ip: ipv4{255, 255, 255, 255}, port: dhcpServerPort}, req)))
+	if _, err := g.conn.Write(frame); err != nil {
+		g.t.Fatal(err)
+	}
+
+	_, payload := g.recvIPv4(protoUDP)
+	_, dstPort, resp, ok := parseUDP(payload)
+	if !ok || dstPort != dhcpClientPort {
+		g.t.Fatalf("want DHCP reply but got port %d", dstPort)
+	}
+	return resp, parseDHCPOptions(resp[bootpLen+4:])
+}
+
+func TestDHCP(t *testing.T) {
+	g := newTestGuest(t, &Config{Subnet: "10.0.2.0/24"})
+	resp, options := g.discover()
+	if !bytes.Equal(resp[4:8], []byte{1, 2, 3, 4}) {
+		t.Fatalf("unexpected xid %v", resp[4:8])
+	}
+	if got := net.IP(resp[16:20]); !got.Equal(net.IPv4(10, 0, 2, 2)) {
+		t.Fatalf("want offer of 10.0.2.2 but got %s", got)
+	}
+	if got := options[dhcpOptionMessageType]; !bytes.Equal(got, []byte{dhcpOffer}) {
+		t.Fatalf("want OFFER but got %v", got)
+	}
+	if got := net.IP(options[dhcpOptionRouter]); !got.Equal(net.IPv4(10, 0, 2, 1)) {
+		t.Fatalf("want router 10.0.2.1 but got %s", got)
+	}
+}
+
+func TestUDPHostLoopback(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	g := newTestGuest(t, &Config{HostLoopback: true})
+	guest := endpoint{ip: g.n.guestIP, port: 40000}
+	remote := endpoint{ip: g.n.gatewayIP, port: port}
+	g.sendIPv4(remote.ip, protoUDP, udpDatagram(guest, remote, []byte("hello")))
+
+	h, payload := g.recvIPv4(protoUDP)
+	srcPort, dstPort, data, ok := parseUDP(payload)
+	if !ok {
+		t.Fatal("invalid UDP datagram")
+	}
+	if h.src != remote.ip || srcPort != remote.port || dstPort != guest.port {
+		t.Fatalf("unexpected addresses %s:%d -> %d", h.src, srcPort, dstPort)
+	}
+	if string(data) != "HELLO" {
+		t.Fatalf("want HELLO but got %q", data)
+	}
+}
+
+func TestTCPHostLoopback(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	g := newTestGuest(t, &Config{HostLoopback: true})
+	remote := endpoint{ip: g.n.gatewayIP, port: port}
+	const guestPort, iss = 40001, 1000
+	g.sendTCP(remote, tcpSegment{srcPort: guestPort, dstPort: port, seq: iss, flags: tcpSYN, window: 65535, mss: 1460})
+
+	synAck := g.recvTCP()
+	if !synAck.has(tcpSYN|tcpACK) || synAck.ack != iss+1 {
+		t.Fatalf("want SYN-ACK of %d but got flags %#x ack %d", iss+1, synAck.flags, synAck.ack)
+	}
+	peer := synAck.seq + 1
+	g.sendTCP(remote, tcpSegment{srcPort: guestPort, dstPort: port, seq: iss + 1, ack: peer, flags: tcpACK | tcpPSH, window: 65535, payload: []byte("ping")})
+
+	var got []byte
+	for len(got) < 4 {
+		seg := g.recvTCP()
+		if seg.has(tcpRST) {
+			t.Fatal("connection is reset")
+		}
+		if len(seg.payload) > 0 {
+			if seg.seq != peer+uint32(len(got)) {
+				t.Fatalf("unexpected seq %d", seg.seq)
+			}
+			got = append(got, seg.payload...)
+		}
+	}
+	if string(got) != "ping" {
+		t.Fatalf("want ping but got %q", got)
+	}
+
+	// close from the guest, and the echo server closes too.
+	g.sendTCP(remote, tcpSegment{srcPort: guestPort, dstPort: port, seq: iss + 5, ack: peer + 4, flags: tcpACK | tcpFIN, window: 65535})
+	for {
+		seg := g.recvTCP()
+		if seg.has(tcpFIN) {
+			if seg.ack != iss+6 {
+				t.Fatalf("want ack of FIN but got %d", seg.ack)
+			}
+			g.sendTCP(remote, tcpSegment{srcPort: guestPort, dstPort: port, seq: iss + 6, ack: seg.seq + 1, flags: tcpACK, window: 65535})
+			break
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.n.mu.Lock()
+		remaining := len(g.n.tcpConns)
+		g.n.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPRefused(t *testing.T) {
+	g := newTestGuest(t, &Config{})
+	remote := endpoint{ip: g.n.gatewayIP, port: 22}
+	g.sendTCP(remote, tcpSegment{srcPort: 40002, dstPort: 22, seq: 1, flags: tcpSYN, window: 65535})
+	seg := g.recvTCP()
+	if !seg.has(tcpRST|tcpACK) || seg.ack != 2 {
+		t.Fatalf("want RST but got flags %#x ack %d", seg.flags, seg.ack)
+	}
+}
+
+func TestHostOnly(t *testing.T) {
+	g := newTestGuest(t, &Config{HostOnly: true, HostLoopback: true})
+	_, options := g.discover()
+	if router, dns := options[dhcpOptionRouter], options[dhcpOptionDNS]; router != nil || dns != nil {
+		t.Fatalf("want no router and DNS server but got %v and %v", router, dns)
+	}
+
+	remote := endpoint{ip: ipv4{203, 0, 113, 1}, port: 80}
+	g.sendTCP(remote, tcpSegment{srcPort: 40003, dstPort: 80, seq: 1, flags: tcpSYN, window: 65535})
+	seg := g.recvTCP()
+	if !seg.has(tcpRST|tcpACK) || seg.ack != 2 {
+		t.Fatalf("want RST but got flags %#x ack %d", seg.flags, seg.ack)
+	}
+	if addr, ok := g.n.translate(endpoint{ip: g.n.gatewayIP, port: 22}); !ok || addr != "127.0.0.1:22" {
+		t.Fatalf("want the gateway to reach the host loopback but got %q, %v", addr, ok)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	g := newTestGuest(t, &Config{})
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := g.n.DialContext(context.Background(), "tcp", "guest:80")
+		ch <- result{conn, err}
+	}()
+
+	syn := g.recvTCP()
+	if !syn.has(tcpSYN) || syn.has(tcpACK) || syn.dstPort != 80 {
+		t.Fatalf("want SYN to port 80 but got flags %#x port %d", syn.flags, syn.dstPort)
+	}
+	remote := endpoint{ip: g.n.gatewayIP, port: syn.srcPort}
+	const iss = 5000
+	g.sendTCP(remote, tcpSegment{srcPort: 80, dstPort: syn.srcPort, seq: iss, ack: syn.seq + 1, flags: tcpSYN | tcpACK, window: 65535, mss: 1460})
+	if ack := g.recvTCP(); !ack.has(tcpACK) || ack.ack != iss+1 {
+		t.Fatalf("want ACK of SYN-ACK but got flags %#x ack %d", ack.flags, ack.ack)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.conn.Close()
+
+	if _, err := r.conn.Write([]byte("GET /")); err != nil {
+		t.Fatal(err)
+	}
+	seg := g.recvTCP()
+	if string(seg.payload) != "GET /" || seg.seq != syn.seq+1 {
+		t.Fatalf("unexpected segment seq %d payload %q", seg.seq, seg.payload)
+	}
+	g.sendTCP(remote, tcpSegment{srcPort: 80, dstPort: syn.srcPort, seq: iss + 1, ack: seg.seq + 5, flags: tcpACK | tcpPSH, window: 65535, payload: []byte("200")})
+
+	buf := make([]byte, 16)
+	r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := r.conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "200" {
+		t.Fatalf("want 200 but got %q", buf[:n])
+	}
+}
+
+func TestDialContextRefused(t *testing.T) {
+	g := newTestGuest(t, &Config{})
+	ch := make(chan error, 1)
+	go func() {
+		_, err := g.n.DialContext(context.Background(), "tcp", "guest:81")
+		ch <- err
+	}()
+	syn := g.recvTCP()
+	g.sendTCP(endpoint{ip: g.n.gatewayIP, port: syn.srcPort}, tcpSegment{srcPort: 81, dstPort: syn.srcPort, ack: syn.seq + 1, flags: tcpRST | tcpACK})
+	if err := <-ch; err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func TestResolvConfServers(t *testing.T) {
+	path := t.TempDir() + "/resolv.conf"
+	content := "# comment\nnameserver 192.0.2.53\nnameserver ::1\nsearch example.com\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := resolvConfServers(path)
+	if len(got) != 1 || got[0] != "192.0.2.53:53" {
+		t.Fatalf("unexpected servers %v", got)
+	}
+}
+
+func TestTCPSendWindow(t *testing.T) {
+	g := newTestGuest(t, &Config{})
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, err := g.n.DialContext(context.Background(), "tcp", "guest:80")
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- conn
+	}()
+	syn := g.recvTCP()
+	remote := endpoint{ip: g.n.gatewayIP, port: syn.srcPort}
+	const iss, window = 7000, 1000
+	g.sendTCP(remote, tcpSegment{srcPort: 80, dstPort: syn.srcPort, seq: iss, ack: syn.seq + 1, flags: tcpSYN | tcpACK, window: window, mss: 1460})
+	g.recvTCP()
+	conn := <-ch
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 500)
+	go conn.Write(data)
+
+	var got []byte
+	next := syn.seq + 1
+	for len(got) < len(data) {
+		seg := g.recvTCP()
+		if len(seg.payload) == 0 {
+			continue
+		}
+		if seg.seq != next {
+			t.Fatalf("want seq %d but got %d", next, seg.seq)
+		}
+		if len(seg.payload) > window {
+			t.Fatalf("segment of %d bytes exceeds the window", len(seg.payload))
+		}
+		got = append(got, seg.payload...)
+		next += uint32(len(seg.payload))
+		g.sendTCP(remote, tcpSegment{srcPort: 80, dstPort: syn.srcPort, seq: iss + 1, ack: next, flags: tcpACK, window: window})
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received data is different")
+	}
+}
@@ -0,0 +1,84 @@
+//go:build darwin
+// +build darwin
+
+package vnet
+
+import (
+	"fmt"
+
+	"github.com/Code-Hex/vz/v2"
+)
+
+// Mode is the network which NewAttachment attaches the guest to.
+type Mode int
+
+const (
+	// ModeNAT attaches the guest to the NAT network which is shared by the virtual machines on the
+	// host, by vz.NewNATNetworkDeviceAttachment. Virtualization.framework does not expose any
+	// option of the NAT network, e.g. the subnet or the port mapping, so Config is not used.
+	ModeNAT Mode = iota
+
+	// ModeUserspaceNAT attaches the guest to a Network which translates its connections to the
+	// sockets on the host.
+	ModeUserspaceNAT
+
+	// ModeHostOnly attaches the guest to a Network with Config.HostOnly, so the guest can reach
+	// only the gateway and is isolated from the outside network.
+	ModeHostOnly
+)
+
+// String returns the name of the mode.
+func (m Mode) String() string {
+	switch m {
+	case ModeNAT:
+		return "nat"
+	case ModeUserspaceNAT:
+		return "userspace-nat"
+	case ModeHostOnly:
+		return "host-only"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// NewAttachment creates the network device attachment for the mode.
+//
+// For ModeUserspaceNAT and ModeHostOnly, the attachment is paired with the returned Network which is
+// created with cfg, and the caller must Run it until the virtual machine is stopped:
+//
+//	attachment, n, err := vnet.NewAttachment(vnet.ModeHostOnly, &vnet.Config{HostLoopback: true})
+//	if err != nil {
+//		return err
+//	}
+//	if n != nil {
+//		go n.Run(ctx)
+//	}
+//
+// For ModeNAT, the returned Network is nil. cfg is not modified and can be nil.
+func NewAttachment(mode Mode, cfg *Config) (vz.NetworkDeviceAttachment, *Network, error) {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+	switch mode {
+	case ModeNAT:
+		return vz.NewNATNetworkDeviceAttachment(), nil, nil
+	case ModeUserspaceNAT:
+	case ModeHostOnly:
+		c.HostOnly = true
+	default:
+		return nil, nil, fmt.Errorf("vnet: unknown mode %s", mode)
+	}
+
+	n, err := New(&c)
+	if err != nil {
+		return nil, nil, err
+	}
+	attachment := vz.NewFileHandleNetworkDeviceAttachment(n.GuestFile())
+	if n.mtu != DefaultMTU {
+		if err := attachment.SetMaximumTransmissionUnit(n.mtu); err != nil {
+			n.Close()
+			return nil, nil, fmt.Errorf("vnet: %w", err)
+		}
+	}
+	return attachment, n, nil
+}
@@ -0,0 +1,270 @@
+// Package vztest provides a fake virtual machine which implements vz.VM without
+// Virtualization.framework, so the code which orchestrates the virtual machines can be unit
+// tested on Linux and the CI machines which can not run them:
+//
+//	func TestRestart(t *testing.T) {
+//		m := vztest.NewMachine()
+//		m.FailNext(vztest.OpStart, errors.New("boom"))
+//		if err := restart(m); err == nil { // restart takes vz.VM
+//			t.Fatal("want error")
+//		}
+//	}
+//
+// The fake moves through the same states as the real virtual machine, e.g. Start changes the
+// state to starting and then running, and the operations which are invalid in the current state
+// fail with ErrInvalidTransition. The operations complete immediately.
+package vztest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Code-Hex/vz/v2"
+	"github.com/Code-Hex/vz/v2/internal/eventqueue"
+)
+
+// ErrInvalidTransition is passed to the completion handler when the operation is invalid in the
+// current state, as Virtualization.framework reports it.
+var ErrInvalidTransition = errors.New("vztest: invalid virtual machine state transition")
+
+// Op is an operation of the virtual machine.
+type Op string
+
+// The operations which can be failed by FailNext.
+const (
+	OpStart       Op = "start"
+	OpPause       Op = "pause"
+	OpResume      Op = "resume"
+	OpStop        Op = "stop"
+	OpRequestStop Op = "requestStop"
+)
+
+// Machine is a fake virtual machine. The zero value is not usable, use NewMachine.
+type Machine struct {
+	id string
+
+	mu          sync.Mutex
+	state       vz.VirtualMachineState
+	history     []vz.VirtualMachineState
+	failures    map[Op][]error
+	ignoreStop  bool // set only by the options
+	calls       map[Op]int
+	stateNotify chan vz.VirtualMachineState
+	notifyQueue *eventqueue.Queue
+}
+
+var _ vz.VM = (*Machine)(nil)
+
+// Option is an option for NewMachine.
+type Option func(*Machine)
+
+// WithID sets the identifier of the machine. The default is "vztest".
+func WithID(id string) Option {
+	return func(m *Machine) {
+		m.id = id
+	}
+}
+
+// WithState sets the initial state of the machine. The default is vz.VirtualMachineStateStopped.
+func WithState(state vz.VirtualMachineState) Option {
+	return func(m *Machine) {
+		m.state = state
+	}
+}
+
+// WithGuestIgnoringStopRequest makes the guest ignore RequestStop, e.g. to test the fallback to Stop.
+// By default, the guest stops immediately when it is requested.
+func WithGuestIgnoringStopRequest() Option {
+	return func(m *Machine) {
+		m.ignoreStop = true
+	}
+}
+
+// NewMachine creates a new fake virtual machine.
+func NewMachine(opts ...Option) *Machine {
+	m := &Machine{
+		id:          "vztest",
+		state:       vz.VirtualMachineStateStopped,
+		failures:    make(map[Op][]error),
+		calls:       make(map[Op]int),
+		stateNotify: make(chan vz.VirtualMachineState),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.notifyQueue = eventqueue.New(m.sendStateNotify)
+	return m
+}
+
+// Close stops delivering the states to the channel of StateChangedNotify.
+func (m *Machine) Close() error {
+	m.notifyQueue.Close()
+	return nil
+}
+
+// sendStateNotify is the deliver function of notifyQueue, so the state changes never block
+// the operations as the real virtual machine.
+func (m *Machine) sendStateNotify(state interface{}) {
+	select {
+	case m.stateNotify <- state.(vz.VirtualMachineState):
+	case <-m.notifyQueue.Done():
+	}
+}
+
+// ID returns the identifier of the machine.
+func (m *Machine) ID() string { return m.id }
+
+// State returns the current state.
+func (m *Machine) State() vz.VirtualMachineState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// StateChangedNotify returns the channel which receives the changes of the state in order.
+func (m *Machine) StateChangedNotify() <-chan vz.VirtualMachineState { return m.stateNotify }
+
+// History returns the states which the machine has moved through, in order.
+func (m *Machine) History() []vz.VirtualMachineState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]vz.VirtualMachineState(nil), m.history...)
+}
+
+// Calls returns the number of times op has been called.
+func (m *Machine) Calls(op Op) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[op]
+}
+
+// FailNext makes the next call of op fail with err. The state is not changed by the failed call
+// except OpStart, which moves the machine to the error state after starting as the real one.
+// Multiple failures are used in the order of the calls.
+func (m *Machine) FailNext(op Op, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[op] = append(m.failures[op], err)
+}
+
+// Crash moves the machine to the error state, as the virtual machine encountered an internal error.
+func (m *Machine) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setStateLocked(vz.VirtualMachineStateError)
+}
+
+// GuestStop stops the machine as the guest shuts itself down. It does nothing if the machine is not running.
+func (m *Machine) GuestStop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == vz.VirtualMachineStateRunning {
+		m.setStateLocked(vz.VirtualMachineStateStopping, vz.VirtualMachineStateStopped)
+	}
+}
+
+func (m *Machine) setStateLocked(states ...vz.VirtualMachineState) {
+	for _, s := range states {
+		m.state = s
+		m.history = append(m.history, s)
+		m.notifyQueue.Push(s)
+	}
+}
+
+// beginLocked counts the call of op and returns the failure which is set by FailNext.
+func (m *Machine) beginLocked(op Op) error {
+	m.calls[op]++
+	errs := m.failures[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	m.failures[op] = errs[1:]
+	return errs[0]
+}
+
+func (m *Machine) canLocked(op Op) bool {
+	switch op {
+	case OpStart:
+		return m.state == vz.VirtualMachineStateStopped || m.state == vz.VirtualMachineStateError
+	case OpPause, OpRequestStop:
+		return m.state == vz.VirtualMachineStateRunning
+	case OpResume:
+		return m.state == vz.VirtualMachineStatePaused
+	case OpStop:
+		return m.state == vz.VirtualMachineStateRunning || m.state == vz.VirtualMachineStatePaused
+	}
+	return false
+}
+
+func (m *Machine) can(op Op) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.canLocked(op)
+}
+
+// CanStart returns true if the machine is stopped or in the error state.
+func (m *Machine) CanStart() bool { return m.can(OpStart) }
+
+// CanPause returns true if the machine is running.
+func (m *Machine) CanPause() bool { return m.can(OpPause) }
+
+// CanResume returns true if the machine is paused.
+func (m *Machine) CanResume() bool { return m.can(OpResume) }
+
+// CanRequestStop returns true if the machine is running.
+func (m *Machine) CanRequestStop() bool { return m.can(OpRequestStop) }
+
+// CanStop returns true if the machine is running or paused.
+func (m *Machine) CanStop() bool { return m.can(OpStop) }
+
+// transition runs op which moves the machine through the states. The result is passed to the
+// completion handler after the lock is released, so the handler can call the machine.
+func (m *Machine) transition(op Op, states ...vz.VirtualMachineState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.beginLocked(op); err != nil {
+		if op == OpStart && m.canLocked(op) {
+			m.setStateLocked(vz.VirtualMachineStateStarting, vz.VirtualMachineStateError)
+		}
+		return err
+	}
+	if !m.canLocked(op) {
+		return fmt.Errorf("%w: cannot %s in %s state", ErrInvalidTransition, op, m.state)
+	}
+	m.setStateLocked(states...)
+	return nil
+}
+
+// Start starts the machine which is stopped or in the error state.
+func (m *Machine) Start(fn func(error)) {
+	fn(m.transition(OpStart, vz.VirtualMachineStateStarting, vz.VirtualMachineStateRunning))
+}
+
+// Pause pauses the running machine.
+func (m *Machine) Pause(fn func(error)) {
+	fn(m.transition(OpPause, vz.VirtualMachineStatePausing, vz.VirtualMachineStatePaused))
+}
+
+// Resume resumes the paused machine.
+func (m *Machine) Resume(fn func(error)) {
+	fn(m.transition(OpResume, vz.VirtualMachineStateResuming, vz.VirtualMachineStateRunning))
+}
+
+// Stop stops the running or paused machine.
+func (m *Machine) Stop(fn func(error)) {
+	fn(m.transition(OpStop, vz.VirtualMachineStateStopping, vz.VirtualMachineStateStopped))
+}
+
+// RequestStop requests the guest to stop. The guest stops immediately unless the machine is created
+// with WithGuestIgnoringStopRequest.
+func (m *Machine) RequestStop() (bool, error) {
+	var states []vz.VirtualMachineState
+	if !m.ignoreStop {
+		states = []vz.VirtualMachineState{vz.VirtualMachineStateStopping, vz.VirtualMachineStateStopped}
+	}
+	if err := m.transition(OpRequestStop, states...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,139 @@
+package vztest_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2"
+	"github.com/Code-Hex/vz/v2/vztest"
+)
+
+func result(t *testing.T) (fn func(error), get func() error) {
+	t.Helper()
+	called := false
+	var got error
+	return func(err error) {
+			called = true
+			got = err
+		}, func() error {
+			t.Helper()
+			if !called {
+				t.Fatal("completion handler is not called")
+			}
+			return got
+		}
+}
+
+func TestLifecycle(t *testing.T) {
+	m := vztest.NewMachine()
+	defer m.Close()
+
+	steps := []struct {
+		op   func(fn func(error))
+		want vz.VirtualMachineState
+	}{
+		{m.Start, vz.VirtualMachineStateRunning},
+		{m.Pause, vz.VirtualMachineStatePaused},
+		{m.Resume, vz.VirtualMachineStateRunning},
+		{m.Stop, vz.VirtualMachineStateStopped},
+	}
+	for _, step := range steps {
+		fn, get := result(t)
+		step.op(fn)
+		if err := get(); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.State(); got != step.want {
+			t.Fatalf("want %s but got %s", step.want, got)
+		}
+	}
+	want := []vz.VirtualMachineState{
+		vz.VirtualMachineStateStarting, vz.VirtualMachineStateRunning,
+		vz.VirtualMachineStatePausing, vz.VirtualMachineStatePaused,
+		vz.VirtualMachineStateResuming, vz.VirtualMachineStateRunning,
+		vz.VirtualMachineStateStopping, vz.VirtualMachineStateStopped,
+	}
+	if got := m.History(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v but got %v", want, got)
+	}
+	for i, w := range want {
+		select {
+		case got := <-m.StateChangedNotify():
+			if got != w {
+				t.Fatalf("notification %d: want %s but got %s", i, w, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("notification %d is not received", i)
+		}
+	}
+}
+
+func TestInvalidTransition(t *testing.T) {
+	m := vztest.NewMachine()
+	defer m.Close()
+	if m.CanPause() || !m.CanStart() {
+		t.Fatal("want only start to be possible in stopped state")
+	}
+	fn, get := result(t)
+	m.Pause(fn)
+	if err := get(); !errors.Is(err, vztest.ErrInvalidTransition) {
+		t.Fatalf("want ErrInvalidTransition but got %v", err)
+	}
+	if _, err := m.RequestStop(); !errors.Is(err, vztest.ErrInvalidTransition) {
+		t.Fatalf("want ErrInvalidTransition but got %v", err)
+	}
+	if got := m.State(); got != vz.VirtualMachineStateStopped {
+		t.Fatalf("want stopped but got %s", got)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	m := vztest.NewMachine()
+	defer m.Close()
+	boom := errors.New("boom")
+	m.FailNext(vztest.OpStart, boom)
+
+	fn, get := result(t)
+	m.Start(fn)
+	if err := get(); err != boom {
+		t.Fatalf("want boom but got %v", err)
+	}
+	if got := m.State(); got != vz.VirtualMachineStateError {
+		t.Fatalf("want error state but got %s", got)
+	}
+
+	fn, get = result(t)
+	m.Start(fn)
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Calls(vztest.OpStart); got != 2 {
+		t.Fatalf("want 2 calls but got %d", got)
+	}
+}
+
+func TestRequestStop(t *testing.T) {
+	m := vztest.NewMachine(vztest.WithState(vz.VirtualMachineStateRunning))
+	defer m.Close()
+	if ok, err := m.RequestStop(); !ok || err != nil {
+		t.Fatalf("want success but got %v, %v", ok, err)
+	}
+	if got := m.State(); got != vz.VirtualMachineStateStopped {
+		t.Fatalf("want stopped but got %s", got)
+	}
+
+	ignoring := vztest.NewMachine(vztest.WithState(vz.VirtualMachineStateRunning), vztest.WithGuestIgnoringStopRequest())
+	defer ignoring.Close()
+	if ok, err := ignoring.RequestStop(); !ok || err != nil {
+		t.Fatalf("want success but got %v, %v", ok, err)
+	}
+	if got := ignoring.State(); got != vz.VirtualMachineStateRunning {
+		t.Fatalf("want running but got %s", got)
+	}
+	ignoring.GuestStop()
+	if got := ignoring.State(); got != vz.VirtualMachineStateStopped {
+		t.Fatalf("want stopped but got %s", got)
+	}
+}
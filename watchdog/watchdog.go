@@ -0,0 +1,297 @@
+// Package watchdog detects a hung guest and takes an action on it.
+//
+// A Watchdog probes the guest periodically with a Prober, e.g. a heartbeat of the agent over
+// vsock by AgentProber or a connection to a port of the guest by DialProber. When the probes fail
+// consecutively, the Policy is invoked to log, stop or restart the virtual machine.
+//
+//	w := watchdog.New(vm, watchdog.AgentProber(connect),
+//		watchdog.WithPolicy(watchdog.Policies(
+//			watchdog.LogPolicy(log.Printf),
+//			watchdog.RestartPolicy(),
+//		)),
+//	)
+//	go w.Run(ctx)
+//
+// The probes are skipped while the virtual machine is paused, and Run returns when the
+// virtual machine is stopped, so the Watchdog stops together with the virtual machine.
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/agent"
+)
+
+// Default values of the options.
+const (
+	DefaultInterval         = 10 * time.Second
+	DefaultTimeout          = 5 * time.Second
+	DefaultFailureThreshold = 3
+)
+
+// Machine is the virtual machine which is watched. *vz.VirtualMachine implements Machine.
+type Machine interface {
+	// CanStop reports false once the virtual machine is stopped.
+	CanStop() bool
+
+	// CanResume reports true while the virtual machine is paused.
+	CanResume() bool
+
+	Start(fn func(error))
+	Stop(fn func(error))
+}
+
+// Prober checks that the guest is responding.
+type Prober interface {
+	// Probe returns nil if the guest is responding. ctx is done when the probe times out.
+	Probe(ctx context.Context) error
+}
+
+// ProberFunc is an adapter to allow the use of ordinary functions as Prober.
+type ProberFunc func(ctx context.Context) error
+
+// Probe calls f(ctx).
+func (f ProberFunc) Probe(ctx context.Context) error {
+	return f(ctx)
+}
+
+// AgentProber returns a Prober which pings the agent in the guest. See the agent package.
+//
+// connect is called to make a new connection to the agent for each probe.
+// Typically, it connects to agent.DefaultPort with (*vz.VirtioSocketDevice).ConnectToPort.
+func AgentProber(connect func(ctx context.Context) (net.Conn, error)) Prober {
+	return ProberFunc(func(ctx context.Context) error {
+		conn, err := connect(ctx)
+		if err != nil {
+			return err
+		}
+		client := agent.NewClient(conn)
+		defer client.Close()
+		return client.Ping(ctx)
+	})
+}
+
+// DialProber returns a Prober which connects to the address on the named network,
+// e.g. the SSH port of the guest, and closes the connection immediately.
+//
+// See net.Dial for the network and the address.
+func DialProber(network, address string) Prober {
+	return ProberFunc(func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// Event describes the guest which stopped responding.
+type Event struct {
+	// Failures is the number of the consecutive failed probes.
+	Failures int
+
+	// Err is the error of the last probe.
+	Err error
+
+	// LastSeen is the time of the last successful probe. This is the time when
+	// Run started if no probe has succeeded.
+	LastSeen time.Time
+}
+
+// Policy is invoked when the guest stops responding.
+//
+// If the returned error is not nil, Run returns it.
+type Policy func(ctx context.Context, m Machine, ev Event) error
+
+// Policies returns a Policy which invokes the policies in order. It stops at the first error.
+func Policies(policies ...Policy) Policy {
+	return func(ctx context.Context, m Machine, ev Event) error {
+		for _, p := range policies {
+			if err := p(ctx, m, ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// LogPolicy returns a Policy which reports the event by logf, e.g. log.Printf.
+func LogPolicy(logf func(format string, args ...interface{})) Policy {
+	return func(ctx context.Context, m Machine, ev Event) error {
+		logf("watchdog: guest is not responding since %s (%d failures): %v",
+			ev.LastSeen.Format(time.RFC3339), ev.Failures, ev.Err)
+		return nil
+	}
+}
+
+// StopPolicy returns a Policy which stops the virtual machine forcibly.
+// Run returns after that because the virtual machine is stopped.
+func StopPolicy() Policy {
+	return func(ctx context.Context, m Machine, ev Event) error {
+		return stop(m)
+	}
+}
+
+// RestartPolicy returns a Policy which stops the virtual machine forcibly and starts it again.
+func RestartPolicy() Policy {
+	return func(ctx context.Context, m Machine, ev Event) error {
+		if err := stop(m); err != nil {
+			return err
+		}
+		var startErr error
+		m.Start(func(err error) {
+			startErr = err
+		})
+		if startErr != nil {
+			return fmt.Errorf("failed to start virtual machine: %w", startErr)
+		}
+		return nil
+	}
+}
+
+func stop(m Machine) error {
+	if !m.CanStop() {
+		return nil
+	}
+	var stopErr error
+	m.Stop(func(err error) {
+		stopErr = err
+	})
+	if stopErr != nil {
+		return fmt.Errorf("failed to stop virtual machine: %w", stopErr)
+	}
+	return nil
+}
+
+// Option is an option for New.
+type Option func(*Watchdog)
+
+// WithInterval sets the interval of the probes. The default is DefaultInterval.
+func WithInterval(d time.Duration) Option {
+	return func(w *Watchdog) {
+		w.interval = d
+	}
+}
+
+// WithTimeout sets the timeout of each probe. The default is DefaultTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(w *Watchdog) {
+		w.timeout = d
+	}
+}
+
+// WithFailureThreshold sets the number of the consecutive failed probes which invokes the policy.
+// The default is DefaultFailureThreshold.
+func WithFailureThreshold(n int) Option {
+	return func(w *Watchdog) {
+		w.threshold = n
+	}
+}
+
+// WithPolicy sets the policy which is invoked when the guest stops responding.
+// The default policy does nothing, so this should be set in most cases.
+func WithPolicy(p Policy) Option {
+	return func(w *Watchdog) {
+		w.policy = p
+	}
+}
+
+// Watchdog watches the guest of the virtual machine.
+type Watchdog struct {
+	m         Machine
+	prober    Prober
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	policy    Policy
+}
+
+// New creates a new Watchdog which watches m with p.
+func New(m Machine, p Prober, opts ...Option) *Watchdog {
+	w := &Watchdog{
+		m:         m,
+		prober:    p,
+		interval:  DefaultInterval,
+		timeout:   DefaultTimeout,
+		threshold: DefaultFailureThreshold,
+		policy:    func(context.Context, Machine, Event) error { return nil },
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.threshold < 1 {
+		w.threshold = 1
+	}
+	return w
+}
+
+// Run probes the guest every interval until ctx is done or the virtual machine is stopped.
+//
+// Run must be called after the virtual machine has been started. The failures are counted
+// from zero again after the policy is invoked, so a restarted guest has the same time to
+// respond as the first boot. Run returns nil when ctx is done or the virtual machine is
+// stopped, or the error which is returned by the policy.
+func (w *Watchdog) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	failures := 0
+	lastSeen := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if !w.m.CanStop() {
+			return nil
+		}
+		if w.m.CanResume() {
+			// the guest does not run while paused, so the probe must not fail it.
+			failures = 0
+			lastSeen = time.Now()
+			continue
+		}
+		err := w.probe(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			failures = 0
+			lastSeen = time.Now()
+			continue
+		}
+		failures++
+		if failures < w.threshold {
+			continue
+		}
+		ev := Event{
+			Failures: failures,
+			Err:      err,
+			LastSeen: lastSeen,
+		}
+		if err := w.policy(ctx, w.m, ev); err != nil {
+			return fmt.Errorf("watchdog: %w", err)
+		}
+		failures = 0
+		lastSeen = time.Now()
+	}
+}
+
+// ErrProbeTimeout is wrapped by the error of Event when the probe did not finish within the timeout.
+var ErrProbeTimeout = errors.New("probe timed out")
+
+func (w *Watchdog) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	err := w.prober.Probe(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrProbeTimeout, err)
+	}
+	return err
+}
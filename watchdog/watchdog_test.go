@@ -0,0 +1,244 @@
+package watchdog_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v2/agent"
+	"github.com/Code-Hex/vz/v2/watchdog"
+)
+
+// fakeMachine emulates the states of *vz.VirtualMachine which are used by the watchdog.
+type fakeMachine struct {
+	mu       sync.Mutex
+	running  bool
+	paused   bool
+	starts   int
+	stops    int
+	startErr error
+}
+
+func (m *fakeMachine) CanStop() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running
+}
+
+func (m *fakeMachine) CanResume() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused
+}
+
+func (m *fakeMachine) Start(fn func(error)) {
+	m.mu.Lock()
+	m.starts++
+	if m.startErr == nil {
+		m.running = true
+	}
+	err := m.startErr
+	m.mu.Unlock()
+	fn(err)
+}
+
+func (m *fakeMachine) Stop(fn func(error)) {
+	m.mu.Lock()
+	m.stops++
+	m.running = false
+	m.mu.Unlock()
+	fn(nil)
+}
+
+func (m *fakeMachine) counts() (starts, stops int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.starts, m.stops
+}
+
+var errNoResponse = errors.New("no response")
+
+func failingProber() watchdog.Prober {
+	return watchdog.ProberFunc(func(ctx context.Context) error {
+		return errNoResponse
+	})
+}
+
+func runWatchdog(t *testing.T, w *watchdog.Watchdog, ctx context.Context) <-chan error {
+	t.Helper()
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Run(ctx) }()
+	return errCh
+}
+
+func TestStopPolicy(t *testing.T) {
+	m := &fakeMachine{running: true}
+	var (
+		mu     sync.Mutex
+		events []watchdog.Event
+	)
+	w := watchdog.New(m, failingProber(),
+		watchdog.WithInterval(time.Millisecond),
+		watchdog.WithFailureThreshold(3),
+		watchdog.WithPolicy(watchdog.Policies(
+			func(ctx context.Context, _ watchdog.Machine, ev watchdog.Event) error {
+				mu.Lock()
+				events = append(events, ev)
+				mu.Unlock()
+				return nil
+			},
+			watchdog.StopPolicy(),
+		)),
+	)
+	select {
+	case err := <-runWatchdog(t, w, context.Background()):
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the virtual machine was stopped")
+	}
+	if _, stops := m.counts(); stops != 1 {
+		t.Fatalf("want 1 stop but got %d", stops)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 {
+		t.Fatalf("want 1 event but got %d", len(events))
+	}
+	if ev := events[0]; ev.Failures != 3 || !errors.Is(ev.Err, errNoResponse) {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	m := &fakeMachine{running: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := watchdog.New(m, failingProber(),
+		watchdog.WithInterval(time.Millisecond),
+		watchdog.WithFailureThreshold(1),
+		watchdog.WithPolicy(func(ctx context.Context, m watchdog.Machine, ev watchdog.Event) error {
+			if err := watchdog.RestartPolicy()(ctx, m, ev); err != nil {
+				return err
+			}
+			if starts, _ := m.(*fakeMachine).counts(); starts == 2 {
+				cancel()
+			}
+			return nil
+		}),
+	)
+	if err := <-runWatchdog(t, w, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if starts, stops := m.counts(); starts != 2 || stops != 2 {
+		t.Fatalf("want 2 restarts but got starts=%d stops=%d", starts, stops)
+	}
+}
+
+func TestPolicyError(t *testing.T) {
+	m := &fakeMachine{running: true, startErr: errors.New("boom")}
+	w := watchdog.New(m, failingProber(),
+		watchdog.WithInterval(time.Millisecond),
+		watchdog.WithFailureThreshold(1),
+		watchdog.WithPolicy(watchdog.RestartPolicy()),
+	)
+	if err := <-runWatchdog(t, w, context.Background()); err == nil {
+		t.Fatal("want error but got nil")
+	}
+}
+
+func TestPausedIsNotProbed(t *testing.T) {
+	m := &fakeMachine{running: true, paused: true}
+	probed := make(chan struct{}, 1)
+	prober := watchdog.ProberFunc(func(ctx context.Context) error {
+		select {
+		case probed <- struct{}{}:
+		default:
+		}
+		return errNoResponse
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := watchdog.New(m, prober,
+		watchdog.WithInterval(time.Millisecond),
+		watchdog.WithPolicy(watchdog.StopPolicy()),
+	)
+	if err := <-runWatchdog(t, w, ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-probed:
+		t.Fatal("the paused guest was probed")
+	default:
+	}
+	if _, stops := m.counts(); stops != 0 {
+		t.Fatalf("want no stop but got %d", stops)
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	m := &fakeMachine{running: true}
+	prober := watchdog.ProberFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	var got watchdog.Event
+	w := watchdog.New(m, prober,
+		watchdog.WithInterval(time.Millisecond),
+		watchdog.WithTimeout(time.Millisecond),
+		watchdog.WithFailureThreshold(1),
+		watchdog.WithPolicy(func(ctx context.Context, m watchdog.Machine, ev watchdog.Event) error {
+			got = ev
+			return watchdog.StopPolicy()(ctx, m, ev)
+		}),
+	)
+	if err := <-runWatchdog(t, w, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(got.Err, watchdog.ErrProbeTimeout) {
+		t.Fatalf("want ErrProbeTimeout but got %v", got.Err)
+	}
+}
+
+func TestAgentProber(t *testing.T) {
+	server := &agent.Server{}
+	prober := watchdog.AgentProber(func(ctx context.Context) (net.Conn, error) {
+		host, guest := net.Pipe()
+		go server.ServeConn(guest)
+		return host, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := prober.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialProber(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	ctx := context.Background()
+	if err := watchdog.DialProber("tcp", addr).Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if err := watchdog.DialProber("tcp", addr).Probe(ctx); err == nil {
+		t.Fatal("want error after the listener is closed")
+	}
+}